@@ -0,0 +1,399 @@
+package alerting
+
+import (
+	"context"
+	"fmt"
+	"openrouter_polling/apimanager"
+	"openrouter_polling/config"
+	"openrouter_polling/utils"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	Log       *logrus.Logger
+	ApiKeyMgr *apimanager.ApiKeyManager
+)
+
+// 告警状态。
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+)
+
+// 告警级别。
+const (
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// 告警规则名称（同时作为告警指纹的前缀）。
+const (
+	RuleKeysAvailableLow    = "keys_available_low"
+	RuleKeyDisabled         = "key_disabled"
+	RuleErrorRateHigh       = "error_rate_high"
+	RuleHealthCheckFailures = "health_check_failures"
+	RuleTest                = "test"
+)
+
+// notifyTimeout 是单个通知渠道发送一条告警的超时时间。
+const notifyTimeout = 15 * time.Second
+
+// Alert 是发送给各通知渠道的告警内容。同一问题在触发期间保持相同的 Fingerprint，
+// 各渠道可据此对重复通知和恢复通知进行关联。
+type Alert struct {
+	Rule        string                 `json:"rule"`
+	Fingerprint string                 `json:"fingerprint"`
+	Status      string                 `json:"status"`
+	Severity    string                 `json:"severity"`
+	Summary     string                 `json:"summary"`
+	Details     map[string]interface{} `json:"details,omitempty"`
+	StartsAt    time.Time              `json:"starts_at"`
+	ResolvedAt  *time.Time             `json:"resolved_at,omitempty"`
+}
+
+// ChannelResult 是一次测试发送在单个通知渠道上的结果。
+type ChannelResult struct {
+	Channel string `json:"channel"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
+
+// activeAlert 记录一个正在触发的告警及其上次通知时间，用于去重和重复通知。
+type activeAlert struct {
+	alert        Alert
+	lastNotified time.Time
+}
+
+// Manager 周期性地评估告警规则，对告警去重后发送到所有已配置的通知渠道，并在条件解除时发送恢复通知。
+// 所有方法都可以在 nil 接收者上调用（未配置任何通知渠道时为 nil），此时不做任何事。
+type Manager struct {
+	mu                    sync.Mutex
+	notifiers             []Notifier
+	active                map[string]*activeAlert // 以指纹为键的正在触发的告警
+	outcomes              *outcomeWindow
+	lastHealthCheckFailed map[string]bool // 上一个健康检查周期中失败的密钥后缀
+}
+
+// NewManager 根据配置创建告警管理器。没有配置任何通知渠道时返回 nil，即不启用告警。
+func NewManager() *Manager {
+	notifiers := configuredNotifiers()
+	if len(notifiers) == 0 {
+		return nil
+	}
+	names := make([]string, len(notifiers))
+	for i, n := range notifiers {
+		names[i] = n.Name()
+	}
+	Log.Infof("告警通知已启用，通知渠道: %s。", strings.Join(names, ", "))
+	return &Manager{
+		notifiers:             notifiers,
+		active:                make(map[string]*activeAlert),
+		outcomes:              newOutcomeWindow(config.AppSettings.AlertErrorRateWindow),
+		lastHealthCheckFailed: make(map[string]bool),
+	}
+}
+
+// Run 按 ALERT_EVAL_INTERVAL_SECONDS 周期评估基于密钥池状态和错误率的告警规则，直到 ctx 被取消。
+func (m *Manager) Run(ctx context.Context) {
+	if m == nil {
+		return
+	}
+	ticker := time.NewTicker(config.AppSettings.AlertEvalInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			Log.Info("告警规则评估任务因父上下文取消而停止。")
+			return
+		case <-ticker.C:
+			m.evaluateKeyPool()
+			m.evaluateErrorRate()
+		}
+	}
+}
+
+// RecordRequestOutcome 记录一个客户端请求的最终结果，用于计算错误率。
+func (m *Manager) RecordRequestOutcome(failed bool) {
+	if m == nil {
+		return
+	}
+	m.outcomes.record(time.Now(), failed)
+}
+
+// RecordHealthCheckCycle 在每个健康检查周期结束时调用，failedSuffixes 为本周期检查失败的密钥后缀。
+// 出现上一周期没有失败的密钥时触发（或再次通知）告警，某个周期没有任何失败时告警恢复。
+func (m *Manager) RecordHealthCheckCycle(failedSuffixes []string) {
+	if m == nil || !config.AppSettings.AlertHealthCheckFailures {
+		return
+	}
+	m.mu.Lock()
+	var newFailures []string
+	current := make(map[string]bool, len(failedSuffixes))
+	for _, suffix := range failedSuffixes {
+		current[suffix] = true
+		if !m.lastHealthCheckFailed[suffix] {
+			newFailures = append(newFailures, suffix)
+		}
+	}
+	m.lastHealthCheckFailed = current
+	m.mu.Unlock()
+
+	if len(failedSuffixes) == 0 {
+		m.sync(RuleHealthCheckFailures, nil, false)
+		return
+	}
+	sort.Strings(failedSuffixes)
+	alert := Alert{
+		Rule:        RuleHealthCheckFailures,
+		Fingerprint: RuleHealthCheckFailures,
+		Severity:    SeverityWarning,
+		Summary:     fmt.Sprintf("健康检查发现 %d 个失败的密钥", len(failedSuffixes)),
+		Details: map[string]interface{}{
+			"failed_keys": failedSuffixes,
+			"new_failed":  newFailures,
+		},
+	}
+	m.sync(RuleHealthCheckFailures, []Alert{alert}, len(newFailures) > 0)
+}
+
+// ActiveAlerts 返回当前正在触发的告警，按开始时间排序。
+func (m *Manager) ActiveAlerts() []Alert {
+	if m == nil {
+		return []Alert{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	alerts := make([]Alert, 0, len(m.active))
+	for _, a := range m.active {
+		alerts = append(alerts, a.alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].StartsAt.Before(alerts[j].StartsAt) })
+	return alerts
+}
+
+// SendTest 同步地向所有通知渠道发送一条测试告警，返回每个渠道的发送结果。
+func (m *Manager) SendTest(ctx context.Context) []ChannelResult {
+	if m == nil {
+		return nil
+	}
+	alert := Alert{
+		Rule:        RuleTest,
+		Fingerprint: RuleTest,
+		Status:      StatusFiring,
+		Severity:    SeverityWarning,
+		Summary:     "这是一条测试告警，用于验证通知渠道的配置",
+		StartsAt:    time.Now(),
+	}
+	results := make([]ChannelResult, 0, len(m.notifiers))
+	for _, n := range m.notifiers {
+		sendCtx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		err := n.Notify(sendCtx, alert)
+		cancel()
+		result := ChannelResult{Channel: n.Name(), OK: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+			Log.Warnf("告警: 测试告警发送到 %s 失败: %v", n.Name(), err)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// evaluateKeyPool 评估可用密钥数量和单个密钥连续失败的规则。
+func (m *Manager) evaluateKeyPool() {
+	total := ApiKeyMgr.GetTotalKeysCount()
+	available, nextReactivation := ApiKeyMgr.KeyAvailability()
+
+	var lowAlerts []Alert
+	minKeys := config.AppSettings.AlertMinAvailableKeys
+	minPercent := config.AppSettings.AlertMinAvailableKeysPercent
+	belowCount := minKeys > 0 && available < minKeys
+	belowPercent := minPercent > 0 && total > 0 && float64(available)*100/float64(total) < minPercent
+	if belowCount || belowPercent {
+		severity := SeverityWarning
+		if available == 0 {
+			severity = SeverityCritical
+		}
+		details := map[string]interface{}{
+			"available_keys": available,
+			"total_keys":     total,
+		}
+		if nextReactivation != nil {
+			details["next_reactivation"] = nextReactivation.Format(time.RFC3339)
+		}
+		lowAlerts = append(lowAlerts, Alert{
+			Rule:        RuleKeysAvailableLow,
+			Fingerprint: RuleKeysAvailableLow,
+			Severity:    severity,
+			Summary:     fmt.Sprintf("可用密钥不足: %d/%d 个密钥可用", available, total),
+			Details:     details,
+		})
+	}
+	m.sync(RuleKeysAvailableLow, lowAlerts, false)
+
+	var disabledAlerts []Alert
+	if maxFailures := config.AppSettings.KeyMaxConsecutiveFailures; maxFailures > 0 {
+		for _, ks := range ApiKeyMgr.GetCachedKeys() {
+			if ks.FailureCount < maxFailures {
+				continue
+			}
+			suffix := utils.SafeSuffix(ks.Key)
+			details := map[string]interface{}{
+				"key_suffix":    suffix,
+				"failure_count": ks.FailureCount,
+			}
+			if ks.CoolDownUntil != nil {
+				details["cool_down_until"] = ks.CoolDownUntil.Format(time.RFC3339)
+			}
+			disabledAlerts = append(disabledAlerts, Alert{
+				Rule:        RuleKeyDisabled,
+				Fingerprint: RuleKeyDisabled + ":" + suffix,
+				Severity:    SeverityWarning,
+				Summary:     fmt.Sprintf("密钥 %s 已连续失败 %d 次", suffix, ks.FailureCount),
+				Details:     details,
+			})
+		}
+	}
+	m.sync(RuleKeyDisabled, disabledAlerts, false)
+}
+
+// evaluateErrorRate 评估统计窗口内的请求错误率规则。
+func (m *Manager) evaluateErrorRate() {
+	threshold := config.AppSettings.AlertErrorRateThreshold
+	if threshold <= 0 {
+		return
+	}
+	total, failed := m.outcomes.counts(time.Now())
+	var alerts []Alert
+	if total > 0 && total >= config.AppSettings.AlertErrorRateMinRequests {
+		rate := float64(failed) / float64(total)
+		if rate > threshold {
+			alerts = append(alerts, Alert{
+				Rule:        RuleErrorRateHigh,
+				Fingerprint: RuleErrorRateHigh,
+				Severity:    SeverityCritical,
+				Summary:     fmt.Sprintf("请求错误率过高: 最近 %v 内 %.1f%% (%d/%d) 的请求失败", config.AppSettings.AlertErrorRateWindow, rate*100, failed, total),
+				Details: map[string]interface{}{
+					"error_rate":     rate,
+					"failed":         failed,
+					"total":          total,
+					"threshold":      threshold,
+					"window_seconds": int(config.AppSettings.AlertErrorRateWindow.Seconds()),
+				},
+			})
+		}
+	}
+	m.sync(RuleErrorRateHigh, alerts, false)
+}
+
+// sync 将某条规则当前触发的告警与已记录的告警对比：新出现的告警立即通知；仍在触发的告警在
+// forceNotify 为 true 或距上次通知超过 ALERT_REPEAT_INTERVAL_MINUTES 时再次通知；不再触发的告警发送恢复通知。
+func (m *Manager) sync(rule string, firing []Alert, forceNotify bool) {
+	now := time.Now()
+	var toNotify []Alert
+
+	m.mu.Lock()
+	current := make(map[string]bool, len(firing))
+	for _, alert := range firing {
+		current[alert.Fingerprint] = true
+		alert.Status = StatusFiring
+		existing, exists := m.active[alert.Fingerprint]
+		if !exists {
+			alert.StartsAt = now
+			m.active[alert.Fingerprint] = &activeAlert{alert: alert, lastNotified: now}
+			toNotify = append(toNotify, alert)
+			continue
+		}
+		alert.StartsAt = existing.alert.StartsAt
+		existing.alert = alert
+		repeat := config.AppSettings.AlertRepeatInterval
+		if forceNotify || (repeat > 0 && now.Sub(existing.lastNotified) >= repeat) {
+			existing.lastNotified = now
+			toNotify = append(toNotify, alert)
+		}
+	}
+	for fingerprint, existing := range m.active {
+		if existing.alert.Rule != rule || current[fingerprint] {
+			continue
+		}
+		resolved := existing.alert
+		resolved.Status = StatusResolved
+		resolvedAt := now
+		resolved.ResolvedAt = &resolvedAt
+		delete(m.active, fingerprint)
+		toNotify = append(toNotify, resolved)
+	}
+	m.mu.Unlock()
+
+	for _, alert := range toNotify {
+		if alert.Status == StatusFiring {
+			Log.Warnf("告警触发 [%s]: %s", alert.Fingerprint, alert.Summary)
+		} else {
+			Log.Infof("告警恢复 [%s]: %s", alert.Fingerprint, alert.Summary)
+		}
+		go m.dispatch(alert)
+	}
+}
+
+// dispatch 将告警依次发送到所有通知渠道，单个渠道失败只记录日志，不影响其他渠道。
+func (m *Manager) dispatch(alert Alert) {
+	for _, n := range m.notifiers {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		if err := n.Notify(ctx, alert); err != nil {
+			Log.Errorf("告警: 通知 [%s] 发送到 %s 失败: %v", alert.Fingerprint, n.Name(), err)
+		}
+		cancel()
+	}
+}
+
+// outcomeWindow 以秒为粒度的环形计数桶统计滑动窗口内的请求总数和失败数。
+type outcomeWindow struct {
+	mu      sync.Mutex
+	buckets []outcomeBucket
+}
+
+type outcomeBucket struct {
+	second int64
+	total  int
+	failed int
+}
+
+func newOutcomeWindow(window time.Duration) *outcomeWindow {
+	seconds := int(window.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &outcomeWindow{buckets: make([]outcomeBucket, seconds)}
+}
+
+func (w *outcomeWindow) record(now time.Time, failed bool) {
+	second := now.Unix()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	bucket := &w.buckets[second%int64(len(w.buckets))]
+	if bucket.second != second {
+		*bucket = outcomeBucket{second: second}
+	}
+	bucket.total++
+	if failed {
+		bucket.failed++
+	}
+}
+
+func (w *outcomeWindow) counts(now time.Time) (total, failed int) {
+	oldest := now.Unix() - int64(len(w.buckets)) + 1
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, bucket := range w.buckets {
+		if bucket.second >= oldest {
+			total += bucket.total
+			failed += bucket.failed
+		}
+	}
+	return total, failed
+}
@@ -0,0 +1,192 @@
+package alerting
+
+import (
+	"context"
+	"io"
+	"openrouter_polling/config"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// recordingNotifier 把收到的告警依次放入 alerts。
+type recordingNotifier struct {
+	alerts chan Alert
+}
+
+func (n *recordingNotifier) Name() string { return "recording" }
+
+func (n *recordingNotifier) Notify(ctx context.Context, alert Alert) error {
+	n.alerts <- alert
+	return nil
+}
+
+// newTestManager 创建只有一个记录渠道的告警管理器，重复通知间隔为 repeat。
+func newTestManager(t *testing.T, repeat time.Duration) (*Manager, *recordingNotifier) {
+	t.Helper()
+	prevLog, prevSettings := Log, config.AppSettings
+	t.Cleanup(func() { Log, config.AppSettings = prevLog, prevSettings })
+	Log = logrus.New()
+	Log.SetOutput(io.Discard)
+	config.AppSettings.AlertRepeatInterval = repeat
+	config.AppSettings.AlertHealthCheckFailures = true
+
+	notifier := &recordingNotifier{alerts: make(chan Alert, 16)}
+	return &Manager{
+		notifiers:             []Notifier{notifier},
+		active:                make(map[string]*activeAlert),
+		outcomes:              newOutcomeWindow(time.Minute),
+		lastHealthCheckFailed: make(map[string]bool),
+	}, notifier
+}
+
+// expectAlert 等待下一条通知并检查其指纹和状态。
+func expectAlert(t *testing.T, n *recordingNotifier, fingerprint, status string) Alert {
+	t.Helper()
+	select {
+	case alert := <-n.alerts:
+		if alert.Fingerprint != fingerprint || alert.Status != status {
+			t.Fatalf("收到告警 [%s] %s, 期望 [%s] %s", alert.Fingerprint, alert.Status, fingerprint, status)
+		}
+		return alert
+	case <-time.After(time.Second):
+		t.Fatalf("没有收到告警 [%s] %s", fingerprint, status)
+	}
+	return Alert{}
+}
+
+// expectNoAlert 确认短时间内没有新的通知。
+func expectNoAlert(t *testing.T, n *recordingNotifier) {
+	t.Helper()
+	select {
+	case alert := <-n.alerts:
+		t.Fatalf("收到多余的告警 [%s] %s", alert.Fingerprint, alert.Status)
+	case <-time.After(30 * time.Millisecond):
+	}
+}
+
+func disabledKeyAlert(suffix string) Alert {
+	return Alert{Rule: RuleKeyDisabled, Fingerprint: RuleKeyDisabled + ":" + suffix, Severity: SeverityWarning, Summary: "密钥 " + suffix + " 已连续失败"}
+}
+
+func TestSyncDeduplicatesUntilRepeatInterval(t *testing.T) {
+	m, n := newTestManager(t, 50*time.Millisecond)
+	m.sync(RuleKeyDisabled, []Alert{disabledKeyAlert("0001")}, false)
+	first := expectAlert(t, n, RuleKeyDisabled+":0001", StatusFiring)
+
+	// 重复通知间隔内仍在触发的告警不再通知。
+	m.sync(RuleKeyDisabled, []Alert{disabledKeyAlert("0001")}, false)
+	expectNoAlert(t, n)
+
+	time.Sleep(50 * time.Millisecond)
+	m.sync(RuleKeyDisabled, []Alert{disabledKeyAlert("0001")}, false)
+	repeated := expectAlert(t, n, RuleKeyDisabled+":0001", StatusFiring)
+	if !repeated.StartsAt.Equal(first.StartsAt) {
+		t.Errorf("重复通知的开始时间 = %v, 期望保持首次触发时间 %v", repeated.StartsAt, first.StartsAt)
+	}
+	if active := m.ActiveAlerts(); len(active) != 1 {
+		t.Errorf("正在触发的告警数 = %d, 期望 1", len(active))
+	}
+}
+
+func TestSyncWithoutRepeatIntervalNotifiesOnlyOnTransitions(t *testing.T) {
+	m, n := newTestManager(t, 0)
+	m.sync(RuleKeyDisabled, []Alert{disabledKeyAlert("0001"), disabledKeyAlert("0002")}, false)
+	m.sync(RuleErrorRateHigh, []Alert{{Rule: RuleErrorRateHigh, Fingerprint: RuleErrorRateHigh, Severity: SeverityCritical}}, false)
+	if got := collectAlerts(t, n, 3); len(got) != 3 {
+		t.Fatalf("收到的告警 = %v, 期望 3 条触发通知", got)
+	}
+
+	m.sync(RuleKeyDisabled, []Alert{disabledKeyAlert("0002")}, false)
+	resolved := expectAlert(t, n, RuleKeyDisabled+":0001", StatusResolved)
+	if resolved.ResolvedAt == nil {
+		t.Error("恢复通知期望携带恢复时间")
+	}
+	expectNoAlert(t, n)
+
+	// 强制通知用于同一告警出现新情况（例如新的失败密钥）的场景。
+	m.sync(RuleKeyDisabled, []Alert{disabledKeyAlert("0002")}, true)
+	expectAlert(t, n, RuleKeyDisabled+":0002", StatusFiring)
+
+	// 恢复只影响同一规则的告警。
+	m.sync(RuleKeyDisabled, nil, false)
+	expectAlert(t, n, RuleKeyDisabled+":0002", StatusResolved)
+	if active := m.ActiveAlerts(); len(active) != 1 || active[0].Fingerprint != RuleErrorRateHigh {
+		t.Errorf("正在触发的告警 = %v, 期望只剩 %s", active, RuleErrorRateHigh)
+	}
+}
+
+// collectAlerts 收集 count 条通知，返回指纹到状态的映射（多条告警并发发送，顺序不确定）。
+func collectAlerts(t *testing.T, n *recordingNotifier, count int) map[string]string {
+	t.Helper()
+	got := make(map[string]string)
+	for range count {
+		select {
+		case alert := <-n.alerts:
+			got[alert.Fingerprint] = alert.Status
+		case <-time.After(time.Second):
+			t.Fatalf("只收到 %d 条告警, 期望 %d 条", len(got), count)
+		}
+	}
+	return got
+}
+
+func TestErrorRateRule(t *testing.T) {
+	m, n := newTestManager(t, 0)
+	config.AppSettings.AlertErrorRateThreshold = 0.5
+	config.AppSettings.AlertErrorRateMinRequests = 4
+	config.AppSettings.AlertErrorRateWindow = time.Minute
+
+	// 请求数不足时不评估。
+	for range 3 {
+		m.RecordRequestOutcome(true)
+	}
+	m.evaluateErrorRate()
+	expectNoAlert(t, n)
+
+	m.RecordRequestOutcome(false)
+	m.evaluateErrorRate()
+	alert := expectAlert(t, n, RuleErrorRateHigh, StatusFiring)
+	if alert.Severity != SeverityCritical || alert.Details["failed"] != 3 || alert.Details["total"] != 4 {
+		t.Errorf("告警 = %+v, 期望 4 个请求中 3 个失败", alert)
+	}
+
+	// 错误率降到阈值以下后恢复。
+	for range 4 {
+		m.RecordRequestOutcome(false)
+	}
+	m.evaluateErrorRate()
+	expectAlert(t, n, RuleErrorRateHigh, StatusResolved)
+}
+
+func TestHealthCheckCycleNotifiesOnNewFailures(t *testing.T) {
+	m, n := newTestManager(t, 0)
+	m.RecordHealthCheckCycle([]string{"0001"})
+	expectAlert(t, n, RuleHealthCheckFailures, StatusFiring)
+
+	// 同样的密钥继续失败时不重复通知，出现新的失败密钥时再次通知。
+	m.RecordHealthCheckCycle([]string{"0001"})
+	expectNoAlert(t, n)
+	m.RecordHealthCheckCycle([]string{"0002", "0001"})
+	alert := expectAlert(t, n, RuleHealthCheckFailures, StatusFiring)
+	if newFailed, _ := alert.Details["new_failed"].([]string); len(newFailed) != 1 || newFailed[0] != "0002" {
+		t.Errorf("新失败的密钥 = %v, 期望 [0002]", alert.Details["new_failed"])
+	}
+
+	m.RecordHealthCheckCycle(nil)
+	expectAlert(t, n, RuleHealthCheckFailures, StatusResolved)
+}
+
+func TestNilManagerIsNoop(t *testing.T) {
+	var m *Manager
+	m.RecordRequestOutcome(true)
+	m.RecordHealthCheckCycle([]string{"0001"})
+	m.Run(context.Background())
+	if alerts := m.ActiveAlerts(); len(alerts) != 0 {
+		t.Errorf("nil 管理器的告警 = %v, 期望为空", alerts)
+	}
+	if results := m.SendTest(context.Background()); results != nil {
+		t.Errorf("nil 管理器的测试发送结果 = %v, 期望 nil", results)
+	}
+}
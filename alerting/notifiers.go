@@ -0,0 +1,337 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"openrouter_polling/config"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// alertSignatureHeader 是通用 Webhook 请求的签名头部，格式为 "t=<unix 时间戳>,v1=<hex 签名>"。
+const alertSignatureHeader = "X-Alert-Signature"
+
+// Notifier 是一个告警通知渠道。
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// httpClient 是各 Webhook 渠道共用的 HTTP 客户端，超时由每次调用的上下文控制。
+var httpClient = &http.Client{}
+
+// configuredNotifiers 根据配置创建所有启用的通知渠道。
+func configuredNotifiers() []Notifier {
+	settings := config.AppSettings
+	var notifiers []Notifier
+	for _, u := range splitList(settings.AlertWebhookURLs) {
+		notifiers = append(notifiers, &webhookNotifier{url: u, secret: settings.AlertWebhookSecret})
+	}
+	if settings.AlertSlackWebhookURL != "" {
+		notifiers = append(notifiers, &slackNotifier{url: settings.AlertSlackWebhookURL})
+	}
+	if settings.AlertDingTalkWebhookURL != "" {
+		notifiers = append(notifiers, &dingTalkNotifier{url: settings.AlertDingTalkWebhookURL, secret: settings.AlertDingTalkSecret})
+	}
+	if settings.AlertFeishuWebhookURL != "" {
+		notifiers = append(notifiers, &feishuNotifier{url: settings.AlertFeishuWebhookURL, secret: settings.AlertFeishuSecret})
+	}
+	if settings.AlertSMTPHost != "" {
+		if to := splitList(settings.AlertSMTPTo); len(to) > 0 && settings.AlertSMTPFrom != "" {
+			notifiers = append(notifiers, &emailNotifier{
+				host:     settings.AlertSMTPHost,
+				port:     settings.AlertSMTPPort,
+				username: settings.AlertSMTPUsername,
+				password: settings.AlertSMTPPassword,
+				from:     settings.AlertSMTPFrom,
+				to:       to,
+			})
+		} else {
+			Log.Warn("告警: 已配置 ALERT_SMTP_HOST，但 ALERT_SMTP_FROM 或 ALERT_SMTP_TO 为空，邮件通知未启用。")
+		}
+	}
+	return notifiers
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// alertTitle 返回告警的单行标题，例如 "[FIRING][critical] 可用密钥不足: 0/3 个密钥可用"。
+func alertTitle(alert Alert) string {
+	return fmt.Sprintf("[%s][%s] %s", strings.ToUpper(alert.Status), alert.Severity, alert.Summary)
+}
+
+// alertText 返回告警的纯文本正文，供聊天机器人和邮件渠道使用。
+func alertText(alert Alert) string {
+	var b strings.Builder
+	b.WriteString(alertTitle(alert))
+	fmt.Fprintf(&b, "\n规则: %s\n指纹: %s\n开始时间: %s", alert.Rule, alert.Fingerprint, alert.StartsAt.Format(time.RFC3339))
+	if alert.ResolvedAt != nil {
+		fmt.Fprintf(&b, "\n恢复时间: %s", alert.ResolvedAt.Format(time.RFC3339))
+	}
+	keys := make([]string, 0, len(alert.Details))
+	for k := range alert.Details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\n%s: %v", k, alert.Details[k])
+	}
+	return b.String()
+}
+
+// postJSON 将 payload 序列化后 POST 到 url，非 2xx 状态视为失败，返回响应体以便调用方检查渠道特定的错误码。
+// secret 非空时附带 X-Alert-Signature 签名头部。
+func postJSON(ctx context.Context, url string, payload interface{}, secret string) ([]byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		timestamp := time.Now().Unix()
+		req.Header.Set(alertSignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, signAlert(secret, timestamp, body)))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return respBody, fmt.Errorf("返回状态 %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, nil
+}
+
+// webhookNotifier 将告警对象以 JSON 格式 POST 到通用 Webhook，配置了密钥时附带 X-Alert-Signature 签名头部。
+type webhookNotifier struct {
+	url    string
+	secret string
+}
+
+// signAlert 计算通用 Webhook 签名：HMAC-SHA256(secret, "<timestamp>.<body>")。
+func signAlert(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *webhookNotifier) Name() string {
+	return "webhook(" + redactURL(n.url) + ")"
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, alert Alert) error {
+	_, err := postJSON(ctx, n.url, alert, n.secret)
+	return err
+}
+
+// slackNotifier 发送到 Slack Incoming Webhook（以及兼容其 {"text": ...} 格式的服务）。
+type slackNotifier struct {
+	url string
+}
+
+func (n *slackNotifier) Name() string { return "slack" }
+
+func (n *slackNotifier) Notify(ctx context.Context, alert Alert) error {
+	_, err := postJSON(ctx, n.url, map[string]string{"text": alertText(alert)}, "")
+	return err
+}
+
+// dingTalkNotifier 发送到钉钉群机器人。配置了加签密钥时在 URL 上附加 timestamp 和 sign 参数。
+type dingTalkNotifier struct {
+	url    string
+	secret string
+}
+
+func (n *dingTalkNotifier) Name() string { return "dingtalk" }
+
+func (n *dingTalkNotifier) Notify(ctx context.Context, alert Alert) error {
+	target := n.url
+	if n.secret != "" {
+		timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write([]byte(timestamp + "\n" + n.secret))
+		query := url.Values{"timestamp": {timestamp}, "sign": {base64.StdEncoding.EncodeToString(mac.Sum(nil))}}
+		separator := "?"
+		if strings.Contains(target, "?") {
+			separator = "&"
+		}
+		target += separator + query.Encode()
+	}
+	payload := map[string]interface{}{
+		"msgtype": "text",
+		"text":    map[string]string{"content": alertText(alert)},
+	}
+	respBody, err := postJSON(ctx, target, payload, "")
+	if err != nil {
+		return err
+	}
+	// 钉钉在 HTTP 200 的响应体中通过 errcode 返回错误
+	var result struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}
+	if json.Unmarshal(respBody, &result) == nil && result.ErrCode != 0 {
+		return fmt.Errorf("钉钉返回错误 %d: %s", result.ErrCode, result.ErrMsg)
+	}
+	return nil
+}
+
+// feishuNotifier 发送到飞书群机器人。配置了签名校验密钥时在请求体中附加 timestamp 和 sign 字段。
+type feishuNotifier struct {
+	url    string
+	secret string
+}
+
+func (n *feishuNotifier) Name() string { return "feishu" }
+
+func (n *feishuNotifier) Notify(ctx context.Context, alert Alert) error {
+	payload := map[string]interface{}{
+		"msg_type": "text",
+		"content":  map[string]string{"text": alertText(alert)},
+	}
+	if n.secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		// 飞书的签名以 "timestamp\nsecret" 作为 HMAC 密钥、对空消息计算
+		mac := hmac.New(sha256.New, []byte(timestamp+"\n"+n.secret))
+		payload["timestamp"] = timestamp
+		payload["sign"] = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	respBody, err := postJSON(ctx, n.url, payload, "")
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	}
+	if json.Unmarshal(respBody, &result) == nil && result.Code != 0 {
+		return fmt.Errorf("飞书返回错误 %d: %s", result.Code, result.Msg)
+	}
+	return nil
+}
+
+// emailNotifier 通过 SMTP 发送纯文本告警邮件。端口 465 使用隐式 TLS，其他端口在服务器支持时使用 STARTTLS。
+type emailNotifier struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+func (n *emailNotifier) Name() string { return "email" }
+
+func (n *emailNotifier) Notify(ctx context.Context, alert Alert) error {
+	addr := net.JoinHostPort(n.host, strconv.Itoa(n.port))
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	var err error
+	if n.port == 465 {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: n.host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("连接 SMTP 服务器失败: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("SMTP 握手失败: %w", err)
+	}
+	defer client.Close()
+	if n.port != 465 {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(&tls.Config{ServerName: n.host}); err != nil {
+				return fmt.Errorf("SMTP STARTTLS 失败: %w", err)
+			}
+		}
+	}
+	if n.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.username, n.password, n.host)); err != nil {
+			return fmt.Errorf("SMTP 认证失败: %w", err)
+		}
+	}
+	if err := client.Mail(n.from); err != nil {
+		return fmt.Errorf("SMTP MAIL FROM 失败: %w", err)
+	}
+	for _, rcpt := range n.to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("SMTP RCPT TO %s 失败: %w", rcpt, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("SMTP DATA 失败: %w", err)
+	}
+	if _, err := w.Write(n.message(alert)); err != nil {
+		w.Close()
+		return fmt.Errorf("写入邮件内容失败: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("SMTP 服务器拒绝邮件: %w", err)
+	}
+	return client.Quit()
+}
+
+func (n *emailNotifier) message(alert Alert) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", n.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", alertTitle(alert)))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString([]byte(alertText(alert)))
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded + "\r\n")
+	return b.Bytes()
+}
+
+// redactURL 只保留 URL 的协议和主机部分，避免在日志和接口响应中泄露路径中的令牌。
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "invalid-url"
+	}
+	return u.Scheme + "://" + u.Host
+}
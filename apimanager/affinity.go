@@ -0,0 +1,149 @@
+package apimanager
+
+import (
+	"hash/fnv"
+	"math"
+	"openrouter_polling/config"
+	"openrouter_polling/models"
+	"openrouter_polling/utils"
+	"time"
+)
+
+// affinitySweepInterval 是清理过期会话绑定的最小间隔。
+const affinitySweepInterval = time.Minute
+
+// affinityEntry 记录一个会话最近一次使用的密钥。
+type affinityEntry struct {
+	key      string
+	lastUsed time.Time
+}
+
+// keyAffinity 保存会话与密钥的绑定及其统计，由 m.lock 保护。
+type keyAffinity struct {
+	entries   map[string]*affinityEntry // 会话标识 -> 绑定
+	sweptAt   time.Time
+	hits      int64
+	fallbacks int64
+	assigned  int64
+}
+
+// GetAPIKeyForConversation 为会话选择一个密钥并占用它的一个并发名额，使同一会话的请求尽量发往同一个密钥，
+// 以命中提供商侧的提示词缓存：会话上次使用的密钥仍可用（未冷却、未停用且有并发名额）时继续使用它；
+// 否则按加权的一致性哈希（rendezvous 哈希）在可用密钥中选择，密钥池变化时只有受影响的会话会换密钥。
+// 会话随后绑定到新的密钥（缓存已在新密钥上建立），绑定空闲 KEY_AFFINITY_IDLE_TTL_SECONDS 后过期。
+// conversation 为空时等同于 GetNextAPIKey。调用者用完密钥后必须调用 ReleaseKey。
+func (m *ApiKeyManager) GetAPIKeyForConversation(conversation string) *ApiKeyStatus {
+	if conversation == "" {
+		return m.GetNextAPIKey()
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.checkAndReactivateKeysInternal()
+	m.refreshEffectiveWeightsLocked()
+	now := time.Now()
+	m.sweepAffinityLocked(now)
+
+	entry := m.affinity.entries[conversation]
+	if entry != nil && now.Sub(entry.lastUsed) > config.AppSettings.KeyAffinityIdleTTL {
+		entry = nil
+	}
+	var selected *ApiKeyStatus
+	if entry != nil {
+		for _, ks := range m.keysStatus {
+			if ks.Key == entry.key && ks.CanUse() && ks.hasFreeSlot() {
+				selected = ks
+				break
+			}
+		}
+	}
+	if selected != nil {
+		m.affinity.hits++
+	} else {
+		selected = m.rendezvousKeyLocked(conversation)
+		if selected == nil {
+			return nil
+		}
+		if entry != nil {
+			m.affinity.fallbacks++
+			m.log.Debugf("会话亲和: 会话上次使用的密钥 %s 当前不可用，改用密钥 %s。", utils.SafeSuffix(entry.key), utils.SafeSuffix(selected.Key))
+		} else {
+			m.affinity.assigned++
+		}
+	}
+	m.affinity.entries[conversation] = &affinityEntry{key: selected.Key, lastUsed: now}
+	return m.takeKeyLocked(selected, map[string]interface{}{"affinity": true})
+}
+
+// rendezvousKeyLocked 按加权 rendezvous 哈希在可用且有并发名额的密钥中为会话选择一个密钥：
+// 每个密钥的得分为 weight / -ln(hash(会话, 密钥))，得分最高者胜出。密钥的增减只影响原本落在该密钥上的会话，
+// 长期来看各密钥分到的会话数与其权重成正比。没有可用密钥时返回 nil。调用方需持有 m.lock。
+func (m *ApiKeyManager) rendezvousKeyLocked(conversation string) *ApiKeyStatus {
+	var best *ApiKeyStatus
+	bestScore := 0.0
+	for _, ks := range m.keysStatus {
+		if !ks.CanUse() || !ks.hasFreeSlot() {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(conversation))
+		h.Write([]byte{0})
+		h.Write([]byte(ks.Key))
+		u := (float64(mixHash(h.Sum64())>>11) + 0.5) / (1 << 53) // 映射到 (0, 1)
+		weight := ks.effectiveWeight
+		if weight <= 0 {
+			weight = 1e-9 // 与 GetNextAPIKey 一致：权重为 0 的密钥只在没有其他可用密钥时使用
+		}
+		score := weight / -math.Log(u)
+		if score > bestScore {
+			best, bestScore = ks, score
+		}
+	}
+	return best
+}
+
+// mixHash 是 MurmurHash3 的 64 位终结函数。FNV 对末尾几个字节不同的输入（例如只有后缀不同的密钥）
+// 得到的哈希值高位几乎线性相关，直接使用会使同一个密钥在大多数会话中胜出，混合后各密钥的得分才相互独立。
+func mixHash(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// sweepAffinityLocked 删除空闲超过 KEY_AFFINITY_IDLE_TTL_SECONDS 的会话绑定，最多每分钟执行一次。调用方需持有 m.lock。
+func (m *ApiKeyManager) sweepAffinityLocked(now time.Time) {
+	if now.Sub(m.affinity.sweptAt) < affinitySweepInterval {
+		return
+	}
+	m.affinity.sweptAt = now
+	ttl := config.AppSettings.KeyAffinityIdleTTL
+	for conversation, entry := range m.affinity.entries {
+		if now.Sub(entry.lastUsed) > ttl {
+			delete(m.affinity.entries, conversation)
+		}
+	}
+}
+
+// AffinityStatus 返回会话亲和的统计快照，用于 /admin/app-status。
+func (m *ApiKeyManager) AffinityStatus() models.KeyAffinityStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	status := models.KeyAffinityStatus{
+		Enabled:          config.AppSettings.KeyAffinityEnabled,
+		IdleTTLSeconds:   config.AppSettings.KeyAffinityIdleTTL.Seconds(),
+		Hits:             m.affinity.hits,
+		Fallbacks:        m.affinity.fallbacks,
+		NewConversations: m.affinity.assigned,
+	}
+	now := time.Now()
+	for _, entry := range m.affinity.entries {
+		if now.Sub(entry.lastUsed) <= config.AppSettings.KeyAffinityIdleTTL {
+			status.Conversations++
+		}
+	}
+	return status
+}
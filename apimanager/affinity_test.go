@@ -0,0 +1,171 @@
+package apimanager
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"openrouter_polling/config"
+	"openrouter_polling/storage"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// newTestManager 创建一个使用临时 SQLite 数据库的密钥管理器，按 weights 依次添加密钥，返回管理器和密钥列表。
+// 并发名额和自适应权重关闭，会话绑定空闲 10 分钟过期，测试结束后恢复全局配置。
+func newTestManager(t *testing.T, weights ...int) (*ApiKeyManager, []string) {
+	t.Helper()
+	prevSettings := config.AppSettings
+	t.Cleanup(func() { config.AppSettings = prevSettings })
+	config.AppSettings.KeyMaxConcurrentRequests = 0
+	config.AppSettings.AdaptiveWeighting = false
+	config.AppSettings.KeyFailureCooldown = time.Minute
+	config.AppSettings.KeyMaxConsecutiveFailures = 0
+	config.AppSettings.KeyAffinityIdleTTL = 10 * time.Minute
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatalf("打开测试数据库失败: %v", err)
+	}
+	if err := db.AutoMigrate(&storage.APIKey{}, &storage.KeyEvent{}); err != nil {
+		t.Fatalf("迁移测试数据库失败: %v", err)
+	}
+	keyStore := storage.NewKeyStore(db)
+	keys := make([]string, 0, len(weights))
+	for i, weight := range weights {
+		key := fmt.Sprintf("sk-or-v1-manager-test-key-%04d", i+1)
+		if err := keyStore.AddKey(&storage.APIKey{Key: key, Weight: weight}); err != nil {
+			t.Fatalf("添加密钥失败: %v", err)
+		}
+		keys = append(keys, key)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	manager := NewApiKeyManager(logger, keyStore, storage.NewKeyEventStore(db))
+	if err := manager.LoadKeysFromDB(); err != nil {
+		t.Fatalf("加载密钥失败: %v", err)
+	}
+	return manager, keys
+}
+
+// acquireForConversation 为会话获取一个密钥并立即归还，返回密钥字符串。
+func acquireForConversation(t *testing.T, m *ApiKeyManager, conversation string) string {
+	t.Helper()
+	ks := m.GetAPIKeyForConversation(conversation)
+	if ks == nil {
+		t.Fatalf("会话 %s 没有获取到密钥", conversation)
+	}
+	m.ReleaseKey(ks.Key)
+	return ks.Key
+}
+
+func TestConversationReusesBoundKey(t *testing.T) {
+	m, _ := newTestManager(t, 1, 1, 1, 1)
+	for i := range 20 {
+		conversation := fmt.Sprintf("conv-%d", i)
+		first := acquireForConversation(t, m, conversation)
+		for range 5 {
+			if got := acquireForConversation(t, m, conversation); got != first {
+				t.Fatalf("会话 %s 使用了密钥 %s, 期望继续使用 %s", conversation, got, first)
+			}
+		}
+	}
+	status := m.AffinityStatus()
+	if status.NewConversations != 20 || status.Hits != 100 || status.Fallbacks != 0 || status.Conversations != 20 {
+		t.Errorf("会话亲和统计 = %+v, 期望 20 个新会话、100 次命中", status)
+	}
+}
+
+func TestConversationFallsBackWhenBoundKeyCoolsDown(t *testing.T) {
+	m, keys := newTestManager(t, 1, 1, 1)
+	bound := make(map[string]string)
+	for i := range 30 {
+		conversation := fmt.Sprintf("conv-%d", i)
+		bound[conversation] = acquireForConversation(t, m, conversation)
+	}
+
+	failed := bound["conv-0"]
+	m.MarkKeyFailure(failed, KeyFailure{Source: SourceRequest, ErrorType: "rate_limit_error", HTTPStatus: 429})
+	moved := 0
+	for conversation, previous := range bound {
+		got := acquireForConversation(t, m, conversation)
+		if got == failed {
+			t.Fatalf("会话 %s 使用了冷却中的密钥", conversation)
+		}
+		if previous != failed && got != previous {
+			t.Errorf("会话 %s 从可用的密钥 %s 换到了 %s, 期望只有冷却密钥上的会话换密钥", conversation, previous, got)
+		}
+		if previous == failed {
+			moved++
+			// 会话随后绑定到新的密钥。
+			if again := acquireForConversation(t, m, conversation); again != got {
+				t.Errorf("会话 %s 换密钥后使用了 %s, 期望继续使用新的密钥 %s", conversation, again, got)
+			}
+		}
+	}
+	if status := m.AffinityStatus(); status.Fallbacks != int64(moved) {
+		t.Errorf("换密钥次数 = %d, 期望 %d", status.Fallbacks, moved)
+	}
+
+	// 所有密钥都不可用时返回 nil。
+	for _, key := range keys {
+		m.MarkKeyFailure(key, KeyFailure{Source: SourceRequest, ErrorType: "rate_limit_error", HTTPStatus: 429})
+	}
+	if ks := m.GetAPIKeyForConversation("conv-0"); ks != nil {
+		t.Errorf("所有密钥冷却时获取到了密钥 %s, 期望 nil", ks.Key)
+	}
+}
+
+func TestConversationSkipsBoundKeyWithoutFreeSlot(t *testing.T) {
+	m, _ := newTestManager(t, 1, 1)
+	config.AppSettings.KeyMaxConcurrentRequests = 1
+	held := m.GetAPIKeyForConversation("conv")
+	if held == nil {
+		t.Fatal("获取密钥失败")
+	}
+	other := m.GetAPIKeyForConversation("conv")
+	if other == nil || other.Key == held.Key {
+		t.Fatalf("绑定的密钥没有并发名额时期望改用另一个密钥, 实际 %v", other)
+	}
+}
+
+func TestAffinitySweepRemovesIdleConversations(t *testing.T) {
+	m, _ := newTestManager(t, 1, 1)
+	config.AppSettings.KeyAffinityIdleTTL = 20 * time.Millisecond
+	acquireForConversation(t, m, "idle-1")
+	acquireForConversation(t, m, "idle-2")
+	time.Sleep(30 * time.Millisecond)
+
+	if status := m.AffinityStatus(); status.Conversations != 0 {
+		t.Errorf("活跃会话数 = %d, 期望空闲的绑定不计入", status.Conversations)
+	}
+	m.lock.Lock()
+	m.affinity.sweptAt = time.Time{} // 清理最多每分钟执行一次，这里模拟距上次清理已超过一分钟
+	m.lock.Unlock()
+	acquireForConversation(t, m, "active")
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.affinity.entries) != 1 || m.affinity.entries["active"] == nil {
+		t.Errorf("清理后的会话绑定数 = %d, 期望只保留 active", len(m.affinity.entries))
+	}
+}
+
+func TestRendezvousSpreadsConversationsByWeight(t *testing.T) {
+	m, keys := newTestManager(t, 1, 3)
+	const conversations = 4000
+	counts := make(map[string]int)
+	for i := range conversations {
+		counts[acquireForConversation(t, m, fmt.Sprintf("conv-%d", i))]++
+	}
+	share := float64(counts[keys[1]]) / conversations
+	if math.Abs(share-0.75) > 0.03 {
+		t.Errorf("权重为 3 的密钥分到 %.3f 的会话, 期望约 0.75", share)
+	}
+}
@@ -0,0 +1,144 @@
+package apimanager
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 密钥管理器发布的事件类型。
+const (
+	EventKeySelected     = "key_selected"     // GetNextAPIKey 选中了密钥
+	EventKeyFailure      = "key_failure"      // 记录了一次密钥失败（密钥进入冷却）
+	EventKeyReactivated  = "key_reactivated"  // 密钥冷却结束或成功请求后恢复为可用
+	EventKeyAdded        = "key_added"        // 新增密钥
+	EventKeyDeleted      = "key_deleted"      // 删除密钥
+	EventKeyUpdated      = "key_updated"      // 管理员启用、停用密钥或修改权重
+	EventSettingsChanged = "settings_changed" // 管理员热更新了配置
+)
+
+// EventTypes 是所有事件类型，供订阅方校验过滤条件。
+var EventTypes = []string{EventKeySelected, EventKeyFailure, EventKeyReactivated, EventKeyAdded, EventKeyDeleted, EventKeyUpdated, EventSettingsChanged}
+
+// Event 是密钥管理器发布的一个状态变化事件。与密钥相关的事件携带变化后的密钥状态快照。
+type Event struct {
+	ID        uint64                 `json:"id"`
+	Type      string                 `json:"type"`
+	Time      time.Time              `json:"time"`
+	KeySuffix string                 `json:"key_suffix,omitempty"`
+	Key       *ApiKeyStatusSafe      `json:"key,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// EventFilter 是订阅的过滤条件，为空的字段表示不按该维度过滤。
+// 按密钥后缀过滤时，不属于任何密钥的事件（如 settings_changed）总是被投递。
+type EventFilter struct {
+	KeySuffixes map[string]bool
+	Types       map[string]bool
+}
+
+// Matches 判断事件是否符合过滤条件。
+func (f EventFilter) Matches(event Event) bool {
+	if len(f.Types) > 0 && !f.Types[event.Type] {
+		return false
+	}
+	if len(f.KeySuffixes) > 0 && event.KeySuffix != "" && !f.KeySuffixes[event.KeySuffix] {
+		return false
+	}
+	return true
+}
+
+// Subscription 是事件总线上的一个订阅。事件通过带缓冲的 C 投递，缓冲区满时新事件被丢弃并计数，
+// 订阅方可通过 Dropped 得知需要重新同步完整状态。
+type Subscription struct {
+	C       <-chan Event
+	ch      chan Event
+	filter  EventFilter
+	dropped atomic.Uint64
+}
+
+// Dropped 返回并清零自上次调用以来因缓冲区已满而丢弃的事件数。
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Swap(0)
+}
+
+// EventBus 是进程内的发布/订阅事件总线。Publish 从不阻塞，因此可以在持有管理器锁时调用，
+// 慢速订阅方只会丢失自己的事件，不会拖慢 GetNextAPIKey 等热路径。
+type EventBus struct {
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	count  atomic.Int32 // 订阅数，供发布方在无人订阅时跳过构造事件
+	nextID atomic.Uint64
+}
+
+// NewEventBus 创建一个空的事件总线。
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe 创建一个订阅，buffer 为事件缓冲区大小。使用完毕后必须调用 Unsubscribe。
+func (b *EventBus) Subscribe(filter EventFilter, buffer int) *Subscription {
+	ch := make(chan Event, max(buffer, 1))
+	sub := &Subscription{C: ch, ch: ch, filter: filter}
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.count.Add(1)
+	b.mu.Unlock()
+	return sub
+}
+
+// Unsubscribe 取消订阅并关闭其事件通道。
+func (b *EventBus) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		b.count.Add(-1)
+		close(sub.ch)
+	}
+}
+
+// HasSubscribers 报告当前是否有订阅。
+func (b *EventBus) HasSubscribers() bool {
+	return b.count.Load() > 0
+}
+
+// Publish 为事件分配 ID 和时间后投递给所有匹配的订阅。
+func (b *EventBus) Publish(event Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.subs) == 0 {
+		return
+	}
+	event.ID = b.nextID.Add(1)
+	event.Time = time.Now()
+	for sub := range b.subs {
+		if !sub.filter.Matches(event) {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// publishKeyEvent 发布与某个密钥相关的事件，附带其当前状态快照。调用方需持有 m.lock。
+func (m *ApiKeyManager) publishKeyEvent(eventType string, ks *ApiKeyStatus, data map[string]interface{}) {
+	if !m.events.HasSubscribers() {
+		return
+	}
+	snapshot := ks.ToSafe()
+	m.events.Publish(Event{Type: eventType, KeySuffix: snapshot.KeySuffix, Key: &snapshot, Data: data})
+}
+
+// Events 返回密钥管理器的事件总线。
+func (m *ApiKeyManager) Events() *EventBus {
+	return m.events
+}
+
+// PublishSettingsChanged 发布配置热更新事件，fields 为本次更新的配置项名称。
+func (m *ApiKeyManager) PublishSettingsChanged(fields []string) {
+	m.events.Publish(Event{Type: EventSettingsChanged, Data: map[string]interface{}{"fields": fields}})
+}
@@ -0,0 +1,143 @@
+package apimanager
+
+import (
+	"openrouter_polling/utils"
+	"testing"
+)
+
+// receiveEvent 非阻塞地从订阅中取出一个事件，没有事件时测试失败。
+func receiveEvent(t *testing.T, sub *Subscription) Event {
+	t.Helper()
+	select {
+	case event := <-sub.C:
+		return event
+	default:
+		t.Fatal("期望收到事件")
+		return Event{}
+	}
+}
+
+// expectNoEvent 断言订阅中没有待处理的事件。
+func expectNoEvent(t *testing.T, sub *Subscription) {
+	t.Helper()
+	select {
+	case event := <-sub.C:
+		t.Errorf("收到意外的事件 %+v", event)
+	default:
+	}
+}
+
+func TestEventBusFansOutToMatchingSubscribers(t *testing.T) {
+	bus := NewEventBus()
+	all := bus.Subscribe(EventFilter{}, 4)
+	failures := bus.Subscribe(EventFilter{Types: map[string]bool{EventKeyFailure: true}}, 4)
+	key1 := bus.Subscribe(EventFilter{KeySuffixes: map[string]bool{"1111": true}}, 4)
+	t.Cleanup(func() {
+		bus.Unsubscribe(all)
+		bus.Unsubscribe(failures)
+		bus.Unsubscribe(key1)
+	})
+
+	bus.Publish(Event{Type: EventKeySelected, KeySuffix: "1111"})
+	bus.Publish(Event{Type: EventKeyFailure, KeySuffix: "2222"})
+	bus.Publish(Event{Type: EventSettingsChanged})
+
+	var lastID uint64
+	for _, want := range []string{EventKeySelected, EventKeyFailure, EventSettingsChanged} {
+		event := receiveEvent(t, all)
+		if event.Type != want {
+			t.Errorf("事件类型 = %s, 期望 %s", event.Type, want)
+		}
+		if event.ID <= lastID || event.Time.IsZero() {
+			t.Errorf("事件 %+v 期望分配递增的 ID 和发布时间", event)
+		}
+		lastID = event.ID
+	}
+	expectNoEvent(t, all)
+
+	if event := receiveEvent(t, failures); event.Type != EventKeyFailure || event.KeySuffix != "2222" {
+		t.Errorf("按类型过滤收到 %+v, 期望只有 key_failure", event)
+	}
+	expectNoEvent(t, failures)
+
+	// 按密钥过滤时，不属于任何密钥的事件同样投递。
+	for _, want := range []string{EventKeySelected, EventSettingsChanged} {
+		if event := receiveEvent(t, key1); event.Type != want {
+			t.Errorf("按密钥过滤收到 %s, 期望 %s", event.Type, want)
+		}
+	}
+	expectNoEvent(t, key1)
+}
+
+func TestEventBusDropsEventsForSlowSubscriber(t *testing.T) {
+	bus := NewEventBus()
+	slow := bus.Subscribe(EventFilter{}, 2)
+	fast := bus.Subscribe(EventFilter{}, 10)
+	t.Cleanup(func() {
+		bus.Unsubscribe(slow)
+		bus.Unsubscribe(fast)
+	})
+
+	// 慢速订阅方缓冲区满后 Publish 不阻塞，只丢弃它自己的事件。
+	for range 5 {
+		bus.Publish(Event{Type: EventKeySelected})
+	}
+	if dropped := slow.Dropped(); dropped != 3 {
+		t.Errorf("慢速订阅方丢弃 %d 个事件, 期望 3", dropped)
+	}
+	if dropped := slow.Dropped(); dropped != 0 {
+		t.Errorf("Dropped 读取后期望清零, 实际 %d", dropped)
+	}
+	if dropped := fast.Dropped(); dropped != 0 {
+		t.Errorf("快速订阅方丢弃 %d 个事件, 期望 0", dropped)
+	}
+	if len(slow.C) != 2 || len(fast.C) != 5 {
+		t.Errorf("缓冲事件数 = %d, %d, 期望 2, 5", len(slow.C), len(fast.C))
+	}
+
+	// 慢速订阅方消费后可以继续接收新事件，保留的是最早的事件。
+	first := receiveEvent(t, slow)
+	bus.Publish(Event{Type: EventKeyFailure})
+	if second := receiveEvent(t, slow); second.ID != first.ID+1 {
+		t.Errorf("第二个事件 ID = %d, 期望 %d", second.ID, first.ID+1)
+	}
+	if event := receiveEvent(t, slow); event.Type != EventKeyFailure {
+		t.Errorf("事件类型 = %s, 期望 key_failure", event.Type)
+	}
+	if dropped := slow.Dropped(); dropped != 0 {
+		t.Errorf("消费后丢弃 %d 个事件, 期望 0", dropped)
+	}
+}
+
+func TestEventBusUnsubscribeClosesChannel(t *testing.T) {
+	bus := NewEventBus()
+	sub := bus.Subscribe(EventFilter{}, 1)
+	if !bus.HasSubscribers() {
+		t.Fatal("订阅后 HasSubscribers 期望为 true")
+	}
+	bus.Unsubscribe(sub)
+	bus.Unsubscribe(sub) // 重复取消订阅不会重复关闭通道
+	if bus.HasSubscribers() {
+		t.Error("取消订阅后 HasSubscribers 期望为 false")
+	}
+	if _, ok := <-sub.C; ok {
+		t.Error("取消订阅后事件通道期望已关闭")
+	}
+	bus.Publish(Event{Type: EventKeySelected})
+}
+
+func TestManagerPublishesKeySelectedEvent(t *testing.T) {
+	m, keys := newTestManager(t, 1)
+	sub := m.Events().Subscribe(EventFilter{}, 4)
+	t.Cleanup(func() { m.Events().Unsubscribe(sub) })
+
+	ks := m.GetNextAPIKey()
+	if ks == nil {
+		t.Fatal("没有获取到密钥")
+	}
+	m.ReleaseKey(ks.Key)
+	event := receiveEvent(t, sub)
+	if event.Type != EventKeySelected || event.KeySuffix != utils.SafeSuffix(keys[0]) || event.Key == nil {
+		t.Errorf("事件 = %+v, 期望携带密钥快照的 key_selected", event)
+	}
+}
@@ -0,0 +1,138 @@
+package apimanager
+
+import (
+	"fmt"
+	"openrouter_polling/storage"
+	"openrouter_polling/utils"
+	"time"
+	"unicode/utf8"
+)
+
+// 密钥状态变化历史（key_events 表）中的事件类型。
+const (
+	KeyEventFailure         = "failure"           // 请求失败
+	KeyEventCooldownStart   = "cooldown_start"    // 密钥从可用进入冷却
+	KeyEventCooldownEnd     = "cooldown_end"      // 冷却期结束，密钥自动恢复
+	KeyEventReactivated     = "reactivated"       // 密钥在失败后因成功请求或健康检查通过而恢复
+	KeyEventHealthCheckPass = "health_check_pass" // 健康检查通过
+	KeyEventHealthCheckFail = "health_check_fail" // 健康检查失败
+	KeyEventAdminEnable     = "admin_enable"      // 管理员启用
+	KeyEventAdminDisable    = "admin_disable"     // 管理员停用
+	KeyEventWeightChange    = "weight_change"     // 管理员修改权重
+)
+
+// 密钥状态变化的来源（KeyFailure.Source 以及历史记录的 cause 字段）。
+const (
+	SourceRequest         = "request"
+	SourceHealthCheck     = "health_check"
+	SourceCooldownExpired = "cooldown_expired"
+	SourceAdmin           = "admin"
+)
+
+// keyEventMessageMaxLen 是历史记录中错误信息片段的最大字符数（与 key_events.message 列宽一致）。
+const keyEventMessageMaxLen = 512
+
+// KeyFailure 描述一次密钥失败的原因，记录在密钥的状态变化历史中。
+type KeyFailure struct {
+	Source     string // SourceRequest 或 SourceHealthCheck
+	ErrorType  string // 错误类型，例如 upstream_timeout_error、rate_limit_error
+	HTTPStatus int    // 上游返回的 HTTP 状态码，网络错误等情况下为 0
+	Message    string // 上游错误信息片段
+}
+
+// recordKeyEvent 将密钥的一次状态变化异步写入 key_events 表，密钥当前的失败次数和冷却时间随记录一起保存。
+// event.CreatedAt 为零值时使用当前时间；事件实际发生在更早时刻（如冷却结束）时由调用方指定。
+// 未配置历史存储时不做任何事。调用方需持有 m.lock。
+func (m *ApiKeyManager) recordKeyEvent(ks *ApiKeyStatus, event storage.KeyEvent) {
+	if m.keyEvents == nil {
+		return
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	event.KeySuffix = utils.SafeSuffix(ks.Key)
+	event.FailureCount = ks.FailureCount
+	if ks.CoolDownUntil != nil {
+		until := *ks.CoolDownUntil
+		event.CoolDownUntil = &until
+	}
+	event.Message = truncateRunes(event.Message, keyEventMessageMaxLen)
+	go func() {
+		if err := m.keyEvents.AddEvent(&event); err != nil {
+			m.log.Errorf("保存密钥 %s 的状态变化记录 (%s) 失败: %v", event.KeySuffix, event.Event, err)
+		}
+	}()
+}
+
+// findKeyBySuffixLocked 按后缀查找密钥。调用方需持有 m.lock。
+func (m *ApiKeyManager) findKeyBySuffixLocked(suffix string) *ApiKeyStatus {
+	for _, ks := range m.keysStatus {
+		if utils.SafeSuffix(ks.Key) == suffix {
+			return ks
+		}
+	}
+	return nil
+}
+
+// SetKeyDisabled 由管理员启用或停用密钥。停用的密钥不参与轮询和健康检查，直到再次启用。
+func (m *ApiKeyManager) SetKeyDisabled(suffix string, disabled bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ks := m.findKeyBySuffixLocked(suffix)
+	if ks == nil {
+		return ErrKeyNotFound
+	}
+	if ks.Disabled == disabled {
+		return nil
+	}
+	if err := m.keyStore.SetDisabled(ks.Key, disabled); err != nil {
+		m.log.Errorf("持久化密钥 %s 的停用状态失败: %v", suffix, err)
+		return err
+	}
+	ks.Disabled = disabled
+	event, action := KeyEventAdminEnable, "启用"
+	if disabled {
+		event, action = KeyEventAdminDisable, "停用"
+	}
+	m.log.Infof("管理员%s了密钥 %s。", action, suffix)
+	m.recordKeyEvent(ks, storage.KeyEvent{Event: event, Cause: SourceAdmin})
+	m.publishKeyEvent(EventKeyUpdated, ks, map[string]interface{}{"change": event})
+	return nil
+}
+
+// SetKeyWeight 由管理员修改密钥的权重。
+func (m *ApiKeyManager) SetKeyWeight(suffix string, weight int) error {
+	if weight < 1 {
+		return ErrInvalidKeyFormat
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ks := m.findKeyBySuffixLocked(suffix)
+	if ks == nil {
+		return ErrKeyNotFound
+	}
+	if ks.Weight == weight {
+		return nil
+	}
+	if err := m.keyStore.UpdateWeight(ks.Key, weight); err != nil {
+		m.log.Errorf("持久化密钥 %s 的权重失败: %v", suffix, err)
+		return err
+	}
+	oldWeight := ks.Weight
+	ks.Weight = weight
+	m.refreshEffectiveWeightsLocked()
+	m.log.Infof("管理员将密钥 %s 的权重从 %d 修改为 %d。", suffix, oldWeight, weight)
+	m.recordKeyEvent(ks, storage.KeyEvent{Event: KeyEventWeightChange, Cause: SourceAdmin, Message: fmt.Sprintf("%d -> %d", oldWeight, weight)})
+	m.publishKeyEvent(EventKeyUpdated, ks, map[string]interface{}{"change": KeyEventWeightChange, "old_weight": oldWeight})
+	return nil
+}
+
+func truncateRunes(s string, maxRunes int) string {
+	if utf8.RuneCountInString(s) <= maxRunes {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:maxRunes])
+}
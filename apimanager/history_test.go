@@ -0,0 +1,62 @@
+package apimanager
+
+import (
+	"io"
+	"openrouter_polling/storage"
+	"openrouter_polling/utils"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+func TestCooldownEndEventStampedAtCooldownExpiry(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatalf("打开测试数据库失败: %v", err)
+	}
+	if err := db.AutoMigrate(&storage.APIKey{}, &storage.KeyEvent{}); err != nil {
+		t.Fatalf("迁移测试数据库失败: %v", err)
+	}
+	keyStore, eventStore := storage.NewKeyStore(db), storage.NewKeyEventStore(db)
+
+	const key = "sk-or-v1-cooldown-test-key"
+	cooledDownAt := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	if err := keyStore.AddKey(&storage.APIKey{Key: key, Weight: 1}); err != nil {
+		t.Fatalf("添加密钥失败: %v", err)
+	}
+	if err := keyStore.UpdateKeyFields(key, map[string]interface{}{"is_active": false, "failure_count": 3, "cool_down_until": cooledDownAt}); err != nil {
+		t.Fatalf("设置冷却状态失败: %v", err)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	manager := NewApiKeyManager(logger, keyStore, eventStore)
+	if err := manager.LoadKeysFromDB(); err != nil {
+		t.Fatalf("加载密钥失败: %v", err)
+	}
+	// 冷却结束十分钟后才有请求触发惰性的重新激活检查。
+	if _, err := manager.GetAllKeyStatusesSafePaginated(1, 10); err != nil {
+		t.Fatalf("获取密钥状态失败: %v", err)
+	}
+
+	var events []storage.KeyEvent
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if events, err = eventStore.ListEvents(utils.SafeSuffix(key), []string{KeyEventCooldownEnd}, 10); err != nil {
+			t.Fatalf("读取密钥历史失败: %v", err)
+		}
+		if len(events) > 0 {
+			break
+		}
+	}
+	if len(events) != 1 {
+		t.Fatalf("cooldown_end 事件数 = %d, 期望 1", len(events))
+	}
+	if !events[0].CreatedAt.Equal(cooledDownAt) {
+		t.Errorf("cooldown_end 事件时间 = %v, 期望冷却截止时间 %v", events[0].CreatedAt, cooledDownAt)
+	}
+}
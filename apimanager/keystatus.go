@@ -1,6 +1,7 @@
 package apimanager
 
 import (
+	"math"
 	"openrouter_polling/config"
 	"openrouter_polling/storage"
 	"openrouter_polling/utils"
@@ -15,12 +16,17 @@ var Log *logrus.Logger
 // 它嵌入了数据库模型 storage.APIKey，并用于管理其在运行时的可用性和行为。
 type ApiKeyStatus struct {
 	storage.APIKey // 嵌入数据库模型
+
+	perf            keyPerf // 近期请求表现的统计（仅在内存中）
+	effectiveWeight float64 // 选择密钥时实际使用的权重，见 refreshEffectiveWeightsLocked
+	inFlight        int     // 正在使用此密钥的上游请求数，由 GetNextAPIKey/AcquireKey 增加、ReleaseKey 减少
 }
 
 // NewApiKeyStatusFromModel 从数据库模型创建一个内存中的 ApiKeyStatus 实例。
 func NewApiKeyStatusFromModel(dbKey *storage.APIKey) *ApiKeyStatus {
 	return &ApiKeyStatus{
-		APIKey: *dbKey,
+		APIKey:          *dbKey,
+		effectiveWeight: float64(dbKey.Weight),
 	}
 }
 
@@ -28,13 +34,17 @@ func NewApiKeyStatusFromModel(dbKey *storage.APIKey) *ApiKeyStatus {
 // 它不暴露完整的 API 密钥，而是显示密钥的后缀，并包含其他对监控有用的状态信息。
 // 字段明确使用 `json:"..."` 标签以匹配前端 (如 dashboard.html JavaScript) 的期望。
 type ApiKeyStatusSafe struct {
-	KeySuffix       string     `json:"key_suffix"`        // API 密钥的末尾几位（例如，最后4位），用于在UI中识别密钥而不暴露完整密钥。
-	IsActive        bool       `json:"is_active"`         // 密钥当前是否激活。这应反映密钥是否已结束冷却且未被手动禁用。
-	FailureCount    int        `json:"failure_count"`     // 连续失败次数。
-	LastFailureTime *time.Time `json:"last_failure_time"` // 上次失败的时间戳。
-	CoolDownUntil   *time.Time `json:"cool_down_until"`   // 密钥的冷却截止时间。如果非nil且在未来，表示密钥正在冷却。
-	LastUsedTime    *time.Time `json:"last_used_time"`    // 上次使用此密钥的时间戳。
-	Weight          int        `json:"weight"`            // 密钥的权重。
+	KeySuffix       string        `json:"key_suffix"`        // API 密钥的末尾几位（例如，最后4位），用于在UI中识别密钥而不暴露完整密钥。
+	IsActive        bool          `json:"is_active"`         // 密钥当前是否激活。这应反映密钥是否已结束冷却且未被手动禁用。
+	FailureCount    int           `json:"failure_count"`     // 连续失败次数。
+	LastFailureTime *time.Time    `json:"last_failure_time"` // 上次失败的时间戳。
+	CoolDownUntil   *time.Time    `json:"cool_down_until"`   // 密钥的冷却截止时间。如果非nil且在未来，表示密钥正在冷却。
+	LastUsedTime    *time.Time    `json:"last_used_time"`    // 上次使用此密钥的时间戳。
+	Weight          int           `json:"weight"`            // 密钥的权重。
+	Disabled        bool          `json:"disabled"`          // 密钥是否被管理员手动停用。
+	EffectiveWeight float64       `json:"effective_weight"`  // 选择密钥时实际使用的权重（未启用自适应权重时等于 weight）。
+	InFlight        int           `json:"in_flight"`         // 正在使用此密钥的上游请求数。
+	Stats           *KeyPerfStats `json:"stats,omitempty"`   // 近期请求表现，尚无请求记录时省略。
 }
 
 // IsCurrentlyCoolingDown 检查密钥当前是否正处于有效的冷却期内。
@@ -45,12 +55,18 @@ func (aks *ApiKeyStatus) IsCurrentlyCoolingDown() bool {
 
 // CanUse 判断密钥当前是否可以被选择用于API请求。
 func (aks *ApiKeyStatus) CanUse() bool {
-	if !aks.IsActive {
+	if !aks.IsActive || aks.Disabled {
 		return false
 	}
 	return true
 }
 
+// hasFreeSlot 判断密钥是否还能承载一个新的上游请求（KEY_MAX_CONCURRENT_REQUESTS 为 0 时不限制）。
+func (aks *ApiKeyStatus) hasFreeSlot() bool {
+	limit := config.AppSettings.KeyMaxConcurrentRequests
+	return limit <= 0 || aks.inFlight < limit
+}
+
 // RecordFailure 在内存中记录一次密钥使用失败。
 // 此方法会更新内存中 ApiKeyStatus 的状态，但不会将其持久化到数据库。
 // 持久化操作由 ApiKeyManager 协调。
@@ -117,5 +133,9 @@ func (aks *ApiKeyStatus) ToSafe() ApiKeyStatusSafe {
 		CoolDownUntil:   aks.CoolDownUntil,
 		LastUsedTime:    aks.LastUsedTime,
 		Weight:          aks.Weight,
+		Disabled:        aks.Disabled,
+		EffectiveWeight: math.Round(aks.effectiveWeight*100) / 100,
+		InFlight:        aks.inFlight,
+		Stats:           aks.perf.stats(),
 	}
 }
@@ -26,6 +26,9 @@ type ApiKeyManager struct {
 	lock       sync.Mutex
 	randSource *rand.Rand
 	log        *logrus.Logger
+	events     *EventBus
+	keyEvents  *storage.KeyEventStore // 密钥状态变化历史，可为 nil
+	affinity   keyAffinity            // 会话与密钥的绑定，见 GetAPIKeyForConversation
 }
 
 type BatchAddResult struct {
@@ -45,7 +48,7 @@ type PaginatedKeyStatus struct {
 }
 
 
-func NewApiKeyManager(logger *logrus.Logger, keyStore *storage.KeyStore) *ApiKeyManager {
+func NewApiKeyManager(logger *logrus.Logger, keyStore *storage.KeyStore, keyEventStore *storage.KeyEventStore) *ApiKeyManager {
 	if Log == nil && logger != nil {
 		Log = logger
 	}
@@ -54,6 +57,9 @@ func NewApiKeyManager(logger *logrus.Logger, keyStore *storage.KeyStore) *ApiKey
 		keyStore:   keyStore,
 		randSource: rand.New(rand.NewSource(time.Now().UnixNano())),
 		log:        logger,
+		events:     NewEventBus(),
+		keyEvents:  keyEventStore,
+		affinity:   keyAffinity{entries: make(map[string]*affinityEntry)},
 	}
 }
 
@@ -226,6 +232,7 @@ func (m *ApiKeyManager) AddKeysBatch(keyData string) (BatchAddResult, error) {
 			for _, newDbKey := range keysToCreate {
 				newKeyStatus := NewApiKeyStatusFromModel(newDbKey)
 				m.keysStatus = append(m.keysStatus, newKeyStatus)
+				m.publishKeyEvent(EventKeyAdded, newKeyStatus, nil)
 			}
 			result.AddedCount = len(keysToCreate)
 		}
@@ -260,6 +267,7 @@ func (m *ApiKeyManager) DeleteKeyBySuffix(suffix string) error {
 		return err
 	}
 
+	m.publishKeyEvent(EventKeyDeleted, m.keysStatus[foundIndex], nil)
 	m.keysStatus = append(m.keysStatus[:foundIndex], m.keysStatus[foundIndex+1:]...)
 	m.log.Infof("成功删除密钥 %s (后缀: %s)。当前总密钥数: %d", utils.SafeSuffix(keyToDelete), suffix, len(m.keysStatus))
 	return nil
@@ -306,6 +314,8 @@ func (m *ApiKeyManager) DeleteKeysBySuffixBatch(suffixes []string) (int64, error
 	for _, ks := range m.keysStatus {
 		if !keysToDeleteSet[ks.Key] {
 			newKeyStatus = append(newKeyStatus, ks)
+		} else {
+			m.publishKeyEvent(EventKeyDeleted, ks, nil)
 		}
 	}
 	m.keysStatus = newKeyStatus
@@ -314,20 +324,22 @@ func (m *ApiKeyManager) DeleteKeysBySuffixBatch(suffixes []string) (int64, error
 	return deletedCount, nil
 }
 
-
+// GetNextAPIKey 按权重随机选择一个可用且还有并发名额的密钥，并占用它的一个并发名额；没有这样的密钥时返回 nil。
+// 调用者用完密钥后必须调用 ReleaseKey。
 func (m *ApiKeyManager) GetNextAPIKey() *ApiKeyStatus {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	m.checkAndReactivateKeysInternal()
+	m.refreshEffectiveWeightsLocked()
 
 	eligibleKeys := make([]*ApiKeyStatus, 0)
-	totalWeight := 0
+	totalWeight := 0.0
 
 	for _, ks := range m.keysStatus {
-		if ks.CanUse() {
+		if ks.CanUse() && ks.hasFreeSlot() {
 			eligibleKeys = append(eligibleKeys, ks)
-			totalWeight += ks.Weight
+			totalWeight += ks.effectiveWeight
 		}
 	}
 
@@ -336,65 +348,133 @@ func (m *ApiKeyManager) GetNextAPIKey() *ApiKeyStatus {
 	}
 
 	if totalWeight <= 0 {
-		return eligibleKeys[m.randSource.Intn(len(eligibleKeys))]
+		return m.takeKeyLocked(eligibleKeys[m.randSource.Intn(len(eligibleKeys))], nil)
 	}
 
-	randomNum := m.randSource.Intn(totalWeight)
-	currentWeightSum := 0
+	randomNum := m.randSource.Float64() * totalWeight
+	currentWeightSum := 0.0
 	for _, ks := range eligibleKeys {
-		currentWeightSum += ks.Weight
+		currentWeightSum += ks.effectiveWeight
 		if randomNum < currentWeightSum {
-			ks.UpdateLastUsed()
-			go func(key string) {
-				if err := m.keyStore.UpdateLastUsedTime(key); err != nil {
-					m.log.Errorf("更新密钥 %s 的 LastUsedTime 失败: %v", utils.SafeSuffix(key), err)
-				}
-			}(ks.Key)
-			return ks
+			return m.takeKeyLocked(ks, nil)
 		}
 	}
-	
-	if len(eligibleKeys) > 0 {
-		selectedKey := eligibleKeys[m.randSource.Intn(len(eligibleKeys))]
-		selectedKey.UpdateLastUsed()
-		go func(key string) {
-			if err := m.keyStore.UpdateLastUsedTime(key); err != nil {
-				m.log.Errorf("更新密钥 %s 的 LastUsedTime 失败: %v", utils.SafeSuffix(key), err)
+	// 浮点误差导致没有命中任何区间时随机选择一个。
+	return m.takeKeyLocked(eligibleKeys[m.randSource.Intn(len(eligibleKeys))], nil)
+}
+
+// takeKeyLocked 占用选中密钥的一个并发名额，更新最后使用时间（数据库在后台更新）并发布 key_selected 事件。
+// 调用方需持有 m.lock。
+func (m *ApiKeyManager) takeKeyLocked(ks *ApiKeyStatus, details map[string]interface{}) *ApiKeyStatus {
+	ks.UpdateLastUsed()
+	ks.inFlight++
+	m.publishKeyEvent(EventKeySelected, ks, details)
+	go func(key string) {
+		if err := m.keyStore.UpdateLastUsedTime(key); err != nil {
+			m.log.Errorf("更新密钥 %s 的 LastUsedTime 失败: %v", utils.SafeSuffix(key), err)
+		}
+	}(ks.Key)
+	return ks
+}
+
+// AcquireKey 在指定密钥上占用一个并发名额并返回该密钥，用于在同一个密钥上重试。
+// 不检查密钥是否处于冷却中；密钥已被删除或并发名额已满时返回 nil。成功后调用者必须调用 ReleaseKey。
+func (m *ApiKeyManager) AcquireKey(keyString string) *ApiKeyStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, ks := range m.keysStatus {
+		if ks.Key == keyString {
+			if !ks.hasFreeSlot() {
+				return nil
 			}
-		}(selectedKey.Key)
-		return selectedKey
+			ks.inFlight++
+			return ks
+		}
 	}
-
 	return nil
 }
 
-func (m *ApiKeyManager) MarkKeyFailure(keyString string) {
+// ReleaseKey 归还 GetNextAPIKey 或 AcquireKey 占用的并发名额。
+func (m *ApiKeyManager) ReleaseKey(keyString string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, ks := range m.keysStatus {
+		if ks.Key == keyString {
+			if ks.inFlight > 0 {
+				ks.inFlight--
+			}
+			return
+		}
+	}
+}
+
+// MarkKeyFailure 记录密钥的一次失败并使其进入冷却，failure 描述失败原因，写入密钥的状态变化历史。
+func (m *ApiKeyManager) MarkKeyFailure(keyString string, failure KeyFailure) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	for _, ks := range m.keysStatus {
 		if ks.Key == keyString {
+			wasUsable := ks.IsActive
 			cooldownDuration := ks.RecordFailure()
 			err := m.keyStore.RecordFailure(ks.Key, ks.FailureCount, cooldownDuration)
 			if err != nil {
 				m.log.Errorf("持久化密钥 %s 的失败状态到数据库失败: %v", utils.SafeSuffix(ks.Key), err)
 			}
+			event := KeyEventFailure
+			if failure.Source == SourceHealthCheck {
+				event = KeyEventHealthCheckFail
+			}
+			m.recordKeyEvent(ks, storage.KeyEvent{Event: event, Cause: failure.Source, ErrorType: failure.ErrorType, HTTPStatus: failure.HTTPStatus, Message: failure.Message})
+			if wasUsable {
+				m.recordKeyEvent(ks, storage.KeyEvent{Event: KeyEventCooldownStart, Cause: failure.Source, Message: fmt.Sprintf("冷却 %v", cooldownDuration)})
+			}
+			m.publishKeyEvent(EventKeyFailure, ks, map[string]interface{}{
+				"cooldown_seconds": int(cooldownDuration.Seconds()),
+				"source":           failure.Source,
+				"error_type":       failure.ErrorType,
+				"http_status":      failure.HTTPStatus,
+			})
 			break
 		}
 	}
 }
 
+// RecordKeySuccess 记录密钥的一次成功请求，清除其失败计数和冷却状态。
 func (m *ApiKeyManager) RecordKeySuccess(keyString string) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
+	m.recordKeySuccessLocked(keyString, SourceRequest)
+}
+
+// RecordHealthCheckPass 记录密钥通过了一次健康检查，并使其恢复可用。
+func (m *ApiKeyManager) RecordHealthCheckPass(keyString string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, ks := range m.keysStatus {
+		if ks.Key == keyString {
+			m.recordKeyEvent(ks, storage.KeyEvent{Event: KeyEventHealthCheckPass, Cause: SourceHealthCheck})
+			break
+		}
+	}
+	m.recordKeySuccessLocked(keyString, SourceHealthCheck)
+}
 
+func (m *ApiKeyManager) recordKeySuccessLocked(keyString, source string) {
 	for _, ks := range m.keysStatus {
 		if ks.Key == keyString {
+			wasDegraded := !ks.IsActive || ks.FailureCount > 0
 			ks.RecordSuccessOrReactivate()
 			err := m.keyStore.RecordSuccessOrReactivate(ks.Key)
 			if err != nil {
 				m.log.Errorf("持久化密钥 %s 的成功状态到数据库失败: %v", utils.SafeSuffix(ks.Key), err)
 			}
+			if wasDegraded {
+				m.recordKeyEvent(ks, storage.KeyEvent{Event: KeyEventReactivated, Cause: source})
+				m.publishKeyEvent(EventKeyReactivated, ks, map[string]interface{}{"cause": source})
+			}
 			break
 		}
 	}
@@ -405,13 +485,18 @@ func (m *ApiKeyManager) checkAndReactivateKeysInternal() {
 	for _, ks := range m.keysStatus {
 		if !ks.IsActive && ks.CoolDownUntil != nil && now.After(*ks.CoolDownUntil) {
 			m.log.Infof("密钥 %s 冷却期已过，正在重新激活...", utils.SafeSuffix(ks.Key))
+			cooledDownAt := *ks.CoolDownUntil // 冷却实际结束的时间，RecordSuccessOrReactivate 会清除该字段
 			ks.RecordSuccessOrReactivate()
 			err := m.keyStore.RecordSuccessOrReactivate(ks.Key)
 			if err != nil {
 				m.log.Errorf("持久化密钥 %s 的重新激活状态失败: %v", utils.SafeSuffix(ks.Key), err)
 				// Revert in-memory change if DB update fails
 				ks.IsActive = false
+				continue
 			}
+			// 重新激活在下一次状态检查时才惰性执行，事件时间记为冷却实际结束的时刻。
+			m.recordKeyEvent(ks, storage.KeyEvent{Event: KeyEventCooldownEnd, Cause: SourceCooldownExpired, CreatedAt: cooledDownAt})
+			m.publishKeyEvent(EventKeyReactivated, ks, map[string]interface{}{"cause": SourceCooldownExpired})
 		}
 	}
 }
@@ -422,6 +507,7 @@ func (m *ApiKeyManager) GetAllKeyStatusesSafePaginated(page, limit int) (*Pagina
 	defer m.lock.Unlock()
 
 	m.checkAndReactivateKeysInternal()
+	m.refreshEffectiveWeightsLocked()
 
 	// 因为状态（如冷却）是动态的，我们从内存中获取所有状态，然后进行分页。
 	// 对于非常大的密钥集，这可能需要优化为直接在数据库中查询，但这会使动态状态处理复杂化。
@@ -486,6 +572,27 @@ func (m *ApiKeyManager) GetTotalKeysCount() int {
 	return len(m.keysStatus)
 }
 
+// KeyAvailability 返回当前可用的密钥数；没有可用密钥时同时返回最早结束冷却的时间（无法确定时为 nil）。
+// 供批处理等后台任务在所有密钥冷却期间暂停发起请求。
+func (m *ApiKeyManager) KeyAvailability() (available int, nextReactivation *time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.checkAndReactivateKeysInternal()
+	for _, ks := range m.keysStatus {
+		if ks.CanUse() {
+			available++
+		} else if !ks.Disabled && ks.CoolDownUntil != nil && (nextReactivation == nil || ks.CoolDownUntil.Before(*nextReactivation)) {
+			until := *ks.CoolDownUntil
+			nextReactivation = &until
+		}
+	}
+	if available > 0 {
+		nextReactivation = nil
+	}
+	return available, nextReactivation
+}
+
 // GetCachedKeys 返回内存中密钥状态的副本，供健康检查等内部服务使用。
 func (m *ApiKeyManager) GetCachedKeys() []*ApiKeyStatus {
 	m.lock.Lock()
@@ -516,6 +623,9 @@ func (m *ApiKeyManager) ReloadKeysFromString(keyData string) (BatchAddResult, er
 	}
 
 	// 2. 清空内存缓存
+	for _, ks := range m.keysStatus {
+		m.publishKeyEvent(EventKeyDeleted, ks, nil)
+	}
 	m.keysStatus = make([]*ApiKeyStatus, 0)
 	m.log.Info("数据库和内存缓存已清空。")
 
@@ -550,6 +660,7 @@ func (m *ApiKeyManager) ReloadKeysFromString(keyData string) (BatchAddResult, er
 
 		newKeyStatus := NewApiKeyStatusFromModel(newDbKey)
 		m.keysStatus = append(m.keysStatus, newKeyStatus)
+		m.publishKeyEvent(EventKeyAdded, newKeyStatus, nil)
 		result.AddedCount++
 	}
 
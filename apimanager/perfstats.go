@@ -0,0 +1,154 @@
+package apimanager
+
+import (
+	"math"
+	"openrouter_polling/config"
+	"slices"
+	"time"
+)
+
+const (
+	perfEWMAAlpha   = 0.1 // 成功率和输出速度的指数加权移动平均系数，约等于最近 20 次请求的权重占 90%
+	perfTTFTWindow  = 100 // 计算首 token 延迟分位数的滑动窗口大小（最近的成功请求数）
+	perfMinSamples  = 10  // 样本数少于此值时不参与自适应权重，避免个别请求造成大幅波动
+	perfSpeedFactor = 0.5 // 速度因子的指数，降低速度差异对权重的影响（速度快一倍的密钥权重约为 1.4 倍）
+)
+
+// KeyPerfSample 是一次上游请求在某个密钥上的表现。
+type KeyPerfSample struct {
+	Success      bool
+	TTFT         time.Duration // 首 token 延迟：流式请求为收到第一个有意义数据块的时间，非流式请求为完整响应的时间
+	Duration     time.Duration // 请求总耗时
+	OutputTokens int           // 上游报告的输出 token 数，未报告时为 0
+}
+
+// keyPerf 在内存中累计单个密钥的性能统计，服务重启或密钥重新加载后清零。
+type keyPerf struct {
+	samples      int
+	successRate  float64 // 成功率的 EWMA
+	tokensPerSec float64 // 输出速度 (token/s) 的 EWMA，0 表示尚无数据
+	ttftWindow   []time.Duration
+	ttftNext     int
+	ttftP50      time.Duration
+	ttftP95      time.Duration
+}
+
+// KeyPerfStats 是密钥性能统计的快照，用于 API 响应。
+type KeyPerfStats struct {
+	Samples         int     `json:"samples"`           // 已记录的请求数
+	SuccessRate     float64 `json:"success_rate"`      // 近期成功率 (EWMA, 0-1)
+	TTFTP50Ms       int64   `json:"ttft_p50_ms"`       // 最近成功请求的首 token 延迟中位数（毫秒）
+	TTFTP95Ms       int64   `json:"ttft_p95_ms"`       // 最近成功请求的首 token 延迟 P95（毫秒）
+	TokensPerSecond float64 `json:"tokens_per_second"` // 近期输出速度 (EWMA)
+}
+
+func (p *keyPerf) record(sample KeyPerfSample) {
+	outcome := 0.0
+	if sample.Success {
+		outcome = 1
+	}
+	if p.samples == 0 {
+		p.successRate = outcome
+	} else {
+		p.successRate += perfEWMAAlpha * (outcome - p.successRate)
+	}
+	p.samples++
+	if !sample.Success {
+		return
+	}
+
+	if len(p.ttftWindow) < perfTTFTWindow {
+		p.ttftWindow = append(p.ttftWindow, sample.TTFT)
+	} else {
+		p.ttftWindow[p.ttftNext] = sample.TTFT
+		p.ttftNext = (p.ttftNext + 1) % perfTTFTWindow
+	}
+	sorted := slices.Clone(p.ttftWindow)
+	slices.Sort(sorted)
+	p.ttftP50 = percentile(sorted, 0.5)
+	p.ttftP95 = percentile(sorted, 0.95)
+
+	// 输出速度按生成阶段（首 token 之后）计算；非流式请求无法区分，按总耗时计算。
+	generation := sample.Duration - sample.TTFT
+	if generation <= 0 {
+		generation = sample.Duration
+	}
+	if sample.OutputTokens > 0 && generation > 0 {
+		tps := float64(sample.OutputTokens) / generation.Seconds()
+		if p.tokensPerSec == 0 {
+			p.tokensPerSec = tps
+		} else {
+			p.tokensPerSec += perfEWMAAlpha * (tps - p.tokensPerSec)
+		}
+	}
+}
+
+func (p *keyPerf) stats() *KeyPerfStats {
+	if p.samples == 0 {
+		return nil
+	}
+	return &KeyPerfStats{
+		Samples:         p.samples,
+		SuccessRate:     math.Round(p.successRate*1000) / 1000,
+		TTFTP50Ms:       p.ttftP50.Milliseconds(),
+		TTFTP95Ms:       p.ttftP95.Milliseconds(),
+		TokensPerSecond: math.Round(p.tokensPerSec*10) / 10,
+	}
+}
+
+// percentile 返回已排序样本的 q 分位数（最近秩法）。
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(q*float64(len(sorted)))) - 1
+	return sorted[max(idx, 0)]
+}
+
+// RecordKeyPerformance 记录一次上游请求在密钥上的表现，用于统计其成功率、首 token 延迟和输出速度。
+func (m *ApiKeyManager) RecordKeyPerformance(keyString string, sample KeyPerfSample) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, ks := range m.keysStatus {
+		if ks.Key == keyString {
+			ks.perf.record(sample)
+			break
+		}
+	}
+}
+
+// refreshEffectiveWeightsLocked 重新计算所有密钥的有效权重。未启用自适应权重时有效权重等于配置权重；
+// 启用后，配置权重乘以健康因子（近期成功率）和速度因子（密钥池首 token 延迟中位数与该密钥中位数之比），
+// 乘积限制在 [AdaptiveWeightMinFactor, AdaptiveWeightMaxFactor] 之间。样本不足的密钥保持配置权重。
+// 调用方需持有 m.lock。
+func (m *ApiKeyManager) refreshEffectiveWeightsLocked() {
+	settings := config.AppSettings
+	if !settings.AdaptiveWeighting {
+		for _, ks := range m.keysStatus {
+			ks.effectiveWeight = float64(ks.Weight)
+		}
+		return
+	}
+
+	// 以各密钥首 token 延迟中位数的中位数作为速度基准。
+	var poolTTFT []time.Duration
+	for _, ks := range m.keysStatus {
+		if ks.perf.samples >= perfMinSamples && ks.perf.ttftP50 > 0 {
+			poolTTFT = append(poolTTFT, ks.perf.ttftP50)
+		}
+	}
+	slices.Sort(poolTTFT)
+	reference := percentile(poolTTFT, 0.5)
+
+	for _, ks := range m.keysStatus {
+		factor := 1.0
+		if ks.perf.samples >= perfMinSamples {
+			factor = ks.perf.successRate
+			if reference > 0 && ks.perf.ttftP50 > 0 {
+				factor *= math.Pow(float64(reference)/float64(ks.perf.ttftP50), perfSpeedFactor)
+			}
+			factor = min(max(factor, settings.AdaptiveWeightMinFactor), settings.AdaptiveWeightMaxFactor)
+		}
+		ks.effectiveWeight = float64(ks.Weight) * factor
+	}
+}
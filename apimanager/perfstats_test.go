@@ -0,0 +1,133 @@
+package apimanager
+
+import (
+	"math"
+	"openrouter_polling/config"
+	"openrouter_polling/utils"
+	"testing"
+	"time"
+)
+
+// successSamples 返回 n 个首 token 延迟为 ttft 的成功样本。
+func successSamples(n int, ttft time.Duration) []KeyPerfSample {
+	samples := make([]KeyPerfSample, n)
+	for i := range samples {
+		samples[i] = KeyPerfSample{Success: true, TTFT: ttft, Duration: 2 * ttft}
+	}
+	return samples
+}
+
+// failureSamples 返回 n 个失败样本。
+func failureSamples(n int) []KeyPerfSample {
+	return make([]KeyPerfSample, n)
+}
+
+// effectiveWeights 返回各密钥（按添加顺序）在状态接口中报告的有效权重。
+func effectiveWeights(t *testing.T, m *ApiKeyManager, keys []string) []float64 {
+	t.Helper()
+	statuses, err := m.GetAllKeyStatusesSafePaginated(1, len(keys))
+	if err != nil {
+		t.Fatalf("获取密钥状态失败: %v", err)
+	}
+	bySuffix := make(map[string]float64, len(statuses.Keys))
+	for _, status := range statuses.Keys {
+		bySuffix[status.KeySuffix] = status.EffectiveWeight
+	}
+	weights := make([]float64, len(keys))
+	for i, key := range keys {
+		weight, ok := bySuffix[utils.SafeSuffix(key)]
+		if !ok {
+			t.Fatalf("状态中缺少密钥 %d", i+1)
+		}
+		weights[i] = weight
+	}
+	return weights
+}
+
+func TestAdaptiveEffectiveWeights(t *testing.T) {
+	tests := []struct {
+		name      string
+		adaptive  bool
+		minFactor float64
+		maxFactor float64
+		samples   [][]KeyPerfSample // 依次为 4 个权重为 10 的密钥记录的样本
+		want      []float64
+	}{
+		{
+			name:     "未启用时等于配置权重",
+			adaptive: false, minFactor: 0.1, maxFactor: 10,
+			samples: [][]KeyPerfSample{successSamples(20, 100*time.Millisecond), failureSamples(20), successSamples(20, 400*time.Millisecond)},
+			want:    []float64{10, 10, 10, 10},
+		},
+		{
+			name:     "样本不足时保持配置权重",
+			adaptive: true, minFactor: 0.1, maxFactor: 10,
+			samples: [][]KeyPerfSample{successSamples(perfMinSamples-1, 50*time.Millisecond), failureSamples(perfMinSamples - 1), successSamples(perfMinSamples, 200*time.Millisecond)},
+			want:    []float64{10, 10, 10, 10},
+		},
+		{
+			name:     "按首 token 延迟相对密钥池中位数调整",
+			adaptive: true, minFactor: 0.1, maxFactor: 10,
+			samples: [][]KeyPerfSample{successSamples(10, 100*time.Millisecond), successSamples(10, 200*time.Millisecond), successSamples(10, 400*time.Millisecond)},
+			want:    []float64{10 * math.Sqrt2, 10, 10 / math.Sqrt2, 10},
+		},
+		{
+			name:     "按近期成功率调整",
+			adaptive: true, minFactor: 0.1, maxFactor: 10,
+			// 第一个样本成功后连续 9 次失败，成功率的 EWMA 为 0.9^9。
+			samples: [][]KeyPerfSample{append(successSamples(1, 200*time.Millisecond), failureSamples(9)...), successSamples(10, 200*time.Millisecond)},
+			want:    []float64{10 * math.Pow(0.9, 9), 10, 10, 10},
+		},
+		{
+			name:     "限制在最小和最大倍数之间",
+			adaptive: true, minFactor: 0.5, maxFactor: 1.2,
+			samples: [][]KeyPerfSample{successSamples(10, 100*time.Millisecond), successSamples(10, 200*time.Millisecond), successSamples(10, 400*time.Millisecond), failureSamples(10)},
+			want:    []float64{12, 10, 10 / math.Sqrt2, 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, keys := newTestManager(t, 10, 10, 10, 10)
+			config.AppSettings.AdaptiveWeighting = tt.adaptive
+			config.AppSettings.AdaptiveWeightMinFactor = tt.minFactor
+			config.AppSettings.AdaptiveWeightMaxFactor = tt.maxFactor
+			for i, samples := range tt.samples {
+				for _, sample := range samples {
+					m.RecordKeyPerformance(keys[i], sample)
+				}
+			}
+			got := effectiveWeights(t, m, keys)
+			for i := range keys {
+				if math.Abs(got[i]-tt.want[i]) > 0.01 {
+					t.Errorf("密钥 %d 有效权重 = %.2f, 期望 %.2f", i+1, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestKeyPerfStats(t *testing.T) {
+	var p keyPerf
+	if p.stats() != nil {
+		t.Error("没有样本时期望返回 nil")
+	}
+	// 首 token 延迟依次为 1ms..100ms，生成阶段 0.8s 输出 80 个 token。
+	for i := 1; i <= 100; i++ {
+		ttft := time.Duration(i) * time.Millisecond
+		p.record(KeyPerfSample{Success: true, TTFT: ttft, Duration: ttft + 800*time.Millisecond, OutputTokens: 80})
+	}
+	stats := p.stats()
+	if stats.Samples != 100 || stats.SuccessRate != 1 || stats.TTFTP50Ms != 50 || stats.TTFTP95Ms != 95 || stats.TokensPerSecond != 100 {
+		t.Errorf("统计 = %+v, 期望 100 个样本、成功率 1、P50 50ms、P95 95ms、100 token/s", stats)
+	}
+
+	// 窗口已满时新样本覆盖最早的样本，失败不进入延迟窗口。
+	for range perfTTFTWindow {
+		p.record(KeyPerfSample{Success: true, TTFT: time.Second, Duration: time.Second})
+	}
+	p.record(KeyPerfSample{})
+	stats = p.stats()
+	if stats.TTFTP50Ms != 1000 || stats.SuccessRate != 0.9 {
+		t.Errorf("统计 = %+v, 期望 P50 1000ms、成功率 0.9", stats)
+	}
+}
@@ -0,0 +1,267 @@
+package circuitbreaker
+
+import (
+	"openrouter_polling/apimanager"
+	"openrouter_polling/config"
+	"openrouter_polling/models"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	Log       *logrus.Logger
+	ApiKeyMgr *apimanager.ApiKeyManager
+)
+
+// 熔断器的状态。
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half_open"
+)
+
+// lastErrorMaxLen 是保存的最近一次错误信息的最大字符数。
+const lastErrorMaxLen = 256
+
+// Breaker 是针对整个上游（OpenRouter）的熔断器。短时间内多个密钥同时出现网络错误、超时或 5xx 时，
+// 判定为上游故障而不是密钥故障：熔断器打开，新请求快速失败，失败不计入密钥，避免故障结束后整个密钥池仍在冷却。
+// 打开一段时间后放行一个探测请求（半开），探测成功则关闭，失败则重新打开并将打开时间加倍。
+// 方法可以在 nil 上安全调用（熔断器视为始终关闭）。
+type Breaker struct {
+	mu              sync.Mutex
+	state           string
+	buckets         []outcomeBucket
+	failingKeys     map[string]time.Time // 密钥后缀 -> 最近一次上游失败时间
+	openDuration    time.Duration        // 当前（或下一次）打开的持续时间
+	openedAt        time.Time
+	trippedAt       time.Time // 最近一次从关闭变为打开的时间
+	retryAt         time.Time // 打开状态下放行探测请求的时间
+	probeStartedAt  time.Time // 半开状态下正在进行的探测请求的开始时间，零值表示没有探测请求
+	tripCount       int
+	lastError       string
+	lastStateChange time.Time
+}
+
+type outcomeBucket struct {
+	second int64
+	total  int
+	failed int
+}
+
+// NewBreaker 创建一个处于关闭状态的上游熔断器。
+func NewBreaker() *Breaker {
+	seconds := max(int(config.AppSettings.CircuitBreakerWindow.Seconds()), 1)
+	return &Breaker{
+		state:        StateClosed,
+		buckets:      make([]outcomeBucket, seconds),
+		failingKeys:  make(map[string]time.Time),
+		openDuration: config.AppSettings.CircuitBreakerOpenDuration,
+	}
+}
+
+func (b *Breaker) record(now time.Time, failed bool) {
+	second := now.Unix()
+	bucket := &b.buckets[second%int64(len(b.buckets))]
+	if bucket.second != second {
+		*bucket = outcomeBucket{second: second}
+	}
+	bucket.total++
+	if failed {
+		bucket.failed++
+	}
+}
+
+func (b *Breaker) counts(now time.Time) (total, failed, failingKeys int) {
+	oldest := now.Unix() - int64(len(b.buckets)) + 1
+	for _, bucket := range b.buckets {
+		if bucket.second >= oldest {
+			total += bucket.total
+			failed += bucket.failed
+		}
+	}
+	cutoff := now.Add(-time.Duration(len(b.buckets)) * time.Second)
+	for suffix, at := range b.failingKeys {
+		if at.Before(cutoff) {
+			delete(b.failingKeys, suffix)
+		}
+	}
+	return total, failed, len(b.failingKeys)
+}
+
+func (b *Breaker) setStateLocked(state string, now time.Time) {
+	b.state = state
+	b.lastStateChange = now
+}
+
+// openLocked 打开熔断器，持续 b.openDuration。
+func (b *Breaker) openLocked(now time.Time) {
+	b.setStateLocked(StateOpen, now)
+	b.openedAt = now
+	b.retryAt = now.Add(b.openDuration)
+	b.probeStartedAt = time.Time{}
+}
+
+// Allow 报告是否可以向上游发起新请求。熔断器打开期间返回 false；打开时间结束后进入半开状态，
+// 只放行一个探测请求，探测请求超过 REQUEST_TIMEOUT_SECONDS 仍未得出结果时再放行下一个。
+// probe 为 true 表示本次放行的是探测请求，调用方在请求结束时（无论结果如何）必须调用 FinishProbe。
+func (b *Breaker) Allow() (allowed bool, probe bool) {
+	if b == nil {
+		return true, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case StateOpen:
+		if now.Before(b.retryAt) {
+			return false, false
+		}
+		b.setStateLocked(StateHalfOpen, now)
+		Log.Info("上游熔断器: 打开时间已结束，进入半开状态，放行一个探测请求。")
+	case StateHalfOpen:
+		if !b.probeStartedAt.IsZero() && now.Sub(b.probeStartedAt) < config.AppSettings.RequestTimeout {
+			return false, false
+		}
+	default:
+		return true, false
+	}
+	b.probeStartedAt = now
+	return true, true
+}
+
+// FinishProbe 在探测请求结束时调用。探测请求既没有记录成功也没有记录失败时（例如客户端断开、
+// 所有密钥都被限流、错误不计入熔断器），熔断器仍处于半开状态，此时释放探测名额，让下一个请求继续探测，
+// 而不是等到 REQUEST_TIMEOUT_SECONDS 之后。
+func (b *Breaker) FinishProbe() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == StateHalfOpen && !b.probeStartedAt.IsZero() {
+		b.probeStartedAt = time.Time{}
+		Log.Debug("上游熔断器: 探测请求结束但未得出上游是否恢复的结论，放行下一个探测请求。")
+	}
+}
+
+// IsOpen 报告熔断器当前是否处于打开状态（不含半开）。
+func (b *Breaker) IsOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == StateOpen
+}
+
+// RetryAfter 返回距离下一次放行探测请求的时间，熔断器未打开时返回 0。
+func (b *Breaker) RetryAfter() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != StateOpen {
+		return 0
+	}
+	return max(time.Until(b.retryAt), 0)
+}
+
+// RecordSuccess 记录一次上游正常响应的请求。半开状态下的成功表示上游已恢复，熔断器关闭。
+func (b *Breaker) RecordSuccess() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.state == StateHalfOpen {
+		Log.Infof("上游熔断器: 探测请求成功，上游已恢复，熔断器关闭（本次共打开 %v）。", now.Sub(b.trippedAt).Round(time.Second))
+		b.setStateLocked(StateClosed, now)
+		b.openDuration = config.AppSettings.CircuitBreakerOpenDuration
+		b.probeStartedAt = time.Time{}
+		clear(b.buckets)
+		clear(b.failingKeys)
+	}
+	b.record(now, false)
+}
+
+// RecordFailure 记录一次可能由上游整体故障引起的失败（网络错误、超时、5xx），返回记录后熔断器是否处于打开状态。
+// 调用方据此决定是否将这次失败计入密钥。
+func (b *Breaker) RecordFailure(keySuffix, detail string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if runes := []rune(detail); len(runes) > lastErrorMaxLen {
+		detail = string(runes[:lastErrorMaxLen])
+	}
+	b.lastError = detail
+
+	settings := config.AppSettings
+	switch b.state {
+	case StateOpen:
+		return true // 打开前已发出的请求，失败同样视为上游故障
+	case StateHalfOpen:
+		b.openDuration = min(b.openDuration*2, max(settings.CircuitBreakerMaxOpenDuration, settings.CircuitBreakerOpenDuration))
+		b.openLocked(now)
+		Log.Warnf("上游熔断器: 探测请求失败 (%s)，熔断器重新打开 %v。", detail, b.openDuration)
+		return true
+	}
+
+	b.record(now, true)
+	b.failingKeys[keySuffix] = now
+	if settings.CircuitBreakerMinFailures <= 0 {
+		return false
+	}
+	// 每次失败都会使密钥进入冷却，密钥较少时失败数和失败密钥数不可能超过密钥总数，阈值以密钥总数为上限。
+	minFailures, minKeys := settings.CircuitBreakerMinFailures, settings.CircuitBreakerMinKeys
+	if ApiKeyMgr != nil {
+		total := ApiKeyMgr.GetTotalKeysCount()
+		minFailures, minKeys = min(minFailures, total), min(minKeys, total)
+	}
+	total, failed, failingKeys := b.counts(now)
+	if failed < max(minFailures, 1) || failingKeys < max(minKeys, 1) ||
+		float64(failed)/float64(total) < settings.CircuitBreakerErrorRateThreshold {
+		return false
+	}
+	b.tripCount++
+	b.trippedAt = now
+	b.openLocked(now)
+	Log.Errorf("上游熔断器: 最近 %v 内 %d/%d 个上游请求失败（涉及 %d 个密钥），判定为上游故障，熔断器打开 %v。最近错误: %s",
+		settings.CircuitBreakerWindow, failed, total, failingKeys, b.openDuration, detail)
+	return true
+}
+
+// Status 返回熔断器状态的快照，用于 /admin/app-status。
+func (b *Breaker) Status() models.CircuitBreakerStatus {
+	if b == nil {
+		return models.CircuitBreakerStatus{State: StateClosed}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	total, failed, failingKeys := b.counts(time.Now())
+	status := models.CircuitBreakerStatus{
+		Enabled:     config.AppSettings.CircuitBreakerMinFailures > 0,
+		State:       b.state,
+		Requests:    total,
+		Failures:    failed,
+		FailingKeys: failingKeys,
+		OpenSeconds: b.openDuration.Seconds(),
+		TripCount:   b.tripCount,
+		LastError:   b.lastError,
+	}
+	if b.state != StateClosed {
+		openedAt, retryAt := b.openedAt, b.retryAt
+		status.OpenedAt, status.RetryAt = &openedAt, &retryAt
+	}
+	if !b.lastStateChange.IsZero() {
+		changed := b.lastStateChange
+		status.LastStateChange = &changed
+	}
+	return status
+}
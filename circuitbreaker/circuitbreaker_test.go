@@ -0,0 +1,141 @@
+package circuitbreaker
+
+import (
+	"io"
+	"openrouter_polling/config"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testOpenDuration = 20 * time.Millisecond
+
+// newTestBreaker 创建一个阈值为 2 次失败、2 个密钥、50% 失败率的熔断器，首次打开 20ms，最长 50ms。
+func newTestBreaker(t *testing.T) *Breaker {
+	t.Helper()
+	prevLog, prevKeyMgr, prevSettings := Log, ApiKeyMgr, config.AppSettings
+	t.Cleanup(func() { Log, ApiKeyMgr, config.AppSettings = prevLog, prevKeyMgr, prevSettings })
+	Log = logrus.New()
+	Log.SetOutput(io.Discard)
+	ApiKeyMgr = nil
+	config.AppSettings.CircuitBreakerMinFailures = 2
+	config.AppSettings.CircuitBreakerMinKeys = 2
+	config.AppSettings.CircuitBreakerErrorRateThreshold = 0.5
+	config.AppSettings.CircuitBreakerWindow = 30 * time.Second
+	config.AppSettings.CircuitBreakerOpenDuration = testOpenDuration
+	config.AppSettings.CircuitBreakerMaxOpenDuration = 50 * time.Millisecond
+	config.AppSettings.RequestTimeout = time.Minute
+	return NewBreaker()
+}
+
+// tripBreaker 用两个不同密钥的失败打开关闭状态的熔断器。
+func tripBreaker(t *testing.T, b *Breaker) {
+	t.Helper()
+	if b.RecordFailure("key1", "502 bad gateway") {
+		t.Fatal("一次失败不应打开熔断器")
+	}
+	if !b.RecordFailure("key2", "502 bad gateway") {
+		t.Fatal("两个密钥各失败一次后期望熔断器打开")
+	}
+}
+
+// waitForProbe 等待打开时间结束并取得探测名额。
+func waitForProbe(t *testing.T, b *Breaker) {
+	t.Helper()
+	time.Sleep(b.RetryAfter() + 5*time.Millisecond)
+	if allowed, probe := b.Allow(); !allowed || !probe {
+		t.Fatalf("打开时间结束后 Allow = %v, %v, 期望放行一个探测请求", allowed, probe)
+	}
+}
+
+func TestBreakerClosedOpenHalfOpenClosedCycle(t *testing.T) {
+	b := newTestBreaker(t)
+	if allowed, probe := b.Allow(); !allowed || probe {
+		t.Fatalf("关闭状态 Allow = %v, %v, 期望放行普通请求", allowed, probe)
+	}
+
+	tripBreaker(t, b)
+	if allowed, _ := b.Allow(); allowed || !b.IsOpen() {
+		t.Fatal("熔断器打开期间期望拒绝请求")
+	}
+	if retryAfter := b.RetryAfter(); retryAfter <= 0 || retryAfter > testOpenDuration {
+		t.Errorf("RetryAfter = %v, 期望在 (0, %v] 之间", retryAfter, testOpenDuration)
+	}
+
+	waitForProbe(t, b)
+	if status := b.Status(); status.State != StateHalfOpen {
+		t.Errorf("状态 = %s, 期望 half_open", status.State)
+	}
+	if allowed, _ := b.Allow(); allowed {
+		t.Error("半开状态下探测请求未结束时期望拒绝其他请求")
+	}
+
+	b.RecordSuccess()
+	status := b.Status()
+	if status.State != StateClosed || status.Failures != 0 || status.FailingKeys != 0 || status.TripCount != 1 {
+		t.Errorf("探测成功后状态 = %+v, 期望关闭并清空统计", status)
+	}
+	if allowed, probe := b.Allow(); !allowed || probe {
+		t.Errorf("关闭后 Allow = %v, %v, 期望放行普通请求", allowed, probe)
+	}
+}
+
+func TestBreakerDoublesOpenDurationAfterFailedProbe(t *testing.T) {
+	b := newTestBreaker(t)
+	tripBreaker(t, b)
+
+	for _, want := range []time.Duration{40 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond} {
+		waitForProbe(t, b)
+		if !b.RecordFailure("key1", "probe failed") {
+			t.Fatal("探测失败后期望熔断器重新打开")
+		}
+		if got := time.Duration(b.Status().OpenSeconds * float64(time.Second)); got != want {
+			t.Errorf("打开时间 = %v, 期望 %v（加倍且不超过上限）", got, want)
+		}
+		if retryAfter := b.RetryAfter(); retryAfter <= testOpenDuration || retryAfter > want {
+			t.Errorf("RetryAfter = %v, 期望在 (%v, %v] 之间", retryAfter, testOpenDuration, want)
+		}
+	}
+
+	waitForProbe(t, b)
+	b.RecordSuccess()
+	if got := time.Duration(b.Status().OpenSeconds * float64(time.Second)); got != testOpenDuration {
+		t.Errorf("恢复后打开时间 = %v, 期望重置为 %v", got, testOpenDuration)
+	}
+}
+
+func TestBreakerFinishProbeReleasesUndecidedProbe(t *testing.T) {
+	b := newTestBreaker(t)
+	tripBreaker(t, b)
+	waitForProbe(t, b)
+
+	// 探测请求没有得出结论（例如客户端断开），下一个请求立即成为新的探测请求。
+	b.FinishProbe()
+	if allowed, probe := b.Allow(); !allowed || !probe {
+		t.Fatalf("释放探测名额后 Allow = %v, %v, 期望放行新的探测请求", allowed, probe)
+	}
+
+	// 已得出结论的探测请求结束时不影响熔断器状态。
+	b.RecordSuccess()
+	b.FinishProbe()
+	if status := b.Status(); status.State != StateClosed {
+		t.Errorf("状态 = %s, 期望保持关闭", status.State)
+	}
+	tripBreaker(t, b)
+	b.FinishProbe()
+	if allowed, _ := b.Allow(); allowed {
+		t.Error("非探测请求结束时不应提前结束打开状态")
+	}
+}
+
+func TestNilBreakerAlwaysAllows(t *testing.T) {
+	var b *Breaker
+	if allowed, probe := b.Allow(); !allowed || probe {
+		t.Errorf("nil 熔断器 Allow = %v, %v, 期望始终放行", allowed, probe)
+	}
+	if b.RecordFailure("key1", "boom") || b.IsOpen() {
+		t.Error("nil 熔断器不应打开")
+	}
+	b.FinishProbe()
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,9 +21,15 @@ const (
 	DefaultRequestTimeoutSeconds     = 180
 	DefaultPort                      = "8000"
 	DefaultLogLevel                  = "info"
+	DefaultLogFormat                 = LogFormatText
+	DefaultLogMaxSizeMB              = 100
+	DefaultLogMaxBackups             = 5
 	DefaultGinMode                   = "debug"
 	DefaultOpenRouterAPIURL          = "https://openrouter.ai/api/v1/chat/completions"
 	DefaultOpenRouterModelsURL       = "https://openrouter.ai/api/v1/models"
+	DefaultOpenRouterCompletionsURL  = "https://openrouter.ai/api/v1/completions"
+	DefaultOpenRouterEmbeddingsURL   = "https://openrouter.ai/api/v1/embeddings"
+	DefaultOpenRouterGenerationURL   = "https://openrouter.ai/api/v1/generation"
 	DefaultModel                     = "deepseek/deepseek-chat-v3-0324:free"
 	DefaultHTTPReferer               = "https://your-app-name.com"
 	DefaultXTitle                    = "Your App Name"
@@ -34,6 +41,97 @@ const (
 	DefaultMySQLDBName               = "openrouter_proxy"
 	DefaultMySQLUser                 = "root"
 	DefaultMySQLPassword             = ""
+	DefaultClientName                = "default"
+	AnonymousClientName              = "anonymous"
+	DefaultContextTrimMode           = ContextTrimModeOff
+	DefaultContextTrimReserveTokens  = 1024
+	DefaultRateLimitStore            = RateLimitStoreMemory
+	DefaultGenerationStatsMaxAttempts = 5
+	DefaultIdempotencyTTLSeconds     = 24 * 60 * 60
+	DefaultIdempotencyMaxEntries     = 10000
+	DefaultStreamResumeGraceSeconds  = 60
+	DefaultStreamResumeMaxBufferMB   = 64
+	DefaultAsyncJobWorkers           = 4
+	DefaultBatchConcurrency          = 8
+	DefaultBatchRequestsPerSecond    = 5
+	DefaultBatchMaxFileMB            = 100
+	DefaultPayloadCaptureStore       = PayloadCaptureStoreDB
+	DefaultPayloadCaptureDir         = "captures"
+	DefaultPayloadCaptureRetentionHours = 72
+	DefaultOTelServiceName           = "openrouter-polling"
+	DefaultTraceSampleRate           = 1.0
+	DefaultAlertEvalIntervalSeconds  = 30
+	DefaultAlertRepeatIntervalMinutes = 60
+	DefaultAlertMinAvailableKeys     = 1
+	DefaultAlertErrorRateThreshold   = 0.5
+	DefaultAlertErrorRateWindowSeconds = 300
+	DefaultAlertErrorRateMinRequests = 20
+	DefaultAlertSMTPPort             = 587
+	DefaultKeyEventRetentionDays     = 30
+	DefaultResponseRetentionDays     = 30
+	DefaultAdaptiveWeightMinFactor   = 0.2
+	DefaultAdaptiveWeightMaxFactor   = 2.0
+	DefaultModelHealthErrorRateThreshold = 0.5
+	DefaultModelHealthWindowSeconds  = 120
+	DefaultModelHealthMinRequests    = 5
+	DefaultModelHealthMinKeys        = 2
+	DefaultModelHealthCooldownSeconds = 60
+	DefaultCircuitBreakerMinFailures = 5
+	DefaultCircuitBreakerMinKeys     = 3
+	DefaultCircuitBreakerErrorRateThreshold = 0.8
+	DefaultCircuitBreakerWindowSeconds = 30
+	DefaultCircuitBreakerOpenSeconds = 15
+	DefaultCircuitBreakerMaxOpenSeconds = 300
+	DefaultRetryOnErrorTypes         = "*"
+	DefaultRetryBackoffBaseMs        = 250
+	DefaultRetryBackoffMaxMs         = 5000
+	DefaultRetryBackoffMultiplier    = 2.0
+	DefaultRetryBackoffJitter        = 0.2
+	DefaultRetryBudgetRatio          = 0.2
+	DefaultRetryBudgetWindowSeconds  = 60
+	DefaultRetryBudgetMinRetries     = 10
+	DefaultRequestQueueMaxSize       = 100
+	DefaultRequestQueueWaitLimitSeconds = 300
+	DefaultKeyAffinitySources        = "session,user,messages"
+	DefaultKeyAffinityIdleTTLSeconds = 600
+)
+
+// 上下文裁剪模式
+const (
+	ContextTrimModeOff  = "off"  // 不裁剪，超长请求由上游返回 400
+	ContextTrimModeAuto = "auto" // 估算提示词长度，超出模型上下文窗口时自动丢弃最早的非 system 轮次
+)
+
+// 限流状态存储方式
+const (
+	RateLimitStoreMemory = "memory" // 令牌桶仅保存在本进程内存中
+	RateLimitStoreDB     = "db"     // 令牌桶保存在数据库中，多实例部署时共享
+)
+
+// 请求排队的优先级，没有可用密钥时高优先级的请求先获得密钥
+const (
+	QueuePriorityHigh   = "high"   // 交互式请求，例如聊天界面
+	QueuePriorityNormal = "normal" // 默认优先级
+	QueuePriorityLow    = "low"    // 批处理、异步任务等对延迟不敏感的请求
+)
+
+// 会话亲和的会话标识来源，按 KEY_AFFINITY_SOURCES 中的顺序取第一个非空的来源
+const (
+	KeyAffinitySourceSession  = "session"  // X-Session-ID 请求头
+	KeyAffinitySourceUser     = "user"     // 请求体的 user 字段
+	KeyAffinitySourceMessages = "messages" // 第一条 user 消息及之前所有消息（通常为 system 提示词）的哈希
+)
+
+// 日志格式（同时作用于应用日志和访问日志）
+const (
+	LogFormatText = "text" // 人类可读的文本格式
+	LogFormatJSON = "json" // 每行一个 JSON 对象，便于日志系统采集
+)
+
+// 请求/响应内容捕获的存储方式
+const (
+	PayloadCaptureStoreDB   = "db"   // 保存在数据库 payload_captures 表中
+	PayloadCaptureStoreDisk = "disk" // 每条捕获保存为 PAYLOAD_CAPTURE_DIR 下的一个 JSON 文件
 )
 
 // Settings 存储应用配置
@@ -43,6 +141,8 @@ type Settings struct {
 	DefaultModel              string
 	OpenRouterAPIURL          string
 	OpenRouterModelsURL       string
+	OpenRouterCompletionsURL  string
+	OpenRouterEmbeddingsURL   string
 	RequestTimeout            time.Duration
 	KeyFailureCooldown        time.Duration
 	KeyMaxConsecutiveFailures int
@@ -52,6 +152,10 @@ type Settings struct {
 	XTitle                    string
 	Port                      string
 	LogLevel                  string
+	LogFormat                 string // 日志格式 (text/json)
+	LogFile                   string // 日志文件路径，为空时仅输出到标准输出
+	LogMaxSizeBytes           int64  // 日志文件达到此大小后轮转
+	LogMaxBackups             int    // 轮转后保留的旧日志文件数量
 	GinMode                   string
 	AdminPassword             string
 	DBType                    string
@@ -61,6 +165,95 @@ type Settings struct {
 	MySQLDBName               string
 	MySQLUser                 string
 	MySQLPassword             string
+	ClientAPIKeys             string // 额外的客户端凭据，格式 "name:token,name2:token2"，与 AppAPIKey 一起用于 /v1 认证
+	ContextTrimMode           string // 全局上下文裁剪模式 (off/auto)
+	ContextTrimClients        string // 逗号分隔的客户端名称列表，这些客户端即使在全局 off 时也启用自动裁剪
+	ContextTrimReserveTokens  int    // 请求未指定 max_tokens 时，为模型输出预留的 token 数
+	RateLimitRPM              int    // 每个客户端默认的每分钟请求数上限，0 表示不限制
+	RateLimitTPM              int    // 每个客户端默认的每分钟 token 数上限（估算输入 + 上游报告的输出），0 表示不限制
+	RateLimitClients          string // 按客户端覆盖的限额，格式 "name:rpm:tpm,..."，某项留空表示沿用全局默认值
+	RateLimitStore            string // 限流状态存储方式 (memory/db)
+	GenerationStatsEnabled    bool   // 是否在请求完成后向 OpenRouter 查询生成统计（原生 token 数、提供商、精确费用）
+	OpenRouterGenerationURL   string // 生成统计端点，按 ?id= 查询
+	GenerationStatsMaxAttempts int   // 查询生成统计的最大尝试次数（统计通常在生成结束后数秒才可用）
+	IdempotencyTTL            time.Duration // Idempotency-Key 对应的最终响应保留时长，0 表示忽略该头部
+	IdempotencyMaxEntries     int           // 内存中保存的幂等键数量上限，超出时淘汰最早保存的响应，0 表示不限制
+	RequestCoalescingEnabled  bool          // 是否将同一客户端同时发出的相同聊天请求合并为一次上游调用
+	StreamResumeEnabled       bool          // 是否默认为流式聊天请求启用断线恢复
+	StreamResumeGracePeriod   time.Duration // 客户端断开后（或流结束后）保留缓冲、等待重连的时长
+	StreamResumeMaxBufferBytes int          // 所有可恢复流缓冲的总字节数上限，超出时淘汰最早的流
+	AsyncJobWorkers           int           // 执行异步聊天任务的工作协程数
+	AsyncJobCallbackSecret    string        // 异步任务完成回调的 HMAC 签名密钥，为空时不接受回调 URL
+	BatchConcurrency          int           // 批处理同时执行的上游请求数上限（同时不超过可用密钥数）
+	BatchRequestsPerSecond    int           // 批处理每秒最多发起的上游请求数，0 表示不限制
+	BatchMaxFileBytes         int64         // 上传的批处理输入文件大小上限
+	PayloadCaptureSampleRate  float64       // 捕获聊天请求完整内容的抽样比例 (0-1)，0 表示仅捕获 PayloadCaptureClients 中的客户端
+	PayloadCaptureClients     string        // 逗号分隔的客户端名称列表（* 表示全部），这些客户端的请求总是被捕获
+	PayloadCaptureRedactPaths string        // 逗号分隔的 JSON 路径（如 messages.*.content），捕获时替换为 [REDACTED]
+	PayloadCaptureRedactRegexes string      // 正则表达式的 JSON 数组，捕获内容中的匹配部分替换为 [REDACTED]
+	PayloadCaptureStore       string        // 捕获内容的存储方式 (db/disk)
+	PayloadCaptureDir         string        // PayloadCaptureStore=disk 时的保存目录
+	PayloadCaptureRetention   time.Duration // 捕获内容的保留时长，0 表示永久保留
+	OTLPEndpoint              string        // OTLP/HTTP 导出端点（如 http://localhost:4318），为空时不启用分布式追踪
+	OTelServiceName           string        // 上报 span 时使用的服务名
+	TraceSampleRate           float64       // 没有上游 traceparent 时新建 trace 的抽样比例 (0-1)
+	AlertEvalInterval         time.Duration // 告警规则的评估间隔
+	AlertRepeatInterval       time.Duration // 持续触发中的告警重复通知的间隔，0 表示只在触发和恢复时通知
+	AlertMinAvailableKeys     int           // 可用密钥数低于此值时告警，0 表示不检查
+	AlertMinAvailableKeysPercent float64    // 可用密钥占比（百分比）低于此值时告警，0 表示不检查
+	AlertErrorRateThreshold   float64       // 窗口内请求最终失败 (5xx) 比例超过此值 (0-1) 时告警，0 表示不检查
+	AlertErrorRateWindow      time.Duration // 错误率的统计窗口
+	AlertErrorRateMinRequests int           // 窗口内请求数少于此值时不评估错误率
+	AlertHealthCheckFailures  bool          // 健康检查周期发现新的失败密钥时是否告警
+	AlertWebhookURLs          string        // 逗号分隔的通用 Webhook 地址，接收 JSON 格式的告警
+	AlertWebhookSecret        string        // 通用 Webhook 的 HMAC 签名密钥，为空时不签名
+	AlertSlackWebhookURL      string        // Slack Incoming Webhook 地址
+	AlertDingTalkWebhookURL   string        // 钉钉群机器人 Webhook 地址
+	AlertDingTalkSecret       string        // 钉钉机器人的加签密钥（可选）
+	AlertFeishuWebhookURL     string        // 飞书群机器人 Webhook 地址
+	AlertFeishuSecret         string        // 飞书机器人的签名校验密钥（可选）
+	AlertSMTPHost             string        // 告警邮件的 SMTP 服务器，为空时不发送邮件
+	AlertSMTPPort             int           // SMTP 端口（465 使用隐式 TLS，其余端口在支持时使用 STARTTLS）
+	AlertSMTPUsername         string        // SMTP 认证用户名，为空时不认证
+	AlertSMTPPassword         string        // SMTP 认证密码
+	AlertSMTPFrom             string        // 发件人地址
+	AlertSMTPTo               string        // 逗号分隔的收件人地址
+	KeyEventRetention         time.Duration // 密钥状态变化历史的保留时长，0 表示永久保留
+	ResponseRetention         time.Duration // /v1/responses 存储的响应自最后一次使用起的保留时长，0 表示永久保留
+	AdaptiveWeighting         bool          // 是否按密钥近期的成功率和速度动态调整其选择权重
+	AdaptiveWeightMinFactor   float64       // 自适应权重相对配置权重的最小倍数
+	AdaptiveWeightMaxFactor   float64       // 自适应权重相对配置权重的最大倍数
+	ModelHealthErrorRateThreshold float64   // 模型在统计窗口内的错误率达到此值时判定为降级，0 表示不判定降级
+	ModelHealthWindow         time.Duration // 模型错误率的统计窗口
+	ModelHealthMinRequests    int           // 窗口内请求数少于此值时不判定降级
+	ModelHealthMinKeys        int           // 窗口内至少有此数量的不同密钥失败时才判定降级，以区分模型故障与个别密钥故障
+	ModelHealthCooldown       time.Duration // 模型降级的持续时间，之后重新放行请求进行探测
+	ModelFallbacks            string        // 逗号分隔的 "模型=备用模型" 列表（* 匹配所有模型），模型降级时改用备用模型
+	CircuitBreakerMinFailures int           // 统计窗口内上游失败（网络错误、超时、5xx）达到此数量时才可能打开熔断器（密钥总数更少时以密钥总数为准），0 表示不启用熔断
+	CircuitBreakerMinKeys     int           // 统计窗口内至少有此数量的不同密钥失败时才打开熔断器（密钥总数更少时以密钥总数为准）
+	CircuitBreakerErrorRateThreshold float64 // 统计窗口内的上游失败率达到此值时打开熔断器
+	CircuitBreakerWindow      time.Duration // 上游失败的统计窗口
+	CircuitBreakerOpenDuration time.Duration // 熔断器首次打开的持续时间，之后放行一个探测请求
+	CircuitBreakerMaxOpenDuration time.Duration // 探测失败后打开时间按倍数增加的上限
+	RetryOnErrorTypes         string        // 逗号分隔的可重试错误类型（* 表示所有需要换密钥重试的错误）
+	RetrySameKeyErrorTypes    string        // 逗号分隔的错误类型，这些错误在同一个密钥上重试而不是换密钥
+	RetryBackoffBase          time.Duration // 第一次重试前的等待时间，之后按倍数增加
+	RetryBackoffMax           time.Duration // 重试等待时间的上限
+	RetryBackoffMultiplier    float64       // 每次重试后等待时间的倍数
+	RetryBackoffJitter        float64       // 等待时间的随机抖动比例 (0-1)，例如 0.2 表示在 ±20% 范围内随机
+	RetryDeadline             time.Duration // 单个请求所有尝试（含等待）的总时长上限，0 表示不限制
+	RetryBudgetRatio          float64       // 全局重试预算：窗口内重试次数不超过请求数的此比例，0 表示不限制
+	RetryBudgetWindow         time.Duration // 重试预算的统计窗口
+	RetryBudgetMinRetries     int           // 窗口内总是允许的重试次数，避免请求较少时无法重试
+	RetryPolicyModels         string        // 按模型覆盖重试策略的 JSON 对象，键为模型（* 匹配所有模型）
+	KeyMaxConcurrentRequests  int           // 单个密钥同时进行的上游请求数上限，0 表示不限制
+	RequestQueueMaxSize       int           // 等待可用密钥的请求队列长度上限，0 表示不排队
+	RequestQueueMaxWait       time.Duration // 请求默认的最长排队时间，0 表示默认不排队（没有可用密钥时立即返回 503）
+	RequestQueueWaitLimit     time.Duration // 客户端通过请求头指定的排队时间上限
+	RequestQueueClients       string        // 按客户端覆盖的排队设置，格式 "name:priority:max_wait_seconds,..."，某项留空表示沿用全局默认值
+	KeyAffinityEnabled        bool          // 是否将同一会话的请求尽量发往同一个密钥，以提高提供商提示词缓存的命中率
+	KeyAffinitySources        string        // 逗号分隔的会话标识来源 (session/user/messages)，按顺序取第一个非空的来源
+	KeyAffinityIdleTTL        time.Duration // 会话与密钥的绑定在空闲此时长后过期
 }
 
 // --- 配置热加载支持 ---
@@ -96,6 +289,22 @@ type UpdateSettingsRequest struct {
 	LogLevel                  *string `json:"log_level"`
 	AppAPIKey                 *string `json:"app_api_key"`
 	AdminPassword             *string `json:"admin_password"`
+	ContextTrimMode           *string `json:"context_trim_mode"`
+	RateLimitRPM              *int    `json:"rate_limit_rpm"`
+	RateLimitTPM              *int    `json:"rate_limit_tpm"`
+	AdaptiveWeighting         *bool    `json:"adaptive_weighting"`
+	AdaptiveWeightMinFactor   *float64 `json:"adaptive_weight_min_factor"`
+	AdaptiveWeightMaxFactor   *float64 `json:"adaptive_weight_max_factor"`
+	RetryOnErrorTypes         *string  `json:"retry_on_error_types"`
+	RetrySameKeyErrorTypes    *string  `json:"retry_same_key_error_types"`
+	RetryBackoffBaseMs        *int     `json:"retry_backoff_base_ms"`
+	RetryBackoffMaxMs         *int     `json:"retry_backoff_max_ms"`
+	RetryBackoffMultiplier    *float64 `json:"retry_backoff_multiplier"`
+	RetryBackoffJitter        *float64 `json:"retry_backoff_jitter"`
+	RetryDeadlineSeconds      *int     `json:"retry_deadline_seconds"`
+	RetryBudgetRatio          *float64 `json:"retry_budget_ratio"`
+	RetryBudgetMinRetries     *int     `json:"retry_budget_min_retries"`
+	RetryPolicyModels         *string  `json:"retry_policy_models"`
 }
 
 // UpdateSettings 安全地更新全局配置。
@@ -147,6 +356,70 @@ func UpdateSettings(req UpdateSettingsRequest) {
 		AppSettings.AdminPassword = *req.AdminPassword
 		Log.Infof("配置热更新: AdminPassword 已更新。")
 	}
+	if req.ContextTrimMode != nil {
+		AppSettings.ContextTrimMode = *req.ContextTrimMode
+		Log.Infof("配置热更新: ContextTrimMode -> %s", AppSettings.ContextTrimMode)
+	}
+	if req.RateLimitRPM != nil {
+		AppSettings.RateLimitRPM = *req.RateLimitRPM
+		Log.Infof("配置热更新: RateLimitRPM -> %d", AppSettings.RateLimitRPM)
+	}
+	if req.RateLimitTPM != nil {
+		AppSettings.RateLimitTPM = *req.RateLimitTPM
+		Log.Infof("配置热更新: RateLimitTPM -> %d", AppSettings.RateLimitTPM)
+	}
+	if req.AdaptiveWeighting != nil {
+		AppSettings.AdaptiveWeighting = *req.AdaptiveWeighting
+		Log.Infof("配置热更新: AdaptiveWeighting -> %t", AppSettings.AdaptiveWeighting)
+	}
+	if req.AdaptiveWeightMinFactor != nil {
+		AppSettings.AdaptiveWeightMinFactor = *req.AdaptiveWeightMinFactor
+		Log.Infof("配置热更新: AdaptiveWeightMinFactor -> %g", AppSettings.AdaptiveWeightMinFactor)
+	}
+	if req.AdaptiveWeightMaxFactor != nil {
+		AppSettings.AdaptiveWeightMaxFactor = *req.AdaptiveWeightMaxFactor
+		Log.Infof("配置热更新: AdaptiveWeightMaxFactor -> %g", AppSettings.AdaptiveWeightMaxFactor)
+	}
+	if req.RetryOnErrorTypes != nil {
+		AppSettings.RetryOnErrorTypes = *req.RetryOnErrorTypes
+		Log.Infof("配置热更新: RetryOnErrorTypes -> %s", AppSettings.RetryOnErrorTypes)
+	}
+	if req.RetrySameKeyErrorTypes != nil {
+		AppSettings.RetrySameKeyErrorTypes = *req.RetrySameKeyErrorTypes
+		Log.Infof("配置热更新: RetrySameKeyErrorTypes -> %s", AppSettings.RetrySameKeyErrorTypes)
+	}
+	if req.RetryBackoffBaseMs != nil {
+		AppSettings.RetryBackoffBase = time.Duration(*req.RetryBackoffBaseMs) * time.Millisecond
+		Log.Infof("配置热更新: RetryBackoffBase -> %v", AppSettings.RetryBackoffBase)
+	}
+	if req.RetryBackoffMaxMs != nil {
+		AppSettings.RetryBackoffMax = time.Duration(*req.RetryBackoffMaxMs) * time.Millisecond
+		Log.Infof("配置热更新: RetryBackoffMax -> %v", AppSettings.RetryBackoffMax)
+	}
+	if req.RetryBackoffMultiplier != nil {
+		AppSettings.RetryBackoffMultiplier = *req.RetryBackoffMultiplier
+		Log.Infof("配置热更新: RetryBackoffMultiplier -> %g", AppSettings.RetryBackoffMultiplier)
+	}
+	if req.RetryBackoffJitter != nil {
+		AppSettings.RetryBackoffJitter = *req.RetryBackoffJitter
+		Log.Infof("配置热更新: RetryBackoffJitter -> %g", AppSettings.RetryBackoffJitter)
+	}
+	if req.RetryDeadlineSeconds != nil {
+		AppSettings.RetryDeadline = time.Duration(*req.RetryDeadlineSeconds) * time.Second
+		Log.Infof("配置热更新: RetryDeadline -> %v", AppSettings.RetryDeadline)
+	}
+	if req.RetryBudgetRatio != nil {
+		AppSettings.RetryBudgetRatio = *req.RetryBudgetRatio
+		Log.Infof("配置热更新: RetryBudgetRatio -> %g", AppSettings.RetryBudgetRatio)
+	}
+	if req.RetryBudgetMinRetries != nil {
+		AppSettings.RetryBudgetMinRetries = *req.RetryBudgetMinRetries
+		Log.Infof("配置热更新: RetryBudgetMinRetries -> %d", AppSettings.RetryBudgetMinRetries)
+	}
+	if req.RetryPolicyModels != nil {
+		AppSettings.RetryPolicyModels = *req.RetryPolicyModels
+		Log.Infof("配置热更新: RetryPolicyModels -> %s", AppSettings.RetryPolicyModels)
+	}
 }
 
 // loadConfig 从环境变量加载配置
@@ -157,6 +430,8 @@ func loadConfig() Settings {
 		DefaultModel:              getStringEnv("DEFAULT_MODEL", DefaultModel),
 		OpenRouterAPIURL:          getStringEnv("OPENROUTER_API_URL", DefaultOpenRouterAPIURL),
 		OpenRouterModelsURL:       getStringEnv("OPENROUTER_MODELS_URL", DefaultOpenRouterModelsURL),
+		OpenRouterCompletionsURL:  getStringEnv("OPENROUTER_COMPLETIONS_URL", DefaultOpenRouterCompletionsURL),
+		OpenRouterEmbeddingsURL:   getStringEnv("OPENROUTER_EMBEDDINGS_URL", DefaultOpenRouterEmbeddingsURL),
 		RequestTimeout:            getDurationEnv("REQUEST_TIMEOUT_SECONDS", DefaultRequestTimeoutSeconds),
 		KeyFailureCooldown:        getDurationEnv("KEY_FAILURE_COOLDOWN_SECONDS", DefaultKeyFailureCooldownSeconds),
 		KeyMaxConsecutiveFailures: getIntEnv("KEY_MAX_CONSECUTIVE_FAILURES", DefaultKeyMaxConsecutiveFailures),
@@ -166,6 +441,10 @@ func loadConfig() Settings {
 		XTitle:                    getStringEnv("X_TITLE", DefaultXTitle),
 		Port:                      getStringEnv("PORT", DefaultPort),
 		LogLevel:                  getStringEnv("LOG_LEVEL", DefaultLogLevel),
+		LogFormat:                 strings.ToLower(getStringEnv("LOG_FORMAT", DefaultLogFormat)),
+		LogFile:                   os.Getenv("LOG_FILE"),
+		LogMaxSizeBytes:           int64(getIntEnv("LOG_MAX_SIZE_MB", DefaultLogMaxSizeMB)) << 20,
+		LogMaxBackups:             getIntEnv("LOG_MAX_BACKUPS", DefaultLogMaxBackups),
 		GinMode:                   getStringEnv("GIN_MODE", DefaultGinMode),
 		AdminPassword:             getStringEnv("ADMIN_PASSWORD", DefaultAdminPassword),
 		DBType:                    getStringEnv("DB_TYPE", DefaultDBType),
@@ -175,9 +454,202 @@ func loadConfig() Settings {
 		MySQLDBName:               getStringEnv("MYSQL_DBNAME", DefaultMySQLDBName),
 		MySQLUser:                 getStringEnv("MYSQL_USER", DefaultMySQLUser),
 		MySQLPassword:             os.Getenv("MYSQL_PASSWORD"), // 密码可以为空
+		ClientAPIKeys:             os.Getenv("CLIENT_API_KEYS"),
+		ContextTrimMode:           getStringEnv("CONTEXT_TRIM_MODE", DefaultContextTrimMode),
+		ContextTrimClients:        os.Getenv("CONTEXT_TRIM_CLIENTS"),
+		ContextTrimReserveTokens:  getIntEnv("CONTEXT_TRIM_RESERVE_TOKENS", DefaultContextTrimReserveTokens),
+		RateLimitRPM:              getIntEnv("RATE_LIMIT_RPM", 0),
+		RateLimitTPM:              getIntEnv("RATE_LIMIT_TPM", 0),
+		RateLimitClients:          os.Getenv("RATE_LIMIT_CLIENTS"),
+		RateLimitStore:            getStringEnv("RATE_LIMIT_STORE", DefaultRateLimitStore),
+		GenerationStatsEnabled:    getBoolEnv("GENERATION_STATS_ENABLED", false),
+		OpenRouterGenerationURL:   getStringEnv("OPENROUTER_GENERATION_URL", DefaultOpenRouterGenerationURL),
+		GenerationStatsMaxAttempts: getIntEnv("GENERATION_STATS_MAX_ATTEMPTS", DefaultGenerationStatsMaxAttempts),
+		IdempotencyTTL:            getDurationEnv("IDEMPOTENCY_TTL_SECONDS", DefaultIdempotencyTTLSeconds),
+		IdempotencyMaxEntries:     getIntEnv("IDEMPOTENCY_MAX_ENTRIES", DefaultIdempotencyMaxEntries),
+		RequestCoalescingEnabled:  getBoolEnv("REQUEST_COALESCING_ENABLED", false),
+		StreamResumeEnabled:       getBoolEnv("STREAM_RESUME_ENABLED", false),
+		StreamResumeGracePeriod:   getDurationEnv("STREAM_RESUME_GRACE_SECONDS", DefaultStreamResumeGraceSeconds),
+		StreamResumeMaxBufferBytes: getIntEnv("STREAM_RESUME_MAX_BUFFER_MB", DefaultStreamResumeMaxBufferMB) * 1024 * 1024,
+		AsyncJobWorkers:           getIntEnv("ASYNC_JOB_WORKERS", DefaultAsyncJobWorkers),
+		AsyncJobCallbackSecret:    os.Getenv("ASYNC_JOB_CALLBACK_SECRET"),
+		BatchConcurrency:          getIntEnv("BATCH_CONCURRENCY", DefaultBatchConcurrency),
+		BatchRequestsPerSecond:    getIntEnv("BATCH_REQUESTS_PER_SECOND", DefaultBatchRequestsPerSecond),
+		BatchMaxFileBytes:         int64(getIntEnv("BATCH_MAX_FILE_MB", DefaultBatchMaxFileMB)) * 1024 * 1024,
+		PayloadCaptureSampleRate:  getFloatEnv("PAYLOAD_CAPTURE_SAMPLE_RATE", 0),
+		PayloadCaptureClients:     os.Getenv("PAYLOAD_CAPTURE_CLIENTS"),
+		PayloadCaptureRedactPaths: os.Getenv("PAYLOAD_CAPTURE_REDACT_PATHS"),
+		PayloadCaptureRedactRegexes: os.Getenv("PAYLOAD_CAPTURE_REDACT_REGEXES"),
+		PayloadCaptureStore:       getStringEnv("PAYLOAD_CAPTURE_STORE", DefaultPayloadCaptureStore),
+		PayloadCaptureDir:         getStringEnv("PAYLOAD_CAPTURE_DIR", DefaultPayloadCaptureDir),
+		PayloadCaptureRetention:   time.Duration(getIntEnv("PAYLOAD_CAPTURE_RETENTION_HOURS", DefaultPayloadCaptureRetentionHours)) * time.Hour,
+		OTLPEndpoint:              os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		OTelServiceName:           getStringEnv("OTEL_SERVICE_NAME", DefaultOTelServiceName),
+		TraceSampleRate:           getFloatEnv("TRACE_SAMPLE_RATE", DefaultTraceSampleRate),
+		AlertEvalInterval:         getDurationEnv("ALERT_EVAL_INTERVAL_SECONDS", DefaultAlertEvalIntervalSeconds),
+		AlertRepeatInterval:       time.Duration(getIntEnv("ALERT_REPEAT_INTERVAL_MINUTES", DefaultAlertRepeatIntervalMinutes)) * time.Minute,
+		AlertMinAvailableKeys:     getIntEnv("ALERT_MIN_AVAILABLE_KEYS", DefaultAlertMinAvailableKeys),
+		AlertMinAvailableKeysPercent: getFloatEnv("ALERT_MIN_AVAILABLE_KEYS_PERCENT", 0),
+		AlertErrorRateThreshold:   getFloatEnv("ALERT_ERROR_RATE_THRESHOLD", DefaultAlertErrorRateThreshold),
+		AlertErrorRateWindow:      getDurationEnv("ALERT_ERROR_RATE_WINDOW_SECONDS", DefaultAlertErrorRateWindowSeconds),
+		AlertErrorRateMinRequests: getIntEnv("ALERT_ERROR_RATE_MIN_REQUESTS", DefaultAlertErrorRateMinRequests),
+		AlertHealthCheckFailures:  getBoolEnv("ALERT_HEALTH_CHECK_FAILURES", true),
+		AlertWebhookURLs:          os.Getenv("ALERT_WEBHOOK_URLS"),
+		AlertWebhookSecret:        os.Getenv("ALERT_WEBHOOK_SECRET"),
+		AlertSlackWebhookURL:      os.Getenv("ALERT_SLACK_WEBHOOK_URL"),
+		AlertDingTalkWebhookURL:   os.Getenv("ALERT_DINGTALK_WEBHOOK_URL"),
+		AlertDingTalkSecret:       os.Getenv("ALERT_DINGTALK_SECRET"),
+		AlertFeishuWebhookURL:     os.Getenv("ALERT_FEISHU_WEBHOOK_URL"),
+		AlertFeishuSecret:         os.Getenv("ALERT_FEISHU_SECRET"),
+		AlertSMTPHost:             os.Getenv("ALERT_SMTP_HOST"),
+		AlertSMTPPort:             getIntEnv("ALERT_SMTP_PORT", DefaultAlertSMTPPort),
+		AlertSMTPUsername:         os.Getenv("ALERT_SMTP_USERNAME"),
+		AlertSMTPPassword:         os.Getenv("ALERT_SMTP_PASSWORD"),
+		AlertSMTPFrom:             os.Getenv("ALERT_SMTP_FROM"),
+		AlertSMTPTo:               os.Getenv("ALERT_SMTP_TO"),
+		KeyEventRetention:         time.Duration(getIntEnv("KEY_EVENT_RETENTION_DAYS", DefaultKeyEventRetentionDays)) * 24 * time.Hour,
+		ResponseRetention:         time.Duration(getIntEnv("RESPONSE_RETENTION_DAYS", DefaultResponseRetentionDays)) * 24 * time.Hour,
+		AdaptiveWeighting:         getBoolEnv("ADAPTIVE_WEIGHTING", false),
+		AdaptiveWeightMinFactor:   getFloatEnv("ADAPTIVE_WEIGHT_MIN_FACTOR", DefaultAdaptiveWeightMinFactor),
+		AdaptiveWeightMaxFactor:   getFloatEnv("ADAPTIVE_WEIGHT_MAX_FACTOR", DefaultAdaptiveWeightMaxFactor),
+		ModelHealthErrorRateThreshold: getFloatEnv("MODEL_HEALTH_ERROR_RATE_THRESHOLD", DefaultModelHealthErrorRateThreshold),
+		ModelHealthWindow:         getDurationEnv("MODEL_HEALTH_WINDOW_SECONDS", DefaultModelHealthWindowSeconds),
+		ModelHealthMinRequests:    getIntEnv("MODEL_HEALTH_MIN_REQUESTS", DefaultModelHealthMinRequests),
+		ModelHealthMinKeys:        getIntEnv("MODEL_HEALTH_MIN_KEYS", DefaultModelHealthMinKeys),
+		ModelHealthCooldown:       getDurationEnv("MODEL_HEALTH_COOLDOWN_SECONDS", DefaultModelHealthCooldownSeconds),
+		ModelFallbacks:            os.Getenv("MODEL_FALLBACKS"),
+		CircuitBreakerMinFailures: getIntEnv("CIRCUIT_BREAKER_MIN_FAILURES", DefaultCircuitBreakerMinFailures),
+		CircuitBreakerMinKeys:     getIntEnv("CIRCUIT_BREAKER_MIN_KEYS", DefaultCircuitBreakerMinKeys),
+		CircuitBreakerErrorRateThreshold: getFloatEnv("CIRCUIT_BREAKER_ERROR_RATE_THRESHOLD", DefaultCircuitBreakerErrorRateThreshold),
+		CircuitBreakerWindow:      getDurationEnv("CIRCUIT_BREAKER_WINDOW_SECONDS", DefaultCircuitBreakerWindowSeconds),
+		CircuitBreakerOpenDuration: getDurationEnv("CIRCUIT_BREAKER_OPEN_SECONDS", DefaultCircuitBreakerOpenSeconds),
+		CircuitBreakerMaxOpenDuration: getDurationEnv("CIRCUIT_BREAKER_MAX_OPEN_SECONDS", DefaultCircuitBreakerMaxOpenSeconds),
+		RetryOnErrorTypes:         getStringEnv("RETRY_ON_ERROR_TYPES", DefaultRetryOnErrorTypes),
+		RetrySameKeyErrorTypes:    os.Getenv("RETRY_SAME_KEY_ERROR_TYPES"),
+		RetryBackoffBase:          time.Duration(getIntEnv("RETRY_BACKOFF_BASE_MS", DefaultRetryBackoffBaseMs)) * time.Millisecond,
+		RetryBackoffMax:           time.Duration(getIntEnv("RETRY_BACKOFF_MAX_MS", DefaultRetryBackoffMaxMs)) * time.Millisecond,
+		RetryBackoffMultiplier:    getFloatEnv("RETRY_BACKOFF_MULTIPLIER", DefaultRetryBackoffMultiplier),
+		RetryBackoffJitter:        getFloatEnv("RETRY_BACKOFF_JITTER", DefaultRetryBackoffJitter),
+		RetryDeadline:             getDurationEnv("RETRY_DEADLINE_SECONDS", 0),
+		RetryBudgetRatio:          getFloatEnv("RETRY_BUDGET_RATIO", DefaultRetryBudgetRatio),
+		RetryBudgetWindow:         getDurationEnv("RETRY_BUDGET_WINDOW_SECONDS", DefaultRetryBudgetWindowSeconds),
+		RetryBudgetMinRetries:     getIntEnv("RETRY_BUDGET_MIN_RETRIES", DefaultRetryBudgetMinRetries),
+		RetryPolicyModels:         os.Getenv("RETRY_POLICY_MODELS"),
+		KeyMaxConcurrentRequests:  getIntEnv("KEY_MAX_CONCURRENT_REQUESTS", 0),
+		RequestQueueMaxSize:       getIntEnv("REQUEST_QUEUE_MAX_SIZE", DefaultRequestQueueMaxSize),
+		RequestQueueMaxWait:       getDurationEnv("REQUEST_QUEUE_MAX_WAIT_SECONDS", 0),
+		RequestQueueWaitLimit:     getDurationEnv("REQUEST_QUEUE_WAIT_LIMIT_SECONDS", DefaultRequestQueueWaitLimitSeconds),
+		RequestQueueClients:       os.Getenv("REQUEST_QUEUE_CLIENTS"),
+		KeyAffinityEnabled:        getBoolEnv("KEY_AFFINITY_ENABLED", false),
+		KeyAffinitySources:        getStringEnv("KEY_AFFINITY_SOURCES", DefaultKeyAffinitySources),
+		KeyAffinityIdleTTL:        getDurationEnv("KEY_AFFINITY_IDLE_TTL_SECONDS", DefaultKeyAffinityIdleTTLSeconds),
 	}
 }
 
+// ClientNameForToken 根据客户端提交的令牌解析出客户端名称。
+// AppAPIKey 对应的客户端名称固定为 "default"；CLIENT_API_KEYS 中的条目按 "name:token" 解析。
+// 第二个返回值表示令牌是否有效。
+func ClientNameForToken(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	if AppSettings.AppAPIKey != "" && token == AppSettings.AppAPIKey {
+		return DefaultClientName, true
+	}
+	for _, entry := range strings.Split(AppSettings.ClientAPIKeys, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name, clientToken := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if name != "" && clientToken != "" && token == clientToken {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// ClientAuthEnabled 返回是否配置了任何 /v1 客户端凭据。
+func ClientAuthEnabled() bool {
+	return AppSettings.AppAPIKey != "" || strings.TrimSpace(AppSettings.ClientAPIKeys) != ""
+}
+
+// RateLimitsForClient 返回指定客户端的每分钟请求数和 token 数上限（0 表示不限制）。
+// RATE_LIMIT_CLIENTS 中的条目按 "name:rpm:tpm" 解析，留空的字段沿用全局默认值。
+func RateLimitsForClient(clientName string) (rpm int, tpm int) {
+	rpm, tpm = AppSettings.RateLimitRPM, AppSettings.RateLimitTPM
+	for _, entry := range strings.Split(AppSettings.RateLimitClients, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 3 || strings.TrimSpace(parts[0]) != clientName {
+			continue
+		}
+		if v, err := strconv.Atoi(strings.TrimSpace(parts[1])); err == nil {
+			rpm = v
+		}
+		if v, err := strconv.Atoi(strings.TrimSpace(parts[2])); err == nil {
+			tpm = v
+		}
+		break
+	}
+	return rpm, tpm
+}
+
+// QueueSettingsForClient 返回指定客户端的排队优先级和最长排队时间。
+// REQUEST_QUEUE_CLIENTS 中的条目按 "name:priority:max_wait_seconds" 解析，留空的字段沿用全局默认值。
+func QueueSettingsForClient(clientName string) (priority string, maxWait time.Duration) {
+	priority, maxWait = QueuePriorityNormal, AppSettings.RequestQueueMaxWait
+	for _, entry := range strings.Split(AppSettings.RequestQueueClients, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 3 || strings.TrimSpace(parts[0]) != clientName {
+			continue
+		}
+		if p := strings.TrimSpace(parts[1]); IsValidQueuePriority(p) {
+			priority = p
+		}
+		if v, err := strconv.Atoi(strings.TrimSpace(parts[2])); err == nil {
+			maxWait = time.Duration(v) * time.Second
+		}
+		break
+	}
+	return priority, maxWait
+}
+
+// IsValidQueuePriority 判断是否为有效的排队优先级。
+func IsValidQueuePriority(priority string) bool {
+	return priority == QueuePriorityHigh || priority == QueuePriorityNormal || priority == QueuePriorityLow
+}
+
+// ModelFallbackFor 返回模型降级时使用的备用模型，没有配置时返回空字符串。
+// MODEL_FALLBACKS 中的条目按 "模型=备用模型" 解析，精确匹配优先于 "*"。
+func ModelFallbackFor(model string) string {
+	wildcard := ""
+	for _, entry := range strings.Split(AppSettings.ModelFallbacks, ",") {
+		from, to, ok := strings.Cut(entry, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || to == "" {
+			continue
+		}
+		if from == model {
+			return to
+		}
+		if from == "*" && wildcard == "" {
+			wildcard = to
+		}
+	}
+	return wildcard
+}
+
+// ListContains 判断逗号分隔的配置列表中是否包含指定项（忽略空白，"*" 匹配所有）。
+func ListContains(list string, item string) bool {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "*" || (entry != "" && entry == item) {
+			return true
+		}
+	}
+	return false
+}
+
 func getStringEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -198,6 +670,30 @@ func getIntEnv(key string, defaultValue int) int {
 	return value
 }
 
+func getFloatEnv(key string, defaultValue float64) float64 {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getBoolEnv(key string, defaultValue bool) bool {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
 func getDurationEnv(key string, defaultValueInSeconds int) time.Duration {
 	valueStr := os.Getenv(key)
 	if valueStr == "" {
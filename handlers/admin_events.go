@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"net/http"
+	"openrouter_polling/apimanager"
+	"openrouter_polling/models"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// adminEventBuffer 是每个 /admin/events 订阅的事件缓冲区大小，写出跟不上时超出的事件会被丢弃。
+	adminEventBuffer = 256
+	// adminEventHeartbeat 是没有事件时发送 SSE 注释行的间隔，防止代理或浏览器因空闲断开连接。
+	adminEventHeartbeat = 15 * time.Second
+)
+
+// AdminEventsHandler 处理 `/admin/events` GET 请求，以 SSE 推送密钥管理器的实时事件。
+// 查询参数 key_suffix 和 type 均可为逗号分隔的多个值，用于过滤事件。
+// 订阅方处理过慢导致事件被丢弃时，会收到一个 `dropped` 事件，应重新拉取完整的密钥状态。
+func AdminEventsHandler(c *gin.Context) {
+	filter := apimanager.EventFilter{
+		KeySuffixes: commaSet(c.Query("key_suffix")),
+		Types:       commaSet(c.Query("type")),
+	}
+	for eventType := range filter.Types {
+		if !slices.Contains(apimanager.EventTypes, eventType) {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorDetail{
+				Message: "无效的事件类型 '" + eventType + "'。有效值为: " + strings.Join(apimanager.EventTypes, ", "),
+				Type:    "invalid_request_error", Param: "type"}})
+			return
+		}
+	}
+
+	sub := ApiKeyMgr.Events().Subscribe(filter, adminEventBuffer)
+	defer ApiKeyMgr.Events().Unsubscribe(sub)
+	Log.Infof("AdminEventsHandler: 管理员订阅了密钥事件 (key_suffix=%q, type=%q)。", c.Query("key_suffix"), c.Query("type"))
+
+	setSSEHeaders(c)
+	// 先发送一个 ready 事件，客户端据此知道订阅已建立，可以拉取一次完整状态作为基线
+	if err := writeSSEEvent(c, "ready", gin.H{"types": apimanager.EventTypes}); err != nil {
+		return
+	}
+	heartbeat := time.NewTicker(adminEventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			Log.Debug("AdminEventsHandler: 事件订阅方已断开。")
+			return
+		case event := <-sub.C:
+			if dropped := sub.Dropped(); dropped > 0 {
+				if err := writeSSEEvent(c, "dropped", gin.H{"count": dropped}); err != nil {
+					return
+				}
+			}
+			if err := writeSSEEvent(c, event.Type, event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if dropped := sub.Dropped(); dropped > 0 {
+				if err := writeSSEEvent(c, "dropped", gin.H{"count": dropped}); err != nil {
+					return
+				}
+				continue
+			}
+			if _, err := c.Writer.WriteString(": ping\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// commaSet 将逗号分隔的查询参数解析为集合，空字符串返回 nil（表示不过滤）。
+func commaSet(value string) map[string]bool {
+	var set map[string]bool
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			if set == nil {
+				set = make(map[string]bool)
+			}
+			set[item] = true
+		}
+	}
+	return set
+}
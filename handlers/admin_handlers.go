@@ -305,6 +305,10 @@ func AppStatusHandler(c *gin.Context) {
 		AdminPasswordConfigured:    config.AppSettings.AdminPassword != "" && config.AppSettings.AdminPassword != config.DefaultAdminPassword,
 		LogLevel:                   config.AppSettings.LogLevel,
 		GinMode:                    config.AppSettings.GinMode,
+		UpstreamCircuitBreaker:     UpstreamBreaker.Status(),
+		RetryBudget:                RetryBudget.Status(),
+		RequestQueue:               keyWaitQueue.Status(),
+		KeyAffinity:                ApiKeyMgr.AffinityStatus(),
 	}
 	c.JSON(http.StatusOK, status)
 }
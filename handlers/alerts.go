@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"net/http"
+	"openrouter_polling/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListAlertsHandler 处理 `/admin/alerts` GET 请求，返回当前正在触发的告警。
+func ListAlertsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"enabled": Alerts != nil,
+		"alerts":  Alerts.ActiveAlerts(),
+	})
+}
+
+// TestAlertHandler 处理 `/admin/alerts/test` POST 请求，向所有已配置的通知渠道发送一条测试告警，
+// 返回每个渠道的发送结果。任一渠道失败时返回 502。
+func TestAlertHandler(c *gin.Context) {
+	if Alerts == nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "告警通知未启用：没有配置任何通知渠道。", Type: "alerting_disabled"}})
+		return
+	}
+	results := Alerts.SendTest(c.Request.Context())
+	status := http.StatusOK
+	for _, result := range results {
+		if !result.OK {
+			status = http.StatusBadGateway
+			break
+		}
+	}
+	Log.Infof("TestAlertHandler: 已向 %d 个通知渠道发送测试告警。", len(results))
+	c.JSON(status, gin.H{"results": results})
+}
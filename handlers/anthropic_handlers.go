@@ -0,0 +1,612 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"openrouter_polling/apimanager"
+	"openrouter_polling/config"
+	"openrouter_polling/middleware"
+	"openrouter_polling/models"
+	"openrouter_polling/utils"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// AnthropicMessagesHandler 处理 `/v1/messages` POST 请求（Anthropic Messages API 兼容端点）。
+// 请求会被转换为 OpenAI 风格的 ChatCompletionRequest，经由同一个密钥池发往 OpenRouter，
+// 再将响应（包括流式事件、工具调用和停止原因）转换回 Anthropic 格式。
+func AnthropicMessagesHandler(c *gin.Context) {
+	clientOriginalContext := c.Request.Context()
+	if clientOriginalContext.Err() == context.Canceled {
+		Log.Warn("AnthropicMessagesHandler: 客户端在处理请求前已断开连接。")
+		return
+	}
+
+	var anthropicReq models.AnthropicMessagesRequest
+	if err := c.ShouldBindJSON(&anthropicReq); err != nil {
+		Log.Warnf("AnthropicMessagesHandler: 无效的请求体: %v", err)
+		sendAnthropicError(c, http.StatusBadRequest, "请求体解析失败: "+err.Error(), "invalid_request_error")
+		return
+	}
+	if len(anthropicReq.Messages) == 0 {
+		sendAnthropicError(c, http.StatusBadRequest, "缺少必需参数 'messages'。", "invalid_request_error")
+		return
+	}
+
+	requestData, err := anthropicToChatRequest(anthropicReq)
+	if err != nil {
+		Log.Warnf("AnthropicMessagesHandler: 转换请求失败: %v", err)
+		sendAnthropicError(c, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+	isStreamForClientResponse := anthropicReq.Stream
+
+	logEntry := requestLog(c).WithFields(logrus.Fields{
+		"model":     requestData.Model,
+		"streaming": isStreamForClientResponse,
+		"user":      utils.DerefString(requestData.User, "N/A"),
+		"client_ip": c.ClientIP(),
+		"protocol":  "anthropic",
+	})
+	if requestData.Tools != nil {
+		logEntry = logEntry.WithField("tools_provided", len(*requestData.Tools))
+	}
+	logEntry.Info("收到 Anthropic 消息请求")
+
+	applyContextTrimPolicy(c, &requestData, logEntry)
+
+	payloadBytes, err := json.Marshal(requestData)
+	if err != nil {
+		Log.Errorf("AnthropicMessagesHandler: 序列化请求数据失败: %v", err)
+		sendAnthropicError(c, http.StatusInternalServerError, "内部服务器错误：序列化请求失败。", "internal_server_error")
+		return
+	}
+
+	if isStreamForClientResponse {
+		prepareSSEHeaders(c)
+	}
+
+	withPayloadCapture(c, capturedRequest{Body: anthropicReq, Model: requestData.Model, Stream: isStreamForClientResponse}, func() {
+		executeUpstreamRequest(c, upstreamRequest{
+			URL:       config.AppSettings.OpenRouterAPIURL,
+			Payload:   payloadBytes,
+			IsStream:  isStreamForClientResponse,
+			SendError: sendAnthropicError,
+			HandleOK: func(attemptCtx context.Context, c *gin.Context, resp *http.Response, apiKeyStatus *apimanager.ApiKeyStatus, clientOriginalContext context.Context) (bool, bool, int, string, string) {
+				if !isStreamForClientResponse {
+					return relayAnthropicNonStreamingResponse(c, resp, apiKeyStatus, clientOriginalContext, requestData.Model)
+				}
+				sink := newAnthropicStreamSink(c, requestData.Model)
+				return relayStreamingResponse(attemptCtx, c, resp, apiKeyStatus, clientOriginalContext, inspectChatCompletionChunk, sink)
+			},
+		})
+	})
+}
+
+// AnthropicCountTokensHandler 处理 `/v1/messages/count_tokens` POST 请求。
+// OpenRouter 没有对应的端点，这里使用本地启发式估算（与上下文裁剪使用同一套估算逻辑）。
+func AnthropicCountTokensHandler(c *gin.Context) {
+	var anthropicReq models.AnthropicMessagesRequest
+	if err := c.ShouldBindJSON(&anthropicReq); err != nil {
+		sendAnthropicError(c, http.StatusBadRequest, "请求体解析失败: "+err.Error(), "invalid_request_error")
+		return
+	}
+	requestData, err := anthropicToChatRequest(anthropicReq)
+	if err != nil {
+		sendAnthropicError(c, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"input_tokens": utils.EstimatePromptTokens(requestData.Messages, requestData.Tools)})
+}
+
+// anthropicToChatRequest 将 Anthropic Messages 请求转换为 OpenAI 风格的聊天请求。
+func anthropicToChatRequest(req models.AnthropicMessagesRequest) (models.ChatCompletionRequest, error) {
+	stream := req.Stream
+	chatReq := models.ChatCompletionRequest{
+		Model:       req.Model,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		Stream:      &stream,
+	}
+	if chatReq.Model == "" {
+		chatReq.Model = config.AppSettings.DefaultModel
+	}
+	if req.MaxTokens > 0 {
+		maxTokens := req.MaxTokens
+		chatReq.MaxTokens = &maxTokens
+	}
+	if len(req.StopSequences) > 0 {
+		chatReq.Stop = req.StopSequences
+	}
+	if req.Metadata != nil && req.Metadata.UserID != "" {
+		userID := req.Metadata.UserID
+		chatReq.User = &userID
+	}
+
+	// system 可以是字符串或 text 内容块数组。
+	if len(req.System) > 0 && string(req.System) != "null" {
+		systemText, err := anthropicTextFromRaw(req.System)
+		if err != nil {
+			return chatReq, fmt.Errorf("无效的 'system' 字段: %v", err)
+		}
+		if systemText != "" {
+			chatReq.Messages = append(chatReq.Messages, models.Message{Role: "system", Content: systemText})
+		}
+	}
+
+	for i, msg := range req.Messages {
+		converted, err := anthropicMessageToChatMessages(msg)
+		if err != nil {
+			return chatReq, fmt.Errorf("无效的 messages[%d]: %v", i, err)
+		}
+		chatReq.Messages = append(chatReq.Messages, converted...)
+	}
+
+	if len(req.Tools) > 0 {
+		tools := make([]models.Tool, 0, len(req.Tools))
+		for _, t := range req.Tools {
+			params, err := models.FunctionParametersFromRaw(t.InputSchema)
+			if err != nil {
+				return chatReq, fmt.Errorf("工具 '%s' 的 input_schema 无效: %v", t.Name, err)
+			}
+			tools = append(tools, models.Tool{
+				Type:     "function",
+				Function: models.FunctionDefinition{Name: t.Name, Description: t.Description, Parameters: params},
+			})
+		}
+		chatReq.Tools = &tools
+	}
+
+	if req.ToolChoice != nil {
+		switch req.ToolChoice.Type {
+		case "auto":
+			chatReq.ToolChoice = "auto"
+		case "any":
+			chatReq.ToolChoice = "required"
+		case "none":
+			chatReq.ToolChoice = "none"
+		case "tool":
+			chatReq.ToolChoice = map[string]interface{}{
+				"type":     "function",
+				"function": map[string]string{"name": req.ToolChoice.Name},
+			}
+		}
+	}
+	return chatReq, nil
+}
+
+// anthropicMessageToChatMessages 将单条 Anthropic 消息转换为一条或多条 OpenAI 风格消息。
+// user 消息中的 tool_result 块会拆分为独立的 role=tool 消息（排在该用户消息其余内容之前），
+// assistant 消息中的 tool_use 块会转换为 tool_calls。
+func anthropicMessageToChatMessages(msg models.AnthropicMessage) ([]models.Message, error) {
+	var text string
+	if err := json.Unmarshal(msg.Content, &text); err == nil {
+		return []models.Message{{Role: msg.Role, Content: text}}, nil
+	}
+	var blocks []models.AnthropicContentBlock
+	if err := json.Unmarshal(msg.Content, &blocks); err != nil {
+		return nil, fmt.Errorf("content 必须是字符串或内容块数组")
+	}
+
+	var result []models.Message
+	var parts []map[string]interface{}
+	var textParts []string
+	hasImage := false
+	var toolCalls []models.ToolCall
+
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			parts = append(parts, map[string]interface{}{"type": "text", "text": block.Text})
+			textParts = append(textParts, block.Text)
+		case "image":
+			if block.Source == nil {
+				continue
+			}
+			url := block.Source.URL
+			if block.Source.Type == "base64" {
+				url = fmt.Sprintf("data:%s;base64,%s", block.Source.MediaType, block.Source.Data)
+			}
+			parts = append(parts, map[string]interface{}{"type": "image_url", "image_url": map[string]string{"url": url}})
+			hasImage = true
+		case "tool_use":
+			arguments := "{}"
+			if len(block.Input) > 0 && string(block.Input) != "null" {
+				arguments = string(block.Input)
+			}
+			toolCalls = append(toolCalls, models.ToolCall{
+				ID:       block.ID,
+				Type:     "function",
+				Function: models.ToolCallFunction{Name: block.Name, Arguments: arguments},
+			})
+		case "tool_result":
+			resultText := ""
+			if len(block.Content) > 0 {
+				var err error
+				if resultText, err = anthropicTextFromRaw(block.Content); err != nil {
+					return nil, fmt.Errorf("tool_result 的 content 无效: %v", err)
+				}
+			}
+			if block.IsError {
+				resultText = "[error] " + resultText
+			}
+			toolUseID := block.ToolUseID
+			result = append(result, models.Message{Role: "tool", Content: resultText, ToolCallID: &toolUseID})
+		default:
+			// thinking 等内容块在 OpenAI 格式中没有对应项，直接忽略。
+		}
+	}
+
+	if msg.Role == "assistant" {
+		if len(textParts) > 0 || len(toolCalls) > 0 {
+			assistantMsg := models.Message{Role: "assistant", Content: strings.Join(textParts, "")}
+			if len(toolCalls) > 0 {
+				assistantMsg.ToolCalls = &toolCalls
+			}
+			result = append(result, assistantMsg)
+		}
+		return result, nil
+	}
+
+	if hasImage {
+		result = append(result, models.Message{Role: msg.Role, Content: parts})
+	} else if len(textParts) > 0 {
+		// 纯文本时合并为字符串，以兼容不支持多模态数组的上游模型。
+		result = append(result, models.Message{Role: msg.Role, Content: strings.Join(textParts, "\n")})
+	}
+	return result, nil
+}
+
+// anthropicTextFromRaw 从字符串或内容块数组中提取文本（非 text 块会被忽略）。
+func anthropicTextFromRaw(raw json.RawMessage) (string, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+	var blocks []models.AnthropicContentBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return "", fmt.Errorf("必须是字符串或内容块数组")
+	}
+	texts := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		if block.Type == "text" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// anthropicStopReason 将 OpenAI 的 finish_reason 映射为 Anthropic 的 stop_reason。
+func anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "content_filter":
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+// anthropicUsage 将 OpenAI 风格的用量统计转换为 Anthropic 格式。
+func anthropicUsage(usage *models.Usage) models.AnthropicUsage {
+	if usage == nil {
+		return models.AnthropicUsage{}
+	}
+	result := models.AnthropicUsage{InputTokens: usage.PromptTokens, OutputTokens: usage.CompletionTokens}
+	if usage.PromptTokensDetails != nil {
+		result.CacheReadInputTokens = usage.PromptTokensDetails.CachedTokens
+	}
+	return result
+}
+
+// anthropicMessageID 基于上游生成 ID 构造 Anthropic 风格的消息 ID。
+func anthropicMessageID(upstreamID string) string {
+	if upstreamID == "" {
+		return utils.NewID("msg_")
+	}
+	return "msg_" + upstreamID
+}
+
+// relayAnthropicNonStreamingResponse 读取上游的非流式聊天响应，转换为 Anthropic 消息格式后返回给客户端。
+func relayAnthropicNonStreamingResponse(
+	c *gin.Context,
+	resp *http.Response,
+	apiKeyStatus *apimanager.ApiKeyStatus,
+	clientOriginalContext context.Context,
+	requestModel string,
+) (success bool, retryNeeded bool, statusCodeForError int, errorDetail string, errorType string) {
+	currentOpenRouterKey := apiKeyStatus.Key
+
+	bodyBytes, readErr := io.ReadAll(resp.Body)
+	if readErr != nil {
+		Log.Errorf("relayAnthropicNonStreamingResponse: 读取 OpenRouter 非流式响应体失败: %v (密钥: %s)", readErr, utils.SafeSuffix(currentOpenRouterKey))
+		return false, true, http.StatusInternalServerError, "读取上游非流式响应失败。", "response_read_error"
+	}
+
+	var chatResp models.ChatCompletionResponse
+	if err := json.Unmarshal(bodyBytes, &chatResp); err != nil || len(chatResp.Choices) == 0 {
+		Log.Errorf("relayAnthropicNonStreamingResponse: 无法解析上游聊天响应 (密钥: %s): %v, body: %q", utils.SafeSuffix(currentOpenRouterKey), err, string(bodyBytes))
+		return false, true, http.StatusBadGateway, "上游返回了无法解析的聊天响应。", "upstream_response_parse_error"
+	}
+	ApiKeyMgr.RecordKeySuccess(currentOpenRouterKey)
+	middleware.RecordUsage(c, chatResp.Usage)
+	recordGenerationID(c, chatResp.ID)
+
+	if clientOriginalContext.Err() == context.Canceled {
+		Log.Warnf("relayAnthropicNonStreamingResponse: 成功获取非流式响应，但客户端已断开 (密钥: %s)。", utils.SafeSuffix(currentOpenRouterKey))
+		return true, false, http.StatusOK, "", ""
+	}
+
+	choice := chatResp.Choices[0]
+	content := make([]models.AnthropicContentBlock, 0, 1)
+	if text, ok := choice.Message.Content.(string); ok && text != "" {
+		content = append(content, models.AnthropicContentBlock{Type: "text", Text: text})
+	}
+	if choice.Message.ToolCalls != nil {
+		for _, tc := range *choice.Message.ToolCalls {
+			input := json.RawMessage(tc.Function.Arguments)
+			if !json.Valid(input) {
+				input = json.RawMessage("{}")
+			}
+			content = append(content, models.AnthropicContentBlock{Type: "tool_use", ID: tc.ID, Name: tc.Function.Name, Input: input})
+		}
+	}
+
+	stopReason := anthropicStopReason(utils.DerefString(choice.FinishReason, ""))
+	model := chatResp.Model
+	if model == "" {
+		model = requestModel
+	}
+	c.JSON(http.StatusOK, models.AnthropicMessagesResponse{
+		ID:         anthropicMessageID(chatResp.ID),
+		Type:       "message",
+		Role:       "assistant",
+		Model:      model,
+		Content:    content,
+		StopReason: &stopReason,
+		Usage:      anthropicUsage(chatResp.Usage),
+	})
+	Log.Infof("relayAnthropicNonStreamingResponse: 成功发送 Anthropic 格式非流式响应 (密钥: %s, stop_reason: %s)。", utils.SafeSuffix(currentOpenRouterKey), stopReason)
+	return true, false, http.StatusOK, "", ""
+}
+
+// anthropicStreamSink 是将 OpenAI 风格聊天 SSE 流转换为 Anthropic 事件流的 streamSink。
+// Anthropic 要求内容块依次出现（start → delta... → stop），因此同一时间只保持一个打开的内容块。
+type anthropicStreamSink struct {
+	c              *gin.Context
+	model          string
+	started        bool          // 是否已发送 message_start
+	finished       bool          // 是否已发送 message_stop
+	nextBlockIndex int           // 下一个内容块的序号
+	openBlockType  string        // 当前打开的内容块类型（"text" / "tool_use"），为空表示没有
+	openToolIndex  int           // 当前打开的 tool_use 块对应的上游 tool_calls 序号
+	stopReason     string        // 从 finish_reason 映射得到的停止原因
+	usage          *models.Usage // 上游在最后一个数据块中附带的用量统计
+}
+
+func newAnthropicStreamSink(c *gin.Context, model string) *anthropicStreamSink {
+	return &anthropicStreamSink{c: c, model: model, openToolIndex: -1}
+}
+
+// WriteLine 实现 streamSink：解析上游 SSE 行并输出对应的 Anthropic 事件。
+func (s *anthropicStreamSink) WriteLine(line string) error {
+	trimmedLine := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmedLine, ":") {
+		// 上游心跳转换为 ping 事件以保持连接活跃；message_start 之前的心跳直接丢弃，保证事件顺序符合规范。
+		if !s.started {
+			return nil
+		}
+		return s.writeEvent("ping", gin.H{"type": "ping"})
+	}
+	if !strings.HasPrefix(trimmedLine, models.SSEDataPrefix) {
+		return nil // 空行等分隔符由 writeEvent 自行输出
+	}
+	dataContent := strings.TrimSpace(strings.TrimPrefix(trimmedLine, models.SSEDataPrefix))
+	if dataContent == models.SSEDonePayload {
+		return s.finish()
+	}
+
+	var chunk models.ChatCompletionChunk
+	if err := json.Unmarshal([]byte(dataContent), &chunk); err != nil {
+		return nil // 非标准数据块，忽略（processStreamingResponse 会记录日志）
+	}
+	var upstreamErr struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(dataContent), &upstreamErr) == nil && upstreamErr.Error != nil {
+		return s.writeEvent("error", anthropicErrorBody("api_error", upstreamErr.Error.Message))
+	}
+
+	if err := s.start(chunk.ID, chunk.Model); err != nil {
+		return err
+	}
+	if chunk.Usage != nil {
+		s.usage = chunk.Usage
+	}
+	if len(chunk.Choices) == 0 {
+		return nil
+	}
+	choice := chunk.Choices[0]
+
+	if choice.Delta.Content != nil && *choice.Delta.Content != "" {
+		if s.openBlockType != "text" {
+			if err := s.closeBlock(); err != nil {
+				return err
+			}
+			if err := s.openBlock("text", gin.H{"type": "text", "text": ""}); err != nil {
+				return err
+			}
+		}
+		if err := s.writeEvent("content_block_delta", gin.H{
+			"type":  "content_block_delta",
+			"index": s.nextBlockIndex - 1,
+			"delta": gin.H{"type": "text_delta", "text": *choice.Delta.Content},
+		}); err != nil {
+			return err
+		}
+	}
+
+	if choice.Delta.ToolCalls != nil {
+		for i, tc := range *choice.Delta.ToolCalls {
+			toolIndex := i
+			if tc.Index != nil {
+				toolIndex = *tc.Index
+			}
+			if s.openBlockType != "tool_use" || s.openToolIndex != toolIndex {
+				if err := s.closeBlock(); err != nil {
+					return err
+				}
+				s.openToolIndex = toolIndex
+				if err := s.openBlock("tool_use", models.AnthropicContentBlock{
+					Type: "tool_use", ID: tc.ID, Name: tc.Function.Name, Input: json.RawMessage("{}"),
+				}); err != nil {
+					return err
+				}
+			}
+			if tc.Function.Arguments != "" {
+				if err := s.writeEvent("content_block_delta", gin.H{
+					"type":  "content_block_delta",
+					"index": s.nextBlockIndex - 1,
+					"delta": gin.H{"type": "input_json_delta", "partial_json": tc.Function.Arguments},
+				}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if choice.FinishReason != nil && *choice.FinishReason != "" {
+		s.stopReason = anthropicStopReason(*choice.FinishReason)
+	}
+	return nil
+}
+
+// start 在首个数据块到达时发送 message_start 事件。
+func (s *anthropicStreamSink) start(upstreamID, upstreamModel string) error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	if upstreamModel != "" {
+		s.model = upstreamModel
+	}
+	return s.writeEvent("message_start", gin.H{
+		"type": "message_start",
+		"message": models.AnthropicMessagesResponse{
+			ID:      anthropicMessageID(upstreamID),
+			Type:    "message",
+			Role:    "assistant",
+			Model:   s.model,
+			Content: []models.AnthropicContentBlock{},
+		},
+	})
+}
+
+// openBlock 发送 content_block_start 并记录当前打开的内容块。
+func (s *anthropicStreamSink) openBlock(blockType string, block interface{}) error {
+	s.openBlockType = blockType
+	index := s.nextBlockIndex
+	s.nextBlockIndex++
+	return s.writeEvent("content_block_start", gin.H{"type": "content_block_start", "index": index, "content_block": block})
+}
+
+// closeBlock 如有打开的内容块，则发送 content_block_stop。
+func (s *anthropicStreamSink) closeBlock() error {
+	if s.openBlockType == "" {
+		return nil
+	}
+	s.openBlockType = ""
+	s.openToolIndex = -1
+	return s.writeEvent("content_block_stop", gin.H{"type": "content_block_stop", "index": s.nextBlockIndex - 1})
+}
+
+// finish 在上游流结束时关闭内容块并发送 message_delta / message_stop。
+func (s *anthropicStreamSink) finish() error {
+	if s.finished {
+		return nil
+	}
+	if err := s.start("", ""); err != nil {
+		return err
+	}
+	if err := s.closeBlock(); err != nil {
+		return err
+	}
+	s.finished = true
+	if s.stopReason == "" {
+		s.stopReason = "end_turn"
+	}
+	usage := anthropicUsage(s.usage)
+	if err := s.writeEvent("message_delta", gin.H{
+		"type":  "message_delta",
+		"delta": gin.H{"stop_reason": s.stopReason, "stop_sequence": nil},
+		"usage": gin.H{"output_tokens": usage.OutputTokens, "input_tokens": usage.InputTokens},
+	}); err != nil {
+		return err
+	}
+	return s.writeEvent("message_stop", gin.H{"type": "message_stop"})
+}
+
+// writeEvent 以 `event: <name>` + `data: <json>` 的形式写出一个 Anthropic SSE 事件并刷新。
+func (s *anthropicStreamSink) writeEvent(event string, payload interface{}) error {
+	return writeSSEEvent(s.c, event, payload)
+}
+
+// anthropicErrorBody 构造 Anthropic 风格的错误响应体。
+func anthropicErrorBody(errorType, message string) models.AnthropicErrorResponse {
+	var body models.AnthropicErrorResponse
+	body.Type = "error"
+	body.Error.Type = errorType
+	body.Error.Message = message
+	return body
+}
+
+// anthropicErrorType 将 HTTP 状态码映射为 Anthropic 的错误类型。
+func anthropicErrorType(statusCode int) string {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden, http.StatusPaymentRequired:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable, 529:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
+
+// sendAnthropicError 以 Anthropic 格式向客户端发送错误（实现 upstreamErrorSender）。
+// 如果流已开始（响应头已写入），则以 `event: error` 事件发送。
+func sendAnthropicError(c *gin.Context, statusCode int, message string, errorType string) {
+	if c.Request.Context().Err() == context.Canceled {
+		Log.Warnf("sendAnthropicError: 尝试发送错误 '%s' (状态码 %d)，但客户端已断开。不发送。", message, statusCode)
+		return
+	}
+	body := anthropicErrorBody(anthropicErrorType(statusCode), message)
+	body.RequestID = middleware.RequestID(c)
+	Log.Debugf("sendAnthropicError: 发送 Anthropic 错误 (状态码 %d, 内部类型 %s): %s", statusCode, errorType, message)
+	if sseResponseStarted(c) {
+		if err := writeSSEEvent(c, "error", body); err != nil {
+			Log.Warnf("sendAnthropicError: 写入流式错误事件失败: %v", err)
+		}
+		return
+	}
+	c.JSON(statusCode, body)
+}
@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"openrouter_polling/models"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// anthropicTestEvent 是从 sink 输出中解析出的单个 Anthropic SSE 事件。
+type anthropicTestEvent struct {
+	Name string
+	Data map[string]interface{}
+}
+
+// runAnthropicSink 将 OpenAI 风格的 SSE 行依次喂给 anthropicStreamSink，并解析其输出的事件序列。
+func runAnthropicSink(t *testing.T, lines ...string) []anthropicTestEvent {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	sink := newAnthropicStreamSink(c, "test/model")
+	for _, line := range lines {
+		if err := sink.WriteLine(line); err != nil {
+			t.Fatalf("WriteLine(%q) 返回错误: %v", line, err)
+		}
+	}
+
+	var events []anthropicTestEvent
+	for _, raw := range strings.Split(strings.TrimSpace(recorder.Body.String()), "\n\n") {
+		if raw == "" {
+			continue
+		}
+		parts := strings.SplitN(raw, "\n", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "event: ") || !strings.HasPrefix(parts[1], models.SSEDataPrefix) {
+			t.Fatalf("无法解析的 SSE 事件: %q", raw)
+		}
+		event := anthropicTestEvent{Name: strings.TrimPrefix(parts[0], "event: ")}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(parts[1], models.SSEDataPrefix)), &event.Data); err != nil {
+			t.Fatalf("事件 %s 的数据不是合法 JSON: %v", event.Name, err)
+		}
+		if event.Data["type"] != event.Name {
+			t.Fatalf("事件名 %q 与 data.type %q 不一致", event.Name, event.Data["type"])
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func anthropicEventNames(events []anthropicTestEvent) []string {
+	names := make([]string, 0, len(events))
+	for _, e := range events {
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func anthropicStopReasonOf(t *testing.T, events []anthropicTestEvent) string {
+	t.Helper()
+	for _, e := range events {
+		if e.Name == "message_delta" {
+			delta, _ := e.Data["delta"].(map[string]interface{})
+			reason, _ := delta["stop_reason"].(string)
+			return reason
+		}
+	}
+	t.Fatalf("事件序列中没有 message_delta")
+	return ""
+}
+
+func sseData(payload string) string {
+	return models.SSEDataPrefix + payload
+}
+
+func TestAnthropicStreamSinkTextDeltas(t *testing.T) {
+	events := runAnthropicSink(t,
+		": OPENROUTER PROCESSING",
+		sseData(`{"id":"gen-1","model":"up/model","choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}`),
+		"",
+		sseData(`{"id":"gen-1","choices":[{"index":0,"delta":{"content":"Hel"}}]}`),
+		sseData(`{"id":"gen-1","choices":[{"index":0,"delta":{"content":"lo"}}]}`),
+		sseData(`{"id":"gen-1","choices":[{"index":0,"delta":{},"finish_reason":"stop"}],"usage":{"prompt_tokens":7,"completion_tokens":2,"total_tokens":9}}`),
+		sseData(models.SSEDonePayload),
+	)
+
+	want := []string{
+		"message_start",
+		"content_block_start",
+		"content_block_delta",
+		"content_block_delta",
+		"content_block_stop",
+		"message_delta",
+		"message_stop",
+	}
+	if got := anthropicEventNames(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("事件序列 = %v, 期望 %v", got, want)
+	}
+
+	message := events[0].Data["message"].(map[string]interface{})
+	if message["id"] != "msg_gen-1" || message["model"] != "up/model" {
+		t.Errorf("message_start = %v, 期望 id=msg_gen-1 model=up/model", message)
+	}
+	if block := events[1].Data["content_block"].(map[string]interface{}); block["type"] != "text" {
+		t.Errorf("content_block_start 类型 = %v, 期望 text", block["type"])
+	}
+	var text string
+	for _, e := range events[2:4] {
+		delta := e.Data["delta"].(map[string]interface{})
+		if delta["type"] != "text_delta" || e.Data["index"] != float64(0) {
+			t.Errorf("content_block_delta = %v, 期望 index 0 的 text_delta", e.Data)
+		}
+		text += delta["text"].(string)
+	}
+	if text != "Hello" {
+		t.Errorf("拼接的文本 = %q, 期望 %q", text, "Hello")
+	}
+	if reason := anthropicStopReasonOf(t, events); reason != "end_turn" {
+		t.Errorf("stop_reason = %q, 期望 end_turn", reason)
+	}
+	usage := events[5].Data["usage"].(map[string]interface{})
+	if usage["input_tokens"] != float64(7) || usage["output_tokens"] != float64(2) {
+		t.Errorf("message_delta.usage = %v, 期望 input 7 / output 2", usage)
+	}
+}
+
+func TestAnthropicStreamSinkInterleavedTextAndToolCalls(t *testing.T) {
+	events := runAnthropicSink(t,
+		sseData(`{"id":"gen-2","choices":[{"index":0,"delta":{"content":"Let me check."}}]}`),
+		sseData(`{"id":"gen-2","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_a","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`),
+		sseData(`{"id":"gen-2","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}`),
+		sseData(`{"id":"gen-2","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}}]}}]}`),
+		sseData(`{"id":"gen-2","choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_b","type":"function","function":{"name":"get_time","arguments":"{}"}}]}}]}`),
+		sseData(`{"id":"gen-2","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`),
+		sseData(models.SSEDonePayload),
+	)
+
+	want := []string{
+		"message_start",
+		"content_block_start", // 0: text
+		"content_block_delta",
+		"content_block_stop",
+		"content_block_start", // 1: tool_use call_a
+		"content_block_delta",
+		"content_block_delta",
+		"content_block_stop",
+		"content_block_start", // 2: tool_use call_b
+		"content_block_delta",
+		"content_block_stop",
+		"message_delta",
+		"message_stop",
+	}
+	if got := anthropicEventNames(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("事件序列 = %v, 期望 %v", got, want)
+	}
+
+	first := events[4].Data
+	block := first["content_block"].(map[string]interface{})
+	if first["index"] != float64(1) || block["type"] != "tool_use" || block["id"] != "call_a" || block["name"] != "get_weather" {
+		t.Errorf("第一个 tool_use 的 content_block_start = %v", first)
+	}
+	var partial string
+	for _, e := range events[5:7] {
+		delta := e.Data["delta"].(map[string]interface{})
+		if delta["type"] != "input_json_delta" || e.Data["index"] != float64(1) {
+			t.Errorf("content_block_delta = %v, 期望 index 1 的 input_json_delta", e.Data)
+		}
+		partial += delta["partial_json"].(string)
+	}
+	if partial != `{"city":"Paris"}` {
+		t.Errorf("拼接的 partial_json = %q", partial)
+	}
+	if events[7].Data["index"] != float64(1) {
+		t.Errorf("content_block_stop index = %v, 期望 1", events[7].Data["index"])
+	}
+
+	second := events[8].Data
+	block = second["content_block"].(map[string]interface{})
+	if second["index"] != float64(2) || block["id"] != "call_b" || block["name"] != "get_time" {
+		t.Errorf("第二个 tool_use 的 content_block_start = %v", second)
+	}
+	if reason := anthropicStopReasonOf(t, events); reason != "tool_use" {
+		t.Errorf("stop_reason = %q, 期望 tool_use", reason)
+	}
+}
+
+func TestAnthropicStreamSinkStopReasons(t *testing.T) {
+	tests := []struct {
+		finishReason string
+		want         string
+	}{
+		{"stop", "end_turn"},
+		{"length", "max_tokens"},
+		{"tool_calls", "tool_use"},
+		{"function_call", "tool_use"},
+		{"content_filter", "refusal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.finishReason, func(t *testing.T) {
+			events := runAnthropicSink(t,
+				sseData(`{"id":"gen-3","choices":[{"index":0,"delta":{"content":"x"}}]}`),
+				sseData(`{"id":"gen-3","choices":[{"index":0,"delta":{},"finish_reason":"`+tt.finishReason+`"}]}`),
+				sseData(models.SSEDonePayload),
+			)
+			if reason := anthropicStopReasonOf(t, events); reason != tt.want {
+				t.Errorf("finish_reason %q → stop_reason %q, 期望 %q", tt.finishReason, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnthropicStreamSinkDoneOnly(t *testing.T) {
+	// 上游没有任何数据块就结束时，仍需输出完整且合法的事件序列。
+	events := runAnthropicSink(t, ": keepalive", sseData(models.SSEDonePayload), sseData(models.SSEDonePayload))
+	want := []string{"message_start", "message_delta", "message_stop"}
+	if got := anthropicEventNames(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("事件序列 = %v, 期望 %v", got, want)
+	}
+	if reason := anthropicStopReasonOf(t, events); reason != "end_turn" {
+		t.Errorf("stop_reason = %q, 期望 end_turn", reason)
+	}
+}
+
+func TestAnthropicToChatRequest(t *testing.T) {
+	maxTokens := 256
+	tests := []struct {
+		name           string
+		body           string
+		wantMessages   []models.Message
+		wantToolChoice interface{}
+		check          func(t *testing.T, req models.ChatCompletionRequest)
+	}{
+		{
+			name: "system 字符串",
+			body: `{"model":"m","max_tokens":256,"system":"be brief","messages":[{"role":"user","content":"hi"}]}`,
+			wantMessages: []models.Message{
+				{Role: "system", Content: "be brief"},
+				{Role: "user", Content: "hi"},
+			},
+			check: func(t *testing.T, req models.ChatCompletionRequest) {
+				if req.MaxTokens == nil || *req.MaxTokens != maxTokens {
+					t.Errorf("MaxTokens = %v, 期望 %d", req.MaxTokens, maxTokens)
+				}
+			},
+		},
+		{
+			name: "system 内容块数组",
+			body: `{"model":"m","system":[{"type":"text","text":"rule one"},{"type":"text","text":"rule two"}],"messages":[{"role":"user","content":"hi"}]}`,
+			wantMessages: []models.Message{
+				{Role: "system", Content: "rule one\nrule two"},
+				{Role: "user", Content: "hi"},
+			},
+		},
+		{
+			name: "tool_use 与 tool_result 顺序",
+			body: `{"model":"m","messages":[
+				{"role":"user","content":"weather?"},
+				{"role":"assistant","content":[{"type":"text","text":"checking"},{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}]},
+				{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"sunny"}]},{"type":"tool_result","tool_use_id":"toolu_2","content":"boom","is_error":true},{"type":"text","text":"thanks"}]}
+			]}`,
+			wantMessages: []models.Message{
+				{Role: "user", Content: "weather?"},
+				{Role: "assistant", Content: "checking", ToolCalls: &[]models.ToolCall{{
+					ID: "toolu_1", Type: "function",
+					Function: models.ToolCallFunction{Name: "get_weather", Arguments: `{"city":"Paris"}`},
+				}}},
+				{Role: "tool", Content: "sunny", ToolCallID: strPtr("toolu_1")},
+				{Role: "tool", Content: "[error] boom", ToolCallID: strPtr("toolu_2")},
+				{Role: "user", Content: "thanks"},
+			},
+		},
+		{
+			name: "图片内容块",
+			body: `{"model":"m","messages":[{"role":"user","content":[
+				{"type":"text","text":"what is this?"},
+				{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}},
+				{"type":"image","source":{"type":"url","url":"https://example.com/a.jpg"}}
+			]}]}`,
+			wantMessages: []models.Message{
+				{Role: "user", Content: []map[string]interface{}{
+					{"type": "text", "text": "what is this?"},
+					{"type": "image_url", "image_url": map[string]string{"url": "data:image/png;base64,AAAA"}},
+					{"type": "image_url", "image_url": map[string]string{"url": "https://example.com/a.jpg"}},
+				}},
+			},
+		},
+		{
+			name:           "tool_choice auto",
+			body:           `{"model":"m","messages":[{"role":"user","content":"hi"}],"tool_choice":{"type":"auto"}}`,
+			wantMessages:   []models.Message{{Role: "user", Content: "hi"}},
+			wantToolChoice: "auto",
+		},
+		{
+			name:           "tool_choice any",
+			body:           `{"model":"m","messages":[{"role":"user","content":"hi"}],"tool_choice":{"type":"any"}}`,
+			wantMessages:   []models.Message{{Role: "user", Content: "hi"}},
+			wantToolChoice: "required",
+		},
+		{
+			name:           "tool_choice none",
+			body:           `{"model":"m","messages":[{"role":"user","content":"hi"}],"tool_choice":{"type":"none"}}`,
+			wantMessages:   []models.Message{{Role: "user", Content: "hi"}},
+			wantToolChoice: "none",
+		},
+		{
+			name:         "tool_choice tool",
+			body:         `{"model":"m","messages":[{"role":"user","content":"hi"}],"tools":[{"name":"get_weather","input_schema":{"type":"object","properties":{}}}],"tool_choice":{"type":"tool","name":"get_weather"}}`,
+			wantMessages: []models.Message{{Role: "user", Content: "hi"}},
+			wantToolChoice: map[string]interface{}{
+				"type":     "function",
+				"function": map[string]string{"name": "get_weather"},
+			},
+			check: func(t *testing.T, req models.ChatCompletionRequest) {
+				if req.Tools == nil || len(*req.Tools) != 1 || (*req.Tools)[0].Function.Name != "get_weather" {
+					t.Errorf("Tools = %v, 期望包含 get_weather", req.Tools)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var anthropicReq models.AnthropicMessagesRequest
+			if err := json.Unmarshal([]byte(tt.body), &anthropicReq); err != nil {
+				t.Fatalf("解析测试请求失败: %v", err)
+			}
+			got, err := anthropicToChatRequest(anthropicReq)
+			if err != nil {
+				t.Fatalf("anthropicToChatRequest 返回错误: %v", err)
+			}
+			if !reflect.DeepEqual(got.Messages, tt.wantMessages) {
+				gotJSON, _ := json.Marshal(got.Messages)
+				wantJSON, _ := json.Marshal(tt.wantMessages)
+				t.Errorf("Messages =\n%s\n期望\n%s", gotJSON, wantJSON)
+			}
+			if !reflect.DeepEqual(got.ToolChoice, tt.wantToolChoice) {
+				t.Errorf("ToolChoice = %#v, 期望 %#v", got.ToolChoice, tt.wantToolChoice)
+			}
+			if tt.check != nil {
+				tt.check(t, got)
+			}
+		})
+	}
+}
+
+func TestAnthropicToChatRequestRejectsInvalidContent(t *testing.T) {
+	req := models.AnthropicMessagesRequest{
+		Model:    "m",
+		Messages: []models.AnthropicMessage{{Role: "user", Content: json.RawMessage(`42`)}},
+	}
+	if _, err := anthropicToChatRequest(req); err == nil {
+		t.Fatal("期望非字符串/非数组的 content 返回错误")
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
@@ -3,16 +3,22 @@ package handlers
 
 import (
 	"bufio"                         // 用于带缓冲的读取，提高流式处理效率
-	"bytes"                         // 用于字节缓冲操作，例如创建请求体
+	"bytes"                         // 用于字节切片操作
 	"context"                       // 用于管理请求的上下文，例如超时和取消信号
 	"encoding/json"                 // 用于JSON的编码和解码
 	"fmt"                           // 用于格式化字符串和输出
 	"io"                            // 用于IO操作，如ReadAll和EOF
 	"net"                           // 用于网络相关的操作，如net.Error和Timeout检查
 	"net/http"                      // 用于HTTP客户端和服务器功能
+	"openrouter_polling/alerting"   // 项目告警通知模块
 	"openrouter_polling/apimanager" // 项目内的API密钥管理模块
+	"openrouter_polling/circuitbreaker" // 项目上游熔断器模块
 	"openrouter_polling/config"     // 项目配置模块
+	"openrouter_polling/middleware" // 项目中间件模块（客户端身份、用量记录）
+	"openrouter_polling/modelhealth" // 项目模型健康跟踪模块
 	"openrouter_polling/models"     // 项目数据模型模块
+	"openrouter_polling/retrypolicy" // 项目重试策略模块
+	"openrouter_polling/storage"    // 项目数据库存储模块
 	"openrouter_polling/utils"      // 项目工具函数模块
 	"strconv"                       // 用于字符串和数字转换 (例如，在错误响应中包含状态码)
 	"strings"                       // 用于字符串操作
@@ -21,15 +27,27 @@ import (
 
 	"github.com/gin-gonic/gin"   // Gin Web框架
 	"github.com/sirupsen/logrus" // Logrus日志库
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // 全局变量，将在 main.go 中初始化并注入依赖。
 // 这种方式简化了在 handler 函数中访问这些共享实例的过程。
 var (
-	Log          *logrus.Logger            // 全局日志记录器实例。
-	ApiKeyMgr    *apimanager.ApiKeyManager // API 密钥管理器实例。
-	HttpClient   *http.Client              // 全局 HTTP 客户端，用于向上游 OpenRouter 发出请求。应配置合理的超时和连接池。
-	AppStartTime time.Time                 // 应用程序启动时间，可用于计算运行时长等信息。
+	Log             *logrus.Logger            // 全局日志记录器实例。
+	ApiKeyMgr       *apimanager.ApiKeyManager // API 密钥管理器实例。
+	HttpClient      *http.Client              // 全局 HTTP 客户端，用于向上游 OpenRouter 发出请求。应配置合理的超时和连接池。
+	AppStartTime    time.Time                 // 应用程序启动时间，可用于计算运行时长等信息。
+	RespStore       *storage.ResponseStore    // /v1/responses 的响应存储，用于 previous_response_id 链式对话。
+	CostStore       *storage.CostStore        // 用量费用与客户端预算存储。
+	GenerationStore *storage.GenerationStore  // 上游生成统计（原生 token 数、提供商、精确费用）存储。
+	JobStore        *storage.JobStore         // 异步聊天任务存储。
+	BatchStore      *storage.BatchStore       // 批处理文件、批处理及其请求的存储。
+	Alerts          *alerting.Manager         // 告警管理器。未配置任何通知渠道时为 nil（其方法可安全地在 nil 上调用）。
+	KeyEventStore   *storage.KeyEventStore    // 密钥状态变化历史（key_events 表）。
+	ModelHealth     *modelhealth.Tracker      // 模型健康跟踪器，按模型统计错误率并判定降级。
+	UpstreamBreaker *circuitbreaker.Breaker   // 上游熔断器，上游整体故障时快速失败，避免密钥被误判失败。
+	RetryBudget     *retrypolicy.Budget       // 全局重试预算，限制窗口内重试次数相对请求数的比例。
 )
 
 // 超时常量定义，用于更精细地控制流式响应的超时。
@@ -48,12 +66,12 @@ const (
 // 它会向 OpenRouter 的模型列表 API 发出请求，获取模型信息，
 // 然后将其转换为 OpenAI 兼容的格式并返回给客户端。
 func ListModelsHandler(c *gin.Context) {
-	Log.Debug("ListModelsHandler: 收到 /v1/models 请求")
+	requestLog(c).Debug("ListModelsHandler: 收到 /v1/models 请求")
 	clientOriginalContext := c.Request.Context() // 获取客户端原始请求的上下文，用于检测客户端是否断开
 
 	// 在开始处理之前，检查客户端是否已断开连接。
 	if clientOriginalContext.Err() == context.Canceled {
-		Log.Warn("ListModelsHandler: 客户端在处理请求前已断开连接。")
+		requestLog(c).Warn("ListModelsHandler: 客户端在处理请求前已断开连接。")
 		// 不发送响应，因为客户端已不在。
 		return
 	}
@@ -66,7 +84,7 @@ func ListModelsHandler(c *gin.Context) {
 	// 创建到 OpenRouter /models 端点的 HTTP GET 请求。
 	req, err := http.NewRequestWithContext(reqCtx, "GET", config.AppSettings.OpenRouterModelsURL, nil)
 	if err != nil {
-		Log.Errorf("ListModelsHandler: 创建到 OpenRouter /models 的请求失败: %v", err)
+		requestLog(c).Errorf("ListModelsHandler: 创建到 OpenRouter /models 的请求失败: %v", err)
 		sendErrorResponse(c, http.StatusInternalServerError, "创建上游服务请求失败。", "internal_server_error", false, clientOriginalContext)
 		return
 	}
@@ -77,7 +95,7 @@ func ListModelsHandler(c *gin.Context) {
 	resp, err := HttpClient.Do(req)
 	if err != nil {
 		errMsg := fmt.Sprintf("请求 OpenRouter /models 失败: %v", err)
-		Log.Error(errMsg)
+		requestLog(c).Error(errMsg)
 		statusToSend := http.StatusBadGateway // 默认上游网关错误
 		errType := "upstream_api_error"
 		if reqCtx.Err() == context.DeadlineExceeded { // 检查是否是请求超时
@@ -85,7 +103,7 @@ func ListModelsHandler(c *gin.Context) {
 			statusToSend = http.StatusGatewayTimeout
 			errType = "upstream_timeout_error"
 		} else if clientOriginalContext.Err() == context.Canceled { // 检查客户端是否在此期间断开
-			Log.Warn("ListModelsHandler: 客户端在请求 OpenRouter /models 期间断开连接。")
+			requestLog(c).Warn("ListModelsHandler: 客户端在请求 OpenRouter /models 期间断开连接。")
 			return // 客户端断开，不再发送响应
 		}
 		sendErrorResponse(c, statusToSend, errMsg, errType, false, clientOriginalContext)
@@ -96,7 +114,7 @@ func ListModelsHandler(c *gin.Context) {
 	// 检查 OpenRouter API 的响应状态码。
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body) // 尝试读取错误响应体以获取更多信息。
-		Log.Errorf("ListModelsHandler: OpenRouter /models API 返回非 200 状态: %d. Body: %s", resp.StatusCode, string(bodyBytes))
+		requestLog(c).Errorf("ListModelsHandler: OpenRouter /models API 返回非 200 状态: %d. Body: %s", resp.StatusCode, string(bodyBytes))
 		sendErrorResponse(c, resp.StatusCode, // 将上游的状态码透传或映射
 			fmt.Sprintf("上游模型列表服务错误。状态: %d, 详情: %s", resp.StatusCode, string(bodyBytes)),
 			"upstream_api_error", false, clientOriginalContext)
@@ -106,10 +124,11 @@ func ListModelsHandler(c *gin.Context) {
 	// 解码 OpenRouter 的 JSON 响应到 models.OpenRouterModelsResponse 结构体。
 	var openRouterResp models.OpenRouterModelsResponse
 	if err := json.NewDecoder(resp.Body).Decode(&openRouterResp); err != nil {
-		Log.Errorf("ListModelsHandler: 解码 OpenRouter /models 响应失败: %v", err)
+		requestLog(c).Errorf("ListModelsHandler: 解码 OpenRouter /models 响应失败: %v", err)
 		sendErrorResponse(c, http.StatusInternalServerError, "解析上游模型列表数据失败。", "data_parsing_error", false, clientOriginalContext)
 		return
 	}
+	modelCatalog.store(openRouterResp.Data) // 顺便刷新模型目录缓存
 
 	// 将 OpenRouter 的模型数据转换为 OpenAI 兼容的格式 (models.ModelData)。
 	var resultData []models.ModelData
@@ -140,11 +159,11 @@ func ListModelsHandler(c *gin.Context) {
 		resultData = append(resultData, modelEntry)
 	}
 
-	Log.Infof("ListModelsHandler: 成功从 OpenRouter 获取并转换了 %d 个模型。", len(resultData))
+	requestLog(c).Infof("ListModelsHandler: 成功从 OpenRouter 获取并转换了 %d 个模型。", len(resultData))
 
 	// 在发送最终响应前，再次检查客户端是否已断开连接。
 	if clientOriginalContext.Err() == context.Canceled {
-		Log.Warn("ListModelsHandler: 客户端在准备好响应数据后已断开连接。")
+		requestLog(c).Warn("ListModelsHandler: 客户端在准备好响应数据后已断开连接。")
 		return
 	}
 
@@ -162,14 +181,14 @@ func ChatCompletionsHandler(c *gin.Context) {
 
 	// 请求开始前检查客户端连接状态
 	if clientOriginalContext.Err() == context.Canceled {
-		Log.Warn("ChatCompletionsHandler: 客户端在处理请求前已断开连接。")
+		requestLog(c).Warn("ChatCompletionsHandler: 客户端在处理请求前已断开连接。")
 		return
 	}
 
 	var requestData models.ChatCompletionRequest
 	// 解析请求体 JSON 到 requestData 结构体。
 	if err := c.ShouldBindJSON(&requestData); err != nil {
-		Log.Warnf("ChatCompletionsHandler: 无效的请求体: %v", err)
+		requestLog(c).Warnf("ChatCompletionsHandler: 无效的请求体: %v", err)
 		sendErrorResponse(c, http.StatusBadRequest, "请求体解析失败: "+err.Error(), "invalid_request_error", false, clientOriginalContext)
 		return
 	}
@@ -177,7 +196,7 @@ func ChatCompletionsHandler(c *gin.Context) {
 	// 如果请求中未指定模型，使用配置文件中的默认模型。
 	if requestData.Model == "" {
 		requestData.Model = config.AppSettings.DefaultModel
-		Log.Debugf("ChatCompletionsHandler: 请求未指定模型，使用默认模型: %s", requestData.Model)
+		requestLog(c).Debugf("ChatCompletionsHandler: 请求未指定模型，使用默认模型: %s", requestData.Model)
 	}
 
 	// 判断客户端是否期望流式响应。
@@ -192,7 +211,7 @@ func ChatCompletionsHandler(c *gin.Context) {
 	}
 
 	// --- 增强日志记录 ---
-	logEntry := Log.WithFields(logrus.Fields{
+	logEntry := requestLog(c).WithFields(logrus.Fields{
 		"model":      requestData.Model,
 		"streaming":  isStreamForClientResponse,
 		"user":       utils.DerefString(requestData.User, "N/A"),
@@ -213,21 +232,40 @@ func ChatCompletionsHandler(c *gin.Context) {
 	logEntry.Info("收到聊天请求")
 	// --- 日志记录结束 ---
 
-	// 如果是流式响应，设置相应的 HTTP 头部以支持 Server-Sent Events (SSE)。
-	if isStreamForClientResponse {
-		c.Writer.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
-		c.Writer.Header().Set("Cache-Control", "no-cache") // 禁止缓存
-		c.Writer.Header().Set("Connection", "keep-alive")  // 保持连接活动
-		c.Writer.Header().Set("X-Accel-Buffering", "no")   // 建议：禁用 nginx 等反向代理的缓冲
-		c.Writer.Flush()                                   // 确保头部立即发送给客户端
+	// 异步任务：立即返回任务 ID，由后台工作协程执行。
+	if asyncRequested(c) {
+		submitChatJob(c, requestData, logEntry)
+		return
 	}
 
-	// 调用核心处理逻辑函数。
-	generateChatResponse(c, requestData, isStreamForClientResponse)
+	// 被抽中（或客户端已开启）的请求记录完整的请求与响应内容，管理员可按 X-Request-ID 查询。
+	withPayloadCapture(c, capturedRequest{Body: requestData, Model: requestData.Model, Stream: isStreamForClientResponse, AssembleStream: assembleStreamResponse}, func() {
+		// 以裁剪前的请求内容作为幂等键的比对依据，保证相同请求得到相同的哈希。
+		canonicalPayload, _ := json.Marshal(requestData)
+		withIdempotency(c, canonicalPayload, isStreamForClientResponse, func() {
+			// 同时到达的相同请求（如启用）只发起一次上游调用，结果分发给所有请求。
+			withCoalescing(c, canonicalPayload, func() {
+				// 可恢复的流式请求（如启用）在客户端断开后继续缓冲上游输出。
+				withStreamResume(c, isStreamForClientResponse, func() {
+					// 按策略裁剪超出模型上下文窗口的历史消息（需在写入响应头之前完成）。
+					applyContextTrimPolicy(c, &requestData, logEntry)
+
+					// 如果是流式响应，设置相应的 HTTP 头部以支持 Server-Sent Events (SSE)。
+					if isStreamForClientResponse {
+						prepareSSEHeaders(c)
+					}
+
+					// 调用核心处理逻辑函数。
+					generateChatResponse(c, requestData, isStreamForClientResponse)
+				})
+			})
+		})
+	})
 }
 
 // generateChatResponse 是实际处理聊天请求的核心逻辑。
-// 它管理 API 密钥的选择、请求重试，并根据需要处理流式或非流式响应。
+// 它序列化请求并交由 executeUpstreamRequest 通过密钥池执行（密钥选择、重试、错误分类），
+// 上游成功响应后根据需要处理流式或非流式响应。
 // c: Gin 上下文。
 // requestData: 解析后的客户端请求数据。
 // isStreamForClientResponse: 客户端是否期望流式响应。
@@ -237,280 +275,196 @@ func generateChatResponse(c *gin.Context, requestData models.ChatCompletionReque
 	if requestData.Stream == nil || *requestData.Stream != isStreamForClientResponse {
 		val := isStreamForClientResponse // 创建一个布尔值副本
 		requestData.Stream = &val        // 将指针指向此副本
-		Log.Debugf("generateChatResponse: 修正发送给 OpenRouter 的 payload 中 stream 字段为: %t", isStreamForClientResponse)
+		requestLog(c).Debugf("generateChatResponse: 修正发送给 OpenRouter 的 payload 中 stream 字段为: %t", isStreamForClientResponse)
 	}
 
 	// 将请求数据序列化为 JSON 字节流，准备发送给 OpenRouter。
 	payloadBytes, err := json.Marshal(requestData)
 	if err != nil {
-		Log.Errorf("generateChatResponse: 序列化请求数据失败: %v", err)
+		requestLog(c).Errorf("generateChatResponse: 序列化请求数据失败: %v", err)
 		sendErrorResponse(c, http.StatusInternalServerError, "内部服务器错误：序列化请求失败。", "internal_server_error", isStreamForClientResponse, c.Request.Context())
 		return
 	}
 
-	retriesLeft := config.AppSettings.RetryWithNewKeyCount // 从配置获取初始重试次数
-	var lastExceptionDetail = "在多次尝试使用不同密钥后未能成功处理请求。"      // 默认的最终错误信息
-	var lastStatusCode = http.StatusServiceUnavailable     // 默认的最终错误状态码
-	var lastErrorType = "api_error"                        // 默认的最终错误类型
-	activeRequestKeysTried := make(map[string]bool)        // 记录在本次 `generateChatResponse` 调用中已尝试过的密钥，避免对同一客户端请求用同一坏密钥反复重试。
-	clientOriginalContext := c.Request.Context()           // 客户端原始请求的上下文
+	executeUpstreamRequest(c, upstreamRequest{
+		URL:      config.AppSettings.OpenRouterAPIURL,
+		Payload:  payloadBytes,
+		IsStream: isStreamForClientResponse,
+		HandleOK: chatCompletionResponseHandler(isStreamForClientResponse),
+	})
+}
 
-	// 主重试循环：只要还有重试次数，就继续尝试。
-	for retriesLeft >= 0 {
-		// 在每次尝试前检查客户端是否已断开连接。
-		if clientOriginalContext.Err() == context.Canceled {
-			Log.Warnf("generateChatResponse: 客户端在尝试获取新密钥前已断开连接 (重试循环 %d)。请求终止。", config.AppSettings.RetryWithNewKeyCount-retriesLeft)
-			return // 客户端已断开，无需继续。
+// chatCompletionResponseHandler 返回处理聊天补全 200 OK 响应的 upstreamOKHandler。
+func chatCompletionResponseHandler(isStreamForClientResponse bool) upstreamOKHandler {
+	return func(attemptCtx context.Context, c *gin.Context, resp *http.Response, apiKeyStatus *apimanager.ApiKeyStatus, clientOriginalContext context.Context) (bool, bool, int, string, string) {
+		if !isStreamForClientResponse {
+			return relayNonStreamingResponse(c, resp, apiKeyStatus, clientOriginalContext, logChatCompletionToolCalls)
 		}
+		return relayStreamingResponse(attemptCtx, c, resp, apiKeyStatus, clientOriginalContext, inspectChatCompletionChunk, streamSinkFor(c))
+	}
+}
 
-		// 从 ApiKeyManager 获取下一个可用的 API 密钥。
-		currentAPIKeyStatus := ApiKeyMgr.GetNextAPIKey()
-		if currentAPIKeyStatus == nil {
-			Log.Error("generateChatResponse: 管理器没有可用的 API 密钥用于新的尝试。")
-			lastExceptionDetail = "所有 API 密钥当前都不可用或处于冷却中。"
-			lastStatusCode = http.StatusServiceUnavailable
-			lastErrorType = "no_available_keys_error"
-			break // 没有可用密钥，跳出重试循环。
-		}
-		currentOpenRouterKey := currentAPIKeyStatus.Key // 获取密钥字符串
-
-		// 如果当前轮到的密钥已在此请求中尝试过，并且还有其他未尝试的密钥，则尝试获取一个不同的新密钥。
-		// 这可以避免在一次用户请求中因密钥选择策略（如轮询）而重复使用一个已知对此请求无效的密钥。
-		if _, tried := activeRequestKeysTried[currentOpenRouterKey]; tried && len(activeRequestKeysTried) < ApiKeyMgr.GetTotalKeysCount() {
-			Log.Debugf("generateChatResponse: 密钥 %s 在此请求中已尝试过，尝试获取下一个不同的密钥。", utils.SafeSuffix(currentOpenRouterKey))
-			foundNewUntriedKey := false
-			for i := 0; i < ApiKeyMgr.GetTotalKeysCount(); i++ { // 最多轮询所有密钥一次以查找新密钥
-				nextKeyStatusCandidate := ApiKeyMgr.GetNextAPIKey() // 获取下一个（可能还是同一个，如果只有一个可用）
-				if nextKeyStatusCandidate == nil {                  // 不太可能发生，但作为保护
-					break
-				}
-				if _, alreadyTried := activeRequestKeysTried[nextKeyStatusCandidate.Key]; !alreadyTried {
-					currentAPIKeyStatus = nextKeyStatusCandidate // 找到新的未尝试密钥
-					currentOpenRouterKey = currentAPIKeyStatus.Key
-					foundNewUntriedKey = true
-					Log.Debugf("generateChatResponse: 切换到新的未尝试密钥 %s 用于本次请求。", utils.SafeSuffix(currentOpenRouterKey))
-					break
-				}
-			}
-			if !foundNewUntriedKey {
-				Log.Warnf("generateChatResponse: 无法为此请求找到新的、未尝试过的可用密钥。当前已尝试 %d 个。将继续使用轮到的密钥 %s。", len(activeRequestKeysTried), utils.SafeSuffix(currentOpenRouterKey))
-			}
-		}
-		activeRequestKeysTried[currentOpenRouterKey] = true // 标记此密钥已被用于当前 `generateChatResponse` 调用。
-
-		// 为本次向上游 API 的尝试创建一个带超时的上下文。
-		// 此超时基于全局配置 `config.AppSettings.RequestTimeout`。
-		attemptCtx, cancelAttemptCtx := context.WithTimeout(clientOriginalContext, config.AppSettings.RequestTimeout)
-
-		Log.Infof("generateChatResponse: 尝试使用密钥 %s 向 OpenRouter 发起请求 (URL: %s, 剩余重试次数: %d)",
-			utils.SafeSuffix(currentOpenRouterKey), config.AppSettings.OpenRouterAPIURL, retriesLeft)
-
-		// 调用封装的单次请求尝试逻辑。
-		// attemptOpenRouterRequest 返回:
-		//   success (bool): 本次尝试是否成功并将响应完整发送给客户端。
-		//   retryNeeded (bool): 如果失败，是否应该用新密钥重试当前客户端请求。
-		//   statusCodeForError (int): 如果失败，记录的HTTP状态码。
-		//   errorDetailForError (string): 如果失败，记录的错误详情。
-		//   errorTypeForError (string): 如果失败，记录的错误类型。
-		success, retryNeeded, statusCode, errDetail, errType := attemptOpenRouterRequest(
-			attemptCtx, c, currentAPIKeyStatus, payloadBytes, isStreamForClientResponse,
-			clientOriginalContext,
-		)
-
-		cancelAttemptCtx() // 单次尝试结束（无论成功失败），取消其上下文以释放资源。
-
-		if success {
-			Log.Infof("generateChatResponse: 请求使用密钥 %s 成功处理并完成。", utils.SafeSuffix(currentOpenRouterKey))
-			return // 请求成功处理，整个 generateChatResponse 结束。
-		}
+// relayNonStreamingResponse 读取上游的非流式 200 响应并原样透传给客户端。
+// inspect: 可选的响应体检查函数（仅用于日志增强，不影响主流程）。
+func relayNonStreamingResponse(
+	c *gin.Context,
+	resp *http.Response,
+	apiKeyStatus *apimanager.ApiKeyStatus,
+	clientOriginalContext context.Context,
+	inspect func(bodyBytes []byte, logEntry *logrus.Entry),
+) (success bool, retryNeeded bool, statusCodeForError int, errorDetail string, errorType string) {
+	currentOpenRouterKey := apiKeyStatus.Key
 
-		// 如果尝试失败：
-		lastStatusCode = statusCode
-		lastExceptionDetail = errDetail
-		lastErrorType = errType
+	bodyBytes, readErr := io.ReadAll(resp.Body)
+	if readErr != nil {
+		requestLog(c).Errorf("relayNonStreamingResponse: 读取 OpenRouter 非流式响应体失败: %v (密钥: %s)", readErr, utils.SafeSuffix(currentOpenRouterKey))
+		// 这种错误通常是服务端问题或网络中断。
+		// 不立即标记密钥失败，但也不认为此次请求成功。让上层决定是否用新key重试。
+		return false, true, http.StatusInternalServerError, "读取上游非流式响应失败。", "response_read_error"
+	}
 
-		if !retryNeeded { // 如果错误类型指示不应重试 (例如400 Bad Request非密钥问题，或流已部分发送后中断)
-			Log.Warnf("generateChatResponse: 发生不可重试的错误 (密钥 %s, 状态码 %d: %s)。终止对此客户端请求的重试。", utils.SafeSuffix(currentOpenRouterKey), statusCode, errDetail)
-			break // 退出主重试循环。最终错误将在循环后发送。
-		}
+	// 在发送响应前，检查客户端是否已断开。
+	if clientOriginalContext.Err() == context.Canceled {
+		requestLog(c).Warnf("relayNonStreamingResponse: 成功获取非流式响应，但客户端已断开 (密钥: %s)。", utils.SafeSuffix(currentOpenRouterKey))
+		// 即使客户端断开，也认为对 OpenRouter 的调用是成功的，记录密钥成功。
+		ApiKeyMgr.RecordKeySuccess(currentOpenRouterKey)
+		return true, false, http.StatusOK, "", "" // 标记为成功获取，不需重试（因为客户端没了）。
+	}
 
-		// 如果需要重试：
-		// ApiKeyMgr.MarkKeyFailure(currentOpenRouterKey) // MarkKeyFailure 已在 attemptOpenRouterRequest 中根据情况调用
-		retriesLeft--
-		if retriesLeft < 0 { // 所有重试已用尽
-			Log.Errorf("generateChatResponse: 所有重试已用尽。最后失败于密钥 %s。最终错误: %s (状态码 %d)", utils.SafeSuffix(currentOpenRouterKey), lastExceptionDetail, lastStatusCode)
-			break // 退出主重试循环。最终错误将在循环后发送。
-		}
+	if inspect != nil {
+		inspect(bodyBytes, requestLog(c).WithField("key_suffix", utils.SafeSuffix(currentOpenRouterKey)))
+	}
+	recordUpstreamUsage(c, bodyBytes)
+	recordUpstreamGenerationID(c, bodyBytes)
+	annotateGenAIResponse(trace.SpanFromContext(resp.Request.Context()), bodyBytes)
 
-		Log.Infof("generateChatResponse: 由于错误/超时 (密钥 %s)，将使用新密钥重试 (还剩 %d 次)。错误: %s", utils.SafeSuffix(currentOpenRouterKey), retriesLeft, lastExceptionDetail)
-		// 可选：在重试前稍作等待，以避免快速耗尽所有密钥或对上游服务造成冲击。
-		time.Sleep(250 * time.Millisecond) // 例如，等待250毫秒。
-	} // 结束主重试循环
+	// 将响应体直接透传给客户端。
+	c.Data(http.StatusOK, resp.Header.Get("Content-Type"), bodyBytes) // 使用上游的 Content-Type
+	requestLog(c).Infof("relayNonStreamingResponse: 成功发送非流式响应 (密钥: %s, 大小: %d bytes)。", utils.SafeSuffix(currentOpenRouterKey), len(bodyBytes))
+	ApiKeyMgr.RecordKeySuccess(currentOpenRouterKey) // 记录密钥成功
+	return true, false, http.StatusOK, "", ""        // 成功处理，无需重试。
+}
 
-	// 如果循环结束（所有重试用尽或因不可重试错误跳出），并且客户端未断开连接，则发送最终错误响应。
-	if clientOriginalContext.Err() != context.Canceled {
-		Log.Errorf("generateChatResponse: 请求最终失败。最后错误: %s (状态码: %d, 类型: %s)", lastExceptionDetail, lastStatusCode, lastErrorType)
-		sendErrorResponse(c, lastStatusCode, lastExceptionDetail, lastErrorType, isStreamForClientResponse, clientOriginalContext)
-	} else {
-		Log.Warnf("generateChatResponse: 请求最终失败，但客户端已断开。不发送最终错误。最后错误: %s (状态码: %d)", lastExceptionDetail, lastStatusCode)
+// recordUpstreamUsage 从上游响应体（或流式数据块）中提取 usage 字段，并记录到请求上下文中供限流等中间件使用。
+func recordUpstreamUsage(c *gin.Context, body []byte) {
+	if !bytes.Contains(body, []byte(`"usage"`)) {
+		return
+	}
+	var withUsage struct {
+		Usage *models.Usage `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &withUsage); err == nil && withUsage.Usage != nil {
+		middleware.RecordUsage(c, withUsage.Usage)
 	}
 }
 
-// attemptOpenRouterRequest 封装了向 OpenRouter 发起单次 API 请求并处理其响应的逻辑。
-// attemptCtx: 本次特定尝试的上下文 (带超时)。
-// c: Gin 上下文，用于向客户端发送响应。
-// apiKeyStatus: 当前尝试使用的 ApiKeyStatus 对象。
-// payloadBytes: 已序列化为 JSON 的请求体。
-// isStreamForClientResponse: 客户端是否期望流式响应。
-// clientOriginalContext: 客户端原始请求的上下文，用于检测客户端是否已断开。
-// 返回:
-//
-//	success (bool): 本次尝试是否成功并将响应完整或部分（对于流）发送给了客户端。
-//	retryNeeded (bool): 如果失败或部分成功后中断，是否指示上层逻辑用新密钥重试。
-//	statusCodeForError (int): 如果发生错误，相关的 HTTP 状态码。
-//	errorDetail (string): 如果发生错误，错误详情。
-//	errorType (string): 如果发生错误，错误类型。
-func attemptOpenRouterRequest(
+// relayStreamingResponse 将上游的 SSE 流转发给客户端，并在结束时汇总日志。
+// inspectChunk: 用于判断单个 data 块是否包含有意义内容的检查函数（各端点的块格式不同）。
+// sink: 输出端，透传时使用 passthroughSink，协议转换时使用相应的转换器。
+func relayStreamingResponse(
 	attemptCtx context.Context,
 	c *gin.Context,
+	resp *http.Response,
 	apiKeyStatus *apimanager.ApiKeyStatus,
-	payloadBytes []byte,
-	isStreamForClientResponse bool,
 	clientOriginalContext context.Context,
+	inspectChunk sseChunkInspector,
+	sink streamSink,
 ) (success bool, retryNeeded bool, statusCodeForError int, errorDetail string, errorType string) {
-	currentOpenRouterKey := apiKeyStatus.Key // 获取密钥字符串
+	currentOpenRouterKey := apiKeyStatus.Key
 
-	// 创建到 OpenRouter 的 POST 请求。
-	req, err := http.NewRequestWithContext(attemptCtx, "POST", config.AppSettings.OpenRouterAPIURL, bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		Log.Errorf("attemptOpenRouterRequest: 创建到 OpenRouter 的请求失败: %v (密钥: %s)", err, utils.SafeSuffix(currentOpenRouterKey))
-		// 这种错误通常是内部问题，不一定与密钥有关，但为了安全，可以视为可重试。
-		return false, true, http.StatusInternalServerError, "创建上游 API 请求失败。", "internal_server_error"
-	}
+	requestLog(c).Infof("relayStreamingResponse: 开始从 OpenRouter 流式传输数据 (密钥: %s)", utils.SafeSuffix(currentOpenRouterKey))
+	// processStreamingResponse 会处理流的读取、超时、错误，并将数据转发给客户端。
+	// 它也会在适当的时候调用 ApiKeyMgr.RecordKeySuccess 或决定是否需要重试。
+	streamSuccess, streamRetryNeeded, streamErrStatusCode, streamErrDetail, streamErrType := processStreamingResponse(
+		attemptCtx, c, resp, apiKeyStatus, clientOriginalContext, inspectChunk, sink,
+	)
 
-	// 设置必要的 HTTP 请求头。
-	req.Header.Set("Authorization", "Bearer "+currentOpenRouterKey)
-	req.Header.Set("Content-Type", "application/json")
-	if config.AppSettings.HTTPReferer != "" {
-		req.Header.Set("HTTP-Referer", config.AppSettings.HTTPReferer)
+	if !streamSuccess { // 如果流处理不完全成功
+		// streamRetryNeeded 会告诉我们是否应该由上层用新密钥重试
+		// streamErrStatusCode, streamErrDetail, streamErrType 提供了失败信息
+		requestLog(c).Warnf("relayStreamingResponse: 流处理未完全成功 (密钥 %s): %s. 重试需求: %t", utils.SafeSuffix(currentOpenRouterKey), streamErrDetail, streamRetryNeeded)
+		// MarkKeyFailure 通常已在 processStreamingResponse 中处理
+		return false, streamRetryNeeded, streamErrStatusCode, streamErrDetail, streamErrType
 	}
-	if config.AppSettings.XTitle != "" {
-		req.Header.Set("X-Title", config.AppSettings.XTitle)
+
+	// 流处理成功完成（可能包括客户端中途断开，此时 streamSuccess 仍为 true，但 retryNeeded 为 false）
+	if clientOriginalContext.Err() == context.Canceled {
+		requestLog(c).Warnf("relayStreamingResponse: 流处理完成/中止，因客户端已断开 (密钥 %s)。", utils.SafeSuffix(currentOpenRouterKey))
+	} else {
+		requestLog(c).Infof("relayStreamingResponse: 流式响应处理完成 (密钥 %s)。", utils.SafeSuffix(currentOpenRouterKey))
 	}
-	// 可以添加其他自定义头部，例如追踪ID等。
+	// ApiKeyMgr.RecordKeySuccess(currentOpenRouterKey) 已在 processStreamingResponse 内部成功时调用
+	return true, false, http.StatusOK, "", "" // 流处理完成或因不可重试原因结束。
+}
 
-	// 使用全局 HttpClient 执行 HTTP 请求。
-	resp, err := HttpClient.Do(req)
-	if err != nil {
-		// 处理 HttpClient.Do 返回的错误 (例如网络错误、上下文超时/取消等)。
-		errMsg := fmt.Sprintf("请求 OpenRouter 时出错 (密钥: %s): %v", utils.SafeSuffix(currentOpenRouterKey), err)
-		Log.Error(errMsg) // 记录详细错误
-
-		// 根据错误类型决定是否重试和返回的状态码/信息。
-		if attemptCtx.Err() == context.DeadlineExceeded { // 单次尝试超时
-			ApiKeyMgr.MarkKeyFailure(currentOpenRouterKey) // 超时通常与密钥或其承载的服务有关，标记失败。
-			return false, true, http.StatusGatewayTimeout, fmt.Sprintf("请求上游 API 超时 (密钥: %s)。", utils.SafeSuffix(currentOpenRouterKey)), "upstream_timeout_error"
-		}
-		if attemptCtx.Err() == context.Canceled {
-			if clientOriginalContext.Err() == context.Canceled { // 检查是否是原始客户端请求取消导致的
-				Log.Warnf("attemptOpenRouterRequest: 客户端上下文在请求 OpenRouter 期间被取消 (密钥: %s). 客户端可能已断开。终止。", utils.SafeSuffix(currentOpenRouterKey))
-				return false, false, http.StatusServiceUnavailable, "客户端已断开连接。", "client_disconnected_error" // 不重试，因为客户端已离开。
-			}
-			// 可能是内部超时或其他原因导致的 attemptCtx 取消。
-			ApiKeyMgr.MarkKeyFailure(currentOpenRouterKey) // 假设与密钥相关
-			return false, true, http.StatusServiceUnavailable, fmt.Sprintf("上游 API 请求被内部取消 (密钥: %s)。", utils.SafeSuffix(currentOpenRouterKey)), "request_canceled_error"
+// logChatCompletionToolCalls 检查非流式聊天响应中是否包含 tool_calls，并记录增强日志。
+func logChatCompletionToolCalls(bodyBytes []byte, logEntry *logrus.Entry) {
+	var tempResponse struct {
+		Choices []struct {
+			Message struct {
+				ToolCalls *[]models.ToolCall `json:"tool_calls"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	// 尝试解析，即使失败也不影响主流程
+	if err := json.Unmarshal(bodyBytes, &tempResponse); err == nil {
+		if len(tempResponse.Choices) > 0 && tempResponse.Choices[0].Message.ToolCalls != nil && len(*tempResponse.Choices[0].Message.ToolCalls) > 0 {
+			logEntry.WithField("tool_calls", len(*tempResponse.Choices[0].Message.ToolCalls)).Info("非流式响应包含工具调用。")
 		}
-		// 其他网络错误 (例如 DNS 解析失败、连接被拒绝等)。
-		ApiKeyMgr.MarkKeyFailure(currentOpenRouterKey) // 标记失败，因为无法连接到服务。
-		return false, true, http.StatusBadGateway, fmt.Sprintf("上游 API 网络错误 (密钥: %s): %v", utils.SafeSuffix(currentOpenRouterKey), err), "network_error"
 	}
-	defer resp.Body.Close() // 确保响应体在函数结束时关闭。
-
-	// --- 处理 OpenRouter 的响应 ---
-	if resp.StatusCode == http.StatusOK { // HTTP 200 OK
-		// 至少 API 调用是通的，并且服务器返回了成功状态。
-		// 对于流式响应，成功与否还取决于流是否正确完成。
-		// 对于非流式，200 OK 基本意味着成功。
-		// ApiKeyMgr.RecordKeySuccess(currentOpenRouterKey) // RecordKeySuccess 在流/非流成功后或错误处理中更精确地调用
-
-		if !isStreamForClientResponse {
-			// --- 处理非流式响应 ---
-			bodyBytes, readErr := io.ReadAll(resp.Body)
-			if readErr != nil {
-				Log.Errorf("attemptOpenRouterRequest: 读取 OpenRouter 非流式响应体失败: %v (密钥: %s)", readErr, utils.SafeSuffix(currentOpenRouterKey))
-				// 这种错误通常是服务端问题或网络中断。
-				// 不立即标记密钥失败，但也不认为此次请求成功。让上层决定是否用新key重试。
-				return false, true, http.StatusInternalServerError, "读取上游非流式响应失败。", "response_read_error"
-			}
-
-			// 在发送响应前，检查客户端是否已断开。
-			if clientOriginalContext.Err() == context.Canceled {
-				Log.Warnf("attemptOpenRouterRequest: 成功获取非流式响应，但客户端已断开 (密钥: %s)。", utils.SafeSuffix(currentOpenRouterKey))
-				// 即使客户端断开，也认为对 OpenRouter 的调用是成功的，记录密钥成功。
-				ApiKeyMgr.RecordKeySuccess(currentOpenRouterKey)
-				return true, false, http.StatusOK, "", "" // 标记为成功获取，不需重试（因为客户端没了）。
-			}
+}
 
-			// --- 增强日志：检查非流式响应中是否包含 tool_calls ---
-			var tempResponse struct {
-				Choices []struct {
-					Message struct {
-						ToolCalls *[]models.ToolCall `json:"tool_calls"`
-					} `json:"message"`
-				} `json:"choices"`
-			}
-			// 尝试解析，即使失败也不影响主流程
-			if err := json.Unmarshal(bodyBytes, &tempResponse); err == nil {
-				if len(tempResponse.Choices) > 0 && tempResponse.Choices[0].Message.ToolCalls != nil && len(*tempResponse.Choices[0].Message.ToolCalls) > 0 {
-					Log.WithFields(logrus.Fields{
-						"key_suffix":  utils.SafeSuffix(currentOpenRouterKey),
-						"tool_calls":  len(*tempResponse.Choices[0].Message.ToolCalls),
-					}).Info("非流式响应包含工具调用。")
-				}
-			}
-			// --- 日志增强结束 ---
+// streamSink 接收从上游读取的原始 SSE 行（含换行符），并负责将其原样或转换格式后写给客户端。
+// 返回错误表示客户端写入失败（通常意味着客户端已断开）。
+type streamSink interface {
+	WriteLine(line string) error
+}
 
-			// 将响应体直接透传给客户端。
-			c.Data(http.StatusOK, resp.Header.Get("Content-Type"), bodyBytes) // 使用上游的 Content-Type
-			Log.Infof("attemptOpenRouterRequest: 成功发送非流式响应 (密钥: %s, 大小: %d bytes)。", utils.SafeSuffix(currentOpenRouterKey), len(bodyBytes))
-			ApiKeyMgr.RecordKeySuccess(currentOpenRouterKey) // 记录密钥成功
-			return true, false, http.StatusOK, "", ""        // 成功处理，无需重试。
-		}
+// passthroughSink 将上游 SSE 行原样转发给客户端，并在每次写入后刷新缓冲区。
+type passthroughSink struct {
+	c *gin.Context
+}
 
-		// --- 处理流式响应 ---
-		Log.Infof("attemptOpenRouterRequest: 开始从 OpenRouter 流式传输数据 (密钥: %s)", utils.SafeSuffix(currentOpenRouterKey))
-		// processStreamingResponse 会处理流的读取、超时、错误，并将数据转发给客户端。
-		// 它也会在适当的时候调用 ApiKeyMgr.RecordKeySuccess 或决定是否需要重试。
-		streamSuccess, streamRetryNeeded, streamErrStatusCode, streamErrDetail, streamErrType := processStreamingResponse(
-			attemptCtx, c, resp, apiKeyStatus, clientOriginalContext,
-		)
-
-		if !streamSuccess { // 如果流处理不完全成功
-			// streamRetryNeeded 会告诉我们是否应该由上层用新密钥重试
-			// streamErrStatusCode, streamErrDetail, streamErrType 提供了失败信息
-			Log.Warnf("attemptOpenRouterRequest: 流处理未完全成功 (密钥 %s): %s. 重试需求: %t", utils.SafeSuffix(currentOpenRouterKey), streamErrDetail, streamRetryNeeded)
-			// MarkKeyFailure 通常已在 processStreamingResponse 中处理
-			return false, streamRetryNeeded, streamErrStatusCode, streamErrDetail, streamErrType
-		}
+// WriteLine 实现 streamSink。
+func (s passthroughSink) WriteLine(line string) error {
+	if _, err := s.c.Writer.WriteString(line); err != nil {
+		return err
+	}
+	// 如果写入成功，并且 Writer 支持 http.Flusher 接口，则刷新缓冲区。
+	if flusher, ok := s.c.Writer.(http.Flusher); ok {
+		flusher.Flush() // 确保数据立即发送给客户端。
+	}
+	return nil
+}
 
-		// 流处理成功完成（可能包括客户端中途断开，此时 streamSuccess 仍为 true，但 retryNeeded 为 false）
-		if clientOriginalContext.Err() == context.Canceled {
-			Log.Warnf("attemptOpenRouterRequest: 流处理完成/中止，因客户端已断开 (密钥 %s)。", utils.SafeSuffix(currentOpenRouterKey))
-		} else {
-			Log.Infof("attemptOpenRouterRequest: 流式响应处理完成 (密钥 %s)。", utils.SafeSuffix(currentOpenRouterKey))
-		}
-		// ApiKeyMgr.RecordKeySuccess(currentOpenRouterKey) 已在 processStreamingResponse 内部成功时调用
-		return true, false, http.StatusOK, "", "" // 流处理完成或因不可重试原因结束。
+// sseChunkInspector 检查单个 SSE data 负载（已去掉 "data: " 前缀）是否包含有意义的生成内容。
+// logEntry 携带请求 ID、生成 ID 和密钥后缀；返回的 error 非 nil 表示负载无法按预期格式解析。
+type sseChunkInspector func(dataContent string, logEntry *logrus.Entry) (meaningful bool, err error)
 
-	} else {
-		// --- OpenRouter 返回非 200 OK 状态码 ---
-		// 调用 handleOpenRouterErrorResponse 处理错误，它会决定是否标记密钥失败和是否需要重试。
-		_, shouldRetry, errCode, errStr, errTypeStr := handleOpenRouterErrorResponse(resp, currentOpenRouterKey, clientOriginalContext)
-		if shouldRetry { // 如果错误类型指示密钥可能有问题
-			ApiKeyMgr.MarkKeyFailure(currentOpenRouterKey)
-		}
-		return false, shouldRetry, errCode, errStr, errTypeStr
+// inspectChatCompletionChunk 是聊天补全流的 sseChunkInspector：非空 delta.content 或 delta.tool_calls 视为有意义。
+func inspectChatCompletionChunk(dataContent string, logEntry *logrus.Entry) (bool, error) {
+	var chunk models.ChatCompletionChunk
+	if err := json.Unmarshal([]byte(dataContent), &chunk); err != nil {
+		return false, err
 	}
+	if len(chunk.Choices) == 0 {
+		logEntry.Debugf("processStreamingResponse: 收到数据块，但内容为空或非聊天内容: %q", dataContent)
+		return false, nil
+	}
+	// 检查并记录 finish_reason
+	if chunk.Choices[0].FinishReason != nil && *chunk.Choices[0].FinishReason == "tool_calls" {
+		logEntry.WithField("reason", "tool_calls").Info("流式响应因工具调用而结束。")
+	}
+	if chunk.Choices[0].Delta.Content != nil && *chunk.Choices[0].Delta.Content != "" {
+		logEntry.Infof("processStreamingResponse: 收到首块有意义聊天数据: %q", *chunk.Choices[0].Delta.Content)
+		return true, nil
+	}
+	if chunk.Choices[0].Delta.ToolCalls != nil {
+		// 如果首个有意义的数据是 tool_calls 而不是 content
+		logEntry.Info("processStreamingResponse: 收到首块有意义工具调用数据")
+		return true, nil
+	}
+	return false, nil
 }
 
 // processStreamingResponse 负责处理来自 OpenRouter 的流式响应。
@@ -520,6 +474,8 @@ func attemptOpenRouterRequest(
 // resp: 来自 OpenRouter 的 HTTP 响应对象。
 // apiKeyStatus: 当前使用的 ApiKeyStatus 对象。
 // clientOriginalContext: 客户端原始请求的上下文，用于检测客户端是否已断开。
+// inspectChunk: 判断 data 块是否包含有意义内容的检查函数。
+// sink: 接收上游 SSE 行并写给客户端的输出端。
 // 返回:
 //
 //	streamSuccess (bool): 流是否被认为是成功处理（可能部分成功后客户端断开）。
@@ -533,8 +489,12 @@ func processStreamingResponse(
 	resp *http.Response,
 	apiKeyStatus *apimanager.ApiKeyStatus,
 	clientOriginalContext context.Context,
+	inspectChunk sseChunkInspector,
+	sink streamSink,
 ) (streamSuccess bool, streamRetryNeeded bool, statusCodeForError int, errorDetail string, errorType string) {
 	currentOpenRouterKey := apiKeyStatus.Key
+	logEntry := requestLog(c)            // 收到上游生成 ID 后补充 generation_id 字段。
+	span := trace.SpanFromContext(attemptCtx)
 	reader := bufio.NewReader(resp.Body) // 带缓冲的读取器，提高效率。
 	processedDone := false               // 标记是否已处理过 SSE 的 "[DONE]" 信号。
 	var firstChunkReceivedTime time.Time // 记录收到第一个任何类型数据块的时间。
@@ -555,9 +515,9 @@ func processStreamingResponse(
 	var connWithDeadline interface{ SetReadDeadline(time.Time) error }
 	if cw, ok := resp.Body.(interface{ SetReadDeadline(time.Time) error }); ok {
 		connWithDeadline = cw
-		Log.Debugf("processStreamingResponse: 响应体支持 SetReadDeadline (密钥: %s)", utils.SafeSuffix(currentOpenRouterKey))
+		logEntry.Debugf("processStreamingResponse: 响应体支持 SetReadDeadline (密钥: %s)", utils.SafeSuffix(currentOpenRouterKey))
 	} else {
-		Log.Debugf("processStreamingResponse: 响应体不支持 SetReadDeadline (密钥: %s)，将依赖外部 Timer 进行超时控制。", utils.SafeSuffix(currentOpenRouterKey))
+		logEntry.Debugf("processStreamingResponse: 响应体不支持 SetReadDeadline (密钥: %s)，将依赖外部 Timer 进行超时控制。", utils.SafeSuffix(currentOpenRouterKey))
 	}
 
 	// setReadDeadline 辅助函数：如果支持，则设置响应体的读取截止时间。
@@ -565,7 +525,7 @@ func processStreamingResponse(
 		if connWithDeadline != nil {
 			deadline := time.Now().Add(duration)
 			if err := connWithDeadline.SetReadDeadline(deadline); err != nil {
-				Log.Warnf("processStreamingResponse: 无法为流式响应设置读取截止时间: %v (密钥: %s)", err, utils.SafeSuffix(currentOpenRouterKey))
+				logEntry.Warnf("processStreamingResponse: 无法为流式响应设置读取截止时间: %v (密钥: %s)", err, utils.SafeSuffix(currentOpenRouterKey))
 			}
 		}
 	}
@@ -573,7 +533,7 @@ func processStreamingResponse(
 	clearReadDeadlineWrapper := func() {
 		if connWithDeadline != nil {
 			if err := connWithDeadline.SetReadDeadline(time.Time{}); err != nil { // 传入零值时间以清除截止。
-				// Log.Warnf("processStreamingResponse: 清除读取截止时间失败: %v", err) // 通常不关键
+				// logEntry.Warnf("processStreamingResponse: 清除读取截止时间失败: %v", err) // 通常不关键
 			}
 		}
 	}
@@ -585,17 +545,16 @@ func processStreamingResponse(
 		// 优先检查外部上下文取消和计时器超时事件。
 		select {
 		case <-attemptCtx.Done(): // 整体API调用尝试的上下文被取消 (可能是总超时或上层逻辑取消)。
-			Log.Warnf("processStreamingResponse: 流式读取时，尝试上下文被取消 (密钥 %s): %v", utils.SafeSuffix(currentOpenRouterKey), attemptCtx.Err())
+			logEntry.Warnf("processStreamingResponse: 流式读取时，尝试上下文被取消 (密钥 %s): %v", utils.SafeSuffix(currentOpenRouterKey), attemptCtx.Err())
 			clearReadDeadlineWrapper()
 			if clientOriginalContext.Err() == context.Canceled {
 				return true, false, http.StatusServiceUnavailable, "客户端已断开连接。", "client_disconnected_error" // 客户端取消，不重试，但流可能已部分成功。
 			}
 			// 可能是总请求超时，这种情况下我们认为密钥可能存在问题或响应过慢。
-			ApiKeyMgr.MarkKeyFailure(currentOpenRouterKey)
-			return false, true, http.StatusGatewayTimeout, fmt.Sprintf("上游流为密钥 %s 中断或超时。", utils.SafeSuffix(currentOpenRouterKey)), "upstream_timeout_error"
+			return failKeyForRetry(c, currentOpenRouterKey, http.StatusGatewayTimeout, fmt.Sprintf("上游流为密钥 %s 中断或超时。", utils.SafeSuffix(currentOpenRouterKey)), "upstream_timeout_error")
 
 		case <-clientOriginalContext.Done(): // 客户端原始请求的上下文被取消 (客户端主动断开)。
-			Log.Warnf("processStreamingResponse: 客户端在流式传输期间断开 (select检查) (密钥: %s)。", utils.SafeSuffix(currentOpenRouterKey))
+			logEntry.Warnf("processStreamingResponse: 客户端在流式传输期间断开 (select检查) (密钥: %s)。", utils.SafeSuffix(currentOpenRouterKey))
 			clearReadDeadlineWrapper()
 			// 即使客户端断开，也认为对 OpenRouter 的部分调用（如果已开始）是成功的。
 			// 如果在收到任何有意义数据前断开，则密钥状态不更新。
@@ -604,19 +563,17 @@ func processStreamingResponse(
 
 		case <-firstAnyDataTimer.C: // 等待第一块任何数据的计时器超时。
 			if firstChunkReceivedTime.IsZero() { // 确认是 firstAnyDataTimer 触发且确实未收到任何数据。
-				Log.Warnf("processStreamingResponse: 等待首块任何数据超时 (>%v)，密钥: %s. 标记失败并重试。", firstChunkTimeoutDuration, utils.SafeSuffix(currentOpenRouterKey))
+				logEntry.Warnf("processStreamingResponse: 等待首块任何数据超时 (>%v)，密钥: %s. 标记失败并重试。", firstChunkTimeoutDuration, utils.SafeSuffix(currentOpenRouterKey))
 				clearReadDeadlineWrapper()
-				ApiKeyMgr.MarkKeyFailure(currentOpenRouterKey)
-				return false, true, http.StatusGatewayTimeout, fmt.Sprintf("等待密钥 %s 初始任何数据超时。", utils.SafeSuffix(currentOpenRouterKey)), "initial_data_timeout_error"
+				return failKeyForRetry(c, currentOpenRouterKey, http.StatusGatewayTimeout, fmt.Sprintf("等待密钥 %s 初始任何数据超时。", utils.SafeSuffix(currentOpenRouterKey)), "initial_data_timeout_error")
 			}
 			// 如果已收到数据 (firstChunkReceivedTime 非零)，则此超时无效，继续。
 
 		case <-meaningfulDataTimerChan: // 等待有意义数据的计时器超时 (通过channel异步传递)。
 			if atomic.LoadInt32(&receivedMeaningfulData) == 0 { // 检查是否仍未收到有意义数据。
-				Log.Warnf("processStreamingResponse: 等待有意义聊天数据超时 (>%v)，密钥: %s. 标记失败并重试。", meaningfulDataTimeoutDuration, utils.SafeSuffix(currentOpenRouterKey))
+				logEntry.Warnf("processStreamingResponse: 等待有意义聊天数据超时 (>%v)，密钥: %s. 标记失败并重试。", meaningfulDataTimeoutDuration, utils.SafeSuffix(currentOpenRouterKey))
 				clearReadDeadlineWrapper()
-				ApiKeyMgr.MarkKeyFailure(currentOpenRouterKey)
-				return false, true, http.StatusGatewayTimeout, fmt.Sprintf("等待密钥 %s 有意义聊天数据超时。", utils.SafeSuffix(currentOpenRouterKey)), "meaningful_data_timeout_error"
+				return failKeyForRetry(c, currentOpenRouterKey, http.StatusGatewayTimeout, fmt.Sprintf("等待密钥 %s 有意义聊天数据超时。", utils.SafeSuffix(currentOpenRouterKey)), "meaningful_data_timeout_error")
 			}
 			// 如果已收到有意义数据，则此超时无效，继续。
 		default:
@@ -632,7 +589,8 @@ func processStreamingResponse(
 		// --- 处理首次数据接收逻辑 ---
 		if firstChunkReceivedTime.IsZero() && (errRead == nil || (errRead == io.EOF && line != "")) { // 收到第一行数据（或EOF但行非空）
 			firstChunkReceivedTime = time.Now() // 记录时间
-			Log.Debugf("processStreamingResponse: 收到首块任何数据 (密钥: %s，耗时 %s，原始行: %q)", // 【注意】这里的耗时是相对 firstChunkReceivedTime=Zero 时的，实际应该从请求开始计时
+			span.AddEvent(streamEventFirstChunk)
+			logEntry.Debugf("processStreamingResponse: 收到首块任何数据 (密钥: %s，耗时 %s，原始行: %q)", // 【注意】这里的耗时是相对 firstChunkReceivedTime=Zero 时的，实际应该从请求开始计时
 				utils.SafeSuffix(currentOpenRouterKey), time.Since(firstChunkReceivedTime).Round(time.Millisecond), line)
 
 			firstAnyDataTimer.Stop() // 成功收到数据，停止 firstAnyDataTimer。
@@ -660,21 +618,21 @@ func processStreamingResponse(
 					return
 				}
 			}(meaningfulDataTimer, currentOpenRouterKey, meaningfulDataTimerChan, attemptCtx)
-			Log.Debugf("processStreamingResponse: 已启动 %v 的有意义数据超时计时器 (密钥: %s)", meaningfulDataTimeoutDuration, utils.SafeSuffix(currentOpenRouterKey))
+			logEntry.Debugf("processStreamingResponse: 已启动 %v 的有意义数据超时计时器 (密钥: %s)", meaningfulDataTimeoutDuration, utils.SafeSuffix(currentOpenRouterKey))
 		}
 
 		// 【关键修改】: 如果已收到首块数据，但尚未收到有意义数据，并且当前成功读取到非空行，则重置有意义数据定时器。
 		// 这样可以允许“思考中”的数据块（如注释行或空内容的数据块）作为心跳来延长等待有意义内容的时间。
 		if !firstChunkReceivedTime.IsZero() && atomic.LoadInt32(&receivedMeaningfulData) == 0 && errRead == nil && len(strings.TrimSpace(line)) > 0 {
 			if meaningfulDataTimer != nil {
-				Log.Debugf("processStreamingResponse: 收到活动行 (密钥: %s)，重置有意义数据定时器。行: %q", utils.SafeSuffix(currentOpenRouterKey), strings.TrimSpace(line))
+				logEntry.Debugf("processStreamingResponse: 收到活动行 (密钥: %s)，重置有意义数据定时器。行: %q", utils.SafeSuffix(currentOpenRouterKey), strings.TrimSpace(line))
 				// 停止旧的timer并尝试清空其channel，以防旧的超时信号干扰。
 				// Stop 返回 false 表示 timer 已经过期或已经被 Stop。
 				if !meaningfulDataTimer.Stop() {
 					// 尝试消耗可能已发送的信号，避免主select循环捕获到旧的超时。
 					select {
 					case <-meaningfulDataTimerChan:
-						Log.Debugf("processStreamingResponse: 从 meaningfulDataTimerChan 中消耗了一个旧的超时信号。")
+						logEntry.Debugf("processStreamingResponse: 从 meaningfulDataTimerChan 中消耗了一个旧的超时信号。")
 					default:
 					}
 				}
@@ -695,71 +653,48 @@ func processStreamingResponse(
 		// --- 处理读取到的行数据 ---
 		if len(line) > 0 { // 如果读取到非空行
 			if Log.GetLevel() >= logrus.DebugLevel { // 避免在高并发下因日志格式化影响性能。
-				Log.Debugf("processStreamingResponse: 从 OpenRouter 读取行 (密钥 %s): %q", utils.SafeSuffix(currentOpenRouterKey), line)
+				logEntry.Debugf("processStreamingResponse: 从 OpenRouter 读取行 (密钥 %s): %q", utils.SafeSuffix(currentOpenRouterKey), line)
 			}
 
-			// 尝试将读取到的行数据写入客户端响应。
-			if _, errWrite := c.Writer.WriteString(line); errWrite != nil {
-				Log.Warnf("processStreamingResponse: 写入流数据到客户端失败: %v (密钥: %s). 客户端可能已断开。", errWrite, utils.SafeSuffix(currentOpenRouterKey))
+			// 尝试将读取到的行数据（经 sink 原样或转换后）写入客户端响应。
+			if errWrite := sink.WriteLine(line); errWrite != nil {
+				logEntry.Warnf("processStreamingResponse: 写入流数据到客户端失败: %v (密钥: %s). 客户端可能已断开。", errWrite, utils.SafeSuffix(currentOpenRouterKey))
 				clearReadDeadlineWrapper()
 				// 客户端断开，不标记密钥失败（因为它可能工作正常），也不重试。
 				return true, false, http.StatusServiceUnavailable, "写入客户端失败。", "client_write_error"
 			}
-			// 如果写入成功，并且 Writer 支持 http.Flusher 接口，则刷新缓冲区。
-			if flusher, ok := c.Writer.(http.Flusher); ok {
-				flusher.Flush() // 确保数据立即发送给客户端。
-			}
 
 			// 检查 SSE 内容以更新状态 (例如，是否收到 "[DONE]" 或有意义数据)。
 			trimmedLine := strings.TrimSpace(line)
 			if strings.HasPrefix(trimmedLine, models.SSEDataPrefix) { // "data: "
 				dataContent := strings.TrimSpace(strings.TrimPrefix(trimmedLine, models.SSEDataPrefix))
+				// 上游在最后一个数据块中附带用量统计（如果有）。
+				recordUpstreamUsage(c, []byte(dataContent))
+				recordUpstreamGenerationID(c, []byte(dataContent))
+				annotateGenAIStreamChunk(span, []byte(dataContent))
+				logEntry = withGenerationID(c, logEntry)
 				if dataContent == models.SSEDonePayload { // "[DONE]"
-					Log.Infof("processStreamingResponse: 收到显式 [DONE] 信号 (密钥: %s)", utils.SafeSuffix(currentOpenRouterKey))
+					logEntry.Infof("processStreamingResponse: 收到显式 [DONE] 信号 (密钥: %s)", utils.SafeSuffix(currentOpenRouterKey))
 					processedDone = true // 标记已处理 [DONE]。
 					errRead = io.EOF     // 将 errRead 设为 io.EOF 以便跳出循环，表示流正常结束。
 				} else if atomic.LoadInt32(&receivedMeaningfulData) == 0 { // 仅在还未标记收到有意义数据时检查。
-					var chunk models.ChatCompletionChunk
-					// 尝试解析数据块，检查是否包含实际内容。
-					if errJson := json.Unmarshal([]byte(dataContent), &chunk); errJson == nil {
-						// 检查 Delta.Content 是否非空。
-						if len(chunk.Choices) > 0 {
-							// 检查并记录 finish_reason
-							if chunk.Choices[0].FinishReason != nil && *chunk.Choices[0].FinishReason == "tool_calls" {
-								Log.WithFields(logrus.Fields{
-									"key_suffix": utils.SafeSuffix(currentOpenRouterKey),
-									"reason":     "tool_calls",
-								}).Info("流式响应因工具调用而结束。")
-							}
-
-							if atomic.LoadInt32(&receivedMeaningfulData) == 0 && chunk.Choices[0].Delta.Content != nil && *chunk.Choices[0].Delta.Content != "" {
-								Log.Infof("processStreamingResponse: 收到首块有意义聊天数据 (密钥: %s): %q", utils.SafeSuffix(currentOpenRouterKey), *chunk.Choices[0].Delta.Content)
-								atomic.StoreInt32(&receivedMeaningfulData, 1) // 标记已收到有意义数据。
-								if meaningfulDataTimer != nil {
-									meaningfulDataTimer.Stop() // 停止 meaningfulDataTimer。
-								}
-								clearReadDeadlineWrapper()                       // 清除特定的短时读取超时。
-								ApiKeyMgr.RecordKeySuccess(currentOpenRouterKey) // 收到有意义数据，认为密钥是好的
-							} else if atomic.LoadInt32(&receivedMeaningfulData) == 0 && chunk.Choices[0].Delta.ToolCalls != nil {
-								// 如果首个有意义的数据是 tool_calls 而不是 content
-								Log.Infof("processStreamingResponse: 收到首块有意义工具调用数据 (密钥: %s)", utils.SafeSuffix(currentOpenRouterKey))
-								atomic.StoreInt32(&receivedMeaningfulData, 1) // 标记已收到有意义数据。
-								if meaningfulDataTimer != nil {
-									meaningfulDataTimer.Stop()
-								}
-								clearReadDeadlineWrapper()
-								ApiKeyMgr.RecordKeySuccess(currentOpenRouterKey)
-							}
-						} else {
-							Log.Debugf("processStreamingResponse: 收到数据块，但内容为空或非聊天内容 (密钥 %s): %q", utils.SafeSuffix(currentOpenRouterKey), dataContent)
+					// 尝试解析数据块，检查是否包含实际内容（文本或工具调用）。
+					if meaningful, errJson := inspectChunk(dataContent, logEntry.WithField("key_suffix", utils.SafeSuffix(currentOpenRouterKey))); errJson != nil {
+						// 如果 JSON 解析失败，可能不是标准数据块，但仍是数据。
+						logEntry.Warnf("processStreamingResponse: 无法解析收到的 data 块 JSON (密钥 %s, 内容可能非标准数据块，忽略检查有意义内容): %v, data: %q", utils.SafeSuffix(currentOpenRouterKey), errJson, dataContent)
+					} else if meaningful {
+						atomic.StoreInt32(&receivedMeaningfulData, 1) // 标记已收到有意义数据。
+						span.AddEvent(streamEventFirstMeaningfulChunk)
+						c.Set(firstTokenContextKey, time.Now())
+						if meaningfulDataTimer != nil {
+							meaningfulDataTimer.Stop() // 停止 meaningfulDataTimer。
 						}
-					} else {
-						// 如果 JSON 解析失败，可能不是标准聊天块，但仍是数据。
-						Log.Warnf("processStreamingResponse: 无法解析收到的 data 块 JSON (密钥 %s, 内容可能非标准聊天块，忽略检查有意义内容): %v, data: %q", utils.SafeSuffix(currentOpenRouterKey), errJson, dataContent)
+						clearReadDeadlineWrapper()                       // 清除特定的短时读取超时。
+						ApiKeyMgr.RecordKeySuccess(currentOpenRouterKey) // 收到有意义数据，认为密钥是好的
 					}
 				}
 			} else if strings.HasPrefix(trimmedLine, ":") { // SSE 注释/心跳行
-				Log.Debugf("processStreamingResponse: 收到注释/心跳行 (密钥 %s): %q", utils.SafeSuffix(currentOpenRouterKey), trimmedLine)
+				logEntry.Debugf("processStreamingResponse: 收到注释/心跳行 (密钥 %s): %q", utils.SafeSuffix(currentOpenRouterKey), trimmedLine)
 				// 注释行也算是服务器有响应。上面的【关键修改】部分会处理重置 meaningfulDataTimer。
 			}
 		} // 结束 if len(line) > 0
@@ -776,16 +711,14 @@ func processStreamingResponse(
 			// 如果错误是网络超时 (由 SetReadDeadline 触发)
 			if netErr, ok := errRead.(net.Error); ok && netErr.Timeout() {
 				if firstChunkReceivedTime.IsZero() {
-					Log.Warnf("processStreamingResponse: 等待首块数据超时 (net.Error, ReadDeadline)，密钥: %s. 标记失败并重试。", utils.SafeSuffix(currentOpenRouterKey))
-					ApiKeyMgr.MarkKeyFailure(currentOpenRouterKey)
-					return false, true, http.StatusGatewayTimeout, fmt.Sprintf("等待密钥 %s 初始数据超时 (net.Error)。", utils.SafeSuffix(currentOpenRouterKey)), "initial_data_timeout_error"
+					logEntry.Warnf("processStreamingResponse: 等待首块数据超时 (net.Error, ReadDeadline)，密钥: %s. 标记失败并重试。", utils.SafeSuffix(currentOpenRouterKey))
+					return failKeyForRetry(c, currentOpenRouterKey, http.StatusGatewayTimeout, fmt.Sprintf("等待密钥 %s 初始数据超时 (net.Error)。", utils.SafeSuffix(currentOpenRouterKey)), "initial_data_timeout_error")
 				} else if atomic.LoadInt32(&receivedMeaningfulData) == 0 {
-					Log.Warnf("processStreamingResponse: 等待有意义聊天数据超时 (net.Error, ReadDeadline)，密钥: %s. 标记失败并重试。", utils.SafeSuffix(currentOpenRouterKey))
-					ApiKeyMgr.MarkKeyFailure(currentOpenRouterKey)
-					return false, true, http.StatusGatewayTimeout, fmt.Sprintf("等待密钥 %s 有意义聊天数据超时 (net.Error)。", utils.SafeSuffix(currentOpenRouterKey)), "meaningful_data_timeout_error"
+					logEntry.Warnf("processStreamingResponse: 等待有意义聊天数据超时 (net.Error, ReadDeadline)，密钥: %s. 标记失败并重试。", utils.SafeSuffix(currentOpenRouterKey))
+					return failKeyForRetry(c, currentOpenRouterKey, http.StatusGatewayTimeout, fmt.Sprintf("等待密钥 %s 有意义聊天数据超时 (net.Error)。", utils.SafeSuffix(currentOpenRouterKey)), "meaningful_data_timeout_error")
 				} else {
 					// 已经收到有意义数据后发生的读取超时，可能是网络问题或服务器提前关闭连接。
-					Log.Warnf("processStreamingResponse: 读取后续数据块时网络超时 (net.Error, ReadDeadline): %v, 密钥: %s. 流已部分发送，不重试。", errRead, utils.SafeSuffix(currentOpenRouterKey))
+					logEntry.Warnf("processStreamingResponse: 读取后续数据块时网络超时 (net.Error, ReadDeadline): %v, 密钥: %s. 流已部分发送，不重试。", errRead, utils.SafeSuffix(currentOpenRouterKey))
 					// 已经给客户端发送了部分数据，通常不应在此请求内静默重试。让客户端感知到流中断。
 					// 密钥可能没问题，也可能是暂时性网络故障，不立即标记失败。
 					return true, false, http.StatusGatewayTimeout, fmt.Sprintf("密钥 %s 流传输中网络超时。", utils.SafeSuffix(currentOpenRouterKey)), "subsequent_data_timeout_error"
@@ -794,25 +727,23 @@ func processStreamingResponse(
 
 			// 如果错误是 io.EOF (流正常结束或已收到 "[DONE]")
 			if errRead == io.EOF {
-				Log.Infof("processStreamingResponse: OpenRouter 流结束 (EOF 或 [DONE] 已处理) (密钥: %s)", utils.SafeSuffix(currentOpenRouterKey))
+				logEntry.Infof("processStreamingResponse: OpenRouter 流结束 (EOF 或 [DONE] 已处理) (密钥: %s)", utils.SafeSuffix(currentOpenRouterKey))
 				if !processedDone && atomic.LoadInt32(&receivedMeaningfulData) == 1 {
 					// 如果已收到有意义数据，但流结束时没有显式收到 "[DONE]" 信号
 					// （例如，上游直接关闭连接），则我们手动为客户端补发一个 "[DONE]"。
-					Log.Debugf("processStreamingResponse: 流结束但未收到显式 [DONE]，且已收到有意义数据，手动发送 [DONE] (密钥: %s)", utils.SafeSuffix(currentOpenRouterKey))
+					logEntry.Debugf("processStreamingResponse: 流结束但未收到显式 [DONE]，且已收到有意义数据，手动发送 [DONE] (密钥: %s)", utils.SafeSuffix(currentOpenRouterKey))
 					if clientOriginalContext.Err() != context.Canceled { // 确保客户端还连接着
-						if _, errWrite := fmt.Fprintf(c.Writer, "%s%s\n\n", models.SSEDataPrefix, models.SSEDonePayload); errWrite != nil {
-							Log.Warnf("processStreamingResponse: 发送最终 [DONE] 失败: %v (密钥: %s)", errWrite, utils.SafeSuffix(currentOpenRouterKey))
-						} else if flusher, ok := c.Writer.(http.Flusher); ok {
-							flusher.Flush()
+						if errWrite := sink.WriteLine(fmt.Sprintf("%s%s\n\n", models.SSEDataPrefix, models.SSEDonePayload)); errWrite != nil {
+							logEntry.Warnf("processStreamingResponse: 发送最终 [DONE] 失败: %v (密钥: %s)", errWrite, utils.SafeSuffix(currentOpenRouterKey))
 						}
 					}
 				} else if !processedDone && atomic.LoadInt32(&receivedMeaningfulData) == 0 && !firstChunkReceivedTime.IsZero() {
 					// 流结束了，但连有意义的数据都没收到 (并且已收到过首块数据，排除了首块超时的情况)。
 					// 这可能表示密钥有效但模型无法生成内容，或者上游服务有问题。
-					Log.Warnf("processStreamingResponse: OpenRouter 流在收到有意义数据前意外结束 (EOF)，密钥 %s。标记失败并重试。", utils.SafeSuffix(currentOpenRouterKey))
-					ApiKeyMgr.MarkKeyFailure(currentOpenRouterKey)
-					return false, true, http.StatusBadGateway, fmt.Sprintf("密钥 %s 的流在发送有意义数据前意外结束。", utils.SafeSuffix(currentOpenRouterKey)), "premature_eof_error"
+					logEntry.Warnf("processStreamingResponse: OpenRouter 流在收到有意义数据前意外结束 (EOF)，密钥 %s。标记失败并重试。", utils.SafeSuffix(currentOpenRouterKey))
+					return failKeyForRetry(c, currentOpenRouterKey, http.StatusBadGateway, fmt.Sprintf("密钥 %s 的流在发送有意义数据前意外结束。", utils.SafeSuffix(currentOpenRouterKey)), "premature_eof_error")
 				}
+				span.AddEvent(streamEventDone, trace.WithAttributes(attribute.Bool("proxy.done_signal", processedDone)))
 				// 如果 processedDone 为 true，或未收到有意义数据前EOF (firstChunkReceivedTime is Zero, handled by timer)，则流正常结束。
 				// ApiKeyMgr.RecordKeySuccess 应该在收到有意义数据时已被调用。
 				return true, false, http.StatusOK, "", "" // 流正常结束（或已处理），不需重试。
@@ -821,19 +752,17 @@ func processStreamingResponse(
 			// 其他类型的读取错误。
 			// 再次检查父上下文是否已取消（可能在 ReadString 阻塞期间发生）。
 			if attemptCtx.Err() != nil { // 涵盖 Canceled 和 DeadlineExceeded
-				Log.Errorf("processStreamingResponse: 读取流时发现尝试上下文已取消/超时: %v (读取错误: %v, 密钥: %s).", attemptCtx.Err(), errRead, utils.SafeSuffix(currentOpenRouterKey))
+				logEntry.Errorf("processStreamingResponse: 读取流时发现尝试上下文已取消/超时: %v (读取错误: %v, 密钥: %s).", attemptCtx.Err(), errRead, utils.SafeSuffix(currentOpenRouterKey))
 				if clientOriginalContext.Err() == context.Canceled {
 					return true, false, http.StatusServiceUnavailable, "客户端已断开。", "client_disconnected_error" // 客户端主动取消，不重试。
 				}
 				// 可能是整体请求超时或内部取消，标记为可重试，并标记密钥失败。
-				ApiKeyMgr.MarkKeyFailure(currentOpenRouterKey)
-				return false, true, http.StatusGatewayTimeout, fmt.Sprintf("上游流为密钥 %s 中断或超时 (读取错误: %v)。", utils.SafeSuffix(currentOpenRouterKey), errRead), "upstream_timeout_on_read_error"
+				return failKeyForRetry(c, currentOpenRouterKey, http.StatusGatewayTimeout, fmt.Sprintf("上游流为密钥 %s 中断或超时 (读取错误: %v)。", utils.SafeSuffix(currentOpenRouterKey), errRead), "upstream_timeout_on_read_error")
 			}
 
 			// 对于其他未知或未特定处理的读取错误。
-			Log.Errorf("processStreamingResponse: 读取流时意外错误: %v (密钥: %s). 标记失败并重试。", errRead, utils.SafeSuffix(currentOpenRouterKey))
-			ApiKeyMgr.MarkKeyFailure(currentOpenRouterKey)
-			return false, true, http.StatusInternalServerError, fmt.Sprintf("读取上游流为密钥 %s 时发生错误: %v", utils.SafeSuffix(currentOpenRouterKey), errRead), "stream_read_error"
+			logEntry.Errorf("processStreamingResponse: 读取流时意外错误: %v (密钥: %s). 标记失败并重试。", errRead, utils.SafeSuffix(currentOpenRouterKey))
+			return failKeyForRetry(c, currentOpenRouterKey, http.StatusInternalServerError, fmt.Sprintf("读取上游流为密钥 %s 时发生错误: %v", utils.SafeSuffix(currentOpenRouterKey), errRead), "stream_read_error")
 		} // 结束 if errRead != nil
 	} // 结束 for 流式数据读取循环
 }
@@ -850,19 +779,19 @@ func processStreamingResponse(
 //	statusCodeForError (int): 从 OpenRouter 收到的 HTTP 状态码。
 //	errorDetail (string): 从 OpenRouter 收到的错误详情。
 //	errorType (string): 根据状态码推断的错误类型。
-func handleOpenRouterErrorResponse(resp *http.Response, currentOpenRouterKey string, clientOriginalContext context.Context) (success bool, retryNeeded bool, statusCodeForError int, errorDetail string, errorType string) {
+func handleOpenRouterErrorResponse(resp *http.Response, currentOpenRouterKey string, clientOriginalContext context.Context, logEntry *logrus.Entry) (success bool, retryNeeded bool, statusCodeForError int, errorDetail string, errorType string) {
 	errorContentBytes, _ := io.ReadAll(resp.Body) // 尝试读取错误响应体。
 	errorDetailStr := strings.TrimSpace(string(errorContentBytes))
 	if errorDetailStr == "" {
 		errorDetailStr = fmt.Sprintf("上游服务返回状态码 %d，但响应体为空。", resp.StatusCode)
 	}
 
-	Log.Warnf("handleOpenRouterErrorResponse: OpenRouter API 错误 (状态码: %d) 使用密钥 %s: %s",
+	logEntry.Warnf("handleOpenRouterErrorResponse: OpenRouter API 错误 (状态码: %d) 使用密钥 %s: %s",
 		resp.StatusCode, utils.SafeSuffix(currentOpenRouterKey), errorDetailStr)
 
 	// 在处理错误前，检查客户端是否已断开连接。
 	if clientOriginalContext.Err() == context.Canceled {
-		Log.Warnf("handleOpenRouterErrorResponse: 客户端在 OpenRouter 返回错误 (%d) 后已断开。不重试。", resp.StatusCode)
+		logEntry.Warnf("handleOpenRouterErrorResponse: 客户端在 OpenRouter 返回错误 (%d) 后已断开。不重试。", resp.StatusCode)
 		// 密钥本身可能有问题，但由于客户端已断开，不重试此请求。
 		// MarkKeyFailure 将在 attemptOpenRouterRequest 返回后，如果 retryNeeded 为 true 时调用。
 		// 这里返回 retryNeeded=true 是为了让上层标记密钥，即使客户端断了。
@@ -893,7 +822,7 @@ func handleOpenRouterErrorResponse(resp *http.Response, currentOpenRouterKey str
 		} else {
 			// 其他类型的 400 错误，很可能是客户端请求参数本身的问题（例如，无效的模型名称、格式错误的 messages）。
 			// 这种情况下不应该重试密钥，因为问题不在密钥。直接将错误返回给客户端。
-			Log.Warnf("handleOpenRouterErrorResponse: OpenRouter 返回 400 Bad Request (非密钥/配额类): %s。请求参数可能存在问题，不重试。", errorDetailStr)
+			logEntry.Warnf("handleOpenRouterErrorResponse: OpenRouter 返回 400 Bad Request (非密钥/配额类): %s。请求参数可能存在问题，不重试。", errorDetailStr)
 			shouldRetry = false
 			inferredErrorType = "invalid_request_error"
 		}
@@ -904,7 +833,7 @@ func handleOpenRouterErrorResponse(resp *http.Response, currentOpenRouterKey str
 	default:
 		// 对于其他未明确处理的错误码 (例如 404 Not Found, 415 Unsupported Media Type 等)。
 		// 通常这些错误与请求本身（例如错误的路径、内容类型）或模型特定问题相关，而不是密钥本身。
-		Log.Warnf("handleOpenRouterErrorResponse: OpenRouter 返回未特殊处理的错误码 %d: %s。默认不重试。", resp.StatusCode, errorDetailStr)
+		logEntry.Warnf("handleOpenRouterErrorResponse: OpenRouter 返回未特殊处理的错误码 %d: %s。默认不重试。", resp.StatusCode, errorDetailStr)
 		shouldRetry = false             // 默认不重试这些类型的错误。
 		inferredErrorType = "api_error" // 通用API错误
 	}
@@ -922,7 +851,7 @@ func handleOpenRouterErrorResponse(resp *http.Response, currentOpenRouterKey str
 func sendErrorResponse(c *gin.Context, statusCode int, message string, errorType string, isStream bool, originalCtx context.Context) {
 	// 如果客户端已断开连接，则不发送任何响应，仅记录日志。
 	if originalCtx != nil && originalCtx.Err() == context.Canceled {
-		Log.Warnf("sendErrorResponse: 尝试发送错误 '%s' (状态码 %d)，但客户端已断开。不发送。", message, statusCode)
+		requestLog(c).Warnf("sendErrorResponse: 尝试发送错误 '%s' (状态码 %d)，但客户端已断开。不发送。", message, statusCode)
 		return
 	}
 
@@ -930,16 +859,16 @@ func sendErrorResponse(c *gin.Context, statusCode int, message string, errorType
 	if c.Writer.Written() {
 		// 对于非流式请求，如果头已写，通常无法再发送标准 JSON 错误体。
 		if !isStream {
-			Log.Warnf("sendErrorResponse: 尝试发送 JSON 错误 '%s' (状态码 %d)，但响应头已写入。不发送。", message, statusCode)
+			requestLog(c).Warnf("sendErrorResponse: 尝试发送 JSON 错误 '%s' (状态码 %d)，但响应头已写入。不发送。", message, statusCode)
 			return
 		}
 		// 对于流式请求，即使头已写（通常是 200 OK for SSE），我们仍可以尝试发送错误事件。
 		// 检查已发送的状态码，如果不是200，记录一个更详细的警告。
 		currentSentStatus := c.Writer.Status()
 		if currentSentStatus != http.StatusOK && currentSentStatus != 0 { // 0表示 WriteHeader 未被调用
-			Log.Warnf("sendErrorResponse: 尝试发送 SSE 错误事件 '%s'，但响应头已写入且状态非200/0 (%d)。仍将尝试发送错误事件。", message, currentSentStatus)
+			requestLog(c).Warnf("sendErrorResponse: 尝试发送 SSE 错误事件 '%s'，但响应头已写入且状态非200/0 (%d)。仍将尝试发送错误事件。", message, currentSentStatus)
 		} else if currentSentStatus == http.StatusOK {
-			Log.Debugf("sendErrorResponse: SSE 流已开始 (200 OK)，现在尝试发送错误事件: %s", message)
+			requestLog(c).Debugf("sendErrorResponse: SSE 流已开始 (200 OK)，现在尝试发送错误事件: %s", message)
 		}
 	}
 
@@ -949,11 +878,12 @@ func sendErrorResponse(c *gin.Context, statusCode int, message string, errorType
 			Message: message,
 			Type:    errorType,                // 使用传入的错误类型
 			Code:    strconv.Itoa(statusCode), // 将数字状态码转为字符串作为 code
+			RequestID: middleware.RequestID(c),
 		},
 	}
 	errorJSON, err := json.Marshal(errorPayload)
 	if err != nil { // 如果序列化错误响应本身失败
-		Log.Errorf("sendErrorResponse: 无法序列化错误响应体: %v. 原始错误: %s", err, message)
+		requestLog(c).Errorf("sendErrorResponse: 无法序列化错误响应体: %v. 原始错误: %s", err, message)
 		// 尝试发送一个最基本的纯文本错误。
 		if !c.Writer.Written() { // 如果还能写头部
 			// c.String(http.StatusInternalServerError, "Internal Server Error: Failed to prepare error response.")
@@ -980,15 +910,15 @@ func sendErrorResponse(c *gin.Context, statusCode int, message string, errorType
 			c.Writer.Flush() // 确保头部已发送
 		}
 
-		Log.Debugf("sendErrorResponse: 向客户端发送 SSE 错误事件: data: %s", string(errorJSON))
+		requestLog(c).Debugf("sendErrorResponse: 向客户端发送 SSE 错误事件: data: %s", string(errorJSON))
 		// 发送错误事件。
 		if _, errFprintf := fmt.Fprintf(c.Writer, "%s%s\n\n", models.SSEDataPrefix, string(errorJSON)); errFprintf != nil {
-			Log.Warnf("sendErrorResponse: 发送 SSE 错误事件失败: %v (客户端可能已断开)", errFprintf)
+			requestLog(c).Warnf("sendErrorResponse: 发送 SSE 错误事件失败: %v (客户端可能已断开)", errFprintf)
 			return // 如果这里写入失败，客户端可能已断开，无需继续。
 		}
 		// 发送 [DONE] 事件来明确结束流，即使是在错误之后。
 		if _, errFprintf := fmt.Fprintf(c.Writer, "%s%s\n\n", models.SSEDataPrefix, models.SSEDonePayload); errFprintf != nil {
-			Log.Warnf("sendErrorResponse: 发送 SSE [DONE] 事件在错误之后失败: %v (客户端可能已断开)", errFprintf)
+			requestLog(c).Warnf("sendErrorResponse: 发送 SSE [DONE] 事件在错误之后失败: %v (客户端可能已断开)", errFprintf)
 		}
 		if flusher, ok := c.Writer.(http.Flusher); ok {
 			flusher.Flush() // 确保数据立即发送。
@@ -999,7 +929,7 @@ func sendErrorResponse(c *gin.Context, statusCode int, message string, errorType
 			c.Data(statusCode, "application/json; charset=utf-8", errorJSON)
 		} else {
 			// 对于非流式，如果头已写，之前已检查过，这里只是双重保险。
-			Log.Warnf("sendErrorResponse: 尝试发送 JSON 错误，但响应已写入。错误: %s", message)
+			requestLog(c).Warnf("sendErrorResponse: 尝试发送 JSON 错误，但响应已写入。错误: %s", message)
 		}
 	}
 }
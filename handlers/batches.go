@@ -0,0 +1,845 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"openrouter_polling/config"
+	"openrouter_polling/middleware"
+	"openrouter_polling/models"
+	"openrouter_polling/storage"
+	"openrouter_polling/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	filePurposeBatch       = "batch"        // 批处理输入文件
+	filePurposeBatchOutput = "batch_output" // 批处理生成的结果文件
+
+	batchEndpointChatCompletions = "/v1/chat/completions" // 目前唯一支持的批处理端点
+	batchCompletionWindow        = "24h"                  // 唯一支持的完成时间窗口
+	batchCompletionWindowPeriod  = 24 * time.Hour
+
+	maxBatchRequests           = 50000            // 单个批处理的最大请求数
+	maxBatchValidationErrors   = 100              // 校验失败时最多报告的错误数
+	batchRequestMaxAttempts    = 5                // 暂时性失败（无可用密钥、限流、上游 5xx）时单个请求的最大执行次数
+	batchRetryInitialBackoff   = 2 * time.Second  // 暂时性失败后首次重试前的等待时间，此后每次翻倍
+	batchRetryMaxBackoff       = 60 * time.Second // 单次重试等待的上限
+	batchKeyWaitPollInterval   = 5 * time.Second  // 等待可用密钥或并发名额时重新检查的间隔
+	batchKeyWaitMaxInterval    = 30 * time.Second // 所有密钥冷却时单次等待的上限
+	batchMultipartOverheadSize = 1 << 20          // 上传文件时为 multipart 表单其余部分预留的字节数
+)
+
+// errBatchCancelled 是批处理被客户端取消时执行上下文的取消原因。
+var errBatchCancelled = errors.New("batch cancelled")
+
+// batchLimiter 在所有批处理之间共享，控制批处理发起上游请求的并发数和速率：
+// 同时执行的请求数不超过 BATCH_CONCURRENCY 与当前可用密钥数中的较小值，使负载分散到各个密钥；
+// 所有密钥都在冷却时暂停发起请求，直到最早的密钥结束冷却。
+type batchLimiter struct {
+	mu        sync.Mutex
+	inFlight  int
+	nextStart time.Time     // 按 BATCH_REQUESTS_PER_SECOND 计算的下一个请求最早发起时间
+	released  chan struct{} // 有请求结束时关闭并替换，用于唤醒等待者
+}
+
+// acquire 等待直到可以发起一个上游请求，ctx 取消时返回错误。成功后调用者必须调用 release。
+func (l *batchLimiter) acquire(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err // 批处理已取消或过期时不再发起新请求，即使此刻有空闲名额
+		}
+		available, nextReactivation := ApiKeyMgr.KeyAvailability()
+		concurrency := max(config.AppSettings.BatchConcurrency, 1)
+
+		l.mu.Lock()
+		now := time.Now()
+		var wait time.Duration
+		switch {
+		case available == 0:
+			wait = batchKeyWaitPollInterval
+			if nextReactivation != nil {
+				wait = min(max(time.Until(*nextReactivation), 100*time.Millisecond), batchKeyWaitMaxInterval)
+			}
+		case l.inFlight >= min(concurrency, available):
+			wait = batchKeyWaitPollInterval // 可用密钥数可能随时变化，因此除了等待请求结束外也定期重新检查
+		case now.Before(l.nextStart):
+			wait = l.nextStart.Sub(now)
+		default:
+			l.inFlight++
+			if rps := config.AppSettings.BatchRequestsPerSecond; rps > 0 {
+				l.nextStart = now.Add(time.Second / time.Duration(rps))
+			}
+			l.mu.Unlock()
+			return nil
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-released:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// release 归还 acquire 获得的名额并唤醒等待者。
+func (l *batchLimiter) release() {
+	l.mu.Lock()
+	l.inFlight--
+	close(l.released)
+	l.released = make(chan struct{})
+	l.mu.Unlock()
+}
+
+// batchRunRegistry 登记正在执行的批处理，用于避免重复执行和响应取消请求。
+type batchRunRegistry struct {
+	mu      sync.Mutex
+	baseCtx context.Context
+	running map[string]context.CancelCauseFunc
+}
+
+var (
+	batchRuns      *batchRunRegistry // 在 RunBatchWorkers 启动后创建；为 nil 时批处理功能不可用
+	batchRateLimit = &batchLimiter{released: make(chan struct{})}
+)
+
+// start 在后台开始（或继续）执行批处理；已在执行中时不做任何事。
+func (r *batchRunRegistry) start(batch storage.Batch) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.running[batch.BatchID]; exists {
+		return
+	}
+	ctx, cancel := context.WithCancelCause(r.baseCtx)
+	r.running[batch.BatchID] = cancel
+	go func() {
+		defer func() {
+			r.mu.Lock()
+			delete(r.running, batch.BatchID)
+			r.mu.Unlock()
+			cancel(nil)
+		}()
+		runBatch(ctx, batch)
+	}()
+}
+
+// cancel 通知正在执行的批处理停止发起新的请求。
+func (r *batchRunRegistry) cancel(batchID string) {
+	r.mu.Lock()
+	cancel, exists := r.running[batchID]
+	r.mu.Unlock()
+	if exists {
+		cancel(errBatchCancelled)
+	}
+}
+
+// RunBatchWorkers 启用批处理功能，并继续执行服务重启前未结束的批处理，直到 ctx 取消。
+func RunBatchWorkers(ctx context.Context) {
+	batchRuns = &batchRunRegistry{baseCtx: ctx, running: make(map[string]context.CancelCauseFunc)}
+	Log.Infof("批处理后台任务已启动 (并发上限: %d, 每秒请求数上限: %d)。", config.AppSettings.BatchConcurrency, config.AppSettings.BatchRequestsPerSecond)
+
+	unfinished, err := BatchStore.ListUnfinishedBatches()
+	if err != nil {
+		Log.Errorf("RunBatchWorkers: 读取未结束的批处理失败: %v", err)
+		return
+	}
+	if len(unfinished) > 0 {
+		Log.Infof("RunBatchWorkers: 恢复 %d 个未结束的批处理。", len(unfinished))
+	}
+	for _, batch := range unfinished {
+		batchRuns.start(batch)
+	}
+}
+
+// runBatch 按批处理的当前状态推进执行：校验输入文件、执行请求、生成结果文件，直到批处理结束或服务关闭。
+// 每一步的进度都保存在数据库中，服务重启后从中断处继续。
+func runBatch(ctx context.Context, batch storage.Batch) {
+	logEntry := Log.WithFields(logrus.Fields{"batch_id": batch.BatchID, "client": batch.ClientID})
+	for ctx.Err() == nil || context.Cause(ctx) == errBatchCancelled {
+		current, err := BatchStore.GetBatch(batch.BatchID, batch.ClientID)
+		if err != nil {
+			logEntry.Errorf("runBatch: 读取批处理失败: %v", err)
+			return
+		}
+		switch current.Status {
+		case storage.BatchStatusValidating:
+			if !validateBatch(current, logEntry) {
+				return
+			}
+		case storage.BatchStatusInProgress:
+			switch executeBatch(ctx, current, logEntry) {
+			case storage.BatchStatusCompleted:
+				if _, err := BatchStore.TransitionBatch(current.BatchID, []string{storage.BatchStatusInProgress},
+					map[string]interface{}{"status": storage.BatchStatusFinalizing, "finalizing_at": time.Now()}); err != nil {
+					logEntry.Errorf("runBatch: 更新批处理状态失败: %v", err)
+					return
+				}
+			case storage.BatchStatusExpired:
+				finalizeBatch(current, storage.BatchStatusExpired, logEntry)
+				return
+			case storage.BatchStatusCancelled:
+				// 取消处理器已将状态改为 cancelling，下一轮循环生成结果文件
+			default:
+				return // 服务关闭，保持 in_progress 以便重启后继续
+			}
+		case storage.BatchStatusFinalizing:
+			finalizeBatch(current, storage.BatchStatusCompleted, logEntry)
+			return
+		case storage.BatchStatusCancelling:
+			finalizeBatch(current, storage.BatchStatusCancelled, logEntry)
+			return
+		default:
+			return
+		}
+	}
+}
+
+// validateBatch 解析并校验输入文件。全部通过时保存每一行请求并开始执行，否则将批处理标记为失败。
+// 读写数据库出错时返回 false。
+func validateBatch(batch *storage.Batch, logEntry *logrus.Entry) bool {
+	file, err := BatchStore.GetFile(batch.InputFileID, batch.ClientID)
+	var requests []storage.BatchRequest
+	var validationErrors []models.BatchError
+	if err != nil {
+		if !errors.Is(err, storage.ErrFileNotFound) {
+			logEntry.Errorf("validateBatch: 读取输入文件失败: %v", err)
+			return false
+		}
+		validationErrors = []models.BatchError{{Code: "invalid_file", Message: "输入文件 '" + batch.InputFileID + "' 不存在或已被删除。", Param: "input_file_id"}}
+	} else {
+		requests, validationErrors = parseBatchInput(batch, file.Content)
+	}
+
+	now := time.Now()
+	if len(validationErrors) > 0 {
+		errorsJSON, _ := json.Marshal(models.BatchErrors{Object: "list", Data: validationErrors})
+		if _, err := BatchStore.TransitionBatch(batch.BatchID, []string{storage.BatchStatusValidating}, map[string]interface{}{
+			"status": storage.BatchStatusFailed, "failed_at": now, "errors": string(errorsJSON),
+		}); err != nil {
+			logEntry.Errorf("validateBatch: 更新批处理状态失败: %v", err)
+			return false
+		}
+		logEntry.Warnf("validateBatch: 输入文件校验失败 (%d 处错误)。", len(validationErrors))
+		return true
+	}
+
+	started, err := BatchStore.StartBatch(batch.BatchID, requests, now)
+	if err != nil {
+		logEntry.Errorf("validateBatch: 保存批处理请求失败: %v", err)
+		return false
+	}
+	if started {
+		logEntry.Infof("validateBatch: 输入文件校验通过，开始执行 %d 个请求。", len(requests))
+	}
+	return true
+}
+
+// parseBatchInput 将输入文件的每一个非空行解析为批处理请求，并收集校验错误（行号从 1 开始）。
+func parseBatchInput(batch *storage.Batch, content string) ([]storage.BatchRequest, []models.BatchError) {
+	var requests []storage.BatchRequest
+	var validationErrors []models.BatchError
+	addError := func(lineNumber int, code, message, param string) {
+		if len(validationErrors) < maxBatchValidationErrors {
+			line := lineNumber
+			validationErrors = append(validationErrors, models.BatchError{Code: code, Message: message, Param: param, Line: &line})
+		}
+	}
+
+	seenCustomIDs := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(content)+1)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		rawLine := bytes.TrimSpace(scanner.Bytes())
+		if len(rawLine) == 0 {
+			continue
+		}
+		var line models.BatchInputLine
+		if err := json.Unmarshal(rawLine, &line); err != nil {
+			addError(lineNumber, "invalid_json_line", "该行不是有效的 JSON: "+err.Error(), "")
+			continue
+		}
+		switch {
+		case line.CustomID == "":
+			addError(lineNumber, "missing_required_parameter", "缺少 custom_id。", "custom_id")
+			continue
+		case seenCustomIDs[line.CustomID]:
+			addError(lineNumber, "duplicate_custom_id", "custom_id '"+line.CustomID+"' 重复。", "custom_id")
+			continue
+		case strings.ToUpper(line.Method) != http.MethodPost:
+			addError(lineNumber, "invalid_method", "method 必须为 POST。", "method")
+			continue
+		case line.URL != batch.Endpoint:
+			addError(lineNumber, "mismatched_endpoint", "url 必须与批处理的 endpoint ("+batch.Endpoint+") 一致。", "url")
+			continue
+		}
+		var body models.ChatCompletionRequest
+		if err := json.Unmarshal(line.Body, &body); err != nil || len(body.Messages) == 0 {
+			addError(lineNumber, "invalid_request", "body 必须是包含 messages 的聊天补全请求。", "body")
+			continue
+		}
+		seenCustomIDs[line.CustomID] = true
+		requests = append(requests, storage.BatchRequest{
+			BatchID:   batch.BatchID,
+			LineIndex: lineNumber - 1,
+			RequestID: utils.NewID("batch_req_"),
+			CustomID:  line.CustomID,
+			Status:    storage.BatchRequestStatusPending,
+			Body:      string(line.Body),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		addError(lineNumber+1, "invalid_file", "读取输入文件失败: "+err.Error(), "")
+	}
+	if len(validationErrors) == 0 {
+		if len(requests) == 0 {
+			validationErrors = append(validationErrors, models.BatchError{Code: "empty_file", Message: "输入文件中没有任何请求。"})
+		} else if len(requests) > maxBatchRequests {
+			validationErrors = append(validationErrors, models.BatchError{Code: "too_many_requests", Message: fmt.Sprintf("单个批处理最多包含 %d 个请求。", maxBatchRequests)})
+		}
+	}
+	return requests, validationErrors
+}
+
+// executeBatch 执行批处理中所有尚未完成的请求，返回执行结束的原因：completed（全部完成）、
+// cancelled（客户端取消）、expired（超过完成时间窗口）；服务关闭时返回空字符串。
+// 取消或过期时不再发起新请求，但已在执行的请求会继续完成并保存结果。
+func executeBatch(ctx context.Context, batch *storage.Batch, logEntry *logrus.Entry) string {
+	pending, err := BatchStore.ListPendingBatchRequests(batch.BatchID)
+	if err != nil {
+		logEntry.Errorf("executeBatch: 读取待执行的请求失败: %v", err)
+		return ""
+	}
+	// 请求本身只随服务关闭而取消；dispatchCtx 在取消或过期时停止发起新请求。
+	shutdownCtx := batchRuns.baseCtx
+	dispatchCtx, cancelDispatch := context.WithDeadline(ctx, batch.ExpiresAt)
+	defer cancelDispatch()
+
+	logEntry.Infof("executeBatch: 开始执行 %d 个待处理的请求。", len(pending))
+	var wg sync.WaitGroup
+	for i := range pending {
+		if err := batchRateLimit.acquire(dispatchCtx); err != nil {
+			break
+		}
+		wg.Add(1)
+		go func(request *storage.BatchRequest) {
+			defer wg.Done()
+			runBatchRequest(shutdownCtx, dispatchCtx, batch, request, logEntry)
+		}(&pending[i])
+	}
+	wg.Wait()
+
+	switch {
+	case shutdownCtx.Err() != nil:
+		return ""
+	case context.Cause(ctx) == errBatchCancelled:
+		logEntry.Info("executeBatch: 批处理已取消。")
+		return storage.BatchStatusCancelled
+	case dispatchCtx.Err() != nil:
+		expired, err := BatchStore.ExpirePendingBatchRequests(batch.BatchID)
+		if err != nil {
+			logEntry.Errorf("executeBatch: 标记过期请求失败: %v", err)
+		}
+		logEntry.Warnf("executeBatch: 批处理超过完成时间窗口，%d 个请求未执行。", expired)
+		return storage.BatchStatusExpired
+	}
+	return storage.BatchStatusCompleted
+}
+
+// runBatchRequest 执行单个请求（调用前已获得限速名额），暂时性失败时退避后重新排队执行。
+// 服务关闭、批处理取消或过期导致请求未能得到最终结果时，请求保持 pending，不计入结果。
+func runBatchRequest(requestCtx, dispatchCtx context.Context, batch *storage.Batch, request *storage.BatchRequest, logEntry *logrus.Entry) {
+	logEntry = logEntry.WithField("custom_id", request.CustomID)
+	backoff := batchRetryInitialBackoff
+	for {
+		statusCode, body := executeBatchRequest(requestCtx, batch, request, logEntry)
+		batchRateLimit.release()
+		if requestCtx.Err() != nil {
+			return
+		}
+		request.Attempts++
+		transient := statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+		if !transient || request.Attempts >= batchRequestMaxAttempts {
+			request.StatusCode = statusCode
+			request.Response = string(body)
+			request.Status = storage.BatchRequestStatusCompleted
+			if statusCode != http.StatusOK {
+				request.Status = storage.BatchRequestStatusFailed
+			}
+			if err := BatchStore.RecordBatchRequestResult(request); err != nil {
+				logEntry.Errorf("runBatchRequest: 保存请求结果失败: %v", err)
+			}
+			return
+		}
+
+		logEntry.Debugf("runBatchRequest: 第 %d 次执行遇到暂时性错误 (状态码: %d)，%v 后重试。", request.Attempts, statusCode, backoff)
+		select {
+		case <-dispatchCtx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, batchRetryMaxBackoff)
+		if err := batchRateLimit.acquire(dispatchCtx); err != nil {
+			return
+		}
+	}
+}
+
+// executeBatchRequest 通过与同步请求相同的处理路径（上下文裁剪、密钥池、重试、费用统计）执行一个请求，
+// 返回状态码和响应体。批处理结果总是非流式的。
+func executeBatchRequest(ctx context.Context, batch *storage.Batch, request *storage.BatchRequest, logEntry *logrus.Entry) (int, []byte) {
+	var requestData models.ChatCompletionRequest
+	if err := json.Unmarshal([]byte(request.Body), &requestData); err != nil {
+		return http.StatusBadRequest, mustMarshalError("请求体无法解析: "+err.Error(), "invalid_request_error")
+	}
+	requestData.Stream = nil
+
+	recorder := runInternalRequest(ctx, http.MethodPost, batch.Endpoint, func(c *gin.Context) {
+		c.Set(middleware.ClientIDContextKey, batch.ClientID)
+		c.Set(middleware.RequestIDContextKey, request.RequestID) // 日志中的请求 ID 与结果行的 ID 一致
+		// 没有可用密钥时，后台请求排在交互式请求之后
+		c.Request.Header.Set(queuePriorityHeader, config.QueuePriorityLow)
+
+		// 批处理请求的执行结果同样参与抽样捕获，按结果行的 ID 查询。
+		withPayloadCapture(c, capturedRequest{Body: requestData, Model: requestData.Model}, func() {
+			applyContextTrimPolicy(c, &requestData, logEntry)
+			generateChatResponse(c, requestData, false)
+		})
+	})
+	return recorder.Code, recorder.Body.Bytes()
+}
+
+// finalizeBatch 生成结果文件并将批处理标记为 finalStatus：得到上游响应的请求（包括非 200 响应）写入输出文件，
+// 未能得到任何响应的请求（例如批处理过期前未执行）写入错误文件，与 OpenAI Batch API 一致。
+func finalizeBatch(batch *storage.Batch, finalStatus string, logEntry *logrus.Entry) {
+	finished, err := BatchStore.ListFinishedBatchRequests(batch.BatchID)
+	if err != nil {
+		logEntry.Errorf("finalizeBatch: 读取请求结果失败: %v", err)
+		return
+	}
+
+	var output, errorOutput bytes.Buffer
+	succeeded, failed := 0, 0
+	for _, request := range finished {
+		line := models.BatchOutputLine{ID: request.RequestID, CustomID: request.CustomID}
+		if request.StatusCode == 0 {
+			line.Error = &models.BatchOutputError{Code: "batch_expired", Message: "该请求在批处理过期前未能执行。"}
+		} else {
+			body := json.RawMessage(request.Response)
+			if !json.Valid(body) {
+				body = mustMarshalError(request.Response, "api_error")
+			}
+			line.Response = &models.BatchOutputResponse{StatusCode: request.StatusCode, RequestID: request.RequestID, Body: body}
+		}
+		encoded, err := json.Marshal(line)
+		if err != nil {
+			logEntry.Errorf("finalizeBatch: 序列化结果行失败: %v", err)
+			continue
+		}
+		target := &output
+		if request.StatusCode == 0 {
+			target = &errorOutput
+		}
+		if request.Status == storage.BatchRequestStatusFailed {
+			failed++
+		} else {
+			succeeded++
+		}
+		target.Write(encoded)
+		target.WriteByte('\n')
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{"status": finalStatus}
+	switch finalStatus {
+	case storage.BatchStatusCompleted:
+		updates["completed_at"] = now
+	case storage.BatchStatusCancelled:
+		updates["cancelled_at"] = now
+	case storage.BatchStatusExpired:
+		updates["expired_at"] = now
+	}
+	for _, result := range []struct {
+		content *bytes.Buffer
+		suffix  string
+		column  string
+	}{
+		{&output, "output", "output_file_id"},
+		{&errorOutput, "error", "error_file_id"},
+	} {
+		if result.content.Len() == 0 {
+			continue
+		}
+		file := &storage.StoredFile{
+			FileID:   utils.NewID("file-"),
+			ClientID: batch.ClientID,
+			Filename: batch.BatchID + "_" + result.suffix + ".jsonl",
+			Purpose:  filePurposeBatchOutput,
+			Bytes:    int64(result.content.Len()),
+			Content:  result.content.String(),
+		}
+		if err := BatchStore.CreateFile(file); err != nil {
+			logEntry.Errorf("finalizeBatch: 保存结果文件失败: %v", err)
+			return
+		}
+		updates[result.column] = file.FileID
+	}
+
+	if _, err := BatchStore.TransitionBatch(batch.BatchID, []string{storage.BatchStatusInProgress, storage.BatchStatusFinalizing, storage.BatchStatusCancelling}, updates); err != nil {
+		logEntry.Errorf("finalizeBatch: 更新批处理状态失败: %v", err)
+		return
+	}
+	logEntry.Infof("finalizeBatch: 批处理结束 (状态: %s, 成功: %d, 失败: %d)。", finalStatus, succeeded, failed)
+}
+
+// --- 文件端点 ---
+
+// UploadFileHandler 处理 `/v1/files` POST 请求（multipart 表单：file、purpose）。目前只接受 purpose=batch。
+func UploadFileHandler(c *gin.Context) {
+	clientOriginalContext := c.Request.Context()
+	maxBytes := config.AppSettings.BatchMaxFileBytes
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes+batchMultipartOverheadSize)
+
+	purpose := c.PostForm("purpose")
+	if purpose != filePurposeBatch {
+		sendErrorResponse(c, http.StatusBadRequest, "purpose 必须为 'batch'。", "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			sendErrorResponse(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("文件大小不能超过 %d MB。", maxBytes/1024/1024), "invalid_request_error", false, clientOriginalContext)
+			return
+		}
+		sendErrorResponse(c, http.StatusBadRequest, "缺少上传的文件 (file 字段)。", "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+	if header.Size > maxBytes {
+		sendErrorResponse(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("文件大小不能超过 %d MB。", maxBytes/1024/1024), "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+	uploaded, err := header.Open()
+	if err != nil {
+		sendErrorResponse(c, http.StatusBadRequest, "读取上传的文件失败。", "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+	defer uploaded.Close()
+	content, err := io.ReadAll(uploaded)
+	if err != nil {
+		sendErrorResponse(c, http.StatusBadRequest, "读取上传的文件失败。", "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+
+	file := &storage.StoredFile{
+		FileID:   utils.NewID("file-"),
+		ClientID: middleware.ClientID(c),
+		Filename: header.Filename,
+		Purpose:  purpose,
+		Bytes:    int64(len(content)),
+		Content:  string(content),
+	}
+	if err := BatchStore.CreateFile(file); err != nil {
+		Log.Errorf("UploadFileHandler: 保存文件失败: %v", err)
+		sendErrorResponse(c, http.StatusInternalServerError, "保存文件时发生内部错误。", "internal_server_error", false, clientOriginalContext)
+		return
+	}
+	Log.Infof("UploadFileHandler: 客户端 %s 上传了文件 %s (%d 字节)。", file.ClientID, file.FileID, file.Bytes)
+	c.JSON(http.StatusOK, fileObject(file))
+}
+
+// ListFilesHandler 处理 `/v1/files` GET 请求，支持 purpose 查询参数。
+func ListFilesHandler(c *gin.Context) {
+	files, err := BatchStore.ListFiles(middleware.ClientID(c), c.Query("purpose"))
+	if err != nil {
+		Log.Errorf("ListFilesHandler: 查询文件失败: %v", err)
+		sendErrorResponse(c, http.StatusInternalServerError, "查询文件时发生内部错误。", "internal_server_error", false, c.Request.Context())
+		return
+	}
+	list := models.FileList{Object: "list", Data: make([]models.File, 0, len(files))}
+	for i := range files {
+		list.Data = append(list.Data, fileObject(&files[i]))
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// GetFileHandler 处理 `/v1/files/:id` GET 请求。
+func GetFileHandler(c *gin.Context) {
+	if file, ok := loadFile(c); ok {
+		c.JSON(http.StatusOK, fileObject(file))
+	}
+}
+
+// GetFileContentHandler 处理 `/v1/files/:id/content` GET 请求，返回文件原始内容。
+func GetFileContentHandler(c *gin.Context) {
+	if file, ok := loadFile(c); ok {
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file.Filename))
+		c.Data(http.StatusOK, "application/jsonl", []byte(file.Content))
+	}
+}
+
+// DeleteFileHandler 处理 `/v1/files/:id` DELETE 请求。
+func DeleteFileHandler(c *gin.Context) {
+	fileID := c.Param("id")
+	if err := BatchStore.DeleteFile(fileID, middleware.ClientID(c)); err != nil {
+		if errors.Is(err, storage.ErrFileNotFound) {
+			sendErrorResponse(c, http.StatusNotFound, "未找到文件 '"+fileID+"'。", "invalid_request_error", false, c.Request.Context())
+			return
+		}
+		Log.Errorf("DeleteFileHandler: 删除文件 %s 失败: %v", fileID, err)
+		sendErrorResponse(c, http.StatusInternalServerError, "删除文件失败。", "internal_server_error", false, c.Request.Context())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": fileID, "object": "file", "deleted": true})
+}
+
+// loadFile 读取当前客户端的文件，失败时写出错误响应并返回 false。
+func loadFile(c *gin.Context) (*storage.StoredFile, bool) {
+	fileID := c.Param("id")
+	file, err := BatchStore.GetFile(fileID, middleware.ClientID(c))
+	if err != nil {
+		if errors.Is(err, storage.ErrFileNotFound) {
+			sendErrorResponse(c, http.StatusNotFound, "未找到文件 '"+fileID+"'。", "invalid_request_error", false, c.Request.Context())
+			return nil, false
+		}
+		Log.Errorf("loadFile: 读取文件 %s 失败: %v", fileID, err)
+		sendErrorResponse(c, http.StatusInternalServerError, "读取文件时发生内部错误。", "internal_server_error", false, c.Request.Context())
+		return nil, false
+	}
+	return file, true
+}
+
+// fileObject 将数据库中的文件转换为对外返回的文件对象。
+func fileObject(file *storage.StoredFile) models.File {
+	return models.File{
+		ID:        file.FileID,
+		Object:    "file",
+		Bytes:     file.Bytes,
+		CreatedAt: file.CreatedAt.Unix(),
+		Filename:  file.Filename,
+		Purpose:   file.Purpose,
+		Status:    "processed",
+	}
+}
+
+// --- 批处理端点 ---
+
+// CreateBatchHandler 处理 `/v1/batches` POST 请求。输入文件在后台校验，批处理创建后立即返回（状态为 validating）。
+func CreateBatchHandler(c *gin.Context) {
+	clientOriginalContext := c.Request.Context()
+	if batchRuns == nil || BatchStore == nil {
+		sendErrorResponse(c, http.StatusServiceUnavailable, "批处理功能未启用。", "api_error", false, clientOriginalContext)
+		return
+	}
+	var req models.BatchCreateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		sendErrorResponse(c, http.StatusBadRequest, "无效的请求体: "+err.Error(), "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+	if req.Endpoint != batchEndpointChatCompletions {
+		sendErrorResponse(c, http.StatusBadRequest, "endpoint 目前只支持 "+batchEndpointChatCompletions+"。", "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+	if req.CompletionWindow != batchCompletionWindow {
+		sendErrorResponse(c, http.StatusBadRequest, "completion_window 目前只支持 "+batchCompletionWindow+"。", "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+
+	clientID := middleware.ClientID(c)
+	file, err := BatchStore.GetFile(req.InputFileID, clientID)
+	if err != nil {
+		if errors.Is(err, storage.ErrFileNotFound) {
+			sendErrorResponse(c, http.StatusBadRequest, "未找到输入文件 '"+req.InputFileID+"'。", "invalid_request_error", false, clientOriginalContext)
+			return
+		}
+		Log.Errorf("CreateBatchHandler: 读取输入文件 %s 失败: %v", req.InputFileID, err)
+		sendErrorResponse(c, http.StatusInternalServerError, "读取输入文件时发生内部错误。", "internal_server_error", false, clientOriginalContext)
+		return
+	}
+	if file.Purpose != filePurposeBatch {
+		sendErrorResponse(c, http.StatusBadRequest, "输入文件的 purpose 必须为 'batch'。", "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+
+	var metadata string
+	if len(req.Metadata) > 0 {
+		encoded, _ := json.Marshal(req.Metadata)
+		metadata = string(encoded)
+	}
+	now := time.Now()
+	batch := &storage.Batch{
+		BatchID:          utils.NewID("batch_"),
+		ClientID:         clientID,
+		Endpoint:         req.Endpoint,
+		InputFileID:      req.InputFileID,
+		CompletionWindow: req.CompletionWindow,
+		Status:           storage.BatchStatusValidating,
+		Metadata:         metadata,
+		ExpiresAt:        now.Add(batchCompletionWindowPeriod),
+	}
+	if err := BatchStore.CreateBatch(batch); err != nil {
+		Log.Errorf("CreateBatchHandler: 保存批处理失败: %v", err)
+		sendErrorResponse(c, http.StatusInternalServerError, "保存批处理时发生内部错误。", "internal_server_error", false, clientOriginalContext)
+		return
+	}
+	Log.WithFields(logrus.Fields{"batch_id": batch.BatchID, "client": clientID}).Infof("已创建批处理 (输入文件: %s)", batch.InputFileID)
+	batchRuns.start(*batch)
+	c.JSON(http.StatusOK, batchObject(batch))
+}
+
+// ListBatchesHandler 处理 `/v1/batches` GET 请求。支持的查询参数：after（分页游标）、limit（默认 20，最大 100）。
+func ListBatchesHandler(c *gin.Context) {
+	clientOriginalContext := c.Request.Context()
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit < 1 || limit > 100 {
+		sendErrorResponse(c, http.StatusBadRequest, "limit 必须是 1 到 100 之间的整数。", "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+	batches, err := BatchStore.ListBatches(middleware.ClientID(c), c.Query("after"), limit)
+	if err != nil {
+		if errors.Is(err, storage.ErrBatchNotFound) {
+			sendErrorResponse(c, http.StatusBadRequest, "未找到 after 指定的批处理 '"+c.Query("after")+"'。", "invalid_request_error", false, clientOriginalContext)
+			return
+		}
+		Log.Errorf("ListBatchesHandler: 查询批处理失败: %v", err)
+		sendErrorResponse(c, http.StatusInternalServerError, "查询批处理时发生内部错误。", "internal_server_error", false, clientOriginalContext)
+		return
+	}
+
+	list := models.BatchList{Object: "list", Data: make([]models.Batch, 0, len(batches))}
+	if len(batches) > limit {
+		list.HasMore = true
+		batches = batches[:limit]
+	}
+	for i := range batches {
+		list.Data = append(list.Data, batchObject(&batches[i]))
+	}
+	if len(list.Data) > 0 {
+		list.FirstID = &list.Data[0].ID
+		list.LastID = &list.Data[len(list.Data)-1].ID
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// GetBatchHandler 处理 `/v1/batches/:id` GET 请求。
+func GetBatchHandler(c *gin.Context) {
+	if batch, ok := loadBatch(c); ok {
+		c.JSON(http.StatusOK, batchObject(batch))
+	}
+}
+
+// CancelBatchHandler 处理 `/v1/batches/:id/cancel` POST 请求。批处理进入 cancelling 状态，
+// 已在执行的请求完成后生成结果文件并进入 cancelled 状态。
+func CancelBatchHandler(c *gin.Context) {
+	batch, ok := loadBatch(c)
+	if !ok {
+		return
+	}
+	cancellable := []string{storage.BatchStatusValidating, storage.BatchStatusInProgress}
+	cancelled, err := BatchStore.TransitionBatch(batch.BatchID, cancellable, map[string]interface{}{
+		"status": storage.BatchStatusCancelling, "cancelling_at": time.Now(),
+	})
+	if err != nil {
+		Log.Errorf("CancelBatchHandler: 取消批处理 %s 失败: %v", batch.BatchID, err)
+		sendErrorResponse(c, http.StatusInternalServerError, "取消批处理时发生内部错误。", "internal_server_error", false, c.Request.Context())
+		return
+	}
+	if cancelled {
+		Log.WithFields(logrus.Fields{"batch_id": batch.BatchID, "client": batch.ClientID}).Info("批处理已被客户端取消")
+		if batchRuns != nil {
+			batchRuns.cancel(batch.BatchID)
+		}
+	} else if batch.Status != storage.BatchStatusCancelling && batch.Status != storage.BatchStatusCancelled {
+		sendErrorResponse(c, http.StatusConflict, "状态为 "+batch.Status+" 的批处理无法取消。", "invalid_request_error", false, c.Request.Context())
+		return
+	}
+
+	if batch, ok = loadBatch(c); ok {
+		c.JSON(http.StatusOK, batchObject(batch))
+	}
+}
+
+// loadBatch 读取当前客户端的批处理，失败时写出错误响应并返回 false。
+func loadBatch(c *gin.Context) (*storage.Batch, bool) {
+	batchID := c.Param("id")
+	batch, err := BatchStore.GetBatch(batchID, middleware.ClientID(c))
+	if err != nil {
+		if errors.Is(err, storage.ErrBatchNotFound) {
+			sendErrorResponse(c, http.StatusNotFound, "未找到批处理 '"+batchID+"'。", "invalid_request_error", false, c.Request.Context())
+			return nil, false
+		}
+		Log.Errorf("loadBatch: 读取批处理 %s 失败: %v", batchID, err)
+		sendErrorResponse(c, http.StatusInternalServerError, "读取批处理时发生内部错误。", "internal_server_error", false, c.Request.Context())
+		return nil, false
+	}
+	return batch, true
+}
+
+// batchObject 将数据库中的批处理转换为对外返回的批处理对象。
+func batchObject(batch *storage.Batch) models.Batch {
+	unix := func(t *time.Time) *int64 {
+		if t == nil {
+			return nil
+		}
+		value := t.Unix()
+		return &value
+	}
+	optional := func(s string) *string {
+		if s == "" {
+			return nil
+		}
+		return &s
+	}
+	obj := models.Batch{
+		ID:               batch.BatchID,
+		Object:           "batch",
+		Endpoint:         batch.Endpoint,
+		InputFileID:      batch.InputFileID,
+		CompletionWindow: batch.CompletionWindow,
+		Status:           batch.Status,
+		OutputFileID:     optional(batch.OutputFileID),
+		ErrorFileID:      optional(batch.ErrorFileID),
+		CreatedAt:        batch.CreatedAt.Unix(),
+		InProgressAt:     unix(batch.InProgressAt),
+		ExpiresAt:        unix(&batch.ExpiresAt),
+		FinalizingAt:     unix(batch.FinalizingAt),
+		CompletedAt:      unix(batch.CompletedAt),
+		FailedAt:         unix(batch.FailedAt),
+		ExpiredAt:        unix(batch.ExpiredAt),
+		CancellingAt:     unix(batch.CancellingAt),
+		CancelledAt:      unix(batch.CancelledAt),
+		RequestCounts: models.BatchRequestCounts{
+			Total:     batch.TotalCount,
+			Completed: batch.CompletedCount,
+			Failed:    batch.FailedCount,
+		},
+	}
+	if batch.Errors != "" {
+		var batchErrors models.BatchErrors
+		if err := json.Unmarshal([]byte(batch.Errors), &batchErrors); err == nil {
+			obj.Errors = &batchErrors
+		}
+	}
+	if batch.Metadata != "" {
+		_ = json.Unmarshal([]byte(batch.Metadata), &obj.Metadata)
+	}
+	return obj
+}
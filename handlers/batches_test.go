@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"openrouter_polling/config"
+	"openrouter_polling/models"
+	"openrouter_polling/storage"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// batchTestClient 是测试批处理所属的客户端。
+const batchTestClient = "batch-client"
+
+// batchChatLine 返回一行指向聊天补全端点的批处理输入。
+func batchChatLine(customID, content string) string {
+	return `{"custom_id":"` + customID + `","method":"POST","url":"/v1/chat/completions","body":{"model":"` + stubUpstreamModel + `","messages":[{"role":"user","content":"` + content + `"}]}}`
+}
+
+// stubChatUpstream 对内容包含 "bad" 的请求返回 400，其余返回一个成功的聊天补全；started 非 nil 时每个请求开始时发送一次信号，
+// release 非 nil 时请求等待其关闭后才返回。
+func stubChatUpstream(started chan<- struct{}, release <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if started != nil {
+			started <- struct{}{}
+		}
+		if release != nil {
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(string(body), "bad") {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":{"message":"invalid messages","code":400}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"gen-1","object":"chat.completion","model":"` + stubUpstreamModel + `","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`))
+	}
+}
+
+// useBatchTest 初始化桩上游与批处理执行环境，批处理的并发与速率限制由调用者设置。
+func useBatchTest(t *testing.T, handler http.HandlerFunc) context.Context {
+	t.Helper()
+	useStubUpstream(t, handler)
+	config.AppSettings.BatchConcurrency = 4
+	config.AppSettings.BatchRequestsPerSecond = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	prevRuns := batchRuns
+	batchRuns = &batchRunRegistry{baseCtx: ctx, running: make(map[string]context.CancelCauseFunc)}
+	t.Cleanup(func() {
+		cancel()
+		batchRuns = prevRuns
+	})
+	return ctx
+}
+
+// createTestBatch 保存输入文件并创建一个处于 validating 状态的批处理。
+func createTestBatch(t *testing.T, expiresAt time.Time, lines ...string) storage.Batch {
+	t.Helper()
+	file := &storage.StoredFile{FileID: "file-" + t.Name(), ClientID: batchTestClient, Filename: "input.jsonl", Purpose: filePurposeBatch, Content: strings.Join(lines, "\n")}
+	if err := BatchStore.CreateFile(file); err != nil {
+		t.Fatalf("保存输入文件失败: %v", err)
+	}
+	batch := &storage.Batch{
+		BatchID:          "batch_" + t.Name(),
+		ClientID:         batchTestClient,
+		Endpoint:         batchEndpointChatCompletions,
+		InputFileID:      file.FileID,
+		CompletionWindow: batchCompletionWindow,
+		Status:           storage.BatchStatusValidating,
+		ExpiresAt:        expiresAt,
+	}
+	if err := BatchStore.CreateBatch(batch); err != nil {
+		t.Fatalf("创建批处理失败: %v", err)
+	}
+	return *batch
+}
+
+// getTestBatch 读取批处理的当前状态。
+func getTestBatch(t *testing.T, batchID string) *storage.Batch {
+	t.Helper()
+	batch, err := BatchStore.GetBatch(batchID, batchTestClient)
+	if err != nil {
+		t.Fatalf("读取批处理失败: %v", err)
+	}
+	return batch
+}
+
+// mustGetFileContent 返回当前客户端文件的内容。
+func mustGetFileContent(t *testing.T, fileID string) string {
+	t.Helper()
+	file, err := BatchStore.GetFile(fileID, batchTestClient)
+	if err != nil {
+		t.Fatalf("读取文件 %s 失败: %v", fileID, err)
+	}
+	return file.Content
+}
+
+// readBatchResultFile 读取结果文件并按 custom_id 索引其中的结果行；fileID 为空时返回空结果。
+func readBatchResultFile(t *testing.T, fileID string) map[string]models.BatchOutputLine {
+	t.Helper()
+	lines := make(map[string]models.BatchOutputLine)
+	if fileID == "" {
+		return lines
+	}
+	file, err := BatchStore.GetFile(fileID, batchTestClient)
+	if err != nil {
+		t.Fatalf("读取结果文件 %s 失败: %v", fileID, err)
+	}
+	if file.Purpose != filePurposeBatchOutput {
+		t.Errorf("结果文件 purpose = %q, 期望 %q", file.Purpose, filePurposeBatchOutput)
+	}
+	for _, raw := range strings.Split(strings.TrimSpace(file.Content), "\n") {
+		var line models.BatchOutputLine
+		if err := json.Unmarshal([]byte(raw), &line); err != nil {
+			t.Fatalf("结果行不是有效的 JSON: %q: %v", raw, err)
+		}
+		lines[line.CustomID] = line
+	}
+	return lines
+}
+
+func TestParseBatchInputValidation(t *testing.T) {
+	batch := &storage.Batch{BatchID: "batch_parse", Endpoint: batchEndpointChatCompletions}
+	tests := []struct {
+		name     string
+		content  string
+		wantCode string
+		wantLine int
+	}{
+		{"无效 JSON", "{not json", "invalid_json_line", 1},
+		{"缺少 custom_id", `{"method":"POST","url":"/v1/chat/completions","body":{"messages":[{"role":"user","content":"hi"}]}}`, "missing_required_parameter", 1},
+		{"custom_id 重复", batchChatLine("a", "hi") + "\n" + batchChatLine("a", "again"), "duplicate_custom_id", 2},
+		{"method 不是 POST", `{"custom_id":"a","method":"GET","url":"/v1/chat/completions","body":{"messages":[{"role":"user","content":"hi"}]}}`, "invalid_method", 1},
+		{"url 与 endpoint 不一致", `{"custom_id":"a","method":"POST","url":"/v1/embeddings","body":{"messages":[{"role":"user","content":"hi"}]}}`, "mismatched_endpoint", 1},
+		{"body 缺少 messages", `{"custom_id":"a","method":"POST","url":"/v1/chat/completions","body":{"model":"m"}}`, "invalid_request", 1},
+		{"空行不计入请求但计入行号", "\n\n{oops", "invalid_json_line", 3},
+		{"空文件", "\n  \n", "empty_file", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests, errs := parseBatchInput(batch, tt.content)
+			if len(errs) != 1 {
+				t.Fatalf("校验错误 = %+v, 期望恰好 1 处错误", errs)
+			}
+			if errs[0].Code != tt.wantCode {
+				t.Errorf("错误码 = %q, 期望 %q", errs[0].Code, tt.wantCode)
+			}
+			gotLine := 0
+			if errs[0].Line != nil {
+				gotLine = *errs[0].Line
+			}
+			if gotLine != tt.wantLine {
+				t.Errorf("错误行号 = %d, 期望 %d", gotLine, tt.wantLine)
+			}
+			if tt.wantCode == "duplicate_custom_id" && len(requests) != 1 {
+				t.Errorf("解析出 %d 个请求, 期望保留第一个 custom_id 的请求", len(requests))
+			}
+		})
+	}
+
+	requests, errs := parseBatchInput(batch, batchChatLine("a", "hi")+"\n\n"+batchChatLine("b", "there")+"\n")
+	if len(errs) != 0 {
+		t.Fatalf("有效输入返回了校验错误: %+v", errs)
+	}
+	if len(requests) != 2 || requests[0].LineIndex != 0 || requests[1].LineIndex != 2 {
+		t.Fatalf("解析结果 = %+v, 期望两个请求，行号分别为 0 和 2", requests)
+	}
+	for _, request := range requests {
+		if request.BatchID != batch.BatchID || request.Status != storage.BatchRequestStatusPending || !strings.HasPrefix(request.RequestID, "batch_req_") {
+			t.Errorf("请求 %+v 的批处理 ID、状态或请求 ID 不正确", request)
+		}
+	}
+}
+
+func TestFinalizeBatchWritesEveryResponseToOutputFile(t *testing.T) {
+	useBatchTest(t, stubChatUpstream(nil, nil))
+	batch := createTestBatch(t, time.Now().Add(time.Hour), batchChatLine("ok", "hi"), batchChatLine("rejected", "hi"), batchChatLine("never-ran", "hi"))
+	requests, errs := parseBatchInput(&batch, mustGetFileContent(t, batch.InputFileID))
+	if len(errs) != 0 {
+		t.Fatalf("解析输入失败: %+v", errs)
+	}
+	if _, err := BatchStore.StartBatch(batch.BatchID, requests, time.Now()); err != nil {
+		t.Fatalf("开始批处理失败: %v", err)
+	}
+	pending, _ := BatchStore.ListPendingBatchRequests(batch.BatchID)
+	results := map[string]struct {
+		status string
+		code   int
+		body   string
+	}{
+		"ok":       {storage.BatchRequestStatusCompleted, http.StatusOK, `{"id":"gen-1"}`},
+		"rejected": {storage.BatchRequestStatusFailed, http.StatusBadRequest, `{"error":{"message":"bad"}}`},
+	}
+	for i := range pending {
+		result, ok := results[pending[i].CustomID]
+		if !ok {
+			continue
+		}
+		pending[i].Status, pending[i].StatusCode, pending[i].Response = result.status, result.code, result.body
+		if err := BatchStore.RecordBatchRequestResult(&pending[i]); err != nil {
+			t.Fatalf("保存请求结果失败: %v", err)
+		}
+	}
+	if _, err := BatchStore.ExpirePendingBatchRequests(batch.BatchID); err != nil {
+		t.Fatalf("标记过期请求失败: %v", err)
+	}
+
+	finalizeBatch(getTestBatch(t, batch.BatchID), storage.BatchStatusExpired, Log.WithField("test", t.Name()))
+
+	final := getTestBatch(t, batch.BatchID)
+	if final.Status != storage.BatchStatusExpired || final.ExpiredAt == nil {
+		t.Errorf("批处理状态 = %s (expired_at: %v), 期望 expired", final.Status, final.ExpiredAt)
+	}
+	output := readBatchResultFile(t, final.OutputFileID)
+	if len(output) != 2 {
+		t.Fatalf("输出文件包含 %d 行, 期望得到上游响应的 2 个请求", len(output))
+	}
+	for customID, result := range results {
+		line := output[customID]
+		if line.Response == nil || line.Error != nil {
+			t.Errorf("%s: 结果行 = %+v, 期望包含 response 而不是 error", customID, line)
+			continue
+		}
+		if line.Response.StatusCode != result.code || string(line.Response.Body) != result.body {
+			t.Errorf("%s: response = %d %s, 期望 %d %s", customID, line.Response.StatusCode, line.Response.Body, result.code, result.body)
+		}
+	}
+	errorsFile := readBatchResultFile(t, final.ErrorFileID)
+	if len(errorsFile) != 1 || errorsFile["never-ran"].Error == nil || errorsFile["never-ran"].Error.Code != "batch_expired" {
+		t.Errorf("错误文件 = %+v, 期望只包含未执行请求的 batch_expired 错误", errorsFile)
+	}
+	if final.CompletedCount != 1 || final.FailedCount != 2 {
+		t.Errorf("完成/失败计数 = %d/%d, 期望 1/2", final.CompletedCount, final.FailedCount)
+	}
+}
+
+func TestRunBatchCompletesAndRecordsResults(t *testing.T) {
+	ctx := useBatchTest(t, stubChatUpstream(nil, nil))
+	batch := createTestBatch(t, time.Now().Add(time.Hour), batchChatLine("ok", "hello"), batchChatLine("rejected", "bad input"))
+
+	runBatch(ctx, batch)
+
+	final := getTestBatch(t, batch.BatchID)
+	if final.Status != storage.BatchStatusCompleted {
+		t.Fatalf("批处理状态 = %s, 期望 completed", final.Status)
+	}
+	if final.InProgressAt == nil || final.FinalizingAt == nil || final.CompletedAt == nil {
+		t.Errorf("状态时间点 in_progress=%v finalizing=%v completed=%v, 期望都已记录", final.InProgressAt, final.FinalizingAt, final.CompletedAt)
+	}
+	if final.TotalCount != 2 || final.CompletedCount != 1 || final.FailedCount != 1 {
+		t.Errorf("总数/完成/失败 = %d/%d/%d, 期望 2/1/1", final.TotalCount, final.CompletedCount, final.FailedCount)
+	}
+	output := readBatchResultFile(t, final.OutputFileID)
+	if line := output["ok"]; line.Response == nil || line.Response.StatusCode != http.StatusOK {
+		t.Errorf("ok 的结果行 = %+v, 期望 200 响应", line)
+	}
+	if line := output["rejected"]; line.Response == nil || line.Response.StatusCode != http.StatusBadRequest {
+		t.Errorf("rejected 的结果行 = %+v, 期望以 400 响应写入输出文件", line)
+	}
+	if final.ErrorFileID != "" {
+		t.Errorf("所有请求都得到了响应，不应生成错误文件 (error_file_id: %s)", final.ErrorFileID)
+	}
+}
+
+func TestRunBatchFailsInvalidInput(t *testing.T) {
+	ctx := useBatchTest(t, stubChatUpstream(nil, nil))
+	batch := createTestBatch(t, time.Now().Add(time.Hour), batchChatLine("a", "hi"), `{"custom_id":"b","method":"GET","url":"/v1/chat/completions","body":{}}`)
+
+	runBatch(ctx, batch)
+
+	final := getTestBatch(t, batch.BatchID)
+	if final.Status != storage.BatchStatusFailed || final.FailedAt == nil {
+		t.Fatalf("批处理状态 = %s (failed_at: %v), 期望 failed", final.Status, final.FailedAt)
+	}
+	var batchErrors models.BatchErrors
+	if err := json.Unmarshal([]byte(final.Errors), &batchErrors); err != nil || len(batchErrors.Data) != 1 || batchErrors.Data[0].Code != "invalid_method" {
+		t.Errorf("errors = %s, 期望一处 invalid_method 错误", final.Errors)
+	}
+	if pending, _ := BatchStore.ListPendingBatchRequests(batch.BatchID); len(pending) != 0 {
+		t.Errorf("校验失败后保存了 %d 个请求, 期望不保存任何请求", len(pending))
+	}
+}
+
+func TestRunBatchExpiresUnexecutedRequests(t *testing.T) {
+	var calls atomic.Int32
+	ctx := useBatchTest(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		stubChatUpstream(nil, nil)(w, r)
+	})
+	batch := createTestBatch(t, time.Now().Add(-time.Minute), batchChatLine("a", "hi"), batchChatLine("b", "hi"))
+
+	runBatch(ctx, batch)
+
+	final := getTestBatch(t, batch.BatchID)
+	if final.Status != storage.BatchStatusExpired {
+		t.Fatalf("批处理状态 = %s, 期望 expired", final.Status)
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("上游被请求了 %d 次, 期望过期的批处理不再发起请求", got)
+	}
+	if final.OutputFileID != "" {
+		t.Errorf("没有请求得到响应，不应生成输出文件 (output_file_id: %s)", final.OutputFileID)
+	}
+	errorsFile := readBatchResultFile(t, final.ErrorFileID)
+	for _, customID := range []string{"a", "b"} {
+		if line := errorsFile[customID]; line.Error == nil || line.Error.Code != "batch_expired" {
+			t.Errorf("%s 的错误行 = %+v, 期望 batch_expired", customID, line)
+		}
+	}
+}
+
+func TestCancelBatchStopsDispatchAndKeepsFinishedResults(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	useBatchTest(t, stubChatUpstream(started, release))
+	config.AppSettings.BatchConcurrency = 1
+	batch := createTestBatch(t, time.Now().Add(time.Hour), batchChatLine("first", "hi"), batchChatLine("second", "hi"), batchChatLine("third", "hi"))
+
+	batchRuns.start(batch)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("批处理没有开始执行请求")
+	}
+	// 与 CancelBatchHandler 相同：先进入 cancelling，再通知执行中的批处理停止发起新请求。
+	if ok, err := BatchStore.TransitionBatch(batch.BatchID, []string{storage.BatchStatusInProgress}, map[string]interface{}{
+		"status": storage.BatchStatusCancelling, "cancelling_at": time.Now(),
+	}); err != nil || !ok {
+		t.Fatalf("取消批处理失败: %v, %v", ok, err)
+	}
+	batchRuns.cancel(batch.BatchID)
+	close(release)
+
+	// 等待后台执行结束（从登记表中移除），结果文件此时已生成。
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		batchRuns.mu.Lock()
+		_, running := batchRuns.running[batch.BatchID]
+		batchRuns.mu.Unlock()
+		if !running {
+			break
+		}
+	}
+	final := getTestBatch(t, batch.BatchID)
+	if final.Status != storage.BatchStatusCancelled || final.CancelledAt == nil {
+		t.Fatalf("批处理状态 = %s, 期望 cancelled", final.Status)
+	}
+	if len(started) != 0 {
+		t.Errorf("取消后又发起了 %d 个上游请求", len(started))
+	}
+	output := readBatchResultFile(t, final.OutputFileID)
+	if len(output) != 1 || output["first"].Response == nil || output["first"].Response.StatusCode != http.StatusOK {
+		t.Errorf("输出文件 = %+v, 期望只包含取消前已在执行的请求", output)
+	}
+	if final.ErrorFileID != "" {
+		t.Errorf("取消的批处理不应为未执行的请求生成错误文件 (error_file_id: %s)", final.ErrorFileID)
+	}
+}
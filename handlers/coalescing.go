@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"openrouter_polling/config"
+	"openrouter_polling/middleware"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 请求合并相关的 HTTP 头部。
+const (
+	coalesceRequestHeader = "X-Coalesce"  // 请求级开关：on 启用，off 禁用，优先级高于全局配置
+	coalescedHeader       = "X-Coalesced" // 响应头：本次响应复用了另一个相同请求的上游调用
+)
+
+// coalescedFlight 是一次正在执行的上游调用。领头请求写出的状态码、头部和响应体字节被记录下来，
+// 并广播给所有合并到该调用的跟随请求；迟到的跟随者先收到已缓冲的前缀，再继续接收后续数据。
+type coalescedFlight struct {
+	mu            sync.Mutex
+	changed       chan struct{} // 有新数据或调用结束时关闭并替换，用于唤醒跟随者
+	headerWritten bool
+	statusCode    int
+	header        http.Header
+	body          []byte
+	done          bool
+	subscribers   int                // 仍在接收响应的客户端数（含领头请求）
+	followers     int                // 仍在接收响应的跟随者数
+	cancel        context.CancelFunc // 所有客户端都离开后取消上游调用
+}
+
+// publishHeader 记录领头请求的状态码和头部（只记录第一次）。
+func (f *coalescedFlight) publishHeader(statusCode int, header http.Header) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.headerWritten {
+		return
+	}
+	f.headerWritten = true
+	f.statusCode = statusCode
+	f.header = header
+	f.notifyLocked()
+}
+
+// append 追加领头请求写出的响应体字节。
+func (f *coalescedFlight) append(data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.body = append(f.body, data...)
+	f.notifyLocked()
+}
+
+// finish 标记上游调用结束。
+func (f *coalescedFlight) finish() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.done = true
+	f.notifyLocked()
+}
+
+// notifyLocked 唤醒所有等待中的跟随者。调用者必须持有 f.mu。
+func (f *coalescedFlight) notifyLocked() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// hasFollowers 判断是否还有跟随者在接收响应。
+func (f *coalescedFlight) hasFollowers() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.followers > 0
+}
+
+// requestCoalescer 按（客户端、规范化请求哈希）登记正在执行的上游调用。
+// 调用结束后即移除，之后到达的相同请求会发起新的调用（这不是响应缓存）。
+type requestCoalescer struct {
+	mu      sync.Mutex
+	flights map[string]*coalescedFlight
+}
+
+var coalescer = &requestCoalescer{flights: make(map[string]*coalescedFlight)}
+
+// join 加入已有的调用，或在不存在时登记一个新的调用。leader 为 true 表示调用者负责执行上游请求。
+func (rc *requestCoalescer) join(key string) (flight *coalescedFlight, leader bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if existing, ok := rc.flights[key]; ok {
+		existing.mu.Lock()
+		existing.subscribers++
+		existing.followers++
+		existing.mu.Unlock()
+		return existing, false
+	}
+	flight = &coalescedFlight{changed: make(chan struct{}), subscribers: 1}
+	rc.flights[key] = flight
+	return flight, true
+}
+
+// unsubscribe 在一个客户端离开时调用。最后一个客户端离开后立即将调用从登记表中移除并取消上游调用，
+// 之后到达的相同请求会成为新的领头请求，而不是加入一个已被取消的调用。
+// 计数与移除都在 rc.mu 下进行，与 join 互斥，因此不会有跟随者加入一个即将被取消的调用。
+func (rc *requestCoalescer) unsubscribe(key string, flight *coalescedFlight, follower bool) {
+	rc.mu.Lock()
+	flight.mu.Lock()
+	flight.subscribers--
+	if follower {
+		flight.followers--
+	}
+	remaining, cancel := flight.subscribers, flight.cancel
+	flight.mu.Unlock()
+	if remaining <= 0 && rc.flights[key] == flight {
+		delete(rc.flights, key)
+	}
+	rc.mu.Unlock()
+	if remaining <= 0 && cancel != nil {
+		cancel()
+	}
+}
+
+// leave 在上游调用结束后将其移除。
+func (rc *requestCoalescer) leave(key string, flight *coalescedFlight) {
+	rc.mu.Lock()
+	if rc.flights[key] == flight {
+		delete(rc.flights, key)
+	}
+	rc.mu.Unlock()
+}
+
+// coalescingWriter 包装领头请求的 ResponseWriter，将写出的所有内容同时广播给跟随者。
+// 领头请求的客户端断开后，只要还有跟随者，写入错误就会被忽略，使上游调用继续进行。
+type coalescingWriter struct {
+	gin.ResponseWriter
+	flight *coalescedFlight
+}
+
+func (w *coalescingWriter) publishHeader() {
+	w.flight.publishHeader(w.ResponseWriter.Status(), w.ResponseWriter.Header().Clone())
+}
+
+func (w *coalescingWriter) Write(data []byte) (int, error) {
+	w.publishHeader()
+	w.flight.append(data)
+	n, err := w.ResponseWriter.Write(data)
+	if err != nil && w.flight.hasFollowers() {
+		return len(data), nil
+	}
+	return n, err
+}
+
+func (w *coalescingWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *coalescingWriter) WriteHeaderNow() {
+	w.publishHeader()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *coalescingWriter) Flush() {
+	w.publishHeader()
+	w.ResponseWriter.Flush()
+}
+
+// coalescingEnabled 根据请求头和全局配置决定本次请求是否参与合并。
+func coalescingEnabled(c *gin.Context) bool {
+	switch strings.ToLower(strings.TrimSpace(c.GetHeader(coalesceRequestHeader))) {
+	case "on", "true":
+		return true
+	case "off", "false":
+		return false
+	}
+	return config.AppSettings.RequestCoalescingEnabled
+}
+
+// withCoalescing 将同一客户端同时发出的、规范化内容完全相同的请求合并为一次上游调用。
+// 第一个请求通过 run 正常执行，其余请求等待并接收相同的响应（流式请求逐行接收相同的 SSE 数据）。
+// 只要还有任何一个客户端在接收响应，上游调用就会继续；所有客户端都断开后才取消。
+// payload: 用于计算合并键的规范化请求内容（包含 stream 字段）。
+func withCoalescing(c *gin.Context, payload []byte, run func()) {
+	if !coalescingEnabled(c) {
+		run()
+		return
+	}
+	hash := sha256.Sum256(payload)
+	key := middleware.ClientID(c) + "\x00" + hex.EncodeToString(hash[:])
+
+	flight, leader := coalescer.join(key)
+	if !leader {
+		Log.Debugf("withCoalescing: 客户端 %s 的请求与正在执行的相同请求合并。", middleware.ClientID(c))
+		defer coalescer.unsubscribe(key, flight, true)
+		followCoalescedFlight(c, flight)
+		return
+	}
+
+	// 上游调用的生命周期与领头请求的客户端解耦，由所有订阅者共同决定何时取消。
+	clientOriginalContext := c.Request.Context()
+	flightCtx, cancel := context.WithCancel(context.WithoutCancel(clientOriginalContext))
+	flight.mu.Lock()
+	flight.cancel = cancel
+	flight.mu.Unlock()
+	stopWatching := context.AfterFunc(clientOriginalContext, func() { coalescer.unsubscribe(key, flight, false) })
+
+	originalWriter := c.Writer
+	originalRequest := c.Request
+	c.Writer = &coalescingWriter{ResponseWriter: originalWriter, flight: flight}
+	c.Request = c.Request.WithContext(flightCtx)
+	defer func() {
+		c.Writer = originalWriter
+		c.Request = originalRequest
+		coalescer.leave(key, flight)
+		flight.finish()
+		if stopWatching() {
+			coalescer.unsubscribe(key, flight, false)
+		}
+		cancel()
+	}()
+
+	run()
+}
+
+// followCoalescedFlight 将领头请求的响应重放给跟随请求：先写出已缓冲的部分，再随领头请求的进度继续写出。
+func followCoalescedFlight(c *gin.Context, flight *coalescedFlight) {
+	clientOriginalContext := c.Request.Context()
+	headerSent := false
+	offset := 0
+
+	for {
+		flight.mu.Lock()
+		headerWritten, statusCode, header := flight.headerWritten, flight.statusCode, flight.header
+		pending := flight.body[offset:]
+		done := flight.done
+		changed := flight.changed
+		flight.mu.Unlock()
+
+		if headerWritten && !headerSent {
+			for name, values := range replayableHeaders(header) {
+				for _, value := range values {
+					c.Writer.Header().Add(name, value)
+				}
+			}
+			c.Header(coalescedHeader, "true")
+			c.Status(statusCode)
+			c.Writer.WriteHeaderNow()
+			headerSent = true
+		}
+		if len(pending) > 0 {
+			if _, err := c.Writer.Write(pending); err != nil {
+				Log.Warnf("followCoalescedFlight: 写入合并响应失败: %v (客户端可能已断开)", err)
+				return
+			}
+			offset += len(pending)
+		}
+		if headerSent {
+			c.Writer.Flush()
+		}
+
+		if done {
+			if !headerSent {
+				sendErrorResponse(c, http.StatusBadGateway, "合并的上游请求未产生响应。", "api_error", false, clientOriginalContext)
+			}
+			return
+		}
+		select {
+		case <-changed:
+		case <-clientOriginalContext.Done():
+			Log.Warnf("followCoalescedFlight: 客户端在接收合并响应时断开连接。")
+			return
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCoalescerDropsAbandonedFlight(t *testing.T) {
+	rc := &requestCoalescer{flights: make(map[string]*coalescedFlight)}
+	flight, leader := rc.join("k")
+	if !leader {
+		t.Fatal("第一个请求期望成为领头请求")
+	}
+	flightCtx, cancel := context.WithCancel(context.Background())
+	flight.cancel = cancel
+
+	// 领头请求的客户端在任何跟随者加入前断开。
+	rc.unsubscribe("k", flight, false)
+	if flightCtx.Err() == nil {
+		t.Error("所有客户端离开后期望取消上游调用")
+	}
+	next, leader := rc.join("k")
+	if !leader || next == flight {
+		t.Error("期望下一个相同请求成为新的领头请求，而不是加入已取消的调用")
+	}
+
+	// 已取消调用的领头请求随后返回时不会移除新的调用。
+	rc.leave("k", flight)
+	if rc.flights["k"] != next {
+		t.Error("旧调用结束时不应移除新的调用")
+	}
+}
+
+func TestCoalescerKeepsFlightWhileFollowersRemain(t *testing.T) {
+	rc := &requestCoalescer{flights: make(map[string]*coalescedFlight)}
+	flight, _ := rc.join("k")
+	flightCtx, cancel := context.WithCancel(context.Background())
+	flight.cancel = cancel
+	if _, leader := rc.join("k"); leader {
+		t.Fatal("第二个相同请求期望成为跟随者")
+	}
+
+	rc.unsubscribe("k", flight, false)
+	if flightCtx.Err() != nil {
+		t.Error("仍有跟随者时不应取消上游调用")
+	}
+	if joined, leader := rc.join("k"); leader || joined != flight {
+		t.Error("仍有跟随者时新的相同请求期望加入已有调用")
+	}
+}
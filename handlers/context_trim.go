@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"openrouter_polling/config"
+	"openrouter_polling/middleware"
+	"openrouter_polling/models"
+	"openrouter_polling/utils"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// 上下文裁剪相关的 HTTP 头部。
+const (
+	contextTrimRequestHeader  = "X-Context-Trim"    // 请求级开关：auto 启用，off 禁用，优先级高于客户端和全局配置
+	contextTrimmedHeader      = "X-Context-Trimmed" // 响应头：本次请求被丢弃的消息条数
+	contextTrimSafetyMarginPc = 5                   // 估算误差的安全余量（上下文窗口的百分比）
+)
+
+// contextTrimEnabled 根据请求头、客户端配置和全局配置决定本次请求是否启用上下文自动裁剪。
+func contextTrimEnabled(c *gin.Context) bool {
+	switch strings.ToLower(strings.TrimSpace(c.GetHeader(contextTrimRequestHeader))) {
+	case config.ContextTrimModeAuto, "on", "true":
+		return true
+	case config.ContextTrimModeOff, "false":
+		return false
+	}
+	if config.ListContains(config.AppSettings.ContextTrimClients, middleware.ClientID(c)) {
+		return true
+	}
+	return config.AppSettings.ContextTrimMode == config.ContextTrimModeAuto
+}
+
+// applyContextTrimPolicy 在请求转发前检查提示词是否可能超出模型上下文窗口，
+// 如超出则丢弃最早的非 system 轮次，并通过 X-Context-Trimmed 头部报告丢弃的消息数。
+// 必须在写入任何响应头之前调用。
+func applyContextTrimPolicy(c *gin.Context, requestData *models.ChatCompletionRequest, logEntry *logrus.Entry) {
+	if !contextTrimEnabled(c) {
+		return
+	}
+
+	modelInfo, ok := modelCatalog.lookup(c.Request.Context(), requestData.Model)
+	if !ok || modelInfo.ContextLength <= 0 {
+		logEntry.Debugf("applyContextTrimPolicy: 无法获取模型 %s 的上下文长度，跳过裁剪。", requestData.Model)
+		return
+	}
+
+	reserved := config.AppSettings.ContextTrimReserveTokens
+	if requestData.MaxTokens != nil && *requestData.MaxTokens > 0 {
+		reserved = *requestData.MaxTokens
+	}
+	budget := modelInfo.ContextLength - reserved - modelInfo.ContextLength*contextTrimSafetyMarginPc/100
+	if budget <= 0 {
+		logEntry.Warnf("applyContextTrimPolicy: 模型 %s 的上下文长度 (%d) 不足以容纳预留输出 (%d)，跳过裁剪。",
+			requestData.Model, modelInfo.ContextLength, reserved)
+		return
+	}
+
+	estimated := utils.EstimatePromptTokens(requestData.Messages, requestData.Tools)
+	if estimated <= budget {
+		c.Header(contextTrimmedHeader, "0")
+		return
+	}
+
+	trimmed, dropped := trimMessagesToBudget(requestData.Messages, budget-utils.EstimateToolsTokens(requestData.Tools))
+	requestData.Messages = trimmed
+	c.Header(contextTrimmedHeader, strconv.Itoa(dropped))
+	logEntry.WithFields(logrus.Fields{
+		"estimated_tokens": estimated,
+		"budget_tokens":    budget,
+		"dropped_messages": dropped,
+	}).Info("提示词超出模型上下文窗口，已裁剪最早的对话轮次。")
+}
+
+// messageGroup 是裁剪时不可拆分的一组连续消息：
+// 一条普通消息，或一条带 tool_calls 的 assistant 消息及其后紧随的 tool 结果消息。
+type messageGroup struct {
+	indexes []int
+	tokens  int
+}
+
+// trimMessagesToBudget 丢弃最早的非 system 消息组，直到估算 token 数不超过 budget。
+// system 消息始终保留；最后一个消息组（通常是最新的用户输入）也始终保留；
+// 工具调用与其结果作为整体保留或丢弃，避免产生孤立的 tool 消息。
+// 返回裁剪后的消息列表和被丢弃的消息条数。
+func trimMessagesToBudget(messages []models.Message, budget int) ([]models.Message, int) {
+	// 与 applyContextTrimPolicy 的估算口径一致：包含整个请求的固定开销。
+	total := utils.EstimatePromptTokens(messages, nil)
+	groups := make([]*messageGroup, 0)
+	var current *messageGroup
+	for i, msg := range messages {
+		tokens := utils.EstimateMessageTokens(msg)
+		if msg.Role == "system" || msg.Role == "developer" {
+			continue
+		}
+		// tool 结果消息总是归入前一个组，使其与发起调用的 assistant 消息保持在一起。
+		if msg.Role == "tool" && current != nil {
+			current.indexes = append(current.indexes, i)
+			current.tokens += tokens
+			continue
+		}
+		current = &messageGroup{indexes: []int{i}, tokens: tokens}
+		groups = append(groups, current)
+	}
+
+	dropSet := make(map[int]bool)
+	for g := 0; g < len(groups)-1 && total > budget; g++ {
+		for _, idx := range groups[g].indexes {
+			dropSet[idx] = true
+		}
+		total -= groups[g].tokens
+	}
+	if len(dropSet) == 0 {
+		return messages, 0
+	}
+
+	kept := make([]models.Message, 0, len(messages)-len(dropSet))
+	for i, msg := range messages {
+		if !dropSet[i] {
+			kept = append(kept, msg)
+		}
+	}
+	return kept, len(dropSet)
+}
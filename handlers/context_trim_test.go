@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"openrouter_polling/models"
+	"openrouter_polling/utils"
+	"reflect"
+	"testing"
+)
+
+func TestTrimMessagesToBudget(t *testing.T) {
+	toolCallID := "call_1"
+	msg := func(role, content string) models.Message {
+		return models.Message{Role: role, Content: content}
+	}
+	system := msg("system", "you are helpful")
+	user1 := msg("user", "first question")
+	assistantCall := models.Message{Role: "assistant", ToolCalls: &[]models.ToolCall{{ID: toolCallID, Type: "function", Function: models.ToolCallFunction{Name: "lookup", Arguments: `{"q":"x"}`}}}}
+	toolResult := models.Message{Role: "tool", Content: "tool output", ToolCallID: &toolCallID}
+	assistant1 := msg("assistant", "first answer")
+	user2 := msg("user", "latest question")
+	conversation := []models.Message{system, user1, assistantCall, toolResult, assistant1, user2}
+
+	full := utils.EstimatePromptTokens(conversation, nil)
+	messageTokens := full - utils.EstimatePromptTokens(nil, nil)
+	user1Tokens := utils.EstimateMessageTokens(user1)
+
+	tests := []struct {
+		name        string
+		budget      int
+		wantRoles   []string
+		wantDropped int
+	}{
+		{
+			name:        "预算充足时不裁剪",
+			budget:      full,
+			wantRoles:   []string{"system", "user", "assistant", "tool", "assistant", "user"},
+			wantDropped: 0,
+		},
+		{
+			name:        "预算比较包含请求固定开销",
+			budget:      messageTokens,
+			wantRoles:   []string{"system", "assistant", "tool", "assistant", "user"},
+			wantDropped: 1,
+		},
+		{
+			name:        "tool 结果与前一条 assistant 消息一起丢弃",
+			budget:      full - user1Tokens - 1,
+			wantRoles:   []string{"system", "assistant", "user"},
+			wantDropped: 3,
+		},
+		{
+			name:        "system 消息和最后一轮始终保留",
+			budget:      0,
+			wantRoles:   []string{"system", "user"},
+			wantDropped: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := append([]models.Message(nil), conversation...)
+			kept, dropped := trimMessagesToBudget(input, tt.budget)
+			if dropped != tt.wantDropped {
+				t.Errorf("丢弃条数 = %d, 期望 %d", dropped, tt.wantDropped)
+			}
+			roles := make([]string, 0, len(kept))
+			for _, m := range kept {
+				roles = append(roles, m.Role)
+			}
+			if !reflect.DeepEqual(roles, tt.wantRoles) {
+				t.Errorf("保留的消息角色 = %v, 期望 %v", roles, tt.wantRoles)
+			}
+			if len(kept) > 0 && kept[len(kept)-1].Content != user2.Content {
+				t.Errorf("最后一条消息 = %v, 期望保留最新的用户输入", kept[len(kept)-1].Content)
+			}
+		})
+	}
+}
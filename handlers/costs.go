@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"openrouter_polling/apimanager"
+	"openrouter_polling/middleware"
+	"openrouter_polling/models"
+	"openrouter_polling/storage"
+	"openrouter_polling/utils"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// costDayLayout 费用按 UTC 日期累计时使用的日期格式。
+const costDayLayout = "2006-01-02"
+
+// BudgetWarningHeader 客户端费用接近预算时附带的响应头部。
+const BudgetWarningHeader = "X-Budget-Warning"
+
+// parsePrice 解析 OpenRouter 的字符串价格。无法解析或为负数（价格可变）时按 0 计算。
+func parsePrice(price string) float64 {
+	v, err := strconv.ParseFloat(price, 64)
+	if err != nil || v < 0 {
+		return 0
+	}
+	return v
+}
+
+// requestCost 按模型定价和用量计算单次请求的费用（美元）。
+// 命中缓存的输入 token 在定价提供 input_cache_read 时按缓存价格计算。
+func requestCost(pricing *models.OpenRouterPricing, usage *models.Usage) float64 {
+	if pricing == nil {
+		return 0
+	}
+	cost := parsePrice(pricing.Request)
+	if usage == nil {
+		return cost
+	}
+	promptTokens := usage.PromptTokens
+	if usage.PromptTokensDetails != nil && pricing.InputCacheRead != "" {
+		cached := usage.PromptTokensDetails.CachedTokens
+		promptTokens -= cached
+		cost += float64(cached) * parsePrice(pricing.InputCacheRead)
+	}
+	cost += float64(promptTokens) * parsePrice(pricing.Prompt)
+	cost += float64(usage.CompletionTokens) * parsePrice(pricing.Completion)
+	return cost
+}
+
+// recordRequestCost 在上游请求成功后累计本次请求的用量与费用。
+// 定价查询可能需要刷新模型目录，因此在后台协程中完成，不阻塞请求返回。
+func recordRequestCost(c *gin.Context, apiKeyStatus *apimanager.ApiKeyStatus, payload []byte) {
+	if CostStore == nil {
+		return
+	}
+	var withModel struct {
+		Model string `json:"model"`
+	}
+	_ = json.Unmarshal(payload, &withModel)
+	clientID := middleware.ClientID(c)
+	usage := middleware.ReportedUsage(c)
+	generationID := upstreamGenerationID(c)
+	apiKey := apiKeyStatus.Key
+	keySuffix := utils.SafeSuffix(apiKey)
+
+	go func() {
+		record := &storage.UsageCost{
+			Day:       time.Now().UTC().Format(costDayLayout),
+			ClientID:  clientID,
+			KeySuffix: keySuffix,
+			Model:     withModel.Model,
+			Requests:  1,
+		}
+		var pricing *models.OpenRouterPricing
+		if model, ok := modelCatalog.lookup(context.Background(), withModel.Model); ok {
+			pricing = model.Pricing
+		}
+		if usage != nil {
+			record.PromptTokens = int64(usage.PromptTokens)
+			record.CompletionTokens = int64(usage.CompletionTokens)
+			if usage.PromptTokensDetails != nil {
+				record.CachedTokens = int64(usage.PromptTokensDetails.CachedTokens)
+			}
+		}
+		record.CostUSD = requestCost(pricing, usage)
+		if err := CostStore.AddUsage(record); err != nil {
+			Log.Errorf("recordRequestCost: 累计客户端 %s 的费用失败: %v", clientID, err)
+			return
+		}
+		Log.Debugf("recordRequestCost: 客户端 %s 使用模型 %s 花费 $%.6f (密钥: %s)。", clientID, withModel.Model, record.CostUSD, keySuffix)
+
+		// 估算费用随后由生成统计中的实际费用修正（如果启用）。
+		enqueueGenerationStats(&storage.GenerationRecord{
+			GenerationID:     generationID,
+			Day:              record.Day,
+			ClientID:         clientID,
+			KeySuffix:        keySuffix,
+			Model:            withModel.Model,
+			PromptTokens:     record.PromptTokens,
+			CompletionTokens: record.CompletionTokens,
+			EstimatedCostUSD: record.CostUSD,
+		}, apiKey)
+	}()
+}
+
+// checkClientBudget 检查当前客户端的日/月预算。超出时返回错误信息；
+// 已用比例达到预警阈值时写入 X-Budget-Warning 响应头。查询失败时放行请求。
+func checkClientBudget(c *gin.Context) (exceeded bool, message string) {
+	if CostStore == nil {
+		return false, ""
+	}
+	clientID := middleware.ClientID(c)
+	budget, err := CostStore.GetBudget(clientID)
+	if err != nil {
+		if !errors.Is(err, storage.ErrBudgetNotFound) {
+			Log.Errorf("checkClientBudget: 读取客户端 %s 的预算失败: %v", clientID, err)
+		}
+		return false, ""
+	}
+
+	now := time.Now().UTC()
+	today := now.Format(costDayLayout)
+	periods := []struct {
+		name  string
+		from  string
+		limit float64
+	}{
+		{"每日", today, budget.DailyLimitUSD},
+		{"每月", now.AddDate(0, 0, 1-now.Day()).Format(costDayLayout), budget.MonthlyLimitUSD},
+	}
+	for _, period := range periods {
+		if period.limit <= 0 {
+			continue
+		}
+		spent, err := CostStore.SumClientCost(clientID, period.from, today)
+		if err != nil {
+			Log.Errorf("checkClientBudget: 统计客户端 %s 的费用失败: %v", clientID, err)
+			return false, ""
+		}
+		if spent >= period.limit {
+			Log.Warnf("checkClientBudget: 客户端 %s 已超出%s预算 ($%.4f / $%.4f)。", clientID, period.name, spent, period.limit)
+			return true, fmt.Sprintf("客户端 '%s' 已超出%s预算 ($%.4f / $%.4f)。", clientID, period.name, spent, period.limit)
+		}
+		if budget.WarnThreshold > 0 && spent >= period.limit*budget.WarnThreshold {
+			c.Header(BudgetWarningHeader, fmt.Sprintf("%s预算已使用 %.0f%% ($%.4f / $%.4f)", period.name, spent/period.limit*100, spent, period.limit))
+		}
+	}
+	return false, ""
+}
+
+// BudgetRequest 是创建或更新客户端预算的请求体。
+type BudgetRequest struct {
+	ClientID        string   `json:"client_id" binding:"required"`
+	DailyLimitUSD   float64  `json:"daily_limit_usd"`
+	MonthlyLimitUSD float64  `json:"monthly_limit_usd"`
+	WarnThreshold   *float64 `json:"warn_threshold"` // 省略时默认为 0.8
+}
+
+// ListBudgetsHandler 处理 `/admin/budgets` GET 请求。
+func ListBudgetsHandler(c *gin.Context) {
+	budgets, err := CostStore.ListBudgets()
+	if err != nil {
+		Log.Errorf("ListBudgetsHandler: 读取预算列表失败: %v", err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "读取预算列表时发生内部错误。", Type: "internal_server_error"}})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": budgets})
+}
+
+// SaveBudgetHandler 处理 `/admin/budgets` POST 请求，创建或更新客户端预算。
+func SaveBudgetHandler(c *gin.Context) {
+	var req BudgetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		Log.Warnf("SaveBudgetHandler: 无效的预算请求体: %v", err)
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "请求数据无效: " + err.Error(), Type: "invalid_request_error"}})
+		return
+	}
+	warnThreshold := 0.8
+	if req.WarnThreshold != nil {
+		warnThreshold = *req.WarnThreshold
+	}
+	if req.DailyLimitUSD < 0 || req.MonthlyLimitUSD < 0 || warnThreshold < 0 || warnThreshold > 1 {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "预算额度不能为负数，预警阈值必须在 0 到 1 之间。", Type: "invalid_request_error"}})
+		return
+	}
+
+	budget := &storage.ClientBudget{
+		ClientID:        req.ClientID,
+		DailyLimitUSD:   req.DailyLimitUSD,
+		MonthlyLimitUSD: req.MonthlyLimitUSD,
+		WarnThreshold:   warnThreshold,
+	}
+	if err := CostStore.SaveBudget(budget); err != nil {
+		Log.Errorf("SaveBudgetHandler: 保存客户端 %s 的预算失败: %v", req.ClientID, err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "保存预算时发生内部错误。", Type: "internal_server_error"}})
+		return
+	}
+	Log.Infof("SaveBudgetHandler: 已设置客户端 %s 的预算 (每日 $%.4f, 每月 $%.4f, 预警阈值 %.2f)。", req.ClientID, req.DailyLimitUSD, req.MonthlyLimitUSD, warnThreshold)
+	c.JSON(http.StatusOK, gin.H{"message": "客户端 '" + req.ClientID + "' 的预算已保存。"})
+}
+
+// DeleteBudgetHandler 处理 `/admin/budgets/:client_id` DELETE 请求。
+func DeleteBudgetHandler(c *gin.Context) {
+	clientID := c.Param("client_id")
+	if err := CostStore.DeleteBudget(clientID); err != nil {
+		if errors.Is(err, storage.ErrBudgetNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: models.ErrorDetail{
+				Message: "未找到客户端 '" + clientID + "' 的预算。", Type: "budget_not_found"}})
+			return
+		}
+		Log.Errorf("DeleteBudgetHandler: 删除客户端 %s 的预算失败: %v", clientID, err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "删除预算时发生内部错误。", Type: "internal_server_error"}})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "客户端 '" + clientID + "' 的预算已删除。"})
+}
+
+// CostReportHandler 处理 `/admin/costs` GET 请求。
+// 支持的查询参数：from、to（日期，含）、client、model、group_by（day/client/key/model）、format（json/csv）。
+func CostReportHandler(c *gin.Context) {
+	filter := storage.CostReportFilter{
+		FromDay:  c.Query("from"),
+		ToDay:    c.Query("to"),
+		ClientID: c.Query("client"),
+		Model:    c.Query("model"),
+		GroupBy:  c.Query("group_by"),
+	}
+	for param, day := range map[string]string{"from": filter.FromDay, "to": filter.ToDay} {
+		if _, err := time.Parse(costDayLayout, day); day != "" && err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorDetail{
+				Message: "日期格式无效，应为 YYYY-MM-DD。", Type: "invalid_request_error", Param: param}})
+			return
+		}
+	}
+	if !storage.ValidCostReportGroupBy(filter.GroupBy) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "无效的分组维度。有效值为: day, client, key, model", Type: "invalid_request_error", Param: "group_by"}})
+		return
+	}
+
+	rows, err := CostStore.CostReport(filter)
+	if err != nil {
+		Log.Errorf("CostReportHandler: 查询费用报表失败: %v", err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "查询费用报表时发生内部错误。", Type: "internal_server_error"}})
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		writeCostReportCSV(c, rows)
+		return
+	}
+	var totalCost float64
+	var totalRequests int64
+	for _, row := range rows {
+		totalCost += row.CostUSD
+		totalRequests += row.Requests
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":           rows,
+		"total_requests": totalRequests,
+		"total_cost_usd": totalCost,
+	})
+}
+
+// writeCostReportCSV 以 CSV 附件形式输出费用报表。
+func writeCostReportCSV(c *gin.Context, rows []storage.UsageCost) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="costs-%s.csv"`, time.Now().UTC().Format(costDayLayout)))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	_ = w.Write([]string{"day", "client", "key", "model", "requests", "prompt_tokens", "completion_tokens", "cached_tokens", "cost_usd"})
+	for _, row := range rows {
+		_ = w.Write([]string{
+			row.Day, row.ClientID, row.KeySuffix, row.Model,
+			strconv.FormatInt(row.Requests, 10),
+			strconv.FormatInt(row.PromptTokens, 10),
+			strconv.FormatInt(row.CompletionTokens, 10),
+			strconv.FormatInt(row.CachedTokens, 10),
+			strconv.FormatFloat(row.CostUSD, 'f', 6, 64),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		Log.Errorf("CostReportHandler: 写入 CSV 报表失败: %v", err)
+	}
+}
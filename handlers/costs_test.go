@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"openrouter_polling/config"
+	"openrouter_polling/models"
+	"openrouter_polling/storage"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestCost(t *testing.T) {
+	pricing := &models.OpenRouterPricing{Prompt: "0.000001", Completion: "0.000002"}
+	cachedPricing := &models.OpenRouterPricing{Prompt: "0.000001", Completion: "0.000002", InputCacheRead: "0.0000001"}
+	usage := func(prompt, cached, completion int) *models.Usage {
+		u := &models.Usage{PromptTokens: prompt, CompletionTokens: completion, TotalTokens: prompt + completion}
+		if cached > 0 {
+			u.PromptTokensDetails = &models.PromptTokensDetails{CachedTokens: cached}
+		}
+		return u
+	}
+	tests := []struct {
+		name    string
+		pricing *models.OpenRouterPricing
+		usage   *models.Usage
+		want    float64
+	}{
+		{"没有定价时按 0 计算", nil, usage(1000, 0, 500), 0},
+		{"按输入和输出 token 计价", pricing, usage(1000, 0, 500), 0.002},
+		{"命中缓存的输入 token 按缓存价格计算", cachedPricing, usage(1000, 400, 500), 600*0.000001 + 400*0.0000001 + 500*0.000002},
+		{"定价没有缓存价格时按普通输入价格计算", pricing, usage(1000, 400, 500), 0.002},
+		{"按次计费且没有用量", &models.OpenRouterPricing{Request: "0.01"}, nil, 0.01},
+		{"可变价格按 0 计算", &models.OpenRouterPricing{Prompt: "-1", Completion: "0.000002"}, usage(1000, 0, 500), 0.001},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requestCost(tt.pricing, tt.usage); math.Abs(got-tt.want) > 1e-12 {
+				t.Errorf("费用 = %.9f, 期望 %.9f", got, tt.want)
+			}
+		})
+	}
+}
+
+// useCostStore 在桩上游的测试数据库上启用费用统计。
+func useCostStore(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	db := useStubUpstream(t, handler)
+	if err := db.AutoMigrate(&storage.UsageCost{}, &storage.ClientBudget{}); err != nil {
+		t.Fatalf("迁移测试数据库失败: %v", err)
+	}
+	CostStore = storage.NewCostStore(db)
+}
+
+func addTestUsage(t *testing.T, day, client, model string, cost float64) {
+	t.Helper()
+	if err := CostStore.AddUsage(&storage.UsageCost{Day: day, ClientID: client, KeySuffix: "0001", Model: model, Requests: 1, PromptTokens: 100, CompletionTokens: 50, CostUSD: cost}); err != nil {
+		t.Fatalf("累计用量失败: %v", err)
+	}
+}
+
+func TestCheckClientBudget(t *testing.T) {
+	today := time.Now().UTC().Format(costDayLayout)
+	tests := []struct {
+		name        string
+		budget      *storage.ClientBudget
+		spent       float64
+		wantBlocked string // 非空时期望超出预算且错误信息包含该内容
+		wantWarning string // 非空时期望预警头部包含该内容
+	}{
+		{"没有预算时放行", nil, 100, "", ""},
+		{"低于预警阈值时放行", &storage.ClientBudget{DailyLimitUSD: 1, WarnThreshold: 0.8}, 0.5, "", ""},
+		{"达到预警阈值时附带预警头部", &storage.ClientBudget{DailyLimitUSD: 1, WarnThreshold: 0.8}, 0.9, "", "每日预算已使用 90%"},
+		{"超出每月预算", &storage.ClientBudget{DailyLimitUSD: 10, MonthlyLimitUSD: 0.5, WarnThreshold: 0.8}, 0.6, "每月预算", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCostStore(t, func(w http.ResponseWriter, r *http.Request) {})
+			if tt.budget != nil {
+				tt.budget.ClientID = config.AnonymousClientName
+				if err := CostStore.SaveBudget(tt.budget); err != nil {
+					t.Fatalf("保存预算失败: %v", err)
+				}
+			}
+			addTestUsage(t, today, config.AnonymousClientName, stubUpstreamModel, tt.spent)
+			addTestUsage(t, today, "other-client", stubUpstreamModel, 100) // 其他客户端的费用不计入
+
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			exceeded, message := checkClientBudget(c)
+			if exceeded != (tt.wantBlocked != "") || !strings.Contains(message, tt.wantBlocked) {
+				t.Errorf("checkClientBudget = %v, %q, 期望超出预算: %v", exceeded, message, tt.wantBlocked != "")
+			}
+			warning := recorder.Header().Get(BudgetWarningHeader)
+			if (warning != "") != (tt.wantWarning != "") || !strings.Contains(warning, tt.wantWarning) {
+				t.Errorf("%s = %q, 期望 %q", BudgetWarningHeader, warning, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestExceededBudgetRejectsRequestWith402(t *testing.T) {
+	var calls atomic.Int32
+	useCostStore(t, func(w http.ResponseWriter, r *http.Request) { calls.Add(1) })
+	if err := CostStore.SaveBudget(&storage.ClientBudget{ClientID: config.AnonymousClientName, DailyLimitUSD: 1, WarnThreshold: 0.8}); err != nil {
+		t.Fatalf("保存预算失败: %v", err)
+	}
+	addTestUsage(t, time.Now().UTC().Format(costDayLayout), config.AnonymousClientName, stubUpstreamModel, 1.5)
+
+	recorder := serveHandler(ChatCompletionsHandler, "/v1/chat/completions", "/v1/chat/completions",
+		`{"model":"`+stubUpstreamModel+`","messages":[{"role":"user","content":"hi"}]}`)
+	if recorder.Code != http.StatusPaymentRequired {
+		t.Errorf("状态码 = %d, 期望 402", recorder.Code)
+	}
+	if !strings.Contains(recorder.Body.String(), "insufficient_quota") {
+		t.Errorf("响应体 = %q, 期望 insufficient_quota 错误", recorder.Body.String())
+	}
+	if got := calls.Load(); got != 0 {
+		t.Errorf("上游被请求了 %d 次, 期望超出预算时不占用密钥", got)
+	}
+}
+
+func TestCostReportCSV(t *testing.T) {
+	useCostStore(t, func(w http.ResponseWriter, r *http.Request) {})
+	addTestUsage(t, "2026-01-01", "alice", "model/a", 0.25)
+	addTestUsage(t, "2026-01-02", "alice", "model/a", 0.5)
+	addTestUsage(t, "2026-01-02", "bob", "model/b", 1)
+	addTestUsage(t, "2026-01-03", "alice", "model/b", 2) // 超出日期范围
+
+	router := gin.New()
+	router.GET("/admin/costs", CostReportHandler)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/costs?from=2026-01-01&to=2026-01-02&group_by=model&format=csv", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("状态码 = %d, 期望 200", recorder.Code)
+	}
+	if got := recorder.Header().Get("Content-Type"); got != "text/csv; charset=utf-8" {
+		t.Errorf("Content-Type = %q, 期望 CSV", got)
+	}
+	if got := recorder.Header().Get("Content-Disposition"); !strings.HasPrefix(got, `attachment; filename="costs-`) {
+		t.Errorf("Content-Disposition = %q, 期望以附件下载", got)
+	}
+	records, err := csv.NewReader(recorder.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("解析 CSV 失败: %v", err)
+	}
+	want := [][]string{
+		{"day", "client", "key", "model", "requests", "prompt_tokens", "completion_tokens", "cached_tokens", "cost_usd"},
+		{"", "", "", "model/a", "2", "200", "100", "0", "0.750000"},
+		{"", "", "", "model/b", "1", "100", "50", "0", "1.000000"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("CSV = %v, 期望 %v", records, want)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/costs?group_by=week", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("无效分组维度的状态码 = %d, 期望 400", recorder.Code)
+	}
+}
@@ -0,0 +1,602 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"openrouter_polling/apimanager"
+	"openrouter_polling/config"
+	"openrouter_polling/middleware"
+	"openrouter_polling/models"
+	"openrouter_polling/utils"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Gemini 端点路径中模型名之后的方法名。
+const (
+	geminiMethodGenerate       = "generateContent"
+	geminiMethodStreamGenerate = "streamGenerateContent"
+)
+
+// GeminiModelsHandler 处理 `/v1beta/models/*modelAction` POST 请求（Google Gemini 兼容端点）。
+// 路径形如 `/v1beta/models/{model}:generateContent` 或 `:streamGenerateContent`。
+// OpenRouter 的模型 ID 包含斜杠（如 google/gemini-2.5-flash），因此使用通配路由并按最后一个冒号拆分。
+// 请求被转换为 OpenAI 风格的聊天请求，经同一个密钥池发往 OpenRouter，再将结果转换回 Gemini 格式。
+func GeminiModelsHandler(c *gin.Context) {
+	clientOriginalContext := c.Request.Context()
+	if clientOriginalContext.Err() == context.Canceled {
+		Log.Warn("GeminiModelsHandler: 客户端在处理请求前已断开连接。")
+		return
+	}
+
+	modelAction := strings.TrimPrefix(c.Param("modelAction"), "/")
+	sep := strings.LastIndex(modelAction, ":")
+	if sep <= 0 {
+		sendGeminiError(c, http.StatusNotFound, fmt.Sprintf("无效的路径 '%s'，应为 models/{model}:generateContent。", c.Request.URL.Path), "invalid_request_error")
+		return
+	}
+	model, method := modelAction[:sep], modelAction[sep+1:]
+	if method != geminiMethodGenerate && method != geminiMethodStreamGenerate {
+		sendGeminiError(c, http.StatusNotFound, fmt.Sprintf("不支持的方法 '%s'。", method), "invalid_request_error")
+		return
+	}
+	isStreamForClientResponse := method == geminiMethodStreamGenerate
+	useSSE := c.Query("alt") == "sse" // 未指定 alt=sse 时，流式响应以逐步输出的 JSON 数组返回
+
+	var geminiReq models.GeminiGenerateContentRequest
+	if err := c.ShouldBindJSON(&geminiReq); err != nil {
+		Log.Warnf("GeminiModelsHandler: 无效的请求体: %v", err)
+		sendGeminiError(c, http.StatusBadRequest, "请求体解析失败: "+err.Error(), "invalid_request_error")
+		return
+	}
+	if len(geminiReq.Contents) == 0 {
+		sendGeminiError(c, http.StatusBadRequest, "缺少必需参数 'contents'。", "invalid_request_error")
+		return
+	}
+
+	requestData, err := geminiToChatRequest(model, geminiReq, isStreamForClientResponse)
+	if err != nil {
+		Log.Warnf("GeminiModelsHandler: 转换请求失败: %v", err)
+		sendGeminiError(c, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+
+	logEntry := requestLog(c).WithFields(logrus.Fields{
+		"model":     requestData.Model,
+		"streaming": isStreamForClientResponse,
+		"client_ip": c.ClientIP(),
+		"protocol":  "gemini",
+	})
+	if requestData.Tools != nil {
+		logEntry = logEntry.WithField("tools_provided", len(*requestData.Tools))
+	}
+	logEntry.Info("收到 Gemini generateContent 请求")
+
+	applyContextTrimPolicy(c, &requestData, logEntry)
+
+	payloadBytes, err := json.Marshal(requestData)
+	if err != nil {
+		Log.Errorf("GeminiModelsHandler: 序列化请求数据失败: %v", err)
+		sendGeminiError(c, http.StatusInternalServerError, "内部服务器错误：序列化请求失败。", "internal_server_error")
+		return
+	}
+
+	upstreamReq := upstreamRequest{
+		URL:       config.AppSettings.OpenRouterAPIURL,
+		Payload:   payloadBytes,
+		IsStream:  isStreamForClientResponse,
+		SendError: sendGeminiError,
+		HandleOK: func(attemptCtx context.Context, c *gin.Context, resp *http.Response, apiKeyStatus *apimanager.ApiKeyStatus, clientOriginalContext context.Context) (bool, bool, int, string, string) {
+			return relayGeminiNonStreamingResponse(c, resp, apiKeyStatus, clientOriginalContext, requestData.Model)
+		},
+	}
+	if isStreamForClientResponse {
+		// 同一个 sink 贯穿所有重试，以便在 JSON 数组模式下正确记录已输出的元素。
+		sink := &geminiStreamSink{c: c, model: requestData.Model, useSSE: useSSE}
+		if useSSE {
+			prepareSSEHeaders(c)
+		}
+		upstreamReq.SendError = sink.sendError
+		upstreamReq.HandleOK = func(attemptCtx context.Context, c *gin.Context, resp *http.Response, apiKeyStatus *apimanager.ApiKeyStatus, clientOriginalContext context.Context) (bool, bool, int, string, string) {
+			return relayStreamingResponse(attemptCtx, c, resp, apiKeyStatus, clientOriginalContext, inspectChatCompletionChunk, sink)
+		}
+	}
+	withPayloadCapture(c, capturedRequest{Body: geminiReq, Model: requestData.Model, Stream: isStreamForClientResponse}, func() {
+		executeUpstreamRequest(c, upstreamReq)
+	})
+}
+
+// geminiToChatRequest 将 Gemini generateContent 请求转换为 OpenAI 风格的聊天请求。
+func geminiToChatRequest(model string, req models.GeminiGenerateContentRequest, stream bool) (models.ChatCompletionRequest, error) {
+	chatReq := models.ChatCompletionRequest{Model: model, Stream: &stream}
+	if chatReq.Model == "" {
+		chatReq.Model = config.AppSettings.DefaultModel
+	}
+
+	if gc := req.GenerationConfig; gc != nil {
+		chatReq.Temperature = gc.Temperature
+		chatReq.TopP = gc.TopP
+		chatReq.MaxTokens = gc.MaxOutputTokens
+		chatReq.N = gc.CandidateCount
+		chatReq.PresencePenalty = gc.PresencePenalty
+		chatReq.FrequencyPenalty = gc.FrequencyPenalty
+		if len(gc.StopSequences) > 0 {
+			chatReq.Stop = gc.StopSequences
+		}
+		if gc.ResponseMimeType == "application/json" {
+			if len(gc.ResponseSchema) > 0 {
+				chatReq.ResponseFormat = map[string]interface{}{
+					"type":        "json_schema",
+					"json_schema": map[string]interface{}{"name": "response", "schema": normalizeGeminiSchema(gc.ResponseSchema)},
+				}
+			} else {
+				chatReq.ResponseFormat = map[string]string{"type": "json_object"}
+			}
+		}
+	}
+
+	if req.SystemInstruction != nil {
+		var texts []string
+		for _, part := range req.SystemInstruction.Parts {
+			if part.Text != "" {
+				texts = append(texts, part.Text)
+			}
+		}
+		if len(texts) > 0 {
+			chatReq.Messages = append(chatReq.Messages, models.Message{Role: "system", Content: strings.Join(texts, "\n")})
+		}
+	}
+
+	// Gemini 的函数调用不一定带 ID，而 OpenAI 格式要求 tool 消息通过 tool_call_id 关联调用。
+	// 这里为缺少 ID 的调用生成 ID，并按函数名把后续的 functionResponse 与之对应（先进先出）。
+	pendingCallIDs := make(map[string][]string)
+	callSeq := 0
+	for i, content := range req.Contents {
+		var texts []string
+		var parts []map[string]interface{}
+		hasMedia := false
+		var toolCalls []models.ToolCall
+		var toolResults []models.Message
+
+		for _, part := range content.Parts {
+			switch {
+			case part.Thought:
+				continue
+			case part.FunctionCall != nil:
+				callID := part.FunctionCall.ID
+				if callID == "" {
+					callSeq++
+					callID = fmt.Sprintf("call_%d", callSeq)
+				}
+				pendingCallIDs[part.FunctionCall.Name] = append(pendingCallIDs[part.FunctionCall.Name], callID)
+				arguments := "{}"
+				if len(part.FunctionCall.Args) > 0 && string(part.FunctionCall.Args) != "null" {
+					arguments = string(part.FunctionCall.Args)
+				}
+				toolCalls = append(toolCalls, models.ToolCall{
+					ID:       callID,
+					Type:     "function",
+					Function: models.ToolCallFunction{Name: part.FunctionCall.Name, Arguments: arguments},
+				})
+			case part.FunctionResponse != nil:
+				callID := part.FunctionResponse.ID
+				if queue := pendingCallIDs[part.FunctionResponse.Name]; len(queue) > 0 {
+					if callID == "" {
+						callID = queue[0]
+					}
+					pendingCallIDs[part.FunctionResponse.Name] = queue[1:]
+				}
+				if callID == "" {
+					return chatReq, fmt.Errorf("contents[%d]: 函数 '%s' 的 functionResponse 没有对应的 functionCall", i, part.FunctionResponse.Name)
+				}
+				name := part.FunctionResponse.Name
+				toolResults = append(toolResults, models.Message{Role: "tool", Name: &name, Content: string(part.FunctionResponse.Response), ToolCallID: &callID})
+			case part.InlineData != nil:
+				parts = append(parts, map[string]interface{}{
+					"type":      "image_url",
+					"image_url": map[string]string{"url": fmt.Sprintf("data:%s;base64,%s", part.InlineData.MimeType, part.InlineData.Data)},
+				})
+				hasMedia = true
+			case part.FileData != nil:
+				parts = append(parts, map[string]interface{}{"type": "image_url", "image_url": map[string]string{"url": part.FileData.FileURI}})
+				hasMedia = true
+			default:
+				texts = append(texts, part.Text)
+				parts = append(parts, map[string]interface{}{"type": "text", "text": part.Text})
+			}
+		}
+
+		if content.Role == "model" {
+			if len(texts) > 0 || len(toolCalls) > 0 {
+				msg := models.Message{Role: "assistant", Content: strings.Join(texts, "")}
+				if len(toolCalls) > 0 {
+					msg.ToolCalls = &toolCalls
+				}
+				chatReq.Messages = append(chatReq.Messages, msg)
+			}
+			continue
+		}
+		// 函数结果需紧跟在发起调用的 assistant 消息之后，因此排在该用户内容之前。
+		chatReq.Messages = append(chatReq.Messages, toolResults...)
+		if hasMedia {
+			chatReq.Messages = append(chatReq.Messages, models.Message{Role: "user", Content: parts})
+		} else if len(texts) > 0 {
+			chatReq.Messages = append(chatReq.Messages, models.Message{Role: "user", Content: strings.Join(texts, "\n")})
+		}
+	}
+
+	var tools []models.Tool
+	for _, tool := range req.Tools {
+		for _, decl := range tool.FunctionDeclarations {
+			schema := decl.ParametersJSONSchema
+			if len(schema) == 0 {
+				schema = normalizeGeminiSchema(decl.Parameters)
+			}
+			params, err := models.FunctionParametersFromRaw(schema)
+			if err != nil {
+				return chatReq, fmt.Errorf("函数 '%s' 的 parameters 无效: %v", decl.Name, err)
+			}
+			tools = append(tools, models.Tool{
+				Type:     "function",
+				Function: models.FunctionDefinition{Name: decl.Name, Description: decl.Description, Parameters: params},
+			})
+		}
+	}
+	if len(tools) > 0 {
+		chatReq.Tools = &tools
+	}
+
+	if req.ToolConfig != nil && req.ToolConfig.FunctionCallingConfig != nil {
+		fcc := req.ToolConfig.FunctionCallingConfig
+		switch strings.ToUpper(fcc.Mode) {
+		case "AUTO":
+			chatReq.ToolChoice = "auto"
+		case "NONE":
+			chatReq.ToolChoice = "none"
+		case "ANY":
+			if len(fcc.AllowedFunctionNames) == 1 {
+				chatReq.ToolChoice = map[string]interface{}{"type": "function", "function": map[string]string{"name": fcc.AllowedFunctionNames[0]}}
+			} else {
+				chatReq.ToolChoice = "required"
+			}
+		}
+	}
+	return chatReq, nil
+}
+
+// normalizeGeminiSchema 将 Gemini 的 OpenAPI 风格 Schema 转换为标准 JSON Schema：
+// 类型名统一转为小写（Gemini SDK 常发送 "OBJECT"、"STRING" 等），其余字段原样保留。
+func normalizeGeminiSchema(raw json.RawMessage) json.RawMessage {
+	if len(raw) == 0 {
+		return raw
+	}
+	var schema interface{}
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return raw
+	}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			if t, ok := node["type"].(string); ok {
+				node["type"] = strings.ToLower(t)
+			}
+			for _, child := range node {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range node {
+				walk(child)
+			}
+		}
+	}
+	walk(schema)
+	normalized, err := json.Marshal(schema)
+	if err != nil {
+		return raw
+	}
+	return normalized
+}
+
+// geminiFinishReason 将 OpenAI 的 finish_reason 映射为 Gemini 的 finishReason。
+func geminiFinishReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "MAX_TOKENS"
+	case "content_filter":
+		return "SAFETY"
+	default:
+		return "STOP" // Gemini 对函数调用同样使用 STOP
+	}
+}
+
+// geminiUsage 将 OpenAI 风格的用量统计转换为 Gemini 格式。
+func geminiUsage(usage *models.Usage) *models.GeminiUsageMetadata {
+	if usage == nil {
+		return nil
+	}
+	result := &models.GeminiUsageMetadata{
+		PromptTokenCount:     usage.PromptTokens,
+		CandidatesTokenCount: usage.CompletionTokens,
+		TotalTokenCount:      usage.TotalTokens,
+	}
+	if usage.PromptTokensDetails != nil {
+		result.CachedContentTokenCount = usage.PromptTokensDetails.CachedTokens
+	}
+	return result
+}
+
+// geminiFunctionCallPart 将 OpenAI 工具调用转换为 Gemini functionCall 部件。
+func geminiFunctionCallPart(tc models.ToolCall) models.GeminiPart {
+	args := json.RawMessage(tc.Function.Arguments)
+	if !json.Valid(args) {
+		args = json.RawMessage("{}")
+	}
+	return models.GeminiPart{FunctionCall: &models.GeminiFunctionCall{ID: tc.ID, Name: tc.Function.Name, Args: args}}
+}
+
+// relayGeminiNonStreamingResponse 读取上游的非流式聊天响应，转换为 Gemini 格式后返回给客户端。
+func relayGeminiNonStreamingResponse(
+	c *gin.Context,
+	resp *http.Response,
+	apiKeyStatus *apimanager.ApiKeyStatus,
+	clientOriginalContext context.Context,
+	requestModel string,
+) (success bool, retryNeeded bool, statusCodeForError int, errorDetail string, errorType string) {
+	currentOpenRouterKey := apiKeyStatus.Key
+
+	bodyBytes, readErr := io.ReadAll(resp.Body)
+	if readErr != nil {
+		Log.Errorf("relayGeminiNonStreamingResponse: 读取 OpenRouter 非流式响应体失败: %v (密钥: %s)", readErr, utils.SafeSuffix(currentOpenRouterKey))
+		return false, true, http.StatusInternalServerError, "读取上游非流式响应失败。", "response_read_error"
+	}
+
+	var chatResp models.ChatCompletionResponse
+	if err := json.Unmarshal(bodyBytes, &chatResp); err != nil || len(chatResp.Choices) == 0 {
+		Log.Errorf("relayGeminiNonStreamingResponse: 无法解析上游聊天响应 (密钥: %s): %v, body: %q", utils.SafeSuffix(currentOpenRouterKey), err, string(bodyBytes))
+		return false, true, http.StatusBadGateway, "上游返回了无法解析的聊天响应。", "upstream_response_parse_error"
+	}
+	ApiKeyMgr.RecordKeySuccess(currentOpenRouterKey)
+	middleware.RecordUsage(c, chatResp.Usage)
+	recordGenerationID(c, chatResp.ID)
+
+	if clientOriginalContext.Err() == context.Canceled {
+		Log.Warnf("relayGeminiNonStreamingResponse: 成功获取非流式响应，但客户端已断开 (密钥: %s)。", utils.SafeSuffix(currentOpenRouterKey))
+		return true, false, http.StatusOK, "", ""
+	}
+
+	geminiResp := models.GeminiGenerateContentResponse{
+		Candidates:    make([]models.GeminiCandidate, 0, len(chatResp.Choices)),
+		UsageMetadata: geminiUsage(chatResp.Usage),
+		ModelVersion:  chatResp.Model,
+		ResponseID:    chatResp.ID,
+	}
+	if geminiResp.ModelVersion == "" {
+		geminiResp.ModelVersion = requestModel
+	}
+	for _, choice := range chatResp.Choices {
+		parts := make([]models.GeminiPart, 0, 1)
+		if text, ok := choice.Message.Content.(string); ok && text != "" {
+			parts = append(parts, models.GeminiPart{Text: text})
+		}
+		if choice.Message.ToolCalls != nil {
+			for _, tc := range *choice.Message.ToolCalls {
+				parts = append(parts, geminiFunctionCallPart(tc))
+			}
+		}
+		geminiResp.Candidates = append(geminiResp.Candidates, models.GeminiCandidate{
+			Content:      models.GeminiContent{Role: "model", Parts: parts},
+			FinishReason: geminiFinishReason(utils.DerefString(choice.FinishReason, "")),
+			Index:        choice.Index,
+		})
+	}
+	c.JSON(http.StatusOK, geminiResp)
+	Log.Infof("relayGeminiNonStreamingResponse: 成功发送 Gemini 格式非流式响应 (密钥: %s)。", utils.SafeSuffix(currentOpenRouterKey))
+	return true, false, http.StatusOK, "", ""
+}
+
+// geminiStreamSink 是将 OpenAI 风格聊天 SSE 流转换为 Gemini 流式响应的 streamSink。
+// 文本增量即时作为独立分块输出；Gemini 的 functionCall 是完整对象，因此工具调用参数会先缓存，
+// 在流结束时与 finishReason、usageMetadata 一起输出。
+// useSSE 为 true 时输出 `data: {...}` 事件（alt=sse），否则输出逐步写出的 JSON 数组。
+type geminiStreamSink struct {
+	c            *gin.Context
+	model        string
+	useSSE       bool
+	responseID   string
+	elements     int  // 已输出的分块数
+	arrayOpened  bool // JSON 数组模式下是否已写出 "["
+	finished     bool
+	toolCalls    []models.ToolCall // 按上游 tool_calls 序号累积的工具调用
+	finishReason string
+	usage        *models.Usage
+}
+
+// WriteLine 实现 streamSink：解析上游 SSE 行并输出对应的 Gemini 分块。
+func (s *geminiStreamSink) WriteLine(line string) error {
+	trimmedLine := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmedLine, models.SSEDataPrefix) {
+		return nil // 心跳、空行：Gemini 流没有对应格式，直接忽略
+	}
+	dataContent := strings.TrimSpace(strings.TrimPrefix(trimmedLine, models.SSEDataPrefix))
+	if dataContent == models.SSEDonePayload {
+		return s.finish()
+	}
+
+	var chunk models.ChatCompletionChunk
+	if err := json.Unmarshal([]byte(dataContent), &chunk); err != nil {
+		return nil
+	}
+	if chunk.Model != "" {
+		s.model = chunk.Model
+	}
+	if chunk.ID != "" {
+		s.responseID = chunk.ID
+	}
+	if chunk.Usage != nil {
+		s.usage = chunk.Usage
+	}
+	if len(chunk.Choices) == 0 {
+		return nil
+	}
+	choice := chunk.Choices[0]
+
+	if choice.Delta.ToolCalls != nil {
+		for i, tc := range *choice.Delta.ToolCalls {
+			toolIndex := i
+			if tc.Index != nil {
+				toolIndex = *tc.Index
+			}
+			for len(s.toolCalls) <= toolIndex {
+				s.toolCalls = append(s.toolCalls, models.ToolCall{Type: "function"})
+			}
+			acc := &s.toolCalls[toolIndex]
+			if tc.ID != "" {
+				acc.ID = tc.ID
+			}
+			if tc.Function.Name != "" {
+				acc.Function.Name = tc.Function.Name
+			}
+			acc.Function.Arguments += tc.Function.Arguments
+		}
+	}
+	if choice.FinishReason != nil && *choice.FinishReason != "" {
+		s.finishReason = *choice.FinishReason
+	}
+
+	if choice.Delta.Content != nil && *choice.Delta.Content != "" {
+		return s.writeChunk(models.GeminiGenerateContentResponse{
+			Candidates: []models.GeminiCandidate{{Content: models.GeminiContent{Role: "model", Parts: []models.GeminiPart{{Text: *choice.Delta.Content}}}}},
+		})
+	}
+	return nil
+}
+
+// finish 输出包含工具调用、finishReason 和 usageMetadata 的最终分块，并在 JSON 数组模式下闭合数组。
+func (s *geminiStreamSink) finish() error {
+	if s.finished {
+		return nil
+	}
+	s.finished = true
+	parts := make([]models.GeminiPart, 0, len(s.toolCalls))
+	for _, tc := range s.toolCalls {
+		parts = append(parts, geminiFunctionCallPart(tc))
+	}
+	if err := s.writeChunk(models.GeminiGenerateContentResponse{
+		Candidates:    []models.GeminiCandidate{{Content: models.GeminiContent{Role: "model", Parts: parts}, FinishReason: geminiFinishReason(s.finishReason)}},
+		UsageMetadata: geminiUsage(s.usage),
+	}); err != nil {
+		return err
+	}
+	return s.closeArray()
+}
+
+// writeChunk 以当前输出模式写出一个 Gemini 分块。
+func (s *geminiStreamSink) writeChunk(chunk models.GeminiGenerateContentResponse) error {
+	chunk.ModelVersion = s.model
+	chunk.ResponseID = s.responseID
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+	return s.writeElement(data)
+}
+
+// writeElement 写出一个已序列化的元素（SSE 事件或 JSON 数组元素）并刷新。
+func (s *geminiStreamSink) writeElement(data []byte) error {
+	var out string
+	if s.useSSE {
+		out = fmt.Sprintf("%s%s\n\n", models.SSEDataPrefix, data)
+	} else {
+		if !s.arrayOpened {
+			s.arrayOpened = true
+			if !s.c.Writer.Written() {
+				s.c.Writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+				s.c.Writer.Header().Set("X-Accel-Buffering", "no")
+			}
+			out = "["
+		}
+		if s.elements > 0 {
+			out += ",\n"
+		}
+		out += string(data)
+	}
+	s.elements++
+	return passthroughSink{c: s.c}.WriteLine(out)
+}
+
+// closeArray 在 JSON 数组模式下写出结尾的 "]"。
+func (s *geminiStreamSink) closeArray() error {
+	if s.useSSE || !s.arrayOpened {
+		return nil
+	}
+	return passthroughSink{c: s.c}.WriteLine("]")
+}
+
+// sendError 流式请求的 upstreamErrorSender：JSON 数组模式下尚未输出任何内容时发送普通 JSON 错误，
+// 否则（包括 SSE 模式）将错误作为流中的最后一个元素输出。
+func (s *geminiStreamSink) sendError(c *gin.Context, statusCode int, message string, errorType string) {
+	if !sseResponseStarted(c) {
+		sendGeminiError(c, statusCode, message, errorType)
+		return
+	}
+	if c.Request.Context().Err() == context.Canceled {
+		Log.Warnf("geminiStreamSink: 尝试发送错误 '%s' (状态码 %d)，但客户端已断开。不发送。", message, statusCode)
+		return
+	}
+	data, err := json.Marshal(geminiErrorBody(statusCode, message))
+	if err != nil {
+		return
+	}
+	if err := s.writeElement(data); err == nil {
+		err = s.closeArray()
+	}
+	if err != nil {
+		Log.Warnf("geminiStreamSink: 写入流式错误失败: %v", err)
+	}
+}
+
+// geminiErrorBody 构造 Google API 风格的错误响应体。
+func geminiErrorBody(statusCode int, message string) models.GeminiErrorResponse {
+	var body models.GeminiErrorResponse
+	body.Error.Code = statusCode
+	body.Error.Message = message
+	switch statusCode {
+	case http.StatusBadRequest:
+		body.Error.Status = "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		body.Error.Status = "UNAUTHENTICATED"
+	case http.StatusPaymentRequired, http.StatusForbidden:
+		body.Error.Status = "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		body.Error.Status = "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		body.Error.Status = "RESOURCE_EXHAUSTED"
+	case http.StatusServiceUnavailable:
+		body.Error.Status = "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		body.Error.Status = "DEADLINE_EXCEEDED"
+	default:
+		body.Error.Status = "INTERNAL"
+	}
+	return body
+}
+
+// sendGeminiError 以 Google API 格式向客户端发送错误（实现 upstreamErrorSender）。
+func sendGeminiError(c *gin.Context, statusCode int, message string, errorType string) {
+	if c.Request.Context().Err() == context.Canceled {
+		Log.Warnf("sendGeminiError: 尝试发送错误 '%s' (状态码 %d)，但客户端已断开。不发送。", message, statusCode)
+		return
+	}
+	if c.Writer.Written() {
+		Log.Warnf("sendGeminiError: 尝试发送错误 '%s' (状态码 %d)，但响应头已写入。不发送。", message, statusCode)
+		return
+	}
+	Log.Debugf("sendGeminiError: 发送 Gemini 错误 (状态码 %d, 内部类型 %s): %s", statusCode, errorType, message)
+	c.JSON(statusCode, geminiErrorBody(statusCode, message))
+}
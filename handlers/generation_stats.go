@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"openrouter_polling/config"
+	"openrouter_polling/models"
+	"openrouter_polling/storage"
+	"openrouter_polling/utils"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GenerationIDContextKey 是处理器记录上游生成 ID 在 gin.Context 中的键（值类型为 string）。
+const GenerationIDContextKey = "upstream_generation_id"
+
+const (
+	generationStatsWorkerCount    = 4                // 并发查询生成统计的后台协程数
+	generationStatsPollInterval   = time.Second      // 扫描到期待查询记录的间隔
+	generationStatsInitialBackoff = 2 * time.Second  // 首次查询前的等待时间，此后每次失败翻倍
+	generationStatsMaxBackoff     = 60 * time.Second // 单次退避等待的上限
+)
+
+// generationStatsScheduler 按数据库中记录的 next_attempt_at 调度生成统计查询。
+// 工作协程每次只执行一次查询，失败后写回下一次的计划时间即返回，不在协程中等待退避。
+type generationStatsScheduler struct {
+	jobs     chan storage.GenerationRecord
+	wake     chan struct{}
+	mu       sync.Mutex
+	inFlight map[string]bool   // 已派发给工作协程、尚未处理完的生成 ID
+	keys     map[string]string // 生成 ID → 处理该请求的上游密钥，仅保存在内存中
+}
+
+// generationStats 在 RunGenerationStatsWorker 启动后创建；为 nil 时不记录生成统计。
+var generationStats *generationStatsScheduler
+
+// recordGenerationID 记录上游响应中的生成 ID（同一请求只记录第一个）。
+func recordGenerationID(c *gin.Context, generationID string) {
+	if generationID == "" {
+		return
+	}
+	if _, exists := c.Get(GenerationIDContextKey); !exists {
+		c.Set(GenerationIDContextKey, generationID)
+	}
+}
+
+// recordUpstreamGenerationID 从上游响应体（或流式数据块）中提取顶层 id 字段作为生成 ID。
+func recordUpstreamGenerationID(c *gin.Context, body []byte) {
+	if _, exists := c.Get(GenerationIDContextKey); exists || !bytes.Contains(body, []byte(`"id"`)) {
+		return
+	}
+	var withID struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &withID); err == nil {
+		recordGenerationID(c, withID.ID)
+	}
+}
+
+// upstreamGenerationID 返回处理器记录的生成 ID；未记录时返回空字符串。
+func upstreamGenerationID(c *gin.Context) string {
+	return c.GetString(GenerationIDContextKey)
+}
+
+// enqueueGenerationStats 保存待补全的生成记录，由后台调度器在首次退避时间到达后查询生成统计。
+func enqueueGenerationStats(record *storage.GenerationRecord, key string) {
+	scheduler := generationStats
+	if scheduler == nil || GenerationStore == nil || record.GenerationID == "" {
+		return
+	}
+	nextAttemptAt := time.Now().Add(generationStatsInitialBackoff)
+	record.Status = storage.GenerationStatusPending
+	record.NextAttemptAt = &nextAttemptAt
+	scheduler.mu.Lock()
+	scheduler.keys[record.GenerationID] = key
+	scheduler.mu.Unlock()
+	if err := GenerationStore.CreateGeneration(record); err != nil {
+		Log.Errorf("enqueueGenerationStats: 保存生成记录 %s 失败: %v", record.GenerationID, err)
+		scheduler.forget(record.GenerationID)
+	}
+}
+
+// RunGenerationStatsWorker 启动查询 OpenRouter 生成统计的后台协程，直到 ctx 取消。
+// 上次运行时未完成的待查询记录会在启动后继续查询。
+func RunGenerationStatsWorker(ctx context.Context) {
+	scheduler := newGenerationStatsScheduler()
+	generationStats = scheduler
+	for i := 0; i < generationStatsWorkerCount; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case record := <-scheduler.jobs:
+					scheduler.process(ctx, &record)
+				}
+			}
+		}()
+	}
+	go scheduler.dispatch(ctx)
+	Log.Infof("生成统计后台任务已启动 (端点: %s)。", config.AppSettings.OpenRouterGenerationURL)
+}
+
+func newGenerationStatsScheduler() *generationStatsScheduler {
+	return &generationStatsScheduler{
+		jobs:     make(chan storage.GenerationRecord),
+		wake:     make(chan struct{}, 1),
+		inFlight: make(map[string]bool),
+		keys:     make(map[string]string),
+	}
+}
+
+// dispatch 定期从数据库读取到期的待查询记录并派发给工作协程。
+func (s *generationStatsScheduler) dispatch(ctx context.Context) {
+	ticker := time.NewTicker(generationStatsPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+		records, err := GenerationStore.ListDueGenerations(time.Now(), 4*generationStatsWorkerCount)
+		if err != nil {
+			Log.Errorf("generationStatsScheduler: 读取待查询的生成记录失败: %v", err)
+			continue
+		}
+		for _, record := range records {
+			s.mu.Lock()
+			busy := s.inFlight[record.GenerationID]
+			s.inFlight[record.GenerationID] = true
+			s.mu.Unlock()
+			if busy {
+				continue
+			}
+			select {
+			case s.jobs <- record:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if len(records) == 4*generationStatsWorkerCount {
+			// 可能还有更多到期记录，不等下一个周期立即继续派发。
+			select {
+			case s.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// process 对一条记录执行一次生成统计查询，并将结果或下一次的计划时间写回数据库。
+// 获取成功后按实际费用与估算费用的差额修正 usage_costs 中的累计值。
+func (s *generationStatsScheduler) process(ctx context.Context, record *storage.GenerationRecord) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.inFlight, record.GenerationID)
+		s.mu.Unlock()
+	}()
+
+	// 派发前读取的记录可能已被另一次处理更新，以数据库中的最新状态为准。
+	current, err := GenerationStore.GetGeneration(record.GenerationID)
+	if err != nil {
+		Log.Errorf("generationStatsScheduler: 读取生成记录 %s 失败: %v", record.GenerationID, err)
+		return
+	}
+	if current.Status != storage.GenerationStatusPending || (current.NextAttemptAt != nil && current.NextAttemptAt.After(time.Now())) {
+		return
+	}
+	record = current
+
+	key, ok := s.keyFor(record)
+	if !ok {
+		s.fail(record, "处理该请求的密钥已不在密钥池中")
+		return
+	}
+
+	record.Attempts++
+	generation, retryable, err := fetchGenerationStats(ctx, record.GenerationID, key)
+	if err == nil {
+		applyGenerationStats(record, generation)
+		s.forget(record.GenerationID)
+		return
+	}
+	if ctx.Err() != nil {
+		return // 服务关闭导致的失败不计入尝试次数，下次启动时重新查询
+	}
+	record.LastError = err.Error()
+	Log.Debugf("generationStatsScheduler: 查询生成 %s 的统计失败 (第 %d 次, 密钥: %s): %v", record.GenerationID, record.Attempts, utils.SafeSuffix(key), err)
+
+	maxAttempts := config.AppSettings.GenerationStatsMaxAttempts
+	if !retryable || record.Attempts >= maxAttempts {
+		s.fail(record, record.LastError)
+		return
+	}
+	nextAttemptAt := time.Now().Add(generationStatsBackoff(record.Attempts))
+	record.NextAttemptAt = &nextAttemptAt
+	if err := GenerationStore.UpdateGeneration(record); err != nil {
+		Log.Errorf("generationStatsScheduler: 更新生成记录 %s 失败: %v", record.GenerationID, err)
+	}
+}
+
+// fail 将记录标记为失败，不再查询。
+func (s *generationStatsScheduler) fail(record *storage.GenerationRecord, reason string) {
+	s.forget(record.GenerationID)
+	record.Status = storage.GenerationStatusFailed
+	record.LastError = reason
+	record.NextAttemptAt = nil
+	Log.Warnf("generationStatsScheduler: 放弃查询生成 %s 的统计 (已尝试 %d 次): %s", record.GenerationID, record.Attempts, reason)
+	if err := GenerationStore.UpdateGeneration(record); err != nil {
+		Log.Errorf("generationStatsScheduler: 更新生成记录 %s 失败: %v", record.GenerationID, err)
+	}
+}
+
+// keyFor 返回处理该请求的上游密钥。服务重启后内存中的映射已丢失，此时按记录中的密钥后缀在密钥池中查找。
+func (s *generationStatsScheduler) keyFor(record *storage.GenerationRecord) (string, bool) {
+	s.mu.Lock()
+	key, ok := s.keys[record.GenerationID]
+	s.mu.Unlock()
+	if ok {
+		return key, true
+	}
+	if ApiKeyMgr == nil {
+		return "", false
+	}
+	for _, ks := range ApiKeyMgr.GetCachedKeys() {
+		if utils.SafeSuffix(ks.Key) == record.KeySuffix {
+			return ks.Key, true
+		}
+	}
+	return "", false
+}
+
+// forget 删除内存中记录的密钥。
+func (s *generationStatsScheduler) forget(generationID string) {
+	s.mu.Lock()
+	delete(s.keys, generationID)
+	s.mu.Unlock()
+}
+
+// generationStatsBackoff 返回第 attempts 次失败后到下一次查询的等待时间（指数增长，有上限）。
+func generationStatsBackoff(attempts int) time.Duration {
+	backoff := generationStatsInitialBackoff
+	for i := 0; i < attempts && backoff < generationStatsMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, generationStatsMaxBackoff)
+}
+
+// fetchGenerationStats 使用处理该请求的密钥查询一次生成统计。
+// retryable 表示失败是否可能是暂时的（统计尚未就绪返回 404、限流、上游错误或网络错误）。
+func fetchGenerationStats(ctx context.Context, generationID, key string) (generation *models.OpenRouterGeneration, retryable bool, err error) {
+	reqCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	endpoint := config.AppSettings.OpenRouterGenerationURL + "?id=" + url.QueryEscape(generationID)
+	req, err := http.NewRequestWithContext(reqCtx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	resp, err := HttpClient.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		retryable = resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return nil, retryable, fmt.Errorf("上游返回状态 %d: %s", resp.StatusCode, string(body))
+	}
+
+	var generationResp models.OpenRouterGenerationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&generationResp); err != nil {
+		return nil, true, err
+	}
+	if generationResp.Data == nil {
+		return nil, true, errors.New("生成统计响应中缺少 data 字段")
+	}
+	return generationResp.Data, false, nil
+}
+
+// applyGenerationStats 将生成统计写入记录，并修正当天累计费用中的估算误差。
+func applyGenerationStats(record *storage.GenerationRecord, generation *models.OpenRouterGeneration) {
+	record.Status = storage.GenerationStatusCompleted
+	record.LastError = ""
+	record.ProviderName = generation.ProviderName
+	record.NativePromptTokens = int64(generation.NativeTokensPrompt)
+	record.NativeCompletionTokens = int64(generation.NativeTokensCompletion)
+	record.NativeReasoningTokens = int64(generation.NativeTokensReasoning)
+	record.NativeCachedTokens = int64(generation.NativeTokensCached)
+	record.TotalCostUSD = generation.TotalCost
+	record.LatencyMs = int64(generation.Latency)
+	record.GenerationTimeMs = int64(generation.GenerationTime)
+	record.FinishReason = generation.FinishReason
+	if err := GenerationStore.UpdateGeneration(record); err != nil {
+		Log.Errorf("applyGenerationStats: 更新生成记录 %s 失败: %v", record.GenerationID, err)
+		return
+	}
+	Log.Debugf("applyGenerationStats: 生成 %s 由 %s 提供，实际费用 $%.6f (估算 $%.6f)。", record.GenerationID, record.ProviderName, record.TotalCostUSD, record.EstimatedCostUSD)
+
+	if delta := record.TotalCostUSD - record.EstimatedCostUSD; delta != 0 && CostStore != nil {
+		correction := &storage.UsageCost{
+			Day:       record.Day,
+			ClientID:  record.ClientID,
+			KeySuffix: record.KeySuffix,
+			Model:     record.Model,
+			CostUSD:   delta,
+		}
+		if err := CostStore.AddUsage(correction); err != nil {
+			Log.Errorf("applyGenerationStats: 修正客户端 %s 的累计费用失败: %v", record.ClientID, err)
+		}
+	}
+}
+
+// ListGenerationsHandler 处理 `/admin/generations` GET 请求。
+// 支持的查询参数：client、status（pending/completed/failed）、limit（默认 50，最大 500）。
+func ListGenerationsHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "limit 必须是 1 到 500 之间的整数。", Type: "invalid_request_error", Param: "limit"}})
+		return
+	}
+	records, err := GenerationStore.ListGenerations(c.Query("client"), c.Query("status"), limit)
+	if err != nil {
+		Log.Errorf("ListGenerationsHandler: 查询生成记录失败: %v", err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "查询生成记录时发生内部错误。", Type: "internal_server_error"}})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": records})
+}
+
+// GetGenerationHandler 处理 `/admin/generations/:id` GET 请求。
+func GetGenerationHandler(c *gin.Context) {
+	generationID := c.Param("id")
+	record, err := GenerationStore.GetGeneration(generationID)
+	if err != nil {
+		if errors.Is(err, storage.ErrGenerationNotFound) {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{Error: models.ErrorDetail{
+				Message: "未找到生成记录 '" + generationID + "'。", Type: "generation_not_found"}})
+			return
+		}
+		Log.Errorf("GetGenerationHandler: 读取生成记录 %s 失败: %v", generationID, err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "读取生成记录时发生内部错误。", Type: "internal_server_error"}})
+		return
+	}
+	c.JSON(http.StatusOK, record)
+}
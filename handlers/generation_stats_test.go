@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"openrouter_polling/config"
+	"openrouter_polling/storage"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+const generationStatsTestKey = "sk-or-v1-test-key-abcd"
+
+// setupGenerationStatsTest 使用临时 SQLite 数据库和指向 handler 的桩端点初始化生成统计依赖。
+func setupGenerationStatsTest(t *testing.T, handler http.HandlerFunc) *generationStatsScheduler {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatalf("打开测试数据库失败: %v", err)
+	}
+	if err := db.AutoMigrate(&storage.GenerationRecord{}); err != nil {
+		t.Fatalf("迁移测试数据库失败: %v", err)
+	}
+	stub := httptest.NewServer(handler)
+	t.Cleanup(stub.Close)
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	prevLog, prevStore, prevClient, prevStats, prevSettings := Log, GenerationStore, HttpClient, generationStats, config.AppSettings
+	t.Cleanup(func() {
+		Log, GenerationStore, HttpClient, generationStats, config.AppSettings = prevLog, prevStore, prevClient, prevStats, prevSettings
+	})
+	Log = logger
+	GenerationStore = storage.NewGenerationStore(db)
+	HttpClient = stub.Client()
+	config.AppSettings.OpenRouterGenerationURL = stub.URL + "/api/v1/generation"
+	config.AppSettings.GenerationStatsMaxAttempts = 5
+
+	generationStats = newGenerationStatsScheduler()
+	return generationStats
+}
+
+// makeGenerationDue 将记录的计划查询时间提前到过去，模拟退避等待已结束。
+func makeGenerationDue(t *testing.T, generationID string) storage.GenerationRecord {
+	t.Helper()
+	record, err := GenerationStore.GetGeneration(generationID)
+	if err != nil {
+		t.Fatalf("读取生成记录失败: %v", err)
+	}
+	past := time.Now().Add(-time.Second)
+	record.NextAttemptAt = &past
+	if err := GenerationStore.UpdateGeneration(record); err != nil {
+		t.Fatalf("更新生成记录失败: %v", err)
+	}
+	due, err := GenerationStore.ListDueGenerations(time.Now(), 10)
+	if err != nil || len(due) != 1 || due[0].GenerationID != generationID {
+		t.Fatalf("ListDueGenerations = %v, %v, 期望只有 %s", due, err, generationID)
+	}
+	return due[0]
+}
+
+func TestGenerationStatsRetriesUntilStatsAvailable(t *testing.T) {
+	var calls atomic.Int32
+	scheduler := setupGenerationStatsTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer "+generationStatsTestKey {
+			t.Errorf("Authorization = %q, 期望使用处理该请求的密钥", got)
+		}
+		if got := r.URL.Query().Get("id"); got != "gen-123" {
+			t.Errorf("id 查询参数 = %q, 期望 gen-123", got)
+		}
+		if calls.Add(1) == 1 {
+			http.Error(w, `{"error":{"message":"Generation not found"}}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"data":{"id":"gen-123","provider_name":"Anthropic","total_cost":0.0042,
+			"native_tokens_prompt":120,"native_tokens_completion":30,"native_tokens_reasoning":5,"native_tokens_cached":64,
+			"latency":350,"generation_time":1200,"finish_reason":"stop"}}`)
+	})
+
+	enqueueGenerationStats(&storage.GenerationRecord{
+		GenerationID:     "gen-123",
+		ClientID:         "client-a",
+		KeySuffix:        "...abcd",
+		Model:            "anthropic/claude-sonnet-4",
+		EstimatedCostUSD: 0.004,
+	}, generationStatsTestKey)
+
+	// 统计在生成结束后才可用，新记录不会立即被查询。
+	if due, _ := GenerationStore.ListDueGenerations(time.Now(), 10); len(due) != 0 {
+		t.Fatalf("新记录在首次退避结束前就已到期: %v", due)
+	}
+
+	// 第一次查询返回 404：记录保持 pending，并按退避时间安排下一次查询。
+	record := makeGenerationDue(t, "gen-123")
+	before := time.Now()
+	scheduler.process(context.Background(), &record)
+	pending, err := GenerationStore.GetGeneration("gen-123")
+	if err != nil {
+		t.Fatalf("读取生成记录失败: %v", err)
+	}
+	if pending.Status != storage.GenerationStatusPending || pending.Attempts != 1 || pending.LastError == "" {
+		t.Fatalf("第一次失败后记录 = %+v, 期望 pending、attempts=1 且记录错误", pending)
+	}
+	if pending.NextAttemptAt == nil || pending.NextAttemptAt.Before(before.Add(generationStatsBackoff(1))) {
+		t.Fatalf("NextAttemptAt = %v, 期望不早于 %v 之后 %v", pending.NextAttemptAt, before, generationStatsBackoff(1))
+	}
+	if due, _ := GenerationStore.ListDueGenerations(time.Now(), 10); len(due) != 0 {
+		t.Fatalf("退避期间记录不应到期: %v", due)
+	}
+
+	// 第二次查询成功：写入原生统计并清除计划时间。
+	record = makeGenerationDue(t, "gen-123")
+	scheduler.process(context.Background(), &record)
+	completed, err := GenerationStore.GetGeneration("gen-123")
+	if err != nil {
+		t.Fatalf("读取生成记录失败: %v", err)
+	}
+	if completed.Status != storage.GenerationStatusCompleted || completed.Attempts != 2 || completed.LastError != "" {
+		t.Fatalf("成功后记录 = %+v, 期望 completed、attempts=2", completed)
+	}
+	if completed.ProviderName != "Anthropic" || completed.TotalCostUSD != 0.0042 ||
+		completed.NativePromptTokens != 120 || completed.NativeCompletionTokens != 30 ||
+		completed.NativeReasoningTokens != 5 || completed.NativeCachedTokens != 64 ||
+		completed.LatencyMs != 350 || completed.GenerationTimeMs != 1200 || completed.FinishReason != "stop" {
+		t.Errorf("生成统计未正确写入: %+v", completed)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("桩端点被调用 %d 次, 期望 2 次", calls.Load())
+	}
+	if len(scheduler.keys) != 0 || len(scheduler.inFlight) != 0 {
+		t.Errorf("处理结束后调度器仍保留状态: keys=%v inFlight=%v", scheduler.keys, scheduler.inFlight)
+	}
+}
+
+func TestGenerationStatsNonRetryableErrorFails(t *testing.T) {
+	var calls atomic.Int32
+	scheduler := setupGenerationStatsTest(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, `{"error":{"message":"Invalid API key"}}`, http.StatusUnauthorized)
+	})
+	enqueueGenerationStats(&storage.GenerationRecord{GenerationID: "gen-401", KeySuffix: "...abcd"}, generationStatsTestKey)
+
+	record := makeGenerationDue(t, "gen-401")
+	scheduler.process(context.Background(), &record)
+	failed, err := GenerationStore.GetGeneration("gen-401")
+	if err != nil {
+		t.Fatalf("读取生成记录失败: %v", err)
+	}
+	if failed.Status != storage.GenerationStatusFailed || failed.Attempts != 1 || failed.NextAttemptAt != nil {
+		t.Fatalf("不可重试的错误后记录 = %+v, 期望 failed、attempts=1 且无计划时间", failed)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("桩端点被调用 %d 次, 期望 1 次", calls.Load())
+	}
+}
+
+func TestGenerationStatsGivesUpAfterMaxAttempts(t *testing.T) {
+	scheduler := setupGenerationStatsTest(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+	})
+	config.AppSettings.GenerationStatsMaxAttempts = 2
+	enqueueGenerationStats(&storage.GenerationRecord{GenerationID: "gen-502", KeySuffix: "...abcd"}, generationStatsTestKey)
+
+	for i := 0; i < 2; i++ {
+		record := makeGenerationDue(t, "gen-502")
+		scheduler.process(context.Background(), &record)
+	}
+	failed, err := GenerationStore.GetGeneration("gen-502")
+	if err != nil {
+		t.Fatalf("读取生成记录失败: %v", err)
+	}
+	if failed.Status != storage.GenerationStatusFailed || failed.Attempts != 2 {
+		t.Fatalf("达到最大尝试次数后记录 = %+v, 期望 failed、attempts=2", failed)
+	}
+}
+
+func TestGenerationStatsBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, generationStatsInitialBackoff},
+		{1, 2 * generationStatsInitialBackoff},
+		{2, 4 * generationStatsInitialBackoff},
+		{10, generationStatsMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := generationStatsBackoff(tt.attempts); got != tt.want {
+			t.Errorf("generationStatsBackoff(%d) = %v, 期望 %v", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"openrouter_polling/config"
+	"openrouter_polling/middleware"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// IdempotencyKeyHeader 客户端用于标识同一逻辑请求的请求头部。
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader 响应来自已存储结果（而非新的上游调用）时附带的响应头部。
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	// maxIdempotencyKeyLength 幂等键的最大长度。
+	maxIdempotencyKeyLength = 255
+	// idempotencyCleanupInterval 清理过期幂等响应的间隔。
+	idempotencyCleanupInterval = time.Minute
+)
+
+var (
+	errIdempotencyKeyMismatch = errors.New("idempotency key reused with a different request body")
+	errIdempotencyCacheFull   = errors.New("idempotency cache is full of in-flight requests")
+)
+
+// idempotencyEntry 是一个幂等键对应的请求状态。done 关闭前请求仍在执行中；
+// 关闭后 completed 表示响应已保存可供重放，否则表示执行者放弃了该键（例如上游暂时性失败），等待者应自行重新执行。
+type idempotencyEntry struct {
+	requestHash string
+	done        chan struct{}
+	completed   bool
+	statusCode  int
+	header      http.Header
+	body        []byte
+	expiresAt   time.Time
+}
+
+// idempotencyCache 在内存中保存按客户端隔离的幂等键及其最终响应。
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+var idempotencyStore = &idempotencyCache{entries: make(map[string]*idempotencyEntry)}
+
+// begin 查找或登记幂等键。owner 为 true 表示调用者是第一个请求，负责执行并调用 complete 或 release；
+// 否则返回已有的条目供调用者等待或重放。同一键下请求体哈希不一致时返回 errIdempotencyKeyMismatch。
+// 登记新键时条目数已达 IDEMPOTENCY_MAX_ENTRIES 则淘汰最早保存的响应，所有条目都在执行中时返回 errIdempotencyCacheFull。
+func (ic *idempotencyCache) begin(scopeKey, requestHash string) (entry *idempotencyEntry, owner bool, err error) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := ic.entries[scopeKey]; ok {
+		if !existing.completed || !now.After(existing.expiresAt) {
+			if existing.requestHash != requestHash {
+				return nil, false, errIdempotencyKeyMismatch
+			}
+			return existing, false, nil
+		}
+		delete(ic.entries, scopeKey) // 已过期、尚未被定期清理的响应
+	}
+	if limit := config.AppSettings.IdempotencyMaxEntries; limit > 0 && len(ic.entries) >= limit {
+		ic.evictExpiredLocked(now)
+		if len(ic.entries) >= limit && !ic.evictOldestLocked() {
+			return nil, false, errIdempotencyCacheFull
+		}
+	}
+	entry = &idempotencyEntry{requestHash: requestHash, done: make(chan struct{})}
+	ic.entries[scopeKey] = entry
+	return entry, true, nil
+}
+
+// complete 保存最终响应并唤醒等待者。响应在 ttl 内可被重放。
+func (ic *idempotencyCache) complete(entry *idempotencyEntry, statusCode int, header http.Header, body []byte, ttl time.Duration) {
+	ic.mu.Lock()
+	entry.completed = true
+	entry.statusCode = statusCode
+	entry.header = header
+	entry.body = body
+	entry.expiresAt = time.Now().Add(ttl)
+	ic.mu.Unlock()
+	close(entry.done)
+}
+
+// release 放弃幂等键（不保存响应）并唤醒等待者，后续同键请求将重新执行。
+func (ic *idempotencyCache) release(scopeKey string, entry *idempotencyEntry) {
+	ic.mu.Lock()
+	if ic.entries[scopeKey] == entry {
+		delete(ic.entries, scopeKey)
+	}
+	ic.mu.Unlock()
+	close(entry.done)
+}
+
+// evictExpiredLocked 删除已过期的已完成条目。调用者必须持有 ic.mu。
+func (ic *idempotencyCache) evictExpiredLocked(now time.Time) {
+	for key, entry := range ic.entries {
+		if entry.completed && now.After(entry.expiresAt) {
+			delete(ic.entries, key)
+		}
+	}
+}
+
+// evictOldestLocked 淘汰最早保存的已完成条目，没有已完成的条目时返回 false。调用者必须持有 ic.mu。
+func (ic *idempotencyCache) evictOldestLocked() bool {
+	oldestKey := ""
+	var oldest *idempotencyEntry
+	for key, entry := range ic.entries {
+		if entry.completed && (oldest == nil || entry.expiresAt.Before(oldest.expiresAt)) {
+			oldestKey, oldest = key, entry
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(ic.entries, oldestKey)
+	return true
+}
+
+// sweep 清理已过期的响应。
+func (ic *idempotencyCache) sweep(now time.Time) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ic.evictExpiredLocked(now)
+}
+
+// RunIdempotencyCleanup 启动定期清理过期幂等响应的后台任务，直到 ctx 取消。
+func RunIdempotencyCleanup(ctx context.Context) {
+	if config.AppSettings.IdempotencyTTL <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(idempotencyCleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				idempotencyStore.sweep(now)
+			}
+		}
+	}()
+}
+
+// bodyCaptureWriter 在写回客户端的同时保留响应体副本，用于保存幂等请求的最终响应。
+type bodyCaptureWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bodyCaptureWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *bodyCaptureWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// isReplayableStatus 判断最终响应是否应当保存以供重放。
+// 5xx 与 429 通常是暂时性的，保存它们会让客户端的重试永远得到同一个失败结果。
+func isReplayableStatus(statusCode int) bool {
+	return statusCode < http.StatusInternalServerError && statusCode != http.StatusTooManyRequests
+}
+
+// replayableHeaders 复制需要随重放响应一起返回的头部。限流头部和请求 ID 描述的是当前请求，不予保存。
+func replayableHeaders(header http.Header) http.Header {
+	saved := make(http.Header)
+	for name, values := range header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-ratelimit-") || lower == "retry-after" || lower == "x-request-id" {
+			continue
+		}
+		saved[name] = append([]string(nil), values...)
+	}
+	return saved
+}
+
+// withIdempotency 按 Idempotency-Key 头部执行非流式请求：同一客户端同一键的第一个请求通过 run 执行并保存最终响应，
+// 并发的重复请求等待其完成，之后的重复请求直接重放已保存的响应；键相同但请求体不同的请求返回 422。
+// 未提供头部、流式请求或未启用 (IDEMPOTENCY_TTL_SECONDS=0) 时直接执行 run。
+// payload: 用于比对请求体的规范化请求内容。
+func withIdempotency(c *gin.Context, payload []byte, isStream bool, run func()) {
+	idempotencyKey := strings.TrimSpace(c.GetHeader(IdempotencyKeyHeader))
+	ttl := config.AppSettings.IdempotencyTTL
+	if idempotencyKey == "" || isStream || ttl <= 0 {
+		run()
+		return
+	}
+	clientOriginalContext := c.Request.Context()
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		sendErrorResponse(c, http.StatusBadRequest, "Idempotency-Key 长度不能超过 255 个字符。", "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+
+	clientID := middleware.ClientID(c)
+	scopeKey := clientID + "\x00" + idempotencyKey
+	hash := sha256.Sum256(payload)
+	requestHash := hex.EncodeToString(hash[:])
+
+	for {
+		entry, owner, err := idempotencyStore.begin(scopeKey, requestHash)
+		if errors.Is(err, errIdempotencyCacheFull) {
+			Log.Warnf("withIdempotency: 幂等键数量已达上限且都在执行中，拒绝客户端 %s 的幂等请求。", clientID)
+			c.Header("Retry-After", "1")
+			sendErrorResponse(c, http.StatusTooManyRequests, "进行中的幂等请求过多，请稍后重试。", "idempotency_cache_full", false, clientOriginalContext)
+			return
+		}
+		if err != nil {
+			Log.Warnf("withIdempotency: 客户端 %s 使用幂等键 %q 提交了不同的请求体。", clientID, idempotencyKey)
+			sendErrorResponse(c, http.StatusUnprocessableEntity, "该 Idempotency-Key 已被用于内容不同的请求。", "idempotency_key_mismatch", false, clientOriginalContext)
+			return
+		}
+		if owner {
+			executeIdempotentRequest(c, scopeKey, entry, ttl, run)
+			return
+		}
+
+		Log.Debugf("withIdempotency: 客户端 %s 的幂等键 %q 已有请求在处理中或已完成，等待其结果。", clientID, idempotencyKey)
+		select {
+		case <-entry.done:
+		case <-clientOriginalContext.Done():
+			Log.Warnf("withIdempotency: 客户端在等待幂等键 %q 的结果时断开连接。", idempotencyKey)
+			return
+		}
+		if entry.completed {
+			replayIdempotentResponse(c, entry)
+			return
+		}
+		// 执行者未保存结果（例如上游暂时性失败），由当前请求重新执行。
+	}
+}
+
+// executeIdempotentRequest 执行幂等键的第一个请求，并根据最终状态码保存或放弃结果。
+func executeIdempotentRequest(c *gin.Context, scopeKey string, entry *idempotencyEntry, ttl time.Duration, run func()) {
+	capture := &bodyCaptureWriter{ResponseWriter: c.Writer}
+	c.Writer = capture
+	finished := false
+	defer func() {
+		c.Writer = capture.ResponseWriter
+		if !finished { // run 发生 panic 时也要唤醒等待者
+			idempotencyStore.release(scopeKey, entry)
+		}
+	}()
+
+	run()
+
+	finished = true
+	statusCode := capture.Status()
+	if c.Request.Context().Err() != nil || !capture.Written() || !isReplayableStatus(statusCode) {
+		idempotencyStore.release(scopeKey, entry)
+		return
+	}
+	idempotencyStore.complete(entry, statusCode, replayableHeaders(capture.Header()), capture.body.Bytes(), ttl)
+}
+
+// replayIdempotentResponse 向客户端重放已保存的响应。
+func replayIdempotentResponse(c *gin.Context, entry *idempotencyEntry) {
+	for name, values := range entry.header {
+		for _, value := range values {
+			c.Writer.Header().Add(name, value)
+		}
+	}
+	c.Header(IdempotentReplayedHeader, "true")
+	c.Status(entry.statusCode)
+	if _, err := c.Writer.Write(entry.body); err != nil {
+		Log.Warnf("replayIdempotentResponse: 重放响应失败: %v (客户端可能已断开)", err)
+	}
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"openrouter_polling/config"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// idempotencyTestRouter 返回一个按 Idempotency-Key 执行请求的路由：请求体即规范化的请求内容，
+// 每次真正执行时依次使用 statuses 中的状态码响应，并返回执行次数计数器。
+func idempotencyTestRouter(t *testing.T, statuses ...int) (*gin.Engine, *int) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	prevLog, prevStore, prevSettings := Log, idempotencyStore, config.AppSettings
+	t.Cleanup(func() { Log, idempotencyStore, config.AppSettings = prevLog, prevStore, prevSettings })
+	Log = logrus.New()
+	Log.SetOutput(io.Discard)
+	idempotencyStore = &idempotencyCache{entries: make(map[string]*idempotencyEntry)}
+	config.AppSettings.IdempotencyTTL = time.Hour
+	config.AppSettings.IdempotencyMaxEntries = 0
+
+	runs := 0
+	router := gin.New()
+	router.POST("/v1/chat/completions", func(c *gin.Context) {
+		payload, _ := io.ReadAll(c.Request.Body)
+		withIdempotency(c, payload, false, func() {
+			status := statuses[min(runs, len(statuses)-1)]
+			runs++
+			c.Header("X-Request-ID", "req-"+strconv.Itoa(runs))
+			c.JSON(status, gin.H{"run": runs})
+		})
+	})
+	return router, &runs
+}
+
+func sendIdempotent(router *gin.Engine, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set(IdempotencyKeyHeader, key)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestIdempotencyReplaysCompletedResponse(t *testing.T) {
+	router, runs := idempotencyTestRouter(t, http.StatusOK)
+	first := sendIdempotent(router, "key-1", `{"q":1}`)
+	second := sendIdempotent(router, "key-1", `{"q":1}`)
+
+	if *runs != 1 {
+		t.Fatalf("执行次数 = %d, 期望重复请求不再执行", *runs)
+	}
+	if second.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+		t.Errorf("重放响应 = %d %q, 期望与第一次相同 %q", second.Code, second.Body.String(), first.Body.String())
+	}
+	if second.Header().Get(IdempotentReplayedHeader) != "true" || first.Header().Get(IdempotentReplayedHeader) != "" {
+		t.Errorf("%s = %q / %q, 期望只在重放时附带", IdempotentReplayedHeader, first.Header().Get(IdempotentReplayedHeader), second.Header().Get(IdempotentReplayedHeader))
+	}
+	if got := second.Header().Get("X-Request-ID"); got != "" {
+		t.Errorf("重放响应的 X-Request-ID = %q, 期望不重放描述原请求的头部", got)
+	}
+
+	// 不同的键独立执行。
+	sendIdempotent(router, "key-2", `{"q":1}`)
+	if *runs != 2 {
+		t.Errorf("执行次数 = %d, 期望不同的键重新执行", *runs)
+	}
+}
+
+func TestIdempotencyRejectsMismatchedBody(t *testing.T) {
+	router, runs := idempotencyTestRouter(t, http.StatusOK)
+	sendIdempotent(router, "key-1", `{"q":1}`)
+	recorder := sendIdempotent(router, "key-1", `{"q":2}`)
+	if recorder.Code != http.StatusUnprocessableEntity {
+		t.Errorf("状态码 = %d, 期望 422", recorder.Code)
+	}
+	if !strings.Contains(recorder.Body.String(), "idempotency_key_mismatch") {
+		t.Errorf("响应体 = %q, 期望 idempotency_key_mismatch", recorder.Body.String())
+	}
+	if *runs != 1 {
+		t.Errorf("执行次数 = %d, 期望请求体不同的请求不执行", *runs)
+	}
+}
+
+func TestIdempotencyDoesNotReplayTransientFailures(t *testing.T) {
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			router, runs := idempotencyTestRouter(t, status, http.StatusOK)
+			if recorder := sendIdempotent(router, "key-1", `{"q":1}`); recorder.Code != status {
+				t.Fatalf("状态码 = %d, 期望 %d", recorder.Code, status)
+			}
+			recorder := sendIdempotent(router, "key-1", `{"q":1}`)
+			if recorder.Code != http.StatusOK || recorder.Header().Get(IdempotentReplayedHeader) != "" {
+				t.Errorf("重试的响应 = %d (重放: %q), 期望重新执行并成功", recorder.Code, recorder.Header().Get(IdempotentReplayedHeader))
+			}
+			if *runs != 2 {
+				t.Errorf("执行次数 = %d, 期望 2", *runs)
+			}
+		})
+	}
+}
+
+func TestIdempotencyCacheEvictsOldestAtLimit(t *testing.T) {
+	router, runs := idempotencyTestRouter(t, http.StatusOK)
+	config.AppSettings.IdempotencyMaxEntries = 2
+	sendIdempotent(router, "key-1", `{"q":1}`)
+	sendIdempotent(router, "key-2", `{"q":2}`)
+	sendIdempotent(router, "key-3", `{"q":3}`) // 淘汰最早保存的 key-1
+
+	if n := len(idempotencyStore.entries); n != 2 {
+		t.Errorf("条目数 = %d, 期望不超过上限 2", n)
+	}
+	if recorder := sendIdempotent(router, "key-3", `{"q":3}`); recorder.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Error("期望最新的响应仍可重放")
+	}
+	sendIdempotent(router, "key-1", `{"q":1}`)
+	if *runs != 4 {
+		t.Errorf("执行次数 = %d, 期望被淘汰的 key-1 重新执行", *runs)
+	}
+}
+
+func TestIdempotencyCacheFullOfInFlightRequests(t *testing.T) {
+	router, runs := idempotencyTestRouter(t, http.StatusOK)
+	config.AppSettings.IdempotencyMaxEntries = 1
+	entry, owner, err := idempotencyStore.begin(config.AnonymousClientName+"\x00in-flight", "hash")
+	if err != nil || !owner {
+		t.Fatalf("登记幂等键失败: %v", err)
+	}
+
+	recorder := sendIdempotent(router, "key-1", `{"q":1}`)
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("状态码 = %d, Retry-After = %q, 期望 429 并附带 Retry-After", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(recorder.Body.String(), "idempotency_cache_full") || *runs != 0 {
+		t.Errorf("响应体 = %q, 执行次数 = %d, 期望不执行并返回 idempotency_cache_full", recorder.Body.String(), *runs)
+	}
+
+	idempotencyStore.complete(entry, http.StatusOK, http.Header{}, []byte("{}"), time.Hour)
+	if recorder := sendIdempotent(router, "key-1", `{"q":1}`); recorder.Code != http.StatusOK || *runs != 1 {
+		t.Errorf("状态码 = %d, 执行次数 = %d, 期望淘汰已完成的条目后执行", recorder.Code, *runs)
+	}
+}
+
+func TestIdempotencySweepRemovesExpiredResponses(t *testing.T) {
+	router, runs := idempotencyTestRouter(t, http.StatusOK)
+	config.AppSettings.IdempotencyTTL = 20 * time.Millisecond
+	sendIdempotent(router, "key-1", `{"q":1}`)
+	sendIdempotent(router, "key-2", `{"q":2}`)
+	inFlight, _, _ := idempotencyStore.begin("client\x00in-flight", "hash")
+	time.Sleep(30 * time.Millisecond)
+
+	idempotencyStore.sweep(time.Now())
+	if n := len(idempotencyStore.entries); n != 1 || idempotencyStore.entries["client\x00in-flight"] != inFlight {
+		t.Errorf("清理后的条目数 = %d, 期望只保留执行中的条目", n)
+	}
+	// 过期的响应不再重放。
+	sendIdempotent(router, "key-1", `{"q":1}`)
+	if *runs != 3 {
+		t.Errorf("执行次数 = %d, 期望过期后重新执行", *runs)
+	}
+}
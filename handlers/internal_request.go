@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// responseRecorder 是记录状态码、响应头和响应体的 http.ResponseWriter，
+// 用于异步任务、批处理等没有客户端连接的内部请求承接处理器的输出。
+type responseRecorder struct {
+	Code        int
+	header      http.Header
+	Body        bytes.Buffer
+	wroteHeader bool
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{Code: http.StatusOK, header: make(http.Header)}
+}
+
+// Header 实现 http.ResponseWriter。
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+// WriteHeader 实现 http.ResponseWriter，只记录第一次写入的状态码。
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.Code = statusCode
+}
+
+// Write 实现 http.ResponseWriter。
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.Body.Write(data)
+}
+
+// Flush 实现 http.Flusher（gin 的流式写入会调用它），内容已在内存中，无需操作。
+func (r *responseRecorder) Flush() {}
+
+// internalHandlerContextKey 是 runInternalRequest 在请求上下文中传递处理函数的键。
+type internalHandlerContextKey struct{}
+
+// internalEngine 是执行内部请求的 gin 引擎，所有路径都交给请求上下文中携带的处理函数。
+var internalEngine = sync.OnceValue(func() *gin.Engine {
+	engine := gin.New()
+	engine.NoRoute(func(c *gin.Context) {
+		if handler, ok := c.Request.Context().Value(internalHandlerContextKey{}).(gin.HandlerFunc); ok {
+			c.Status(http.StatusOK) // gin 为 NoRoute 预设了 404，内部请求与普通路由一样默认 200
+			handler(c)
+		}
+	})
+	return engine
+})
+
+// runInternalRequest 以 ctx 为请求上下文构造一个内部请求，交给 handler 处理并返回录制的响应。
+// handler 收到的 gin.Context 由 gin 引擎正常创建，与普通 API 请求的用法完全一致。
+func runInternalRequest(ctx context.Context, method, path string, handler gin.HandlerFunc) *responseRecorder {
+	recorder := newResponseRecorder()
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, internalHandlerContextKey{}, handler), method, path, nil)
+	if err != nil {
+		recorder.WriteHeader(http.StatusInternalServerError)
+		recorder.Body.Write(mustMarshalError("构造内部请求失败: "+err.Error(), "internal_server_error"))
+		return recorder
+	}
+	internalEngine().ServeHTTP(recorder, req)
+	return recorder
+}
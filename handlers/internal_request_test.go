@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type internalRequestTestKey struct{}
+
+func TestRunInternalRequestRecordsResponse(t *testing.T) {
+	ctx := context.WithValue(context.Background(), internalRequestTestKey{}, "job-ctx")
+	recorder := runInternalRequest(ctx, http.MethodPost, "/v1/jobs/job_1", func(c *gin.Context) {
+		if got := c.Request.Context().Value(internalRequestTestKey{}); got != "job-ctx" {
+			t.Errorf("请求上下文未传递: %v", got)
+		}
+		if c.Request.URL.Path != "/v1/jobs/job_1" {
+			t.Errorf("请求路径 = %q", c.Request.URL.Path)
+		}
+		c.Header("X-Test", "1")
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "slow down"})
+		c.Writer.Flush()
+	})
+
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("Code = %d, 期望 %d", recorder.Code, http.StatusTooManyRequests)
+	}
+	if got := recorder.Header().Get("X-Test"); got != "1" {
+		t.Errorf("X-Test 头部 = %q, 期望 1", got)
+	}
+	if got := recorder.Body.String(); got != `{"error":"slow down"}` {
+		t.Errorf("Body = %q", got)
+	}
+}
+
+func TestRunInternalRequestDefaultsToOK(t *testing.T) {
+	recorder := runInternalRequest(context.Background(), http.MethodGet, "/", func(c *gin.Context) {
+		_, _ = c.Writer.WriteString("ok")
+	})
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "ok" {
+		t.Errorf("Code = %d, Body = %q, 期望 200 ok", recorder.Code, recorder.Body.String())
+	}
+}
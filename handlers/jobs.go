@@ -0,0 +1,412 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"openrouter_polling/config"
+	"openrouter_polling/middleware"
+	"openrouter_polling/models"
+	"openrouter_polling/storage"
+	"openrouter_polling/utils"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// 异步任务相关的 HTTP 头部。
+const (
+	asyncRequestHeader  = "X-Async"         // 请求头：true 表示以异步任务方式执行聊天补全
+	callbackURLHeader   = "X-Callback-URL"  // 请求头：任务完成后接收回调通知的 URL
+	jobSignatureHeader  = "X-Job-Signature" // 回调请求头：t=<unix 时间戳>,v1=<HMAC-SHA256(secret, "<t>.<body>") 的十六进制>
+	asyncJobContextKey  = "async_job"       // /v1/jobs 端点在 gin.Context 中标记强制异步执行的键
+	jobQueueSize        = 1024              // 待执行任务队列长度
+	jobCallbackAttempts = 3                 // 回调通知的最大尝试次数
+)
+
+// jobQueue 在 RunJobWorkers 启动后创建。
+var jobQueue chan *storage.AsyncJob
+
+// asyncRequested 判断本次聊天请求是否应以异步任务方式执行。
+func asyncRequested(c *gin.Context) bool {
+	if c.GetBool(asyncJobContextKey) {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(c.GetHeader(asyncRequestHeader))) {
+	case "true", "1", "on":
+		return true
+	}
+	return false
+}
+
+// CreateJobHandler 处理 `/v1/jobs` POST 请求。请求体与 /v1/chat/completions 相同，总是以异步任务方式执行。
+func CreateJobHandler(c *gin.Context) {
+	c.Set(asyncJobContextKey, true)
+	ChatCompletionsHandler(c)
+}
+
+// submitChatJob 保存异步任务并立即返回 202 和任务对象，由后台工作协程通过密钥池执行。
+func submitChatJob(c *gin.Context, requestData models.ChatCompletionRequest, logEntry *logrus.Entry) {
+	clientOriginalContext := c.Request.Context()
+	if jobQueue == nil || JobStore == nil {
+		sendErrorResponse(c, http.StatusServiceUnavailable, "异步任务功能未启用。", "api_error", false, clientOriginalContext)
+		return
+	}
+	if requestData.Stream != nil && *requestData.Stream {
+		sendErrorResponse(c, http.StatusBadRequest, "异步任务不支持流式响应，请去掉 stream 参数。", "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+	callbackURL := strings.TrimSpace(c.GetHeader(callbackURLHeader))
+	if callbackURL != "" {
+		if config.AppSettings.AsyncJobCallbackSecret == "" {
+			sendErrorResponse(c, http.StatusBadRequest, "服务未配置回调签名密钥 (ASYNC_JOB_CALLBACK_SECRET)，不支持 X-Callback-URL。", "invalid_request_error", false, clientOriginalContext)
+			return
+		}
+		if err := validateCallbackURL(clientOriginalContext, callbackURL); err != nil {
+			sendErrorResponse(c, http.StatusBadRequest, "X-Callback-URL 无效: "+err.Error(), "invalid_request_error", false, clientOriginalContext)
+			return
+		}
+	}
+
+	payload, err := json.Marshal(requestData)
+	if err != nil {
+		Log.Errorf("submitChatJob: 序列化请求数据失败: %v", err)
+		sendErrorResponse(c, http.StatusInternalServerError, "内部服务器错误：序列化请求失败。", "internal_server_error", false, clientOriginalContext)
+		return
+	}
+	job := &storage.AsyncJob{
+		JobID:       utils.NewID("job_"),
+		ClientID:    middleware.ClientID(c),
+		Status:      storage.JobStatusQueued,
+		Request:     string(payload),
+		CallbackURL: callbackURL,
+	}
+	if err := JobStore.CreateJob(job); err != nil {
+		Log.Errorf("submitChatJob: 保存异步任务失败: %v", err)
+		sendErrorResponse(c, http.StatusInternalServerError, "保存异步任务时发生内部错误。", "internal_server_error", false, clientOriginalContext)
+		return
+	}
+
+	select {
+	case jobQueue <- job:
+	default:
+		Log.Warnf("submitChatJob: 异步任务队列已满，拒绝任务 %s。", job.JobID)
+		finishJob(job, http.StatusServiceUnavailable, mustMarshalError("异步任务队列已满，请稍后重试。", "api_error"))
+		sendErrorResponse(c, http.StatusServiceUnavailable, "异步任务队列已满，请稍后重试。", "api_error", false, clientOriginalContext)
+		return
+	}
+
+	logEntry.WithField("job_id", job.JobID).Info("已提交异步聊天任务")
+	c.Header("Location", "/v1/jobs/"+job.JobID)
+	c.JSON(http.StatusAccepted, jobObject(job))
+}
+
+// GetJobHandler 处理 `/v1/jobs/:id` GET 请求，返回任务状态，任务完成后包含结果。
+func GetJobHandler(c *gin.Context) {
+	jobID := c.Param("id")
+	job, err := JobStore.GetJob(jobID, middleware.ClientID(c))
+	if err != nil {
+		if errors.Is(err, storage.ErrJobNotFound) {
+			sendErrorResponse(c, http.StatusNotFound, "未找到任务 '"+jobID+"'。", "job_not_found", false, c.Request.Context())
+			return
+		}
+		Log.Errorf("GetJobHandler: 读取任务 %s 失败: %v", jobID, err)
+		sendErrorResponse(c, http.StatusInternalServerError, "读取任务时发生内部错误。", "internal_server_error", false, c.Request.Context())
+		return
+	}
+	c.JSON(http.StatusOK, jobObject(job))
+}
+
+// jobObject 将数据库中的任务转换为对外返回的任务对象。
+func jobObject(job *storage.AsyncJob) models.Job {
+	obj := models.Job{
+		ID:        job.JobID,
+		Object:    "job",
+		Status:    job.Status,
+		CreatedAt: job.CreatedAt.Unix(),
+	}
+	if job.CompletedAt != nil {
+		completedAt := job.CompletedAt.Unix()
+		obj.CompletedAt = &completedAt
+		obj.StatusCode = job.StatusCode
+	}
+	switch job.Status {
+	case storage.JobStatusSucceeded:
+		obj.Result = json.RawMessage(job.Result)
+	case storage.JobStatusFailed:
+		var errResp struct {
+			Error json.RawMessage `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(job.Result), &errResp); err == nil && len(errResp.Error) > 0 {
+			obj.Error = errResp.Error
+		} else if json.Valid([]byte(job.Result)) {
+			obj.Error = json.RawMessage(job.Result)
+		}
+	}
+	return obj
+}
+
+// mustMarshalError 生成 OpenAI 风格的错误响应 JSON。
+func mustMarshalError(message, errorType string) []byte {
+	data, _ := json.Marshal(models.ErrorResponse{Error: models.ErrorDetail{Message: message, Type: errorType}})
+	return data
+}
+
+// RunJobWorkers 启动执行异步任务的工作协程，并重新排入服务重启前未完成的任务。
+func RunJobWorkers(ctx context.Context) {
+	jobQueue = make(chan *storage.AsyncJob, jobQueueSize)
+	workers := config.AppSettings.AsyncJobWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-jobQueue:
+					processJob(ctx, job)
+				}
+			}
+		}()
+	}
+	Log.Infof("异步任务工作协程已启动 (数量: %d)。", workers)
+
+	unfinished, err := JobStore.ListUnfinishedJobs()
+	if err != nil {
+		Log.Errorf("RunJobWorkers: 读取未完成的异步任务失败: %v", err)
+		return
+	}
+	if len(unfinished) == 0 {
+		return
+	}
+	Log.Infof("RunJobWorkers: 恢复 %d 个未完成的异步任务。", len(unfinished))
+	go func() {
+		for i := range unfinished {
+			select {
+			case jobQueue <- &unfinished[i]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// processJob 通过与同步请求相同的处理路径（上下文裁剪、密钥池、重试、费用统计）执行任务。
+// 服务关闭导致任务中断时，任务重新标记为排队中，待下次启动时恢复执行。
+func processJob(ctx context.Context, job *storage.AsyncJob) {
+	logEntry := Log.WithFields(logrus.Fields{"job_id": job.JobID, "client": job.ClientID})
+	var requestData models.ChatCompletionRequest
+	if err := json.Unmarshal([]byte(job.Request), &requestData); err != nil {
+		logEntry.Errorf("processJob: 无法解析任务请求: %v", err)
+		finishJob(job, http.StatusBadRequest, mustMarshalError("任务请求无法解析: "+err.Error(), "invalid_request_error"))
+		return
+	}
+
+	job.Status = storage.JobStatusRunning
+	if err := JobStore.SaveJob(job); err != nil {
+		logEntry.Errorf("processJob: 更新任务状态失败: %v", err)
+	}
+	logEntry.Info("开始执行异步聊天任务")
+
+	// 任务没有客户端连接，使用录制器承接响应，并携带提交者的客户端名称以便预算检查和费用统计。
+	recorder := runInternalRequest(ctx, http.MethodPost, "/v1/jobs/"+job.JobID, func(c *gin.Context) {
+		c.Set(middleware.ClientIDContextKey, job.ClientID)
+		c.Set(middleware.RequestIDContextKey, job.JobID) // 日志中的请求 ID 即任务 ID
+		// 没有可用密钥时，后台请求排在交互式请求之后
+		c.Request.Header.Set(queuePriorityHeader, config.QueuePriorityLow)
+
+		// 任务的执行结果同样参与抽样捕获，按任务 ID 查询。
+		withPayloadCapture(c, capturedRequest{Body: requestData, Model: requestData.Model}, func() {
+			applyContextTrimPolicy(c, &requestData, logEntry)
+			generateChatResponse(c, requestData, false)
+		})
+	})
+
+	if ctx.Err() != nil {
+		logEntry.Warn("processJob: 服务关闭，任务将在下次启动时重新执行。")
+		job.Status = storage.JobStatusQueued
+		if err := JobStore.SaveJob(job); err != nil {
+			logEntry.Errorf("processJob: 更新任务状态失败: %v", err)
+		}
+		return
+	}
+	finishJob(job, recorder.Code, recorder.Body.Bytes())
+	logEntry.Infof("异步聊天任务结束 (状态: %s, 状态码: %d)", job.Status, job.StatusCode)
+
+	if job.CallbackURL != "" {
+		deliverJobCallback(ctx, job, logEntry)
+	}
+}
+
+// finishJob 记录任务的最终结果。
+func finishJob(job *storage.AsyncJob, statusCode int, body []byte) {
+	now := time.Now()
+	job.CompletedAt = &now
+	job.StatusCode = statusCode
+	job.Result = string(body)
+	job.Status = storage.JobStatusSucceeded
+	if statusCode != http.StatusOK {
+		job.Status = storage.JobStatusFailed
+	}
+	if err := JobStore.SaveJob(job); err != nil {
+		Log.Errorf("finishJob: 保存任务 %s 的结果失败: %v", job.JobID, err)
+	}
+}
+
+// signJobCallback 计算回调签名：HMAC-SHA256(secret, "<timestamp>.<body>")。
+func signJobCallback(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverJobCallback 将任务对象 POST 到回调 URL，失败时按指数退避重试。
+// 回调请求总是附带 X-Job-Signature 签名头部；签名密钥未配置（例如任务提交后配置被移除）时不发送回调。
+func deliverJobCallback(ctx context.Context, job *storage.AsyncJob, logEntry *logrus.Entry) {
+	secret := config.AppSettings.AsyncJobCallbackSecret
+	if secret == "" {
+		logEntry.Warn("deliverJobCallback: 未配置 ASYNC_JOB_CALLBACK_SECRET，不发送未签名的回调。")
+		job.CallbackStatus = "skipped: callback secret not configured"
+		if err := JobStore.SaveJob(job); err != nil {
+			logEntry.Errorf("deliverJobCallback: 保存回调结果失败: %v", err)
+		}
+		return
+	}
+	body, err := json.Marshal(jobObject(job))
+	if err != nil {
+		logEntry.Errorf("deliverJobCallback: 序列化任务对象失败: %v", err)
+		return
+	}
+	backoff := time.Second
+
+	for attempt := 1; attempt <= jobCallbackAttempts; attempt++ {
+		var callbackStatus string
+		callbackStatus, err = postJobCallback(ctx, job, body, secret)
+		if len(callbackStatus) > 255 {
+			callbackStatus = callbackStatus[:255]
+		}
+		job.CallbackStatus = callbackStatus
+		if err == nil {
+			logEntry.Infof("deliverJobCallback: 回调通知成功 (%s)。", job.CallbackStatus)
+			break
+		}
+		logEntry.Warnf("deliverJobCallback: 第 %d 次回调通知失败: %v", attempt, err)
+		if attempt == jobCallbackAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	if err := JobStore.SaveJob(job); err != nil {
+		logEntry.Errorf("deliverJobCallback: 保存回调结果失败: %v", err)
+	}
+}
+
+// postJobCallback 发送一次回调请求，返回结果描述；非 2xx 响应视为失败。
+func postJobCallback(ctx context.Context, job *storage.AsyncJob, body []byte, secret string) (string, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, job.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err.Error(), err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Job-Id", job.JobID)
+	timestamp := time.Now().Unix()
+	req.Header.Set(jobSignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, signJobCallback(secret, timestamp, body)))
+
+	resp, err := jobCallbackClient.Do(req)
+	if err != nil {
+		return err.Error(), err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.Status, fmt.Errorf("回调地址返回状态 %s", resp.Status)
+	}
+	return resp.Status, nil
+}
+
+// jobCallbackClient 是发送回调通知专用的 HTTP 客户端。回调地址由客户端提供，
+// 因此每次建立连接（包括重定向后的连接）都会检查实际连接的 IP，拒绝访问本机和内网地址；
+// 同时不经过代理，以确保检查的就是实际连接的地址。
+var jobCallbackClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !callbackAddressAllowed(ip) {
+					return fmt.Errorf("回调地址 %s 指向本机或内网，已拒绝", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		MaxIdleConns:    10,
+		IdleConnTimeout: 90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("回调重定向次数过多")
+		}
+		return validateCallbackURL(req.Context(), req.URL.String())
+	},
+}
+
+// validateCallbackURL 检查回调地址是否为 http(s) URL，且主机名解析出的所有地址都不是本机或内网地址。
+func validateCallbackURL(ctx context.Context, rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return errors.New("必须是有效的 http(s) URL")
+	}
+	host := parsed.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if !callbackAddressAllowed(ip) {
+			return errors.New("不允许指向本机、内网或链路本地地址")
+		}
+		return nil
+	}
+	lookupCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(lookupCtx, host)
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("无法解析主机名 %s", host)
+	}
+	for _, addr := range addrs {
+		if !callbackAddressAllowed(addr.IP) {
+			return errors.New("不允许指向本机、内网或链路本地地址")
+		}
+	}
+	return nil
+}
+
+// callbackAddressAllowed 判断回调请求能否连接该 IP：拒绝回环、私有、链路本地（含云元数据服务 169.254.169.254）、
+// 未指定和组播地址。
+func callbackAddressAllowed(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
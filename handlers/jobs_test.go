@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"openrouter_polling/storage"
+	"testing"
+)
+
+func TestCallbackAddressAllowed(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+	}
+	for _, tt := range tests {
+		if got := callbackAddressAllowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("callbackAddressAllowed(%s) = %v, 期望 %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestValidateCallbackURL(t *testing.T) {
+	rejected := []string{
+		"ftp://example.com/hook",
+		"http://",
+		"not a url",
+		"http://127.0.0.1:8080/hook",
+		"http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"https://10.0.0.5/hook",
+		"http://localhost/hook",
+	}
+	for _, rawURL := range rejected {
+		if err := validateCallbackURL(context.Background(), rawURL); err == nil {
+			t.Errorf("validateCallbackURL(%q) 期望返回错误", rawURL)
+		}
+	}
+	if err := validateCallbackURL(context.Background(), "https://93.184.215.14/hook"); err != nil {
+		t.Errorf("公网 IP 的回调地址被拒绝: %v", err)
+	}
+}
+
+func TestJobCallbackRefusesInternalAddresses(t *testing.T) {
+	var hits int
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer internal.Close()
+
+	// 即使提交时的检查被绕过（例如 DNS 重新绑定），建立连接时也会拒绝内网地址。
+	job := &storage.AsyncJob{JobID: "job_test", CallbackURL: internal.URL + "/hook"}
+	if _, err := postJobCallback(context.Background(), job, []byte(`{}`), "secret"); err == nil {
+		t.Fatal("期望回调到本机地址失败")
+	}
+
+	// 重定向到内网地址同样会被拒绝。
+	if err := jobCallbackClient.CheckRedirect(httptest.NewRequest(http.MethodPost, internal.URL+"/hook", nil), []*http.Request{{}}); err == nil {
+		t.Error("期望重定向到本机地址被拒绝")
+	}
+	if hits != 0 {
+		t.Errorf("内网回调地址被请求了 %d 次", hits)
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"openrouter_polling/config"
+	"openrouter_polling/middleware"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionIDHeader 是客户端指定会话标识的请求头，同一会话的请求尽量使用同一个密钥。
+const sessionIDHeader = "X-Session-ID"
+
+// conversationAffinityKey 返回请求所属会话的标识，用于将同一会话的请求发往同一个密钥（见 GetAPIKeyForConversation）。
+// 按 KEY_AFFINITY_SOURCES 的顺序取第一个非空的来源：X-Session-ID 请求头、请求体的 user 字段，
+// 或第一条 user 消息及之前所有消息的内容（多轮对话中这部分保持不变）。
+// 标识是客户端名称、来源和原始值的哈希，不同客户端的相同值互不影响，也不在内存中保存原始内容。
+// 未启用会话亲和或无法确定会话时返回空字符串。
+func conversationAffinityKey(c *gin.Context, payload []byte) string {
+	if !config.AppSettings.KeyAffinityEnabled {
+		return ""
+	}
+	var body struct {
+		User     string            `json:"user"`
+		Messages []json.RawMessage `json:"messages"`
+	}
+	parsed := false
+	for _, source := range strings.Split(config.AppSettings.KeyAffinitySources, ",") {
+		source = strings.TrimSpace(source)
+		if (source == config.KeyAffinitySourceUser || source == config.KeyAffinitySourceMessages) && !parsed {
+			_ = json.Unmarshal(payload, &body)
+			parsed = true
+		}
+		var value []byte
+		switch source {
+		case config.KeyAffinitySourceSession:
+			value = []byte(strings.TrimSpace(c.GetHeader(sessionIDHeader)))
+		case config.KeyAffinitySourceUser:
+			value = []byte(body.User)
+		case config.KeyAffinitySourceMessages:
+			value = conversationPrefix(body.Messages)
+		}
+		if len(value) == 0 {
+			continue
+		}
+		h := sha256.New()
+		h.Write([]byte(middleware.ClientID(c)))
+		h.Write([]byte{0})
+		h.Write([]byte(source))
+		h.Write([]byte{0})
+		h.Write(value)
+		return hex.EncodeToString(h.Sum(nil)[:16])
+	}
+	return ""
+}
+
+// conversationPrefix 返回第一条 user 消息及之前所有消息（去除格式空白后）拼接的内容，没有 user 消息时返回 nil。
+func conversationPrefix(messages []json.RawMessage) []byte {
+	var prefix bytes.Buffer
+	for _, raw := range messages {
+		if err := json.Compact(&prefix, raw); err != nil {
+			return nil
+		}
+		prefix.WriteByte('\n')
+		var message struct {
+			Role string `json:"role"`
+		}
+		if json.Unmarshal(raw, &message) == nil && message.Role == "user" {
+			return prefix.Bytes()
+		}
+	}
+	return nil
+}
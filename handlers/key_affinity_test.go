@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestConversationPrefix(t *testing.T) {
+	parse := func(raw string) []json.RawMessage {
+		var messages []json.RawMessage
+		if err := json.Unmarshal([]byte(raw), &messages); err != nil {
+			t.Fatalf("解析消息失败: %v", err)
+		}
+		return messages
+	}
+	first := conversationPrefix(parse(`[{"role":"system","content":"be brief"},{"role":"user","content":"hi"}]`))
+	if string(first) != "{\"role\":\"system\",\"content\":\"be brief\"}\n{\"role\":\"user\",\"content\":\"hi\"}\n" {
+		t.Errorf("前缀 = %q, 期望第一条 user 消息及之前的消息", first)
+	}
+
+	// 多轮对话中后续的消息不影响前缀，格式空白也不影响。
+	later := conversationPrefix(parse(`[{"role": "system", "content": "be brief"}, {"role": "user", "content": "hi"},
+		{"role":"assistant","content":"hello"},{"role":"user","content":"more"}]`))
+	if string(later) != string(first) {
+		t.Errorf("后续轮次的前缀 = %q, 期望与第一轮相同 %q", later, first)
+	}
+
+	if got := conversationPrefix(parse(`[{"role":"system","content":"be brief"}]`)); got != nil {
+		t.Errorf("没有 user 消息时前缀 = %q, 期望 nil", got)
+	}
+	if got := conversationPrefix(nil); got != nil {
+		t.Errorf("没有消息时前缀 = %q, 期望 nil", got)
+	}
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"openrouter_polling/apimanager"
+	"openrouter_polling/config"
+	"openrouter_polling/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	keyEventsDefaultLimit   = 100
+	keyEventsMaxLimit       = 1000
+	keyEventCleanupInterval = time.Hour
+)
+
+// KeyEventsHandler 处理 `/admin/keys/:suffix/events` GET 请求，按时间倒序返回密钥的状态变化历史，
+// 并附带最近 24 小时和 7 天内各类事件的次数。
+// 查询参数：limit（默认 100，最大 1000）、event（逗号分隔的事件类型，如 failure,cooldown_start）。
+func KeyEventsHandler(c *gin.Context) {
+	suffix := c.Param("suffix")
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(keyEventsDefaultLimit)))
+	if err != nil || limit < 1 {
+		limit = keyEventsDefaultLimit
+	}
+	if limit > keyEventsMaxLimit {
+		limit = keyEventsMaxLimit
+	}
+	var eventTypes []string
+	for eventType := range commaSet(c.Query("event")) {
+		eventTypes = append(eventTypes, eventType)
+	}
+
+	events, err := KeyEventStore.ListEvents(suffix, eventTypes, limit)
+	if err != nil {
+		Log.Errorf("KeyEventsHandler: 读取密钥 %s 的状态变化历史失败: %v", suffix, err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "读取密钥历史时发生内部错误。", Type: "internal_server_error"}})
+		return
+	}
+	summary := gin.H{}
+	now := time.Now()
+	for name, window := range map[string]time.Duration{"last_24h": 24 * time.Hour, "last_7d": 7 * 24 * time.Hour} {
+		counts, err := KeyEventStore.CountEventsSince(suffix, now.Add(-window))
+		if err != nil {
+			Log.Errorf("KeyEventsHandler: 统计密钥 %s 的状态变化次数失败: %v", suffix, err)
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: models.ErrorDetail{
+				Message: "读取密钥历史时发生内部错误。", Type: "internal_server_error"}})
+			return
+		}
+		summary[name] = counts
+	}
+	c.JSON(http.StatusOK, gin.H{"key_suffix": suffix, "events": events, "summary": summary})
+}
+
+// EnableKeyHandler 处理 `/admin/keys/:suffix/enable` POST 请求，重新启用被管理员停用的密钥。
+func EnableKeyHandler(c *gin.Context) {
+	setKeyDisabled(c, false)
+}
+
+// DisableKeyHandler 处理 `/admin/keys/:suffix/disable` POST 请求，停用密钥。
+// 停用的密钥不参与轮询和健康检查，直到再次启用。
+func DisableKeyHandler(c *gin.Context) {
+	setKeyDisabled(c, true)
+}
+
+func setKeyDisabled(c *gin.Context, disabled bool) {
+	suffix := c.Param("suffix")
+	if err := ApiKeyMgr.SetKeyDisabled(suffix, disabled); err != nil {
+		respondKeyUpdateError(c, suffix, err)
+		return
+	}
+	action := "启用"
+	if disabled {
+		action = "停用"
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "后缀为 '" + suffix + "' 的密钥已" + action + "。", "disabled": disabled})
+}
+
+// UpdateKeyWeightHandler 处理 `/admin/keys/:suffix/weight` POST 请求，请求体为 {"weight": N}（N >= 1）。
+func UpdateKeyWeightHandler(c *gin.Context) {
+	suffix := c.Param("suffix")
+	var req struct {
+		Weight int `json:"weight"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Weight < 1 {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "请求体必须为 {\"weight\": N}，且 N 为不小于 1 的整数。", Type: "invalid_request_error", Param: "weight"}})
+		return
+	}
+	if err := ApiKeyMgr.SetKeyWeight(suffix, req.Weight); err != nil {
+		respondKeyUpdateError(c, suffix, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "后缀为 '" + suffix + "' 的密钥权重已更新为 " + strconv.Itoa(req.Weight) + "。", "weight": req.Weight})
+}
+
+func respondKeyUpdateError(c *gin.Context, suffix string, err error) {
+	if errors.Is(err, apimanager.ErrKeyNotFound) {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "未找到具有该后缀的密钥。", Type: "key_not_found"}})
+		return
+	}
+	Log.Errorf("更新密钥 %s 失败: %v", suffix, err)
+	c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: models.ErrorDetail{
+		Message: "更新密钥时发生内部错误。", Type: "operation_failed"}})
+}
+
+// RunKeyEventCleanup 启动按 KEY_EVENT_RETENTION_DAYS 定期删除过期密钥历史的后台任务，直到 ctx 取消。
+func RunKeyEventCleanup(ctx context.Context) {
+	retention := config.AppSettings.KeyEventRetention
+	if KeyEventStore == nil || retention <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(keyEventCleanupInterval)
+		defer ticker.Stop()
+		for {
+			deleted, err := KeyEventStore.DeleteEventsBefore(time.Now().Add(-retention))
+			if err != nil {
+				Log.Errorf("RunKeyEventCleanup: 清理过期的密钥历史失败: %v", err)
+			} else if deleted > 0 {
+				Log.Infof("RunKeyEventCleanup: 已清理 %d 条过期的密钥历史。", deleted)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
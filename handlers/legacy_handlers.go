@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"openrouter_polling/apimanager"
+	"openrouter_polling/config"
+	"openrouter_polling/models"
+	"openrouter_polling/utils"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// CompletionsHandler 处理 `/v1/completions` POST 请求（旧版 prompt 风格的文本补全）。
+// 请求会原样转发到 OpenRouter 的 completions 端点，并复用与聊天接口相同的密钥轮换、重试和错误分类逻辑。
+func CompletionsHandler(c *gin.Context) {
+	clientOriginalContext := c.Request.Context()
+	if clientOriginalContext.Err() == context.Canceled {
+		requestLog(c).Warn("CompletionsHandler: 客户端在处理请求前已断开连接。")
+		return
+	}
+
+	var requestData models.CompletionRequest
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		requestLog(c).Warnf("CompletionsHandler: 无效的请求体: %v", err)
+		sendErrorResponse(c, http.StatusBadRequest, "请求体解析失败: "+err.Error(), "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+	if requestData.Prompt == nil {
+		sendErrorResponse(c, http.StatusBadRequest, "缺少必需参数 'prompt'。", "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+	if requestData.Model == "" {
+		requestData.Model = config.AppSettings.DefaultModel
+		requestLog(c).Debugf("CompletionsHandler: 请求未指定模型，使用默认模型: %s", requestData.Model)
+	}
+
+	isStreamForClientResponse := requestData.Stream != nil && *requestData.Stream
+	requestData.Stream = &isStreamForClientResponse
+
+	requestLog(c).WithFields(logrus.Fields{
+		"model":     requestData.Model,
+		"streaming": isStreamForClientResponse,
+		"user":      utils.DerefString(requestData.User, "N/A"),
+		"client_ip": c.ClientIP(),
+	}).Info("收到文本补全请求")
+
+	payloadBytes, err := json.Marshal(requestData)
+	if err != nil {
+		requestLog(c).Errorf("CompletionsHandler: 序列化请求数据失败: %v", err)
+		sendErrorResponse(c, http.StatusInternalServerError, "内部服务器错误：序列化请求失败。", "internal_server_error", isStreamForClientResponse, clientOriginalContext)
+		return
+	}
+
+	if isStreamForClientResponse {
+		prepareSSEHeaders(c)
+	}
+
+	withPayloadCapture(c, capturedRequest{Body: requestData, Model: requestData.Model, Stream: isStreamForClientResponse}, func() {
+		executeUpstreamRequest(c, upstreamRequest{
+			URL:       config.AppSettings.OpenRouterCompletionsURL,
+			Payload:   payloadBytes,
+			IsStream:  isStreamForClientResponse,
+			Operation: genAIOperationTextCompletion,
+			HandleOK: func(attemptCtx context.Context, c *gin.Context, resp *http.Response, apiKeyStatus *apimanager.ApiKeyStatus, clientOriginalContext context.Context) (bool, bool, int, string, string) {
+				if !isStreamForClientResponse {
+					return relayNonStreamingResponse(c, resp, apiKeyStatus, clientOriginalContext, nil)
+				}
+				return relayStreamingResponse(attemptCtx, c, resp, apiKeyStatus, clientOriginalContext, inspectCompletionChunk, passthroughSink{c: c})
+			},
+		})
+	})
+}
+
+// EmbeddingsHandler 处理 `/v1/embeddings` POST 请求。
+// 向量嵌入没有流式模式，响应会原样透传给客户端。
+func EmbeddingsHandler(c *gin.Context) {
+	clientOriginalContext := c.Request.Context()
+	if clientOriginalContext.Err() == context.Canceled {
+		requestLog(c).Warn("EmbeddingsHandler: 客户端在处理请求前已断开连接。")
+		return
+	}
+
+	var requestData models.EmbeddingRequest
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		requestLog(c).Warnf("EmbeddingsHandler: 无效的请求体: %v", err)
+		sendErrorResponse(c, http.StatusBadRequest, "请求体解析失败: "+err.Error(), "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+	if requestData.Input == nil {
+		sendErrorResponse(c, http.StatusBadRequest, "缺少必需参数 'input'。", "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+	if requestData.Model == "" {
+		// 聊天默认模型通常不是嵌入模型，因此这里要求客户端显式指定。
+		sendErrorResponse(c, http.StatusBadRequest, "缺少必需参数 'model'。", "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+
+	requestLog(c).WithFields(logrus.Fields{
+		"model":     requestData.Model,
+		"user":      utils.DerefString(requestData.User, "N/A"),
+		"client_ip": c.ClientIP(),
+	}).Info("收到向量嵌入请求")
+
+	payloadBytes, err := json.Marshal(requestData)
+	if err != nil {
+		requestLog(c).Errorf("EmbeddingsHandler: 序列化请求数据失败: %v", err)
+		sendErrorResponse(c, http.StatusInternalServerError, "内部服务器错误：序列化请求失败。", "internal_server_error", false, clientOriginalContext)
+		return
+	}
+
+	withPayloadCapture(c, capturedRequest{Body: requestData, Model: requestData.Model}, func() {
+		executeUpstreamRequest(c, upstreamRequest{
+			URL:       config.AppSettings.OpenRouterEmbeddingsURL,
+			Payload:   payloadBytes,
+			IsStream:  false,
+			Operation: genAIOperationEmbeddings,
+			HandleOK: func(attemptCtx context.Context, c *gin.Context, resp *http.Response, apiKeyStatus *apimanager.ApiKeyStatus, clientOriginalContext context.Context) (bool, bool, int, string, string) {
+				return relayNonStreamingResponse(c, resp, apiKeyStatus, clientOriginalContext, nil)
+			},
+		})
+	})
+}
+
+// inspectCompletionChunk 是文本补全流的 sseChunkInspector：非空的 choices[].text 视为有意义。
+func inspectCompletionChunk(dataContent string, logEntry *logrus.Entry) (bool, error) {
+	var chunk models.CompletionChunk
+	if err := json.Unmarshal([]byte(dataContent), &chunk); err != nil {
+		return false, err
+	}
+	for _, choice := range chunk.Choices {
+		if choice.Text != "" {
+			logEntry.Infof("processStreamingResponse: 收到首块有意义文本补全数据: %q", choice.Text)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// setSSEHeaders 设置 Server-Sent Events 所需的响应头并立即发送给客户端。
+func setSSEHeaders(c *gin.Context) {
+	prepareSSEHeaders(c)
+	c.Writer.Flush() // 确保头部立即发送给客户端
+}
+
+// prepareSSEHeaders 设置 Server-Sent Events 所需的响应头，但不立即发送：头部随第一段流数据（或流式错误事件）一起发出。
+// 代理接口使用它，使得在上游响应之前才确定的头部（熔断时的 Retry-After、排队等待时间等）仍能送达客户端。
+func prepareSSEHeaders(c *gin.Context) {
+	c.Writer.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	c.Writer.Header().Set("Cache-Control", "no-cache") // 禁止缓存
+	c.Writer.Header().Set("Connection", "keep-alive")  // 保持连接活动
+	c.Writer.Header().Set("X-Accel-Buffering", "no")   // 建议：禁用 nginx 等反向代理的缓冲
+}
+
+// sseResponseStarted 报告响应是否已进入流式模式：头部已经发出，或已由 prepareSSEHeaders 准备为 SSE。
+// 此时错误应以流中事件的形式发送，而不是普通的 JSON 错误体。
+func sseResponseStarted(c *gin.Context) bool {
+	return c.Writer.Written() || strings.HasPrefix(c.Writer.Header().Get("Content-Type"), "text/event-stream")
+}
+
+// writeSSEEvent 以 `event: <name>` + `data: <json>` 的形式向客户端写出一个具名 SSE 事件并刷新。
+// Anthropic Messages、OpenAI Responses 等使用具名事件的协议共用此函数。
+func writeSSEEvent(c *gin.Context, event string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.Writer, "event: %s\n%s%s\n\n", event, models.SSEDataPrefix, data); err != nil {
+		return err
+	}
+	if flusher, ok := c.Writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
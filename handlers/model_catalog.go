@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"openrouter_polling/config"
+	"openrouter_polling/models"
+	"sync"
+	"time"
+)
+
+// modelCatalogTTL 模型目录缓存的有效期。OpenRouter 的模型列表变化不频繁，一小时刷新一次足够。
+const modelCatalogTTL = time.Hour
+
+// modelCatalogRetryBackoff 刷新失败后再次尝试前的等待时间。期间继续使用已有（可能过期的）缓存，
+// 避免 /models 不可用或响应缓慢时每个请求都为刷新付出超时代价。
+const modelCatalogRetryBackoff = time.Minute
+
+// modelCatalogFetchTimeout 单次拉取模型目录的超时时间。
+const modelCatalogFetchTimeout = 15 * time.Second
+
+// modelCatalogCache 在内存中缓存 OpenRouter 的模型目录（上下文长度、定价等），
+// 供上下文裁剪等需要模型元数据的功能使用，避免每个请求都访问 /models。
+type modelCatalogCache struct {
+	mu          sync.RWMutex
+	models      map[string]models.OpenRouterModel
+	fetchedAt   time.Time
+	lastFailure time.Time     // 最近一次刷新失败的时间，用于退避
+	refreshing  chan struct{} // 非 nil 表示有刷新正在进行，刷新结束时关闭
+}
+
+var modelCatalog = &modelCatalogCache{models: make(map[string]models.OpenRouterModel)}
+
+// store 用一份完整的模型列表替换缓存内容。
+func (mc *modelCatalogCache) store(list []models.OpenRouterModel) {
+	fresh := make(map[string]models.OpenRouterModel, len(list))
+	for _, m := range list {
+		fresh[m.ID] = m
+	}
+	mc.mu.Lock()
+	mc.models = fresh
+	mc.fetchedAt = time.Now()
+	mc.lastFailure = time.Time{}
+	mc.mu.Unlock()
+}
+
+// isFresh 判断缓存是否仍在有效期内。
+func (mc *modelCatalogCache) isFresh() bool {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	return !mc.fetchedAt.IsZero() && time.Since(mc.fetchedAt) < modelCatalogTTL
+}
+
+// lookup 从缓存中查找模型，必要时触发刷新。已有缓存数据时不等待刷新，直接返回（可能过期的）数据；
+// 只有缓存从未加载过时才等待正在进行的刷新完成。
+func (mc *modelCatalogCache) lookup(ctx context.Context, modelID string) (models.OpenRouterModel, bool) {
+	if done, hasData := mc.startRefresh(); done != nil && !hasData {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	m, ok := mc.models[modelID]
+	return m, ok
+}
+
+// startRefresh 在缓存过期且不处于失败退避期时启动一次后台刷新。同一时间最多只有一个刷新在进行，
+// 并发调用者共享它。返回正在进行的刷新的完成信号（没有刷新时为 nil）以及缓存中是否已有数据。
+func (mc *modelCatalogCache) startRefresh() (<-chan struct{}, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	hasData := !mc.fetchedAt.IsZero()
+	if hasData && time.Since(mc.fetchedAt) < modelCatalogTTL {
+		return nil, true
+	}
+	if mc.refreshing == nil {
+		if !mc.lastFailure.IsZero() && time.Since(mc.lastFailure) < modelCatalogRetryBackoff {
+			return nil, hasData
+		}
+		done := make(chan struct{})
+		mc.refreshing = done
+		go mc.runRefresh(done)
+	}
+	return mc.refreshing, hasData
+}
+
+// runRefresh 执行一次刷新并记录结果。刷新不绑定触发它的请求的上下文，
+// 以免该客户端断开连接导致所有等待者的刷新一起失败。
+func (mc *modelCatalogCache) runRefresh(done chan struct{}) {
+	err := mc.refresh(context.Background())
+	if err != nil {
+		Log.Warnf("modelCatalog: 刷新 OpenRouter 模型目录失败，%v 内不再重试: %v", modelCatalogRetryBackoff, err)
+	}
+	mc.mu.Lock()
+	if err != nil {
+		mc.lastFailure = time.Now()
+	}
+	mc.refreshing = nil
+	mc.mu.Unlock()
+	close(done)
+}
+
+// refresh 从 OpenRouter 拉取最新的模型目录。
+func (mc *modelCatalogCache) refresh(ctx context.Context) error {
+	reqCtx, cancel := context.WithTimeout(ctx, modelCatalogFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, "GET", config.AppSettings.OpenRouterModelsURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("上游返回状态 %d: %s", resp.StatusCode, string(body))
+	}
+
+	var openRouterResp models.OpenRouterModelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&openRouterResp); err != nil {
+		return err
+	}
+	mc.store(openRouterResp.Data)
+	Log.Debugf("modelCatalog: 已刷新 OpenRouter 模型目录，共 %d 个模型。", len(openRouterResp.Data))
+	return nil
+}
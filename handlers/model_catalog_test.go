@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"openrouter_polling/config"
+	"openrouter_polling/models"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// useModelCatalogStub 把模型目录地址指向 handler 提供的桩服务。
+func useModelCatalogStub(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	prevSettings, prevClient, prevLog := config.AppSettings, HttpClient, Log
+	t.Cleanup(func() { config.AppSettings, HttpClient, Log = prevSettings, prevClient, prevLog })
+	config.AppSettings.OpenRouterModelsURL = server.URL
+	HttpClient = server.Client()
+	Log = logrus.New()
+	Log.SetOutput(io.Discard)
+}
+
+func TestModelCatalogSingleRefreshForConcurrentLookups(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	useModelCatalogStub(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		_, _ = w.Write([]byte(`{"data":[{"id":"m1","context_length":8192}]}`))
+	})
+	mc := &modelCatalogCache{models: make(map[string]models.OpenRouterModel)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if m, ok := mc.lookup(context.Background(), "m1"); !ok || m.ContextLength != 8192 {
+				t.Errorf("lookup = %+v, %v, 期望找到 m1", m, ok)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if got := calls.Load(); got != 1 {
+		t.Errorf("上游被请求了 %d 次, 期望并发查找只刷新 1 次", got)
+	}
+}
+
+func TestModelCatalogBacksOffAndServesStaleData(t *testing.T) {
+	var calls atomic.Int32
+	useModelCatalogStub(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	})
+	mc := &modelCatalogCache{models: make(map[string]models.OpenRouterModel)}
+	mc.store([]models.OpenRouterModel{{ID: "m1", ContextLength: 4096}})
+	mc.fetchedAt = time.Now().Add(-2 * modelCatalogTTL) // 缓存已过期
+
+	// 过期时立即返回旧数据，刷新在后台进行。
+	if m, ok := mc.lookup(context.Background(), "m1"); !ok || m.ContextLength != 4096 {
+		t.Fatalf("lookup = %+v, %v, 期望返回过期的缓存数据", m, ok)
+	}
+	if done, _ := mc.startRefresh(); done != nil {
+		<-done
+	}
+	for i := 0; i < 5; i++ {
+		if _, ok := mc.lookup(context.Background(), "m1"); !ok {
+			t.Fatal("刷新失败后期望继续返回过期的缓存数据")
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("上游被请求了 %d 次, 期望失败后在退避期内不再重试", got)
+	}
+
+	mc.mu.Lock()
+	mc.lastFailure = time.Now().Add(-2 * modelCatalogRetryBackoff)
+	mc.mu.Unlock()
+	if done, _ := mc.startRefresh(); done == nil {
+		t.Error("退避期结束后期望重新发起刷新")
+	} else {
+		<-done
+	}
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"openrouter_polling/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestModelContextKey 是当前发往上游的模型（改用备用模型后为备用模型）在 gin.Context 中的键。
+const requestModelContextKey = "request_model"
+
+// fallbackModelHeader 是改用备用模型时返回给客户端的响应头，值为实际使用的模型。
+const fallbackModelHeader = "X-Fallback-Model"
+
+// ModelHealthHandler 处理 `/admin/models/health` GET 请求，返回各模型的错误率和降级状态。
+func ModelHealthHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"models": ModelHealth.Snapshot()})
+}
+
+// rerouteToFallback 在模型降级时将请求改为使用 MODEL_FALLBACKS 中配置的备用模型：
+// 重写请求体的 model 字段并设置 X-Fallback-Model 响应头。没有可用的备用模型（未配置或备用模型同样降级）时返回 false。
+func rerouteToFallback(c *gin.Context, upstreamReq *upstreamRequest, model *string) bool {
+	fallback := config.ModelFallbackFor(*model)
+	if fallback == "" || fallback == *model || ModelHealth.IsDegraded(fallback) {
+		return false
+	}
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(upstreamReq.Payload, &body); err != nil {
+		requestLog(c).Errorf("rerouteToFallback: 解析请求体失败，无法改用备用模型: %v", err)
+		return false
+	}
+	body["model"], _ = json.Marshal(fallback)
+	payload, err := json.Marshal(body)
+	if err != nil {
+		requestLog(c).Errorf("rerouteToFallback: 重新序列化请求体失败，无法改用备用模型: %v", err)
+		return false
+	}
+	requestLog(c).Warnf("rerouteToFallback: 模型 %s 处于降级状态，改用备用模型 %s。", *model, fallback)
+	upstreamReq.Payload = payload
+	*model = fallback
+	c.Set(requestModelContextKey, fallback)
+	c.Header(fallbackModelHeader, fallback)
+	return true
+}
@@ -0,0 +1,375 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"openrouter_polling/config"
+	"openrouter_polling/middleware"
+	"openrouter_polling/models"
+	"openrouter_polling/storage"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	redactedPlaceholder           = "[REDACTED]"
+	payloadCaptureCleanupInterval = time.Hour
+)
+
+// PayloadCaptureStore 是请求/响应内容捕获的存储后端，由 main.go 按 PAYLOAD_CAPTURE_STORE 注入
+// 数据库实现 (storage.CaptureStore) 或磁盘实现 (storage.FileCaptureStore)。
+type PayloadCaptureStore interface {
+	SaveCapture(capture *storage.PayloadCapture) error
+	FindCaptures(requestID, clientID string) ([]storage.PayloadCapture, error)
+	DeleteCapturesBefore(cutoff time.Time) (int64, error)
+}
+
+// CaptureStore 为 nil 时不捕获任何内容。
+var CaptureStore PayloadCaptureStore
+
+// payloadRedactor 在保存捕获内容前按配置脱敏：先将 JSON 路径命中的值替换为占位符，再替换正则表达式的匹配部分。
+type payloadRedactor struct {
+	paths   [][]string
+	regexes []*regexp.Regexp
+}
+
+var captureRedactor = &payloadRedactor{}
+
+// InitPayloadRedaction 解析 PAYLOAD_CAPTURE_REDACT_PATHS 和 PAYLOAD_CAPTURE_REDACT_REGEXES 中的脱敏规则。
+func InitPayloadRedaction() error {
+	redactor := &payloadRedactor{}
+	for _, path := range strings.Split(config.AppSettings.PayloadCaptureRedactPaths, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			redactor.paths = append(redactor.paths, strings.Split(path, "."))
+		}
+	}
+	if raw := strings.TrimSpace(config.AppSettings.PayloadCaptureRedactRegexes); raw != "" {
+		var patterns []string
+		if err := json.Unmarshal([]byte(raw), &patterns); err != nil {
+			return fmt.Errorf("PAYLOAD_CAPTURE_REDACT_REGEXES 必须是字符串的 JSON 数组: %w", err)
+		}
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("无效的脱敏正则表达式 %q: %w", pattern, err)
+			}
+			redactor.regexes = append(redactor.regexes, re)
+		}
+	}
+	captureRedactor = redactor
+	Log.Infof("请求内容捕获已启用 (抽样比例: %.4g, 脱敏路径: %d 条, 脱敏正则: %d 条)。", config.AppSettings.PayloadCaptureSampleRate, len(redactor.paths), len(redactor.regexes))
+	return nil
+}
+
+// redact 返回脱敏后的内容。内容不是 JSON 时只应用正则规则。
+func (r *payloadRedactor) redact(data []byte) string {
+	if len(r.paths) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var doc interface{}
+		if err := decoder.Decode(&doc); err == nil {
+			for _, path := range r.paths {
+				doc = redactJSONPath(doc, path)
+			}
+			if redacted, err := json.Marshal(doc); err == nil {
+				data = redacted
+			}
+		}
+	}
+	text := string(data)
+	for _, re := range r.regexes {
+		text = re.ReplaceAllString(text, redactedPlaceholder)
+	}
+	return text
+}
+
+// redactJSONPath 将 path 命中的值替换为占位符。路径段 * 匹配任意对象键或数组元素，数字段匹配数组下标。
+func redactJSONPath(node interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return redactedPlaceholder
+	}
+	segment, rest := path[0], path[1:]
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if segment == "*" || segment == key {
+				value[key] = redactJSONPath(child, rest)
+			}
+		}
+	case []interface{}:
+		for i, child := range value {
+			if segment == "*" || segment == strconv.Itoa(i) {
+				value[i] = redactJSONPath(child, rest)
+			}
+		}
+	}
+	return node
+}
+
+// shouldCapturePayload 决定是否捕获当前客户端的本次请求：PAYLOAD_CAPTURE_CLIENTS 中的客户端总是捕获，
+// 其余请求按 PAYLOAD_CAPTURE_SAMPLE_RATE 抽样。
+func shouldCapturePayload(clientID string) bool {
+	if CaptureStore == nil {
+		return false
+	}
+	if config.ListContains(config.AppSettings.PayloadCaptureClients, clientID) {
+		return true
+	}
+	rate := config.AppSettings.PayloadCaptureSampleRate
+	return rate > 0 && rand.Float64() < rate
+}
+
+// capturedRequest 描述交给 withPayloadCapture 的请求。
+type capturedRequest struct {
+	Body           interface{}             // 客户端提交的请求（按客户端使用的协议格式）
+	Model          string                  // 请求的模型
+	Stream         bool                    // 是否为流式响应
+	AssembleStream func(raw []byte) []byte // 将流式响应拼接为完整对象；为 nil 时保存原始事件流
+}
+
+// withPayloadCapture 在被抽中时记录客户端提交的请求和最终返回给客户端的响应，脱敏后异步保存，
+// 管理员可按 X-Request-ID（和客户端）查询。各协议的处理器在解析请求后用它包裹实际的执行过程。
+func withPayloadCapture(c *gin.Context, request capturedRequest, run func()) {
+	clientID := middleware.ClientID(c)
+	if !shouldCapturePayload(clientID) {
+		run()
+		return
+	}
+	requestID := middleware.RequestID(c)
+	startTime := time.Now()
+	capture := &bodyCaptureWriter{ResponseWriter: c.Writer}
+	c.Writer = capture
+	defer func() { c.Writer = capture.ResponseWriter }()
+
+	run()
+
+	requestJSON, _ := json.Marshal(request.Body)
+	responseBody := capture.body.Bytes()
+	if request.Stream && request.AssembleStream != nil {
+		responseBody = request.AssembleStream(responseBody)
+	}
+	record := &storage.PayloadCapture{
+		RequestID:    requestID,
+		ClientID:     clientID,
+		Endpoint:     c.Request.URL.Path,
+		Model:        request.Model,
+		Stream:       request.Stream,
+		StatusCode:   capture.Status(),
+		DurationMs:   time.Since(startTime).Milliseconds(),
+		GenerationID: upstreamGenerationID(c),
+		Request:      captureRedactor.redact(requestJSON),
+		Response:     captureRedactor.redact(responseBody),
+	}
+	go func() {
+		if err := CaptureStore.SaveCapture(record); err != nil {
+			Log.Errorf("withPayloadCapture: 保存客户端 %s 请求 %s 的捕获内容失败: %v", record.ClientID, record.RequestID, err)
+		}
+	}()
+}
+
+// assembledStreamResponse 是由流式数据块拼接成的完整响应；流中出现错误事件时附带 error 字段。
+type assembledStreamResponse struct {
+	models.ChatCompletionResponse
+	Error json.RawMessage `json:"error,omitempty"`
+}
+
+// assembleStreamResponse 将 SSE 响应中的 chat.completion.chunk 数据块按 choice 拼接为完整的 chat.completion 对象：
+// 合并内容增量、按序号合并工具调用参数，并保留结束原因和用量统计。没有可解析的数据块时原样返回。
+func assembleStreamResponse(raw []byte) []byte {
+	var assembled *assembledStreamResponse
+	choices := make(map[int]*models.ChatCompletionChoice)
+	contents := make(map[int]*strings.Builder)
+	toolCalls := make(map[int][]models.ToolCall)
+
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+		if !ok {
+			continue
+		}
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 || string(data) == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			models.ChatCompletionChunk
+			Error json.RawMessage `json:"error"`
+		}
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			continue
+		}
+		if assembled == nil {
+			assembled = &assembledStreamResponse{ChatCompletionResponse: models.ChatCompletionResponse{
+				ID: chunk.ID, Object: "chat.completion", Created: chunk.Created, Model: chunk.Model,
+			}}
+		}
+		if len(chunk.Error) > 0 {
+			assembled.Error = chunk.Error
+		}
+		if chunk.Usage != nil {
+			assembled.Usage = chunk.Usage
+		}
+		for _, delta := range chunk.Choices {
+			choice, exists := choices[delta.Index]
+			if !exists {
+				choice = &models.ChatCompletionChoice{Index: delta.Index, Message: models.Message{Role: "assistant"}}
+				choices[delta.Index] = choice
+				contents[delta.Index] = &strings.Builder{}
+			}
+			if delta.Delta.Role != nil {
+				choice.Message.Role = *delta.Delta.Role
+			}
+			if delta.Delta.Content != nil {
+				contents[delta.Index].WriteString(*delta.Delta.Content)
+			}
+			if delta.Delta.ToolCalls != nil {
+				toolCalls[delta.Index] = mergeToolCallDeltas(toolCalls[delta.Index], *delta.Delta.ToolCalls)
+			}
+			if delta.FinishReason != nil {
+				choice.FinishReason = delta.FinishReason
+			}
+		}
+	}
+	if assembled == nil {
+		return raw
+	}
+
+	indexes := make([]int, 0, len(choices))
+	for index := range choices {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		choice := choices[index]
+		choice.Message.Content = contents[index].String()
+		if calls := toolCalls[index]; len(calls) > 0 {
+			choice.Message.ToolCalls = &calls
+		}
+		assembled.Choices = append(assembled.Choices, *choice)
+	}
+	data, err := json.Marshal(assembled)
+	if err != nil {
+		return raw
+	}
+	return data
+}
+
+// mergeToolCallDeltas 将工具调用增量按 index 合并：首个增量携带 ID 和函数名，后续增量追加参数片段。
+func mergeToolCallDeltas(calls []models.ToolCall, deltas []models.ToolCall) []models.ToolCall {
+	for _, delta := range deltas {
+		position := -1
+		if delta.Index != nil {
+			for i := range calls {
+				if calls[i].Index != nil && *calls[i].Index == *delta.Index {
+					position = i
+					break
+				}
+			}
+		}
+		if position < 0 {
+			calls = append(calls, models.ToolCall{Index: delta.Index, Type: "function"})
+			position = len(calls) - 1
+		}
+		call := &calls[position]
+		if delta.ID != "" {
+			call.ID = delta.ID
+		}
+		if delta.Type != "" {
+			call.Type = delta.Type
+		}
+		if delta.Function.Name != "" {
+			call.Function.Name = delta.Function.Name
+		}
+		call.Function.Arguments += delta.Function.Arguments
+	}
+	return calls
+}
+
+// RunPayloadCaptureCleanup 启动按 PAYLOAD_CAPTURE_RETENTION_HOURS 定期删除过期捕获的后台任务，直到 ctx 取消。
+func RunPayloadCaptureCleanup(ctx context.Context) {
+	retention := config.AppSettings.PayloadCaptureRetention
+	if CaptureStore == nil || retention <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(payloadCaptureCleanupInterval)
+		defer ticker.Stop()
+		for {
+			deleted, err := CaptureStore.DeleteCapturesBefore(time.Now().Add(-retention))
+			if err != nil {
+				Log.Errorf("RunPayloadCaptureCleanup: 清理过期的捕获内容失败: %v", err)
+			} else if deleted > 0 {
+				Log.Infof("RunPayloadCaptureCleanup: 已清理 %d 条过期的捕获内容。", deleted)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// GetPayloadCaptureHandler 处理 `/admin/captures/:request_id` GET 请求，按请求 ID 返回捕获的请求和响应。
+// 请求 ID 可由客户端自行提供，多个客户端使用了相同的 ID 时返回 409，需通过 `?client=` 指定客户端。
+func GetPayloadCaptureHandler(c *gin.Context) {
+	if CaptureStore == nil {
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "请求内容捕获未启用。", Type: "payload_capture_disabled"}})
+		return
+	}
+	requestID := c.Param("request_id")
+	records, err := CaptureStore.FindCaptures(requestID, c.Query("client"))
+	if err != nil {
+		Log.Errorf("GetPayloadCaptureHandler: 读取请求 %s 的捕获内容失败: %v", requestID, err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "读取捕获内容时发生内部错误。", Type: "internal_server_error"}})
+		return
+	}
+	switch len(records) {
+	case 0:
+		c.JSON(http.StatusNotFound, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "未找到请求 '" + requestID + "' 的捕获内容（可能未被抽中或已过期）。", Type: "capture_not_found"}})
+		return
+	case 1:
+	default:
+		clients := make([]string, 0, len(records))
+		for _, record := range records {
+			clients = append(clients, record.ClientID)
+		}
+		c.JSON(http.StatusConflict, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: fmt.Sprintf("多个客户端使用了请求 ID '%s' (%s)，请通过 ?client= 指定客户端。", requestID, strings.Join(clients, ", ")),
+			Type:    "ambiguous_request_id", Param: "client"}})
+		return
+	}
+	record := records[0]
+	c.JSON(http.StatusOK, gin.H{
+		"request_id":    record.RequestID,
+		"created_at":    record.CreatedAt,
+		"client_id":     record.ClientID,
+		"endpoint":      record.Endpoint,
+		"model":         record.Model,
+		"stream":        record.Stream,
+		"status_code":   record.StatusCode,
+		"duration_ms":   record.DurationMs,
+		"generation_id": record.GenerationID,
+		"request":       capturedBody(record.Request),
+		"response":      capturedBody(record.Response),
+	})
+}
+
+// capturedBody 将捕获内容作为 JSON 原样嵌入响应；不是有效 JSON（例如被正则脱敏破坏）时作为字符串返回。
+func capturedBody(body string) interface{} {
+	if json.Valid([]byte(body)) {
+		return json.RawMessage(body)
+	}
+	return body
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"openrouter_polling/storage"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// payloadCaptureTestStores 返回数据库与磁盘两种捕获存储实现。
+func payloadCaptureTestStores(t *testing.T) map[string]PayloadCaptureStore {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatalf("打开测试数据库失败: %v", err)
+	}
+	if err := db.AutoMigrate(&storage.PayloadCapture{}); err != nil {
+		t.Fatalf("迁移测试数据库失败: %v", err)
+	}
+	fileStore, err := storage.NewFileCaptureStore(filepath.Join(t.TempDir(), "captures"))
+	if err != nil {
+		t.Fatalf("创建磁盘捕获存储失败: %v", err)
+	}
+	return map[string]PayloadCaptureStore{"db": storage.NewCaptureStore(db), "disk": fileStore}
+}
+
+// getPayloadCapture 通过 GetPayloadCaptureHandler 查询捕获内容。
+func getPayloadCapture(t *testing.T, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/admin/captures/:request_id", GetPayloadCaptureHandler)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+	return recorder
+}
+
+func TestPayloadCapturesAreScopedByClient(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	prevLog, prevStore := Log, CaptureStore
+	t.Cleanup(func() { Log, CaptureStore = prevLog, prevStore })
+	Log = logger
+
+	for name, store := range payloadCaptureTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			CaptureStore = store
+			victim := &storage.PayloadCapture{RequestID: "req-1", ClientID: "alice", Request: `{"who":"alice"}`, Response: `{}`}
+			if err := store.SaveCapture(victim); err != nil {
+				t.Fatalf("保存 alice 的捕获失败: %v", err)
+			}
+
+			// 同一客户端重复使用请求 ID 不会覆盖已有捕获。
+			if err := store.SaveCapture(&storage.PayloadCapture{RequestID: "req-1", ClientID: "alice", Request: `{"who":"again"}`}); err == nil {
+				t.Error("期望同一客户端重复的请求 ID 保存失败")
+			}
+			// 其他客户端使用相同的请求 ID 得到独立的捕获。
+			if err := store.SaveCapture(&storage.PayloadCapture{RequestID: "req-1", ClientID: "mallory", Request: `{"who":"mallory"}`, Response: `{}`}); err != nil {
+				t.Fatalf("保存 mallory 的捕获失败: %v", err)
+			}
+
+			if recorder := getPayloadCapture(t, "/admin/captures/req-1"); recorder.Code != http.StatusConflict {
+				t.Errorf("未指定客户端时状态码 = %d, 期望 409", recorder.Code)
+			}
+			recorder := getPayloadCapture(t, "/admin/captures/req-1?client=alice")
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("指定客户端时状态码 = %d, 响应 %s", recorder.Code, recorder.Body.String())
+			}
+			var body struct {
+				ClientID string          `json:"client_id"`
+				Request  json.RawMessage `json:"request"`
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+				t.Fatalf("解析响应失败: %v", err)
+			}
+			if body.ClientID != "alice" || string(body.Request) != `{"who":"alice"}` {
+				t.Errorf("返回的捕获 = %s, 期望 alice 的原始捕获", recorder.Body.String())
+			}
+
+			if recorder := getPayloadCapture(t, "/admin/captures/req-2"); recorder.Code != http.StatusNotFound {
+				t.Errorf("不存在的请求 ID 状态码 = %d, 期望 404", recorder.Code)
+			}
+		})
+	}
+}
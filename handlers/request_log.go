@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"openrouter_polling/middleware"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// requestLog 返回携带本次请求 ID（以及已知时的上游生成 ID）的日志条目，请求处理路径上的日志都应通过它记录，
+// 以便按 request_id / generation_id 关联同一请求的所有日志。
+func requestLog(c *gin.Context) *logrus.Entry {
+	entry := Log.WithField("request_id", middleware.RequestID(c))
+	return withGenerationID(c, entry)
+}
+
+// withGenerationID 在上游生成 ID 已知且日志条目尚未携带时补充 generation_id 字段。
+// 生成 ID 在收到上游响应后才可得，流式处理中每收到数据块后调用一次即可。
+func withGenerationID(c *gin.Context, entry *logrus.Entry) *logrus.Entry {
+	if _, exists := entry.Data["generation_id"]; exists {
+		return entry
+	}
+	if generationID := upstreamGenerationID(c); generationID != "" {
+		return entry.WithField("generation_id", generationID)
+	}
+	return entry
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"openrouter_polling/middleware"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// syncBuffer 是可并发写入的日志缓冲。
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRequestIDPropagatesToUpstreamAndLogs(t *testing.T) {
+	var upstreamRequestID string
+	useStubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequestID = r.Header.Get(middleware.RequestIDHeader)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"gen-1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`))
+	})
+	var logs syncBuffer
+	Log.SetOutput(&logs)
+	Log.SetFormatter(&logrus.JSONFormatter{})
+	Log.SetLevel(logrus.DebugLevel)
+
+	router := gin.New()
+	router.Use(middleware.AssignRequestID())
+	router.POST("/v1/chat/completions", ChatCompletionsHandler)
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"model":"`+stubUpstreamModel+`","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(middleware.RequestIDHeader, "trace-123")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("状态码 = %d, 期望 200, 响应体: %s", recorder.Code, recorder.Body.String())
+	}
+	if got := recorder.Header().Get(middleware.RequestIDHeader); got != "trace-123" {
+		t.Errorf("响应的 %s = %q, 期望沿用客户端的请求 ID", middleware.RequestIDHeader, got)
+	}
+	if upstreamRequestID != "trace-123" {
+		t.Errorf("上游收到的 %s = %q, 期望转发客户端的请求 ID", middleware.RequestIDHeader, upstreamRequestID)
+	}
+
+	// 请求处理路径上的每条日志都是携带该请求 ID 的 JSON。
+	entries := 0
+	scanner := bufio.NewScanner(strings.NewReader(logs.String()))
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("日志行不是 JSON: %q", scanner.Text())
+		}
+		if entry["request_id"] != "trace-123" {
+			t.Errorf("日志 %q 的 request_id = %v, 期望 trace-123", entry["msg"], entry["request_id"])
+		}
+		entries++
+	}
+	if entries == 0 {
+		t.Error("期望处理请求时输出日志")
+	}
+}
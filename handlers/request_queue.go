@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"math"
+	"openrouter_polling/apimanager"
+	"openrouter_polling/config"
+	"openrouter_polling/middleware"
+	"openrouter_polling/models"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 请求排队相关的 HTTP 头部和参数。
+const (
+	queuePriorityHeader = "X-Queue-Priority" // 请求头：排队优先级 high/normal/low，优先级高于客户端和全局配置
+	queueMaxWaitHeader  = "X-Queue-Max-Wait" // 请求头：没有可用密钥时的最长排队时间（秒），不超过 REQUEST_QUEUE_WAIT_LIMIT_SECONDS
+	queueWaitHeader     = "X-Queue-Wait-Ms"  // 响应头：本次请求排队等待密钥的时间（毫秒），没有排队时不设置
+
+	requestQueuePollInterval = time.Second // 排队期间重新检查可用密钥的间隔（并发名额释放会立即唤醒等待者，最早的冷却结束时队首会按时重新检查）
+	requestQueueWaitSamples  = 1000        // 用于计算排队时间分位数的最近样本数
+)
+
+var (
+	errRequestQueueFull    = errors.New("request queue is full")
+	errRequestQueueTimeout = errors.New("request queue wait timed out")
+)
+
+// queuePriorityRanks 是各优先级在队列中的次序，数值小的先获得密钥。
+var queuePriorityRanks = map[string]int{
+	config.QueuePriorityHigh:   0,
+	config.QueuePriorityNormal: 1,
+	config.QueuePriorityLow:    2,
+}
+
+// queueWaiter 是队列中一个等待密钥的请求。
+type queueWaiter struct {
+	priority   string
+	enqueuedAt time.Time
+}
+
+// requestQueue 是等待可用密钥的请求队列：所有密钥都在冷却或并发名额已满时，愿意等待的请求按优先级、
+// 再按到达顺序排队，只有队首的请求尝试获取密钥，获得密钥或离开队列后唤醒下一个。
+// 有密钥的并发名额被释放或最早的冷却结束时，队首的请求重新尝试；管理员新增或启用密钥等其他变化最迟在一个检查间隔后被发现。
+type requestQueue struct {
+	mu      sync.Mutex
+	waiters []*queueWaiter // 按优先级、再按入队顺序排列
+	wake    chan struct{}  // 可能有密钥可用时关闭并替换，用于唤醒等待者
+
+	enqueued, served, timedOut, canceled, rejected int64
+	waits                                          []time.Duration // 最近获得密钥的请求的排队时间（环形缓冲）
+	waitsNext                                      int
+}
+
+var keyWaitQueue = &requestQueue{wake: make(chan struct{})}
+
+// queueSettings 根据请求头、客户端配置和全局配置决定本次请求的排队优先级和最长排队时间。
+// 最长排队时间不超过 REQUEST_QUEUE_WAIT_LIMIT_SECONDS。
+func queueSettings(c *gin.Context) (priority string, maxWait time.Duration) {
+	priority, maxWait = config.QueueSettingsForClient(middleware.ClientID(c))
+	if p := strings.ToLower(strings.TrimSpace(c.GetHeader(queuePriorityHeader))); config.IsValidQueuePriority(p) {
+		priority = p
+	}
+	if v, err := strconv.ParseFloat(strings.TrimSpace(c.GetHeader(queueMaxWaitHeader)), 64); err == nil && v >= 0 {
+		maxWait = time.Duration(v * float64(time.Second))
+	}
+	if limit := config.AppSettings.RequestQueueWaitLimit; maxWait > limit {
+		maxWait = limit
+	}
+	return priority, maxWait
+}
+
+// acquire 为请求获取一个密钥（占用其一个并发名额），conversation 为请求所属会话的标识（见 conversationAffinityKey，可为空）。
+// maxWait 为 0 或未启用排队时不排队，直接返回 GetAPIKeyForConversation 的结果。
+// 否则在队列为空时先直接尝试；没有可用密钥或已有请求在排队时按优先级排队，直到获得密钥、等待超过 maxWait 或 ctx 取消。
+// 返回获得的密钥（失败时为 nil）、排队时间，以及排队失败的原因（队列已满、超时或 ctx 的错误）。
+func (q *requestQueue) acquire(ctx context.Context, conversation, priority string, maxWait time.Duration) (*apimanager.ApiKeyStatus, time.Duration, error) {
+	maxSize := config.AppSettings.RequestQueueMaxSize
+	if maxWait <= 0 || maxSize <= 0 {
+		return ApiKeyMgr.GetAPIKeyForConversation(conversation), 0, nil
+	}
+
+	q.mu.Lock()
+	if len(q.waiters) == 0 {
+		// 没有其他请求在排队时不必排队；有请求在排队时不插队，以保证优先级和到达顺序。
+		q.mu.Unlock()
+		if key := ApiKeyMgr.GetAPIKeyForConversation(conversation); key != nil {
+			return key, 0, nil
+		}
+		q.mu.Lock()
+	}
+	if len(q.waiters) >= maxSize {
+		q.rejected++
+		q.mu.Unlock()
+		return nil, 0, errRequestQueueFull
+	}
+	w := q.pushLocked(priority)
+	q.mu.Unlock()
+
+	timeout := time.NewTimer(maxWait)
+	defer timeout.Stop()
+	for {
+		q.mu.Lock()
+		isHead := q.waiters[0] == w
+		wake := q.wake
+		q.mu.Unlock()
+
+		wait := requestQueuePollInterval
+		if isHead {
+			if key := ApiKeyMgr.GetAPIKeyForConversation(conversation); key != nil {
+				return key, q.leave(w, &q.served), nil
+			}
+			if _, nextReactivation := ApiKeyMgr.KeyAvailability(); nextReactivation != nil {
+				wait = min(max(time.Until(*nextReactivation), 10*time.Millisecond), wait)
+			}
+		}
+
+		poll := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			poll.Stop()
+			return nil, q.leave(w, &q.canceled), ctx.Err()
+		case <-timeout.C:
+			poll.Stop()
+			return nil, q.leave(w, &q.timedOut), errRequestQueueTimeout
+		case <-wake:
+			poll.Stop()
+		case <-poll.C:
+		}
+	}
+}
+
+// pushLocked 按优先级将新的等待者插入队列：排在所有优先级相同或更高的等待者之后。
+func (q *requestQueue) pushLocked(priority string) *queueWaiter {
+	q.enqueued++
+	w := &queueWaiter{priority: priority, enqueuedAt: time.Now()}
+	rank := queuePriorityRanks[priority]
+	i := len(q.waiters)
+	for i > 0 && queuePriorityRanks[q.waiters[i-1].priority] > rank {
+		i--
+	}
+	q.waiters = slices.Insert(q.waiters, i, w)
+	return w
+}
+
+// leave 将等待者移出队列并计入 outcome，返回其排队时间。获得密钥的请求的排队时间计入分位数统计。
+// 离开后唤醒其余等待者，使新的队首立即尝试获取密钥。
+func (q *requestQueue) leave(w *queueWaiter, outcome *int64) time.Duration {
+	waited := time.Since(w.enqueuedAt)
+	q.mu.Lock()
+	q.waiters = slices.DeleteFunc(q.waiters, func(other *queueWaiter) bool { return other == w })
+	*outcome++
+	if outcome == &q.served {
+		if len(q.waits) < requestQueueWaitSamples {
+			q.waits = append(q.waits, waited)
+		} else {
+			q.waits[q.waitsNext] = waited
+			q.waitsNext = (q.waitsNext + 1) % requestQueueWaitSamples
+		}
+	}
+	q.notifyLocked()
+	q.mu.Unlock()
+	return waited
+}
+
+// notify 唤醒所有等待者，在可能有密钥可用时（例如并发名额释放）调用。
+func (q *requestQueue) notify() {
+	q.mu.Lock()
+	q.notifyLocked()
+	q.mu.Unlock()
+}
+
+func (q *requestQueue) notifyLocked() {
+	if len(q.waiters) == 0 {
+		return
+	}
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+// Status 返回队列的快照，用于 /admin/app-status。
+func (q *requestQueue) Status() models.RequestQueueStatus {
+	settings := config.AppSettings
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	status := models.RequestQueueStatus{
+		Enabled:               settings.RequestQueueMaxSize > 0,
+		Length:                len(q.waiters),
+		LengthByPriority:      map[string]int{config.QueuePriorityHigh: 0, config.QueuePriorityNormal: 0, config.QueuePriorityLow: 0},
+		MaxSize:               settings.RequestQueueMaxSize,
+		DefaultMaxWaitSeconds: settings.RequestQueueMaxWait.Seconds(),
+		Enqueued:              q.enqueued,
+		Served:                q.served,
+		TimedOut:              q.timedOut,
+		Canceled:              q.canceled,
+		Rejected:              q.rejected,
+	}
+	for _, w := range q.waiters {
+		status.LengthByPriority[w.priority]++
+		status.OldestWaitMs = max(status.OldestWaitMs, time.Since(w.enqueuedAt).Milliseconds())
+	}
+	if len(q.waits) > 0 {
+		sorted := slices.Clone(q.waits)
+		slices.Sort(sorted)
+		status.WaitP50Ms = queueWaitPercentile(sorted, 0.5).Milliseconds()
+		status.WaitP95Ms = queueWaitPercentile(sorted, 0.95).Milliseconds()
+		status.WaitMaxMs = sorted[len(sorted)-1].Milliseconds()
+	}
+	return status
+}
+
+// queueWaitPercentile 返回已排序样本的 q 分位数（最近秩法）。
+func queueWaitPercentile(sorted []time.Duration, q float64) time.Duration {
+	idx := int(math.Ceil(q*float64(len(sorted)))) - 1
+	return sorted[max(idx, 0)]
+}
+
+// releaseKey 归还请求占用的密钥并发名额，并唤醒排队等待密钥的请求。
+func releaseKey(key string) {
+	ApiKeyMgr.ReleaseKey(key)
+	keyWaitQueue.notify()
+}
@@ -0,0 +1,790 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"openrouter_polling/apimanager"
+	"openrouter_polling/config"
+	"openrouter_polling/middleware"
+	"openrouter_polling/models"
+	"openrouter_polling/storage"
+	"openrouter_polling/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// responseCleanupInterval 清理过期响应的间隔。
+const responseCleanupInterval = time.Hour
+
+// ResponsesHandler 处理 `/v1/responses` POST 请求（OpenAI Responses API 兼容端点）。
+// 请求的 input 项、instructions 以及 previous_response_id 指向的历史会被转换为聊天补全请求，
+// 经由同一个密钥池发往 OpenRouter；响应转换为 Response 对象（流式时为 Responses 事件流），
+// 并在 store 未显式关闭时存入数据库，供后续请求通过 previous_response_id 续接。
+func ResponsesHandler(c *gin.Context) {
+	clientOriginalContext := c.Request.Context()
+	if clientOriginalContext.Err() == context.Canceled {
+		Log.Warn("ResponsesHandler: 客户端在处理请求前已断开连接。")
+		return
+	}
+
+	var responsesReq models.ResponsesRequest
+	if err := c.ShouldBindJSON(&responsesReq); err != nil {
+		Log.Warnf("ResponsesHandler: 无效的请求体: %v", err)
+		sendErrorResponse(c, http.StatusBadRequest, "请求体解析失败: "+err.Error(), "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+	if len(responsesReq.Input) == 0 || string(responsesReq.Input) == "null" {
+		sendErrorResponse(c, http.StatusBadRequest, "缺少必需参数 'input'。", "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+
+	clientID := middleware.ClientID(c)
+	var history []models.Message
+	if responsesReq.PreviousResponseID != nil && *responsesReq.PreviousResponseID != "" {
+		chain, err := RespStore.GetResponseChain(*responsesReq.PreviousResponseID, clientID)
+		if err != nil {
+			if errors.Is(err, storage.ErrResponseNotFound) {
+				sendErrorResponse(c, http.StatusNotFound, fmt.Sprintf("未找到 ID 为 '%s' 的历史响应。", *responsesReq.PreviousResponseID), "invalid_request_error", false, clientOriginalContext)
+				return
+			}
+			if errors.Is(err, storage.ErrResponseChainBroken) {
+				sendErrorResponse(c, http.StatusNotFound, fmt.Sprintf("响应 '%s' 所在对话中较早的响应已被删除或过期，无法续接。", *responsesReq.PreviousResponseID), "invalid_request_error", false, clientOriginalContext)
+				return
+			}
+			Log.Errorf("ResponsesHandler: 读取历史响应 %s 失败: %v", *responsesReq.PreviousResponseID, err)
+			sendErrorResponse(c, http.StatusInternalServerError, "读取历史响应失败。", "internal_server_error", false, clientOriginalContext)
+			return
+		}
+		chainIDs := make([]string, 0, len(chain))
+		for _, previous := range chain {
+			var turn []models.Message
+			if err := json.Unmarshal([]byte(previous.Messages), &turn); err != nil {
+				Log.Errorf("ResponsesHandler: 历史响应 %s 的对话记录已损坏: %v", previous.ResponseID, err)
+				sendErrorResponse(c, http.StatusInternalServerError, "历史响应的对话记录已损坏。", "internal_server_error", false, clientOriginalContext)
+				return
+			}
+			history = append(history, turn...)
+			chainIDs = append(chainIDs, previous.ResponseID)
+		}
+		// 续接即视为使用，刷新整条链的保留期限。
+		if err := RespStore.TouchResponses(chainIDs, time.Now()); err != nil {
+			Log.Warnf("ResponsesHandler: 刷新历史响应的保留期限失败: %v", err)
+		}
+	}
+
+	inputMessages, err := responsesInputToMessages(responsesReq.Input)
+	if err != nil {
+		sendErrorResponse(c, http.StatusBadRequest, "无效的 'input': "+err.Error(), "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+	conversation := append(history, inputMessages...)
+
+	requestData, err := responsesToChatRequest(responsesReq, conversation)
+	if err != nil {
+		sendErrorResponse(c, http.StatusBadRequest, err.Error(), "invalid_request_error", false, clientOriginalContext)
+		return
+	}
+	isStreamForClientResponse := responsesReq.Stream
+
+	logEntry := requestLog(c).WithFields(logrus.Fields{
+		"model":            requestData.Model,
+		"streaming":        isStreamForClientResponse,
+		"user":             utils.DerefString(requestData.User, "N/A"),
+		"client_ip":        c.ClientIP(),
+		"protocol":         "responses",
+		"history_messages": len(history),
+	})
+	logEntry.Info("收到 Responses 请求")
+
+	applyContextTrimPolicy(c, &requestData, logEntry)
+
+	payloadBytes, err := json.Marshal(requestData)
+	if err != nil {
+		Log.Errorf("ResponsesHandler: 序列化请求数据失败: %v", err)
+		sendErrorResponse(c, http.StatusInternalServerError, "内部服务器错误：序列化请求失败。", "internal_server_error", false, clientOriginalContext)
+		return
+	}
+
+	builder := &responseBuilder{
+		id:        utils.NewID("resp_"),
+		createdAt: time.Now().Unix(),
+		model:     requestData.Model,
+		clientID:  clientID,
+		input:     inputMessages,
+		store:     responsesReq.Store == nil || *responsesReq.Store,
+		metadata:  responsesReq.Metadata,
+	}
+	if responsesReq.Instructions != "" {
+		builder.instructions = &responsesReq.Instructions
+	}
+	if responsesReq.PreviousResponseID != nil && *responsesReq.PreviousResponseID != "" {
+		builder.previousResponseID = responsesReq.PreviousResponseID
+	}
+
+	if isStreamForClientResponse {
+		prepareSSEHeaders(c)
+	}
+
+	withPayloadCapture(c, capturedRequest{Body: responsesReq, Model: requestData.Model, Stream: isStreamForClientResponse}, func() {
+		executeUpstreamRequest(c, upstreamRequest{
+			URL:       config.AppSettings.OpenRouterAPIURL,
+			Payload:   payloadBytes,
+			IsStream:  isStreamForClientResponse,
+			SendError: sendResponsesError,
+			HandleOK: func(attemptCtx context.Context, c *gin.Context, resp *http.Response, apiKeyStatus *apimanager.ApiKeyStatus, clientOriginalContext context.Context) (bool, bool, int, string, string) {
+				if !isStreamForClientResponse {
+					return relayResponsesNonStreamingResponse(c, resp, apiKeyStatus, clientOriginalContext, builder)
+				}
+				return relayStreamingResponse(attemptCtx, c, resp, apiKeyStatus, clientOriginalContext, inspectChatCompletionChunk, newResponsesStreamSink(c, builder))
+			},
+		})
+	})
+}
+
+// GetResponseHandler 处理 `GET /v1/responses/:id`，返回已存储的 Response 对象。
+func GetResponseHandler(c *gin.Context) {
+	stored, err := RespStore.GetResponse(c.Param("id"), middleware.ClientID(c))
+	if err != nil {
+		if errors.Is(err, storage.ErrResponseNotFound) {
+			sendErrorResponse(c, http.StatusNotFound, fmt.Sprintf("未找到 ID 为 '%s' 的响应。", c.Param("id")), "invalid_request_error", false, c.Request.Context())
+			return
+		}
+		Log.Errorf("GetResponseHandler: 读取响应 %s 失败: %v", c.Param("id"), err)
+		sendErrorResponse(c, http.StatusInternalServerError, "读取响应失败。", "internal_server_error", false, c.Request.Context())
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(stored.Response))
+}
+
+// DeleteResponseHandler 处理 `DELETE /v1/responses/:id`，删除已存储的响应。
+func DeleteResponseHandler(c *gin.Context) {
+	responseID := c.Param("id")
+	if err := RespStore.DeleteResponse(responseID, middleware.ClientID(c)); err != nil {
+		if errors.Is(err, storage.ErrResponseNotFound) {
+			sendErrorResponse(c, http.StatusNotFound, fmt.Sprintf("未找到 ID 为 '%s' 的响应。", responseID), "invalid_request_error", false, c.Request.Context())
+			return
+		}
+		Log.Errorf("DeleteResponseHandler: 删除响应 %s 失败: %v", responseID, err)
+		sendErrorResponse(c, http.StatusInternalServerError, "删除响应失败。", "internal_server_error", false, c.Request.Context())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": responseID, "object": "response", "deleted": true})
+}
+
+// responsesInputToMessages 将 Responses API 的 input（字符串或输入项数组）转换为 OpenAI 风格聊天消息。
+// 连续的 function_call 项会合并到同一条 assistant 消息的 tool_calls 中。
+func responsesInputToMessages(input json.RawMessage) ([]models.Message, error) {
+	var text string
+	if err := json.Unmarshal(input, &text); err == nil {
+		return []models.Message{{Role: "user", Content: text}}, nil
+	}
+	var items []models.ResponsesInputItem
+	if err := json.Unmarshal(input, &items); err != nil {
+		return nil, fmt.Errorf("必须是字符串或输入项数组")
+	}
+
+	messages := make([]models.Message, 0, len(items))
+	for i, item := range items {
+		switch item.Type {
+		case "", "message":
+			content, err := responsesContentToChatContent(item.Content, item.Role == "assistant")
+			if err != nil {
+				return nil, fmt.Errorf("input[%d]: %v", i, err)
+			}
+			messages = append(messages, models.Message{Role: item.Role, Content: content})
+		case "function_call":
+			toolCall := models.ToolCall{
+				ID:       item.CallID,
+				Type:     "function",
+				Function: models.ToolCallFunction{Name: item.Name, Arguments: item.Arguments},
+			}
+			if n := len(messages); n > 0 && messages[n-1].Role == "assistant" {
+				last := &messages[n-1]
+				if last.ToolCalls == nil {
+					last.ToolCalls = &[]models.ToolCall{}
+				}
+				*last.ToolCalls = append(*last.ToolCalls, toolCall)
+				continue
+			}
+			messages = append(messages, models.Message{Role: "assistant", Content: "", ToolCalls: &[]models.ToolCall{toolCall}})
+		case "function_call_output":
+			callID := item.CallID
+			messages = append(messages, models.Message{Role: "tool", Content: item.Output, ToolCallID: &callID})
+		case "reasoning":
+			// 推理摘要项在聊天补全中没有对应项，直接忽略。
+		default:
+			return nil, fmt.Errorf("input[%d]: 不支持的输入项类型 '%s'", i, item.Type)
+		}
+	}
+	return messages, nil
+}
+
+// responsesContentToChatContent 将输入消息的内容（字符串或内容部件数组）转换为聊天消息内容。
+// 包含图片时返回多模态数组，否则合并为字符串；assistant 消息始终合并为字符串。
+func responsesContentToChatContent(raw json.RawMessage, isAssistant bool) (interface{}, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+	var parts []models.ResponsesContentPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil, fmt.Errorf("content 必须是字符串或内容部件数组")
+	}
+
+	var texts []string
+	var multimodal []map[string]interface{}
+	hasImage := false
+	for _, part := range parts {
+		switch part.Type {
+		case "input_text", "output_text":
+			texts = append(texts, part.Text)
+			multimodal = append(multimodal, map[string]interface{}{"type": "text", "text": part.Text})
+		case "refusal":
+			texts = append(texts, part.Refusal)
+			multimodal = append(multimodal, map[string]interface{}{"type": "text", "text": part.Refusal})
+		case "input_image":
+			if isAssistant || part.ImageURL == "" {
+				continue
+			}
+			multimodal = append(multimodal, map[string]interface{}{"type": "image_url", "image_url": map[string]string{"url": part.ImageURL}})
+			hasImage = true
+		default:
+			return nil, fmt.Errorf("不支持的内容部件类型 '%s'", part.Type)
+		}
+	}
+	if hasImage {
+		return multimodal, nil
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// responsesToChatRequest 根据 Responses 请求参数和完整对话（历史 + 本次输入）构造聊天补全请求。
+func responsesToChatRequest(req models.ResponsesRequest, conversation []models.Message) (models.ChatCompletionRequest, error) {
+	stream := req.Stream
+	chatReq := models.ChatCompletionRequest{
+		Model:       req.Model,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		MaxTokens:   req.MaxOutputTokens,
+		Stream:      &stream,
+		User:        req.User,
+	}
+	if chatReq.Model == "" {
+		chatReq.Model = config.AppSettings.DefaultModel
+	}
+
+	chatReq.Messages = make([]models.Message, 0, len(conversation)+1)
+	if req.Instructions != "" {
+		chatReq.Messages = append(chatReq.Messages, models.Message{Role: "system", Content: req.Instructions})
+	}
+	chatReq.Messages = append(chatReq.Messages, conversation...)
+
+	if len(req.Tools) > 0 {
+		tools := make([]models.Tool, 0, len(req.Tools))
+		for _, t := range req.Tools {
+			if t.Type != "function" {
+				return chatReq, fmt.Errorf("不支持的工具类型 '%s'，目前仅支持 function。", t.Type)
+			}
+			params, err := models.FunctionParametersFromRaw(t.Parameters)
+			if err != nil {
+				return chatReq, fmt.Errorf("工具 '%s' 的 parameters 无效: %v", t.Name, err)
+			}
+			tools = append(tools, models.Tool{
+				Type:     "function",
+				Function: models.FunctionDefinition{Name: t.Name, Description: t.Description, Parameters: params},
+			})
+		}
+		chatReq.Tools = &tools
+	}
+
+	switch choice := req.ToolChoice.(type) {
+	case string:
+		chatReq.ToolChoice = choice
+	case map[string]interface{}:
+		if name, ok := choice["name"].(string); ok && choice["type"] == "function" {
+			chatReq.ToolChoice = map[string]interface{}{"type": "function", "function": map[string]string{"name": name}}
+		} else if choiceType, ok := choice["type"].(string); ok {
+			chatReq.ToolChoice = choiceType
+		}
+	}
+
+	if req.Text != nil && req.Text.Format != nil {
+		switch req.Text.Format.Type {
+		case "json_object":
+			chatReq.ResponseFormat = map[string]string{"type": "json_object"}
+		case "json_schema":
+			schema := map[string]interface{}{"name": req.Text.Format.Name, "schema": req.Text.Format.Schema}
+			if req.Text.Format.Strict != nil {
+				schema["strict"] = *req.Text.Format.Strict
+			}
+			chatReq.ResponseFormat = map[string]interface{}{"type": "json_schema", "json_schema": schema}
+		}
+	}
+	return chatReq, nil
+}
+
+// responseBuilder 保存一次 Responses 请求的元数据，负责构造 Response 对象并在完成后持久化。
+type responseBuilder struct {
+	id                 string
+	createdAt          int64
+	model              string
+	clientID           string
+	instructions       *string
+	previousResponseID *string
+	input              []models.Message // 本次输入（不含历史和 instructions），与模型输出一起作为本轮新增的消息存储
+	store              bool
+	metadata           map[string]string
+}
+
+// object 构造指定状态的 Response 对象。
+func (b *responseBuilder) object(status string, output []models.ResponsesOutputItem) models.ResponseObject {
+	if output == nil {
+		output = []models.ResponsesOutputItem{}
+	}
+	metadata := b.metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	return models.ResponseObject{
+		ID:                 b.id,
+		Object:             "response",
+		CreatedAt:          b.createdAt,
+		Status:             status,
+		Model:              b.model,
+		Output:             output,
+		Instructions:       b.instructions,
+		PreviousResponseID: b.previousResponseID,
+		Store:              b.store,
+		Metadata:           metadata,
+	}
+}
+
+// complete 根据模型输出、finish_reason 和用量构造最终的 Response 对象，并按需持久化。
+func (b *responseBuilder) complete(output []models.ResponsesOutputItem, finishReason string, usage *models.Usage) models.ResponseObject {
+	status := "completed"
+	var incomplete *models.ResponsesIncompleteDetails
+	switch finishReason {
+	case "length":
+		status = "incomplete"
+		incomplete = &models.ResponsesIncompleteDetails{Reason: "max_output_tokens"}
+	case "content_filter":
+		status = "incomplete"
+		incomplete = &models.ResponsesIncompleteDetails{Reason: "content_filter"}
+	}
+	for i := range output {
+		if output[i].Status == "in_progress" {
+			output[i].Status = status
+		}
+	}
+
+	respObj := b.object(status, output)
+	respObj.IncompleteDetails = incomplete
+	if usage != nil {
+		respUsage := &models.ResponsesUsage{
+			InputTokens:  usage.PromptTokens,
+			OutputTokens: usage.CompletionTokens,
+			TotalTokens:  usage.TotalTokens,
+		}
+		if usage.PromptTokensDetails != nil {
+			respUsage.InputTokensDetails.CachedTokens = usage.PromptTokensDetails.CachedTokens
+		}
+		respObj.Usage = respUsage
+	}
+	if b.store {
+		b.persist(respObj)
+	}
+	return respObj
+}
+
+// persist 将 Response 对象及本轮新增的消息存入数据库，完整对话由 previous_response_id 链还原。
+// 存储失败只记录日志，不影响本次响应。
+func (b *responseBuilder) persist(respObj models.ResponseObject) {
+	if RespStore == nil {
+		return
+	}
+	turn := append(append([]models.Message{}, b.input...), responsesOutputToAssistantMessage(respObj.Output))
+	messagesJSON, err := json.Marshal(turn)
+	if err != nil {
+		Log.Errorf("responseBuilder: 序列化响应 %s 的对话记录失败: %v", b.id, err)
+		return
+	}
+	responseJSON, err := json.Marshal(respObj)
+	if err != nil {
+		Log.Errorf("responseBuilder: 序列化响应 %s 失败: %v", b.id, err)
+		return
+	}
+	record := &storage.StoredResponse{
+		ResponseID:         b.id,
+		ClientID:           b.clientID,
+		PreviousResponseID: utils.DerefString(b.previousResponseID, ""),
+		Model:              b.model,
+		Messages:           string(messagesJSON),
+		MessagesIsDelta:    true,
+		Response:           string(responseJSON),
+	}
+	if err := RespStore.SaveResponse(record); err != nil {
+		Log.Errorf("responseBuilder: 存储响应 %s 失败: %v", b.id, err)
+		return
+	}
+	Log.Debugf("responseBuilder: 已存储响应 %s (客户端: %s, 本轮消息数: %d)", b.id, b.clientID, len(turn))
+}
+
+// responsesOutputToAssistantMessage 将输出项还原为一条 assistant 聊天消息，作为后续续接时的历史。
+func responsesOutputToAssistantMessage(output []models.ResponsesOutputItem) models.Message {
+	msg := models.Message{Role: "assistant"}
+	var texts []string
+	var toolCalls []models.ToolCall
+	for _, item := range output {
+		switch item.Type {
+		case "message":
+			for _, part := range item.Content {
+				if part.Type == "output_text" {
+					texts = append(texts, part.Text)
+				}
+			}
+		case "function_call":
+			toolCalls = append(toolCalls, models.ToolCall{
+				ID:       item.CallID,
+				Type:     "function",
+				Function: models.ToolCallFunction{Name: item.Name, Arguments: item.Arguments},
+			})
+		}
+	}
+	msg.Content = strings.Join(texts, "")
+	if len(toolCalls) > 0 {
+		msg.ToolCalls = &toolCalls
+	}
+	return msg
+}
+
+// newResponsesTextItem 构造一个 message 类型的输出项。
+func newResponsesTextItem(text, status string) models.ResponsesOutputItem {
+	return models.ResponsesOutputItem{
+		Type:    "message",
+		ID:      utils.NewID("msg_"),
+		Status:  status,
+		Role:    "assistant",
+		Content: []models.ResponsesContentPart{{Type: "output_text", Text: text, Annotations: []interface{}{}}},
+	}
+}
+
+// newResponsesFunctionCallItem 构造一个 function_call 类型的输出项。
+func newResponsesFunctionCallItem(callID, name, arguments, status string) models.ResponsesOutputItem {
+	return models.ResponsesOutputItem{
+		Type:      "function_call",
+		ID:        utils.NewID("fc_"),
+		Status:    status,
+		CallID:    callID,
+		Name:      name,
+		Arguments: arguments,
+	}
+}
+
+// relayResponsesNonStreamingResponse 读取上游的非流式聊天响应，转换为 Response 对象后返回给客户端。
+func relayResponsesNonStreamingResponse(
+	c *gin.Context,
+	resp *http.Response,
+	apiKeyStatus *apimanager.ApiKeyStatus,
+	clientOriginalContext context.Context,
+	builder *responseBuilder,
+) (success bool, retryNeeded bool, statusCodeForError int, errorDetail string, errorType string) {
+	currentOpenRouterKey := apiKeyStatus.Key
+
+	bodyBytes, readErr := io.ReadAll(resp.Body)
+	if readErr != nil {
+		Log.Errorf("relayResponsesNonStreamingResponse: 读取 OpenRouter 非流式响应体失败: %v (密钥: %s)", readErr, utils.SafeSuffix(currentOpenRouterKey))
+		return false, true, http.StatusInternalServerError, "读取上游非流式响应失败。", "response_read_error"
+	}
+
+	var chatResp models.ChatCompletionResponse
+	if err := json.Unmarshal(bodyBytes, &chatResp); err != nil || len(chatResp.Choices) == 0 {
+		Log.Errorf("relayResponsesNonStreamingResponse: 无法解析上游聊天响应 (密钥: %s): %v, body: %q", utils.SafeSuffix(currentOpenRouterKey), err, string(bodyBytes))
+		return false, true, http.StatusBadGateway, "上游返回了无法解析的聊天响应。", "upstream_response_parse_error"
+	}
+	ApiKeyMgr.RecordKeySuccess(currentOpenRouterKey)
+	middleware.RecordUsage(c, chatResp.Usage)
+	recordGenerationID(c, chatResp.ID)
+
+	choice := chatResp.Choices[0]
+	var output []models.ResponsesOutputItem
+	if text, ok := choice.Message.Content.(string); ok && text != "" {
+		output = append(output, newResponsesTextItem(text, "completed"))
+	}
+	if choice.Message.ToolCalls != nil {
+		for _, tc := range *choice.Message.ToolCalls {
+			output = append(output, newResponsesFunctionCallItem(tc.ID, tc.Function.Name, tc.Function.Arguments, "completed"))
+		}
+	}
+	if chatResp.Model != "" {
+		builder.model = chatResp.Model
+	}
+	// 即使客户端已断开也完成存储，使 previous_response_id 仍可引用本次结果。
+	respObj := builder.complete(output, utils.DerefString(choice.FinishReason, ""), chatResp.Usage)
+
+	if clientOriginalContext.Err() == context.Canceled {
+		Log.Warnf("relayResponsesNonStreamingResponse: 成功获取非流式响应，但客户端已断开 (密钥: %s)。", utils.SafeSuffix(currentOpenRouterKey))
+		return true, false, http.StatusOK, "", ""
+	}
+	c.JSON(http.StatusOK, respObj)
+	Log.Infof("relayResponsesNonStreamingResponse: 成功发送 Response 对象 %s (密钥: %s, 状态: %s)。", respObj.ID, utils.SafeSuffix(currentOpenRouterKey), respObj.Status)
+	return true, false, http.StatusOK, "", ""
+}
+
+// responsesStreamSink 是将 OpenAI 风格聊天 SSE 流转换为 Responses 事件流的 streamSink。
+// 与 Anthropic 转换器相同，同一时间只保持一个打开的输出项（消息或函数调用）。
+type responsesStreamSink struct {
+	c              *gin.Context
+	builder        *responseBuilder
+	sequenceNumber int
+	started        bool
+	finished       bool
+	output         []models.ResponsesOutputItem // 已开始的输出项，最后一个可能仍处于打开状态
+	openItemType   string                       // 当前打开的输出项类型（"message" / "function_call"），为空表示没有
+	openToolIndex  int                          // 当前打开的 function_call 对应的上游 tool_calls 序号
+	finishReason   string
+	usage          *models.Usage
+}
+
+func newResponsesStreamSink(c *gin.Context, builder *responseBuilder) *responsesStreamSink {
+	return &responsesStreamSink{c: c, builder: builder, openToolIndex: -1}
+}
+
+// WriteLine 实现 streamSink：解析上游 SSE 行并输出对应的 Responses 事件。
+func (s *responsesStreamSink) WriteLine(line string) error {
+	trimmedLine := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmedLine, ":") {
+		// Responses 事件流没有心跳事件，原样转发 SSE 注释即可保持连接活跃（客户端会忽略注释）。
+		return passthroughSink{c: s.c}.WriteLine(line)
+	}
+	if !strings.HasPrefix(trimmedLine, models.SSEDataPrefix) {
+		return nil
+	}
+	dataContent := strings.TrimSpace(strings.TrimPrefix(trimmedLine, models.SSEDataPrefix))
+	if dataContent == models.SSEDonePayload {
+		return s.finish()
+	}
+
+	var chunk models.ChatCompletionChunk
+	if err := json.Unmarshal([]byte(dataContent), &chunk); err != nil {
+		return nil
+	}
+	var upstreamErr struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(dataContent), &upstreamErr) == nil && upstreamErr.Error != nil {
+		return s.writeEvent("error", gin.H{"type": "error", "code": "api_error", "message": upstreamErr.Error.Message, "param": nil})
+	}
+
+	if err := s.start(chunk.Model); err != nil {
+		return err
+	}
+	if chunk.Usage != nil {
+		s.usage = chunk.Usage
+	}
+	if len(chunk.Choices) == 0 {
+		return nil
+	}
+	choice := chunk.Choices[0]
+
+	if choice.Delta.Content != nil && *choice.Delta.Content != "" {
+		if s.openItemType != "message" {
+			if err := s.closeItem(); err != nil {
+				return err
+			}
+			if err := s.openItem(newResponsesTextItem("", "in_progress")); err != nil {
+				return err
+			}
+			if err := s.writeEvent("response.content_part.added", gin.H{
+				"type": "response.content_part.added", "item_id": s.current().ID, "output_index": len(s.output) - 1, "content_index": 0,
+				"part": gin.H{"type": "output_text", "text": "", "annotations": []interface{}{}},
+			}); err != nil {
+				return err
+			}
+		}
+		s.current().Content[0].Text += *choice.Delta.Content
+		if err := s.writeEvent("response.output_text.delta", gin.H{
+			"type": "response.output_text.delta", "item_id": s.current().ID, "output_index": len(s.output) - 1, "content_index": 0,
+			"delta": *choice.Delta.Content,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if choice.Delta.ToolCalls != nil {
+		for i, tc := range *choice.Delta.ToolCalls {
+			toolIndex := i
+			if tc.Index != nil {
+				toolIndex = *tc.Index
+			}
+			if s.openItemType != "function_call" || s.openToolIndex != toolIndex {
+				if err := s.closeItem(); err != nil {
+					return err
+				}
+				s.openToolIndex = toolIndex
+				if err := s.openItem(newResponsesFunctionCallItem(tc.ID, tc.Function.Name, "", "in_progress")); err != nil {
+					return err
+				}
+			}
+			if tc.Function.Arguments != "" {
+				s.current().Arguments += tc.Function.Arguments
+				if err := s.writeEvent("response.function_call_arguments.delta", gin.H{
+					"type": "response.function_call_arguments.delta", "item_id": s.current().ID, "output_index": len(s.output) - 1,
+					"delta": tc.Function.Arguments,
+				}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if choice.FinishReason != nil && *choice.FinishReason != "" {
+		s.finishReason = *choice.FinishReason
+	}
+	return nil
+}
+
+// current 返回当前打开的输出项。
+func (s *responsesStreamSink) current() *models.ResponsesOutputItem {
+	return &s.output[len(s.output)-1]
+}
+
+// start 在首个数据块到达时发送 response.created 和 response.in_progress 事件。
+func (s *responsesStreamSink) start(upstreamModel string) error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	if upstreamModel != "" {
+		s.builder.model = upstreamModel
+	}
+	inProgress := s.builder.object("in_progress", nil)
+	if err := s.writeEvent("response.created", gin.H{"type": "response.created", "response": inProgress}); err != nil {
+		return err
+	}
+	return s.writeEvent("response.in_progress", gin.H{"type": "response.in_progress", "response": inProgress})
+}
+
+// openItem 追加一个输出项并发送 response.output_item.added。
+func (s *responsesStreamSink) openItem(item models.ResponsesOutputItem) error {
+	s.output = append(s.output, item)
+	s.openItemType = item.Type
+	var added interface{} = item
+	if item.Type == "message" {
+		// 内容部件通过 content_part.added 单独下发，这里显式输出空数组。
+		added = gin.H{"type": item.Type, "id": item.ID, "status": item.Status, "role": item.Role, "content": []interface{}{}}
+	}
+	return s.writeEvent("response.output_item.added", gin.H{"type": "response.output_item.added", "output_index": len(s.output) - 1, "item": added})
+}
+
+// closeItem 如有打开的输出项，则发送对应的 done 系列事件。
+func (s *responsesStreamSink) closeItem() error {
+	if s.openItemType == "" {
+		return nil
+	}
+	s.openItemType = ""
+	s.openToolIndex = -1
+	item := s.current()
+	item.Status = "completed"
+	outputIndex := len(s.output) - 1
+
+	switch item.Type {
+	case "message":
+		part := item.Content[0]
+		if err := s.writeEvent("response.output_text.done", gin.H{
+			"type": "response.output_text.done", "item_id": item.ID, "output_index": outputIndex, "content_index": 0, "text": part.Text,
+		}); err != nil {
+			return err
+		}
+		if err := s.writeEvent("response.content_part.done", gin.H{
+			"type": "response.content_part.done", "item_id": item.ID, "output_index": outputIndex, "content_index": 0, "part": part,
+		}); err != nil {
+			return err
+		}
+	case "function_call":
+		if err := s.writeEvent("response.function_call_arguments.done", gin.H{
+			"type": "response.function_call_arguments.done", "item_id": item.ID, "output_index": outputIndex, "arguments": item.Arguments,
+		}); err != nil {
+			return err
+		}
+	}
+	return s.writeEvent("response.output_item.done", gin.H{"type": "response.output_item.done", "output_index": outputIndex, "item": *item})
+}
+
+// finish 在上游流结束时关闭输出项、存储响应并发送 response.completed（或 response.incomplete）。
+func (s *responsesStreamSink) finish() error {
+	if s.finished {
+		return nil
+	}
+	if err := s.start(""); err != nil {
+		return err
+	}
+	if err := s.closeItem(); err != nil {
+		return err
+	}
+	s.finished = true
+	respObj := s.builder.complete(s.output, s.finishReason, s.usage)
+	eventType := "response.completed"
+	if respObj.Status == "incomplete" {
+		eventType = "response.incomplete"
+	}
+	return s.writeEvent(eventType, gin.H{"type": eventType, "response": respObj})
+}
+
+// writeEvent 写出一个带递增 sequence_number 的 Responses 事件。
+func (s *responsesStreamSink) writeEvent(event string, payload gin.H) error {
+	payload["sequence_number"] = s.sequenceNumber
+	s.sequenceNumber++
+	return writeSSEEvent(s.c, event, payload)
+}
+
+// sendResponsesError 向 Responses API 客户端发送错误（实现 upstreamErrorSender）。
+// 非流式请求使用标准 OpenAI 错误体；流式请求（SSE 响应头已准备或已发出）发送 Responses 规范的 `error` 事件。
+func sendResponsesError(c *gin.Context, statusCode int, message string, errorType string) {
+	if !sseResponseStarted(c) {
+		sendErrorResponse(c, statusCode, message, errorType, false, c.Request.Context())
+		return
+	}
+	if c.Request.Context().Err() == context.Canceled {
+		Log.Warnf("sendResponsesError: 尝试发送错误 '%s' (状态码 %d)，但客户端已断开。不发送。", message, statusCode)
+		return
+	}
+	if err := writeSSEEvent(c, "error", gin.H{"type": "error", "code": strconv.Itoa(statusCode), "message": message, "param": nil}); err != nil {
+		Log.Warnf("sendResponsesError: 写入流式错误事件失败: %v", err)
+	}
+}
+
+// RunResponseCleanup 启动按 RESPONSE_RETENTION_DAYS 定期删除过期响应的后台任务，直到 ctx 取消。
+// 响应被续接时会刷新整条链的使用时间，因此仍在进行的对话不会被清理。
+func RunResponseCleanup(ctx context.Context) {
+	retention := config.AppSettings.ResponseRetention
+	if RespStore == nil || retention <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(responseCleanupInterval)
+		defer ticker.Stop()
+		for {
+			deleted, err := RespStore.DeleteResponsesBefore(time.Now().Add(-retention))
+			if err != nil {
+				Log.Errorf("RunResponseCleanup: 清理过期的响应失败: %v", err)
+			} else if deleted > 0 {
+				Log.Infof("RunResponseCleanup: 已清理 %d 条过期的响应。", deleted)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -1,9 +1,12 @@
 package handlers
 
 import (
+	"encoding/json"
 	"net/http"
 	"openrouter_polling/config"
 	"openrouter_polling/models"
+	"openrouter_polling/retrypolicy"
+	"slices"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
@@ -28,6 +31,22 @@ func GetSettingsHandler(c *gin.Context) {
 		"health_check_interval_seconds": int(currentSettings.HealthCheckInterval.Seconds()),
 		"log_level":                    currentSettings.LogLevel,
 		"app_api_key":                  currentSettings.AppAPIKey,
+		"context_trim_mode":            currentSettings.ContextTrimMode,
+		"rate_limit_rpm":               currentSettings.RateLimitRPM,
+		"rate_limit_tpm":               currentSettings.RateLimitTPM,
+		"adaptive_weighting":           currentSettings.AdaptiveWeighting,
+		"adaptive_weight_min_factor":   currentSettings.AdaptiveWeightMinFactor,
+		"adaptive_weight_max_factor":   currentSettings.AdaptiveWeightMaxFactor,
+		"retry_on_error_types":         currentSettings.RetryOnErrorTypes,
+		"retry_same_key_error_types":   currentSettings.RetrySameKeyErrorTypes,
+		"retry_backoff_base_ms":        currentSettings.RetryBackoffBase.Milliseconds(),
+		"retry_backoff_max_ms":         currentSettings.RetryBackoffMax.Milliseconds(),
+		"retry_backoff_multiplier":     currentSettings.RetryBackoffMultiplier,
+		"retry_backoff_jitter":         currentSettings.RetryBackoffJitter,
+		"retry_deadline_seconds":       int(currentSettings.RetryDeadline.Seconds()),
+		"retry_budget_ratio":           currentSettings.RetryBudgetRatio,
+		"retry_budget_min_retries":     currentSettings.RetryBudgetMinRetries,
+		"retry_policy_models":          currentSettings.RetryPolicyModels,
 		// 注意：出于安全考虑，不返回 AdminPassword
 	})
 }
@@ -63,10 +82,63 @@ func UpdateSettingsHandler(c *gin.Context) {
 			Message: "请求超时不能为负数。", Type: "invalid_request_error", Param: "request_timeout_seconds"}})
 		return
 	}
+	if req.ContextTrimMode != nil && *req.ContextTrimMode != config.ContextTrimModeOff && *req.ContextTrimMode != config.ContextTrimModeAuto {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "无效的上下文裁剪模式。有效值为: off, auto", Type: "invalid_request_error", Param: "context_trim_mode"}})
+		return
+	}
+	if (req.RateLimitRPM != nil && *req.RateLimitRPM < 0) || (req.RateLimitTPM != nil && *req.RateLimitTPM < 0) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "限流额度不能为负数。", Type: "invalid_request_error"}})
+		return
+	}
+	if (req.AdaptiveWeightMinFactor != nil && *req.AdaptiveWeightMinFactor <= 0) || (req.AdaptiveWeightMaxFactor != nil && *req.AdaptiveWeightMaxFactor <= 0) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "自适应权重倍数必须大于 0。", Type: "invalid_request_error"}})
+		return
+	}
+	current := config.GetSettings()
+	minFactor, maxFactor := current.AdaptiveWeightMinFactor, current.AdaptiveWeightMaxFactor
+	if req.AdaptiveWeightMinFactor != nil {
+		minFactor = *req.AdaptiveWeightMinFactor
+	}
+	if req.AdaptiveWeightMaxFactor != nil {
+		maxFactor = *req.AdaptiveWeightMaxFactor
+	}
+	if minFactor > maxFactor {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "自适应权重的最小倍数不能大于最大倍数。", Type: "invalid_request_error", Param: "adaptive_weight_min_factor"}})
+		return
+	}
+	if (req.RetryBackoffBaseMs != nil && *req.RetryBackoffBaseMs < 0) || (req.RetryBackoffMaxMs != nil && *req.RetryBackoffMaxMs < 0) ||
+		(req.RetryDeadlineSeconds != nil && *req.RetryDeadlineSeconds < 0) || (req.RetryBudgetRatio != nil && *req.RetryBudgetRatio < 0) ||
+		(req.RetryBudgetMinRetries != nil && *req.RetryBudgetMinRetries < 0) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "重试等待时间、截止时间和重试预算不能为负数。", Type: "invalid_request_error"}})
+		return
+	}
+	if req.RetryBackoffMultiplier != nil && *req.RetryBackoffMultiplier < 1 {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "重试等待时间的倍数不能小于 1。", Type: "invalid_request_error", Param: "retry_backoff_multiplier"}})
+		return
+	}
+	if req.RetryBackoffJitter != nil && (*req.RetryBackoffJitter < 0 || *req.RetryBackoffJitter > 1) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorDetail{
+			Message: "重试等待时间的抖动比例必须在 0 到 1 之间。", Type: "invalid_request_error", Param: "retry_backoff_jitter"}})
+		return
+	}
+	if req.RetryPolicyModels != nil {
+		if _, err := retrypolicy.ParseOverrides(*req.RetryPolicyModels); err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorDetail{
+				Message: err.Error(), Type: "invalid_request_error", Param: "retry_policy_models"}})
+			return
+		}
+	}
 	// 可以为其他字段添加更多验证...
 
 	Log.Info("UpdateSettingsHandler: 收到配置热更新请求。")
 	config.UpdateSettings(req)
+	ApiKeyMgr.PublishSettingsChanged(updatedSettingFields(req))
 
 	// 更新需要特殊处理的运行时组件
 	// 例如，更新 http.Client 的 Timeout
@@ -83,3 +155,19 @@ func UpdateSettingsHandler(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{"message": "配置已成功更新。部分设置可能需要重启服务才能完全生效。"})
 }
+
+// updatedSettingFields 返回请求中提供了的配置项名称（JSON 字段名），用于 settings_changed 事件。
+// 事件只携带名称而不携带值，避免向订阅方泄露 app_api_key、admin_password 等敏感配置。
+func updatedSettingFields(req config.UpdateSettingsRequest) []string {
+	raw, _ := json.Marshal(req)
+	var values map[string]json.RawMessage
+	_ = json.Unmarshal(raw, &values)
+	fields := make([]string, 0, len(values))
+	for field, value := range values {
+		if string(value) != "null" {
+			fields = append(fields, field)
+		}
+	}
+	slices.Sort(fields)
+	return fields
+}
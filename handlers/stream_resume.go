@@ -0,0 +1,419 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"openrouter_polling/config"
+	"openrouter_polling/middleware"
+	"openrouter_polling/models"
+	"openrouter_polling/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 流恢复相关的 HTTP 头部。
+const (
+	streamResumeRequestHeader = "X-Stream-Resume" // 请求级开关：on 启用，off 禁用，优先级高于全局配置
+	streamTokenHeader         = "X-Stream-Token"  // 响应头：用于断线后通过 /v1/streams/{token} 恢复流的令牌
+	lastEventIDHeader         = "Last-Event-ID"   // 客户端重连时携带的最后收到的事件 ID
+	streamResumeContextKey    = "resumable_stream"
+)
+
+// resumableEvent 是一个带有 `id:` 字段的 SSE 事件（含结束事件的空行等附属行）。
+type resumableEvent struct {
+	id   int
+	text string
+}
+
+// resumableStream 保存一个可恢复流的已输出事件。原始客户端断开后，上游流会继续被读取并缓冲，
+// 客户端可以在宽限期内携带 Last-Event-ID 重连以获取剩余部分；宽限期内无人重连则取消上游请求。
+type resumableStream struct {
+	token     string
+	clientID  string
+	createdAt time.Time
+
+	mu        sync.Mutex
+	changed   chan struct{} // 有新事件或流结束时关闭并替换，用于唤醒重连的读取者
+	events    []resumableEvent // 已完整结束（收到空行）的事件，只有它们会被重放给重连的读取者
+	pending   *resumableEvent  // 尚未收到结束空行的当前事件
+	nextID    int
+	size      int
+	done      bool
+	evicted   bool      // 因内存上限被淘汰，缓冲已释放，无法再恢复
+	readers   int       // 正在接收该流的客户端数（含原始客户端）
+	original  bool      // 原始客户端是否仍在接收
+	expiresAt time.Time // 零值表示仍有读取者；否则为缓冲可被清理的时间
+	cancel    context.CancelFunc
+}
+
+// notifyLocked 唤醒等待中的读取者。调用者必须持有 s.mu。
+func (s *resumableStream) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// appendLine 缓冲一行上游输出并返回实际写给客户端的文本。事件的第一个 data 行被加上 `id:` 字段；
+// 其他行（后续 data 行、注释）附加到当前事件上，空行结束当前事件并将其发布给重连的读取者。
+// 不属于任何事件的行（如事件之间的注释）只转发给原始客户端，不被缓冲。added 为新增的缓冲字节数。
+func (s *resumableStream) appendLine(line string) (text string, added int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	text = line
+	if strings.HasPrefix(strings.TrimSpace(line), strings.TrimSpace(models.SSEDataPrefix)) && (s.pending == nil || s.pending.id == 0) {
+		s.nextID++
+		text = "id: " + strconv.Itoa(s.nextID) + "\n" + line
+		if !s.evicted {
+			if s.pending == nil {
+				s.pending = &resumableEvent{}
+			}
+			s.pending.id = s.nextID
+		}
+	}
+	if s.evicted || s.pending == nil {
+		return text, 0
+	}
+	s.pending.text += text
+	added = len(text)
+	s.size += added
+	if endsSSEEvent(line) {
+		s.publishPendingLocked()
+	}
+	return text, added
+}
+
+// endsSSEEvent 判断一次写入是否以空行结束（单独的空行，或自带结尾空行的完整事件）。
+func endsSSEEvent(line string) bool {
+	return strings.TrimSpace(line) == "" || strings.HasSuffix(line, "\n\n") || strings.HasSuffix(line, "\r\n\r\n")
+}
+
+// publishPendingLocked 将当前事件加入可重放的事件列表并唤醒读取者。调用者必须持有 s.mu。
+func (s *resumableStream) publishPendingLocked() {
+	if s.pending == nil {
+		return
+	}
+	s.events = append(s.events, *s.pending)
+	s.pending = nil
+	s.notifyLocked()
+}
+
+// attach 登记一个读取者。
+func (s *resumableStream) attach() {
+	s.mu.Lock()
+	s.readers++
+	s.expiresAt = time.Time{}
+	s.mu.Unlock()
+}
+
+// detach 在读取者离开时调用。最后一个读取者离开后开始计算宽限期：
+// 流已结束时缓冲在宽限期后被清理；流未结束且宽限期内无人重连时取消上游请求。
+func (s *resumableStream) detach() {
+	grace := config.AppSettings.StreamResumeGracePeriod
+	s.mu.Lock()
+	s.readers--
+	if s.readers > 0 {
+		s.mu.Unlock()
+		return
+	}
+	s.expiresAt = time.Now().Add(grace)
+	done := s.done
+	s.mu.Unlock()
+	if !done {
+		time.AfterFunc(grace, s.cancelIfAbandoned)
+	}
+}
+
+// detachOriginal 在原始客户端断开或请求结束时调用（只生效一次）。
+func (s *resumableStream) detachOriginal() {
+	s.mu.Lock()
+	wasAttached := s.original
+	s.original = false
+	s.mu.Unlock()
+	if wasAttached {
+		s.detach()
+	}
+}
+
+// originalAttached 判断原始客户端是否仍在接收。
+func (s *resumableStream) originalAttached() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.original
+}
+
+// cancelIfAbandoned 在宽限期结束时检查是否仍无人接收，若是则取消上游请求。
+// 读取者可能在此期间重连后再次离开，此时宽限期从最后一次离开重新计算，由那次离开启动的定时器负责。
+func (s *resumableStream) cancelIfAbandoned() {
+	s.mu.Lock()
+	abandoned := s.readers == 0 && !s.done && !s.expiresAt.IsZero() && !time.Now().Before(s.expiresAt)
+	s.mu.Unlock()
+	if abandoned {
+		Log.Infof("resumableStream: 流 %s 在宽限期内无人重连，取消上游请求。", s.token)
+		s.cancel()
+	}
+}
+
+// finish 标记流结束。上游未以空行结束最后一个事件时，该事件也会被发布。
+func (s *resumableStream) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending != nil && s.pending.id != 0 {
+		s.events = append(s.events, *s.pending)
+	}
+	s.pending = nil
+	s.done = true
+	if s.readers == 0 {
+		s.expiresAt = time.Now().Add(config.AppSettings.StreamResumeGracePeriod)
+	}
+	s.notifyLocked()
+}
+
+// streamResumeRegistry 按令牌登记可恢复流，并将所有流的缓冲总量限制在 STREAM_RESUME_MAX_BUFFER_MB 以内。
+type streamResumeRegistry struct {
+	mu         sync.Mutex
+	streams    map[string]*resumableStream
+	totalBytes int
+}
+
+var streamResumes = &streamResumeRegistry{streams: make(map[string]*resumableStream)}
+
+// register 创建并登记一个新的可恢复流。
+func (r *streamResumeRegistry) register(clientID string, cancel context.CancelFunc) *resumableStream {
+	stream := &resumableStream{
+		token:     utils.NewID("strm_"),
+		clientID:  clientID,
+		createdAt: time.Now(),
+		changed:   make(chan struct{}),
+		readers:   1,
+		original:  true,
+		cancel:    cancel,
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.evictExpiredLocked(time.Now())
+	r.streams[stream.token] = stream
+	return stream
+}
+
+// lookup 按令牌查找属于指定客户端的流。
+func (r *streamResumeRegistry) lookup(token, clientID string) (*resumableStream, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.evictExpiredLocked(time.Now())
+	stream, ok := r.streams[token]
+	if !ok || stream.clientID != clientID {
+		return nil, false
+	}
+	return stream, true
+}
+
+// addBytes 累计新增的缓冲字节数，超出上限时按创建时间淘汰最早的流（优先淘汰已结束的流）。
+func (r *streamResumeRegistry) addBytes(n int) {
+	limit := config.AppSettings.StreamResumeMaxBufferBytes
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.totalBytes += n
+	if limit <= 0 || r.totalBytes <= limit {
+		return
+	}
+
+	candidates := make([]*resumableStream, 0, len(r.streams))
+	for _, stream := range r.streams {
+		candidates = append(candidates, stream)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		di, dj := candidates[i].isDone(), candidates[j].isDone()
+		if di != dj {
+			return di
+		}
+		return candidates[i].createdAt.Before(candidates[j].createdAt)
+	})
+	for _, stream := range candidates {
+		if r.totalBytes <= limit {
+			break
+		}
+		r.removeLocked(stream)
+		Log.Warnf("streamResumeRegistry: 可恢复流缓冲超出上限，淘汰流 %s。", stream.token)
+	}
+}
+
+func (s *resumableStream) isDone() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done
+}
+
+// removeLocked 释放流的缓冲并将其移出登记表；流无人接收且未结束时同时取消上游请求。调用者必须持有 r.mu。
+func (r *streamResumeRegistry) removeLocked(stream *resumableStream) {
+	stream.mu.Lock()
+	r.totalBytes -= stream.size
+	stream.size = 0
+	stream.events = nil
+	stream.pending = nil
+	stream.evicted = true
+	abandoned := stream.readers == 0 && !stream.done
+	stream.notifyLocked()
+	stream.mu.Unlock()
+	delete(r.streams, stream.token)
+	if abandoned {
+		stream.cancel()
+	}
+}
+
+// evictExpiredLocked 清理宽限期已过的流。调用者必须持有 r.mu。
+func (r *streamResumeRegistry) evictExpiredLocked(now time.Time) {
+	for _, stream := range r.streams {
+		stream.mu.Lock()
+		expired := !stream.expiresAt.IsZero() && now.After(stream.expiresAt)
+		stream.mu.Unlock()
+		if expired {
+			r.removeLocked(stream)
+		}
+	}
+}
+
+// resumableSink 为上游 SSE 数据行加上 `id:` 字段后转发给原始客户端，同时缓冲以供断线重连。
+// 原始客户端断开后，写入错误被忽略，上游流继续被读取；流被淘汰且客户端已断开时才停止读取。
+type resumableSink struct {
+	c      *gin.Context
+	stream *resumableStream
+}
+
+func (s *resumableSink) WriteLine(line string) error {
+	text, added := s.stream.appendLine(line)
+	if added > 0 {
+		streamResumes.addBytes(added)
+	}
+	if !s.stream.originalAttached() {
+		s.stream.mu.Lock()
+		evicted := s.stream.evicted
+		s.stream.mu.Unlock()
+		if evicted {
+			return context.Canceled
+		}
+		return nil
+	}
+	if _, err := s.c.Writer.WriteString(text); err != nil {
+		Log.Warnf("resumableSink: 原始客户端断开 (流 %s)，继续缓冲上游输出以供重连: %v", s.stream.token, err)
+		s.stream.detachOriginal()
+		return nil
+	}
+	s.c.Writer.Flush()
+	return nil
+}
+
+// streamResumeEnabled 根据请求头和全局配置决定本次流式请求是否可恢复。
+func streamResumeEnabled(c *gin.Context) bool {
+	switch strings.ToLower(strings.TrimSpace(c.GetHeader(streamResumeRequestHeader))) {
+	case "on", "true":
+		return true
+	case "off", "false":
+		return false
+	}
+	return config.AppSettings.StreamResumeEnabled
+}
+
+// withStreamResume 为流式请求登记可恢复流：通过 X-Stream-Token 响应头返回令牌，
+// 并将上游请求的生命周期与原始客户端连接解耦，由 resumableSink 负责在客户端断开后继续缓冲。
+// 必须在写入任何响应头之前调用。
+func withStreamResume(c *gin.Context, isStream bool, run func()) {
+	if !isStream || !streamResumeEnabled(c) {
+		run()
+		return
+	}
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(c.Request.Context()))
+	stream := streamResumes.register(middleware.ClientID(c), cancel)
+	c.Header(streamTokenHeader, stream.token)
+	c.Set(streamResumeContextKey, stream)
+
+	originalRequest := c.Request
+	c.Request = c.Request.WithContext(streamCtx)
+	stopWatching := context.AfterFunc(originalRequest.Context(), stream.detachOriginal)
+	defer func() {
+		c.Request = originalRequest
+		stopWatching()
+		stream.finish()
+		stream.detachOriginal()
+		cancel()
+	}()
+
+	run()
+}
+
+// streamSinkFor 返回聊天补全流式响应使用的输出端：已登记可恢复流时使用 resumableSink，否则原样透传。
+func streamSinkFor(c *gin.Context) streamSink {
+	if v, ok := c.Get(streamResumeContextKey); ok {
+		if stream, ok := v.(*resumableStream); ok {
+			return &resumableSink{c: c, stream: stream}
+		}
+	}
+	return passthroughSink{c: c}
+}
+
+// ResumeStreamHandler 处理 `/v1/streams/:token` GET 请求：重放 Last-Event-ID 之后的事件，并继续跟随尚未结束的流。
+// Last-Event-ID 也可以通过查询参数 last_event_id 传递；省略时从头重放。
+func ResumeStreamHandler(c *gin.Context) {
+	clientOriginalContext := c.Request.Context()
+	token := c.Param("token")
+	lastEventIDStr := c.GetHeader(lastEventIDHeader)
+	if lastEventIDStr == "" {
+		lastEventIDStr = c.Query("last_event_id")
+	}
+	lastEventID := 0
+	if lastEventIDStr != "" {
+		id, err := strconv.Atoi(strings.TrimSpace(lastEventIDStr))
+		if err != nil || id < 0 {
+			sendErrorResponse(c, http.StatusBadRequest, "Last-Event-ID 必须是非负整数。", "invalid_request_error", false, clientOriginalContext)
+			return
+		}
+		lastEventID = id
+	}
+
+	stream, ok := streamResumes.lookup(token, middleware.ClientID(c))
+	if !ok {
+		sendErrorResponse(c, http.StatusNotFound, "未找到可恢复的流 '"+token+"'，它可能已过期。", "stream_not_found", false, clientOriginalContext)
+		return
+	}
+	stream.attach()
+	defer stream.detach()
+	Log.Infof("ResumeStreamHandler: 客户端从事件 %d 之后恢复流 %s。", lastEventID, token)
+
+	setSSEHeaders(c)
+	for {
+		stream.mu.Lock()
+		var pending []string
+		for _, event := range stream.events {
+			if event.id > lastEventID {
+				pending = append(pending, event.text)
+				lastEventID = event.id
+			}
+		}
+		evicted, done, changed := stream.evicted, stream.done, stream.changed
+		stream.mu.Unlock()
+
+		for _, text := range pending {
+			if _, err := c.Writer.WriteString(text); err != nil {
+				Log.Warnf("ResumeStreamHandler: 写入恢复的流数据失败: %v (客户端可能已断开)", err)
+				return
+			}
+		}
+		c.Writer.Flush()
+
+		if evicted {
+			sendErrorResponse(c, http.StatusGone, "流缓冲已被淘汰，无法继续恢复。", "stream_evicted", true, clientOriginalContext)
+			return
+		}
+		if done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-clientOriginalContext.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"openrouter_polling/config"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// useTestStreamResumes 替换全局的可恢复流登记表和相关配置，测试结束后恢复。
+func useTestStreamResumes(t *testing.T, grace time.Duration, maxBytes int) {
+	t.Helper()
+	prevSettings, prevRegistry, prevLog := config.AppSettings, streamResumes, Log
+	t.Cleanup(func() { config.AppSettings, streamResumes, Log = prevSettings, prevRegistry, prevLog })
+	config.AppSettings.StreamResumeGracePeriod = grace
+	config.AppSettings.StreamResumeMaxBufferBytes = maxBytes
+	streamResumes = &streamResumeRegistry{streams: make(map[string]*resumableStream)}
+	Log = logrus.New()
+	Log.SetOutput(io.Discard)
+}
+
+// writeStreamLines 像 resumableSink 一样把上游行写入流并累计缓冲字节数。
+func writeStreamLines(stream *resumableStream, lines ...string) {
+	for _, line := range lines {
+		if _, added := stream.appendLine(line); added > 0 {
+			streamResumes.addBytes(added)
+		}
+	}
+}
+
+// resumeStream 通过 ResumeStreamHandler 读取流，lastEventID 为空时不携带 Last-Event-ID。
+func resumeStream(ctx context.Context, token, lastEventID string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/v1/streams/:token", ResumeStreamHandler)
+	req := httptest.NewRequest(http.MethodGet, "/v1/streams/"+token, nil).WithContext(ctx)
+	if lastEventID != "" {
+		req.Header.Set(lastEventIDHeader, lastEventID)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestResumableStreamPublishesOnlyTerminatedEvents(t *testing.T) {
+	useTestStreamResumes(t, time.Minute, 0)
+	stream := streamResumes.register("anonymous", func() {})
+
+	writeStreamLines(stream, ": keepalive\n", "data: {\"a\":1}\n")
+	if len(stream.events) != 0 {
+		t.Fatalf("未收到结束空行的事件被发布: %+v", stream.events)
+	}
+	writeStreamLines(stream, "\n", "data: {\"b\":2}\n\n")
+	if len(stream.events) != 2 {
+		t.Fatalf("已发布事件数 = %d, 期望 2", len(stream.events))
+	}
+	if got := stream.events[0].text; got != "id: 1\ndata: {\"a\":1}\n\n" {
+		t.Errorf("第一个事件 = %q", got)
+	}
+	if got := stream.events[1].text; got != "id: 2\ndata: {\"b\":2}\n\n" {
+		t.Errorf("第二个事件 = %q", got)
+	}
+
+	// 上游没有以空行结束最后一个事件时，流结束时也会发布它。
+	writeStreamLines(stream, "data: [DONE]\n")
+	stream.finish()
+	if len(stream.events) != 3 || stream.events[2].text != "id: 3\ndata: [DONE]\n" {
+		t.Errorf("流结束后的事件 = %+v", stream.events)
+	}
+}
+
+func TestResumeStreamReplaysAfterLastEventID(t *testing.T) {
+	useTestStreamResumes(t, time.Minute, 0)
+	stream := streamResumes.register("anonymous", func() {})
+	writeStreamLines(stream, "data: a\n", "\n", "data: b\n", "\n", "data: c\n", "\n")
+	stream.finish()
+	stream.detachOriginal()
+
+	if got := resumeStream(context.Background(), stream.token, "1").Body.String(); got != "id: 2\ndata: b\n\nid: 3\ndata: c\n\n" {
+		t.Errorf("从事件 1 之后恢复 = %q", got)
+	}
+	if got := resumeStream(context.Background(), stream.token, "").Body.String(); got != "id: 1\ndata: a\n\nid: 2\ndata: b\n\nid: 3\ndata: c\n\n" {
+		t.Errorf("从头恢复 = %q", got)
+	}
+	if recorder := resumeStream(context.Background(), stream.token, "x"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("无效的 Last-Event-ID 状态码 = %d, 期望 400", recorder.Code)
+	}
+	if recorder := resumeStream(context.Background(), "strm_missing", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("不存在的流状态码 = %d, 期望 404", recorder.Code)
+	}
+}
+
+func TestResumeStreamFollowsLiveStreamWithExactFraming(t *testing.T) {
+	useTestStreamResumes(t, time.Minute, 0)
+	stream := streamResumes.register("anonymous", func() {})
+	writeStreamLines(stream, "data: a\n", "\n", "data: b\n")
+	stream.detachOriginal()
+
+	// 重连的读取者已收到事件 1；事件 2 的结束空行在重连之后才到达。
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		writeStreamLines(stream, "\n", "data: c\n", "\n")
+		stream.finish()
+	}()
+	if got := resumeStream(context.Background(), stream.token, "1").Body.String(); got != "id: 2\ndata: b\n\nid: 3\ndata: c\n\n" {
+		t.Errorf("跟随中的流 = %q, 期望每个事件都以空行结束", got)
+	}
+}
+
+func TestResumableStreamGracePeriodRestartsOnReattach(t *testing.T) {
+	const grace = 200 * time.Millisecond
+	useTestStreamResumes(t, grace, 0)
+	var cancelled atomic.Bool
+	stream := streamResumes.register("anonymous", func() { cancelled.Store(true) })
+
+	stream.detachOriginal() // 第一次离开，定时器在 grace 后触发
+	time.Sleep(grace / 2)
+	stream.attach()
+	stream.detach() // 重连后再次离开，宽限期从此刻重新计算
+
+	time.Sleep(grace/2 + grace/4) // 第一个定时器已触发，但第二个宽限期尚未结束
+	if cancelled.Load() {
+		t.Fatal("重连后再次离开时，第一次离开的定时器不应取消上游请求")
+	}
+	for deadline := time.Now().Add(2 * grace); !cancelled.Load() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !cancelled.Load() {
+		t.Error("最后一次离开的宽限期结束后期望取消上游请求")
+	}
+}
+
+func TestStreamResumeRegistryEvictsAtMemoryCap(t *testing.T) {
+	useTestStreamResumes(t, time.Minute, 64)
+	var abandonedCancelled atomic.Bool
+	finished := streamResumes.register("anonymous", func() {})
+	writeStreamLines(finished, "data: 0123456789\n", "\n")
+	finished.finish()
+	abandoned := streamResumes.register("anonymous", func() { abandonedCancelled.Store(true) })
+	writeStreamLines(abandoned, "data: 0123456789\n", "\n")
+	abandoned.detachOriginal()
+	live := streamResumes.register("anonymous", func() {})
+
+	// 超出上限时优先淘汰已结束的流。
+	writeStreamLines(live, "data: 0123456789\n", "\n")
+	if _, ok := streamResumes.lookup(finished.token, "anonymous"); ok {
+		t.Error("期望已结束的流首先被淘汰")
+	}
+	if _, ok := streamResumes.lookup(abandoned.token, "anonymous"); !ok {
+		t.Fatal("缓冲回到上限以内后不应继续淘汰")
+	}
+
+	// 再次超出时淘汰最早的未结束流；它已无人接收，上游请求随之取消。
+	writeStreamLines(live, "data: 0123456789\n", "\n")
+	if _, ok := streamResumes.lookup(abandoned.token, "anonymous"); ok {
+		t.Error("期望最早的未结束流被淘汰")
+	}
+	if !abandonedCancelled.Load() {
+		t.Error("淘汰无人接收的流时期望取消上游请求")
+	}
+	if streamResumes.totalBytes > 64 {
+		t.Errorf("淘汰后缓冲总量 = %d, 期望不超过上限", streamResumes.totalBytes)
+	}
+	if recorder := resumeStream(context.Background(), abandoned.token, ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("被淘汰的流状态码 = %d, 期望 404", recorder.Code)
+	}
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"openrouter_polling/tracing"
+	"openrouter_polling/utils"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 上游调用的 GenAI 操作名称（gen_ai.operation.name）。
+const (
+	genAIOperationChat           = "chat"
+	genAIOperationTextCompletion = "text_completion"
+	genAIOperationEmbeddings     = "embeddings"
+)
+
+// 单次上游尝试的结果（proxy.outcome 属性）。
+const (
+	attemptOutcomeSuccess            = "success"
+	attemptOutcomeRetry              = "retry"
+	attemptOutcomeFailed             = "failed"
+	attemptOutcomeClientDisconnected = "client_disconnected"
+)
+
+// 流式响应的里程碑事件。
+const (
+	streamEventFirstChunk           = "first_chunk"
+	streamEventFirstMeaningfulChunk = "first_meaningful_chunk"
+	streamEventDone                 = "done"
+)
+
+// genAIRequestModel 从上游请求体中读取 model 字段，用作 gen_ai.request.model。
+func genAIRequestModel(payload []byte) string {
+	var withModel struct {
+		Model string `json:"model"`
+	}
+	_ = json.Unmarshal(payload, &withModel)
+	return withModel.Model
+}
+
+// startUpstreamAttemptSpan 为一次上游尝试创建客户端 span（父 span 为请求的服务端 span），
+// 按 GenAI 语义约定命名为 "{operation} {model}"。
+func startUpstreamAttemptSpan(ctx context.Context, upstreamReq upstreamRequest, model, key string, attempt int) (context.Context, trace.Span) {
+	operation := upstreamReq.Operation
+	if operation == "" {
+		operation = genAIOperationChat
+	}
+	name := operation
+	if model != "" {
+		name += " " + model
+	}
+	return tracing.Tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.GenAIOperationNameKey.String(operation),
+			semconv.GenAISystemKey.String("openrouter"),
+			semconv.GenAIRequestModel(model),
+			semconv.URLFull(upstreamReq.URL),
+			semconv.HTTPRequestResendCount(attempt),
+			attribute.Int("proxy.retry_index", attempt),
+			attribute.String("proxy.key_suffix", utils.SafeSuffix(key)),
+			attribute.Bool("proxy.stream", upstreamReq.IsStream),
+		),
+	)
+}
+
+// endUpstreamAttemptSpan 记录尝试的结果并结束 span。
+func endUpstreamAttemptSpan(span trace.Span, success, retryNeeded bool, statusCode int, errDetail, errType string) {
+	outcome := attemptOutcomeSuccess
+	switch {
+	case success:
+	case errType == "client_disconnected_error" || errType == "client_disconnected_with_upstream_error":
+		outcome = attemptOutcomeClientDisconnected
+	case retryNeeded:
+		outcome = attemptOutcomeRetry
+	default:
+		outcome = attemptOutcomeFailed
+	}
+	span.SetAttributes(attribute.String("proxy.outcome", outcome), semconv.HTTPResponseStatusCode(statusCode))
+	if !success {
+		span.SetAttributes(semconv.ErrorTypeKey.String(errType))
+		span.SetStatus(codes.Error, errDetail)
+	}
+	span.End()
+}
+
+// annotateGenAIResponse 从上游响应体（或单个流式数据块）中提取响应 ID、模型、token 用量和结束原因，
+// 写入尝试 span 的 GenAI 属性。流式响应的各字段分散在不同数据块中，逐块调用即可。
+func annotateGenAIResponse(span trace.Span, body []byte) {
+	if !span.IsRecording() || len(body) == 0 || body[0] != '{' {
+		return
+	}
+	var response struct {
+		ID      string `json:"id"`
+		Model   string `json:"model"`
+		Choices []struct {
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage *struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return
+	}
+	var attrs []attribute.KeyValue
+	if response.ID != "" {
+		attrs = append(attrs, semconv.GenAIResponseID(response.ID))
+	}
+	if response.Model != "" {
+		attrs = append(attrs, semconv.GenAIResponseModel(response.Model))
+	}
+	if response.Usage != nil {
+		attrs = append(attrs, semconv.GenAIUsageInputTokens(response.Usage.PromptTokens), semconv.GenAIUsageOutputTokens(response.Usage.CompletionTokens))
+	}
+	var finishReasons []string
+	for _, choice := range response.Choices {
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			finishReasons = append(finishReasons, *choice.FinishReason)
+		}
+	}
+	if len(finishReasons) > 0 {
+		attrs = append(attrs, semconv.GenAIResponseFinishReasons(finishReasons...))
+	}
+	span.SetAttributes(attrs...)
+}
+
+// annotateGenAIStreamChunk 是流式数据块的 annotateGenAIResponse：只解析携带用量或结束原因的数据块
+// （这些数据块同样带有 id 和 model），跳过仅含增量内容的普通数据块。
+func annotateGenAIStreamChunk(span trace.Span, data []byte) {
+	if bytes.Contains(data, []byte(`"usage"`)) || bytes.Contains(data, []byte(`"finish_reason":"`)) || bytes.Contains(data, []byte(`"finish_reason": "`)) {
+		annotateGenAIResponse(span, data)
+	}
+}
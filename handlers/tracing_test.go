@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"openrouter_polling/middleware"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestUpstreamAttemptSpans(t *testing.T) {
+	var calls atomic.Int32
+	var traceparent atomic.Value
+	useStubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		traceparent.Store(r.Header.Get("traceparent"))
+		w.Header().Set("Content-Type", "application/json")
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"error":{"message":"rate limited","code":429}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"gen-42","object":"chat.completion","model":"test/model-2025","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}],"usage":{"prompt_tokens":12,"completion_tokens":3,"total_tokens":15}}`))
+	}, "sk-or-v1-stub-upstream-key-0001", "sk-or-v1-stub-upstream-key-0002")
+
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	router := gin.New()
+	router.Use(middleware.AssignRequestID(), middleware.Trace())
+	router.POST("/v1/chat/completions", ChatCompletionsHandler)
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"model":"`+stubUpstreamModel+`","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("状态码 = %d, 期望重试后成功, 响应体: %s", recorder.Code, recorder.Body.String())
+	}
+
+	var server sdktrace.ReadOnlySpan
+	var attempts []sdktrace.ReadOnlySpan
+	for _, span := range spans.Ended() {
+		if span.SpanKind() == trace.SpanKindServer {
+			server = span
+		} else {
+			attempts = append(attempts, span)
+		}
+	}
+	if server == nil || len(attempts) != 2 {
+		t.Fatalf("服务端 span: %v, 尝试 span 数 = %d, 期望 1 个服务端 span 和 2 次尝试", server != nil, len(attempts))
+	}
+
+	keySuffixes := make(map[string]bool)
+	for i, span := range attempts {
+		if span.Name() != "chat "+stubUpstreamModel || span.SpanKind() != trace.SpanKindClient {
+			t.Errorf("第 %d 次尝试的 span = %s (%v), 期望 \"chat %s\" 客户端 span", i, span.Name(), span.SpanKind(), stubUpstreamModel)
+		}
+		if span.Parent().SpanID() != server.SpanContext().SpanID() {
+			t.Errorf("第 %d 次尝试的父 span = %s, 期望为服务端 span", i, span.Parent().SpanID())
+		}
+		attrs := make(map[attribute.Key]attribute.Value)
+		for _, kv := range span.Attributes() {
+			attrs[kv.Key] = kv.Value
+		}
+		want := map[attribute.Key]attribute.Value{
+			"gen_ai.operation.name":     attribute.StringValue(genAIOperationChat),
+			"gen_ai.system":             attribute.StringValue("openrouter"),
+			"gen_ai.request.model":      attribute.StringValue(stubUpstreamModel),
+			"proxy.retry_index":         attribute.IntValue(i),
+			"http.request.resend_count": attribute.IntValue(i),
+			"proxy.stream":              attribute.BoolValue(false),
+		}
+		if i == 0 {
+			want["proxy.outcome"] = attribute.StringValue(attemptOutcomeRetry)
+			want["http.response.status_code"] = attribute.IntValue(http.StatusTooManyRequests)
+			want["error.type"] = attribute.StringValue("rate_limit_error")
+		} else {
+			want["proxy.outcome"] = attribute.StringValue(attemptOutcomeSuccess)
+			want["http.response.status_code"] = attribute.IntValue(http.StatusOK)
+			want["gen_ai.response.id"] = attribute.StringValue("gen-42")
+			want["gen_ai.response.model"] = attribute.StringValue("test/model-2025")
+			want["gen_ai.usage.input_tokens"] = attribute.IntValue(12)
+			want["gen_ai.usage.output_tokens"] = attribute.IntValue(3)
+		}
+		for key, value := range want {
+			if attrs[key] != value {
+				t.Errorf("第 %d 次尝试的属性 %s = %v, 期望 %v", i, key, attrs[key].Emit(), value.Emit())
+			}
+		}
+		keySuffixes[attrs["proxy.key_suffix"].AsString()] = true
+		if wantStatus := map[int]codes.Code{0: codes.Error, 1: codes.Unset}[i]; span.Status().Code != wantStatus {
+			t.Errorf("第 %d 次尝试的 span 状态 = %v, 期望 %v", i, span.Status().Code, wantStatus)
+		}
+		if i == 1 {
+			if reasons := attrs["gen_ai.response.finish_reasons"].AsStringSlice(); len(reasons) != 1 || reasons[0] != "stop" {
+				t.Errorf("结束原因 = %v, 期望 [stop]", reasons)
+			}
+		}
+	}
+	if len(keySuffixes) != 2 {
+		t.Errorf("两次尝试使用的密钥 = %v, 期望换密钥重试", keySuffixes)
+	}
+
+	// 上游请求携带最后一次尝试 span 的 traceparent。
+	if got, _ := traceparent.Load().(string); !strings.Contains(got, attempts[1].SpanContext().SpanID().String()) ||
+		!strings.Contains(got, server.SpanContext().TraceID().String()) {
+		t.Errorf("上游收到的 traceparent = %q, 期望为尝试 span", got)
+	}
+}
@@ -0,0 +1,464 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"openrouter_polling/apimanager"
+	"openrouter_polling/config"
+	"openrouter_polling/middleware"
+	"openrouter_polling/retrypolicy"
+	"openrouter_polling/utils"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// upstreamOKHandler 处理上游返回的 200 OK 响应，并负责将结果写回客户端。
+// 返回值与 attemptOpenRouterRequest 相同：
+//
+//	success (bool): 响应是否成功（或在客户端断开前部分成功）发送给了客户端。
+//	retryNeeded (bool): 如果失败，是否应该用新密钥重试。
+//	statusCodeForError (int): 如果失败，相关的 HTTP 状态码。
+//	errorDetail (string): 如果失败，错误详情。
+//	errorType (string): 如果失败，错误类型。
+type upstreamOKHandler func(
+	attemptCtx context.Context,
+	c *gin.Context,
+	resp *http.Response,
+	apiKeyStatus *apimanager.ApiKeyStatus,
+	clientOriginalContext context.Context,
+) (success bool, retryNeeded bool, statusCodeForError int, errorDetail string, errorType string)
+
+// upstreamErrorSender 以特定协议格式向客户端发送最终错误（例如 Anthropic 或 Gemini 风格的错误体）。
+type upstreamErrorSender func(c *gin.Context, statusCode int, message string, errorType string)
+
+// upstreamRequest 描述一次需要经过密钥池轮换、重试和错误分类后发往 OpenRouter 的请求。
+// 聊天、文本补全、向量嵌入以及各种协议兼容端点都通过它复用同一套执行逻辑。
+type upstreamRequest struct {
+	URL       string              // 上游端点的完整 URL
+	Payload   []byte              // 已序列化为 JSON 的请求体
+	IsStream  bool                // 客户端是否期望流式响应（影响错误响应的发送方式）
+	HandleOK  upstreamOKHandler   // 上游返回 200 OK 时的响应处理函数
+	SendError upstreamErrorSender // 可选：最终失败时的错误发送函数，默认使用 OpenAI 风格的 sendErrorResponse
+	Operation string              // 可选：追踪 span 的 GenAI 操作名称，默认为 chat
+}
+
+// executeUpstreamRequest 通过密钥池执行上游请求。
+// 它管理 API 密钥的选择、失败重试和最终错误响应，成功时由 upstreamReq.HandleOK 负责写回客户端。
+// c: Gin 上下文。
+// upstreamReq: 要执行的上游请求描述。
+func executeUpstreamRequest(c *gin.Context, upstreamReq upstreamRequest) {
+	var lastExceptionDetail = "在多次尝试使用不同密钥后未能成功处理请求。"  // 默认的最终错误信息
+	var lastStatusCode = http.StatusServiceUnavailable // 默认的最终错误状态码
+	var lastErrorType = "api_error"                    // 默认的最终错误类型
+	activeRequestKeysTried := make(map[string]bool)    // 记录在本次调用中已尝试过的密钥，避免对同一客户端请求用同一坏密钥反复重试。
+	clientOriginalContext := c.Request.Context()       // 客户端原始请求的上下文
+
+	// 在占用任何上游密钥之前检查客户端费用预算。
+	if exceeded, message := checkClientBudget(c); exceeded {
+		sendUpstreamError(c, upstreamReq, http.StatusPaymentRequired, message, "insufficient_quota")
+		return
+	}
+
+	// 上游熔断器打开期间快速失败，不占用任何密钥。
+	allowed, probe := UpstreamBreaker.Allow()
+	if probe {
+		defer UpstreamBreaker.FinishProbe() // 探测请求无论以何种结果结束都要释放探测名额
+	}
+	if !allowed {
+		message := "上游服务当前不可用（多个密钥同时出现网络错误或 5xx），熔断器已打开，请稍后重试。"
+		requestLog(c).Warnf("executeUpstreamRequest: %s", message)
+		Alerts.RecordRequestOutcome(true)
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(max(UpstreamBreaker.RetryAfter().Seconds(), 1)))))
+		sendUpstreamError(c, upstreamReq, http.StatusServiceUnavailable, message, "upstream_unavailable_error")
+		return
+	}
+
+	requestModel := genAIRequestModel(upstreamReq.Payload)
+	c.Set(requestModelContextKey, requestModel)
+	attempt := 0 // 本次请求的尝试序号（从 0 开始），记录在追踪 span 中
+
+	// 模型处于降级状态时不消耗密钥：改用备用模型，没有备用模型则快速失败。
+	rerouted := false // 每个请求最多改用一次备用模型
+	if ModelHealth.IsDegraded(requestModel) {
+		if !rerouteToFallback(c, &upstreamReq, &requestModel) {
+			message := "模型 " + requestModel + " 当前处于降级状态（上游在多个密钥上持续出错），请稍后重试或改用其他模型。"
+			requestLog(c).Warnf("executeUpstreamRequest: %s", message)
+			Alerts.RecordRequestOutcome(true)
+			sendUpstreamError(c, upstreamReq, http.StatusServiceUnavailable, message, "model_degraded_error")
+			return
+		}
+		rerouted = true
+	}
+
+	// 重试策略（可按模型覆盖）决定哪些错误重试、在哪个密钥上重试、重试前等待多久以及总时长上限。
+	policy := retrypolicy.For(requestModel)
+	retriesLeft := policy.MaxRetries
+	RetryBudget.RecordRequest()
+	var deadline time.Time // 所有尝试的截止时间，零值表示不限制
+	if policy.Deadline > 0 {
+		deadline = time.Now().Add(policy.Deadline)
+		c.Set(requestDeadlineContextKey, deadline)
+	}
+	var sameKeyRetry *apimanager.ApiKeyStatus // 重试策略要求在同一个密钥上重试时，下一次尝试使用的密钥
+	queuePriority, queueMaxWait := queueSettings(c)
+	var queueWaited time.Duration // 本次请求（所有尝试）累计的排队时间，不超过 queueMaxWait
+	// 启用会话亲和时，同一会话的请求尽量使用同一个密钥，以命中提供商的提示词缓存。
+	conversation := conversationAffinityKey(c, upstreamReq.Payload)
+
+	// 主重试循环：只要还有重试次数，就继续尝试。
+	for ; retriesLeft >= 0; attempt++ {
+		// 在每次尝试前检查客户端是否已断开连接。
+		if clientOriginalContext.Err() == context.Canceled {
+			requestLog(c).Warnf("executeUpstreamRequest: 客户端在尝试获取新密钥前已断开连接 (尝试 %d)。请求终止。", attempt)
+			return // 客户端已断开，无需继续。
+		}
+
+		// 获取本次尝试使用的密钥并占用它的一个并发名额：在同一个密钥上重试时沿用上一次的密钥（其并发名额已满时改用新密钥），
+		// 否则从 ApiKeyManager 获取下一个可用的密钥（启用会话亲和时优先使用会话上次的密钥），没有可用密钥时按请求的排队设置等待。
+		var currentAPIKeyStatus *apimanager.ApiKeyStatus
+		if sameKeyRetry != nil {
+			currentAPIKeyStatus = ApiKeyMgr.AcquireKey(sameKeyRetry.Key)
+		}
+		usingSameKey := currentAPIKeyStatus != nil
+		var queueErr error
+		if currentAPIKeyStatus == nil {
+			maxWait := queueMaxWait - queueWaited
+			if !deadline.IsZero() {
+				maxWait = min(maxWait, time.Until(deadline))
+			}
+			var waited time.Duration
+			currentAPIKeyStatus, waited, queueErr = keyWaitQueue.acquire(clientOriginalContext, conversation, queuePriority, maxWait)
+			if waited > 0 {
+				queueWaited += waited
+				// 流式请求的 SSE 头部随第一段数据才发出（见 prepareSSEHeaders），因此这里设置的头部同样送达流式客户端。
+				c.Header(queueWaitHeader, strconv.FormatInt(queueWaited.Milliseconds(), 10))
+				requestLog(c).Infof("executeUpstreamRequest: 请求以 %s 优先级排队等待密钥 %v。", queuePriority, waited.Round(time.Millisecond))
+			}
+		}
+		if currentAPIKeyStatus == nil {
+			if clientOriginalContext.Err() == context.Canceled {
+				requestLog(c).Warnf("executeUpstreamRequest: 客户端在排队等待密钥期间断开连接 (尝试 %d)。请求终止。", attempt)
+				return
+			}
+			lastStatusCode = http.StatusServiceUnavailable
+			lastErrorType = "no_available_keys_error"
+			switch {
+			case errors.Is(queueErr, errRequestQueueFull):
+				lastExceptionDetail = "所有 API 密钥当前都不可用，且等待密钥的请求队列已满。"
+				lastErrorType = "request_queue_full_error"
+			case errors.Is(queueErr, errRequestQueueTimeout):
+				lastExceptionDetail = fmt.Sprintf("排队等待 %v 后仍没有可用的 API 密钥。", queueWaited.Round(time.Millisecond))
+			default:
+				lastExceptionDetail = "所有 API 密钥当前都不可用或处于冷却中。"
+				if available, _ := ApiKeyMgr.KeyAvailability(); available > 0 {
+					lastExceptionDetail = "所有可用 API 密钥的并发请求数都已达到上限。"
+				}
+			}
+			requestLog(c).Errorf("executeUpstreamRequest: 没有可用的 API 密钥用于新的尝试: %s", lastExceptionDetail)
+			break // 没有可用密钥，跳出重试循环。
+		}
+		currentOpenRouterKey := currentAPIKeyStatus.Key // 获取密钥字符串
+
+		// 如果当前轮到的密钥已在此请求中尝试过，并且还有其他未尝试的密钥，则尝试获取一个不同的新密钥。
+		// 这可以避免在一次用户请求中因密钥选择策略（如轮询）而重复使用一个已知对此请求无效的密钥。
+		if _, tried := activeRequestKeysTried[currentOpenRouterKey]; tried && !usingSameKey && len(activeRequestKeysTried) < ApiKeyMgr.GetTotalKeysCount() {
+			requestLog(c).Debugf("executeUpstreamRequest: 密钥 %s 在此请求中已尝试过，尝试获取下一个不同的密钥。", utils.SafeSuffix(currentOpenRouterKey))
+			foundNewUntriedKey := false
+			for i := 0; i < ApiKeyMgr.GetTotalKeysCount(); i++ { // 最多轮询所有密钥一次以查找新密钥
+				nextKeyStatusCandidate := ApiKeyMgr.GetNextAPIKey() // 获取下一个（可能还是同一个，如果只有一个可用）
+				if nextKeyStatusCandidate == nil {                  // 不太可能发生，但作为保护
+					break
+				}
+				if _, alreadyTried := activeRequestKeysTried[nextKeyStatusCandidate.Key]; !alreadyTried {
+					releaseKey(currentOpenRouterKey)             // 归还原先轮到的密钥的并发名额
+					currentAPIKeyStatus = nextKeyStatusCandidate // 找到新的未尝试密钥
+					currentOpenRouterKey = currentAPIKeyStatus.Key
+					foundNewUntriedKey = true
+					requestLog(c).Debugf("executeUpstreamRequest: 切换到新的未尝试密钥 %s 用于本次请求。", utils.SafeSuffix(currentOpenRouterKey))
+					break
+				}
+				releaseKey(nextKeyStatusCandidate.Key)
+			}
+			if !foundNewUntriedKey {
+				requestLog(c).Warnf("executeUpstreamRequest: 无法为此请求找到新的、未尝试过的可用密钥。当前已尝试 %d 个。将继续使用轮到的密钥 %s。", len(activeRequestKeysTried), utils.SafeSuffix(currentOpenRouterKey))
+			}
+		}
+		activeRequestKeysTried[currentOpenRouterKey] = true // 标记此密钥已被用于当前调用。
+		sameKeyRetry = nil
+
+		// 为本次向上游 API 的尝试创建一个带超时的上下文。
+		// 此超时基于全局配置 `config.AppSettings.RequestTimeout`，且不超过重试策略的截止时间。
+		attemptStart := time.Now()
+		attemptTimeout := config.AppSettings.RequestTimeout
+		if !deadline.IsZero() {
+			attemptTimeout = min(attemptTimeout, time.Until(deadline))
+		}
+		attemptCtx, cancelAttemptCtx := context.WithTimeout(clientOriginalContext, attemptTimeout)
+		attemptCtx, attemptSpan := startUpstreamAttemptSpan(attemptCtx, upstreamReq, requestModel, currentOpenRouterKey, attempt)
+
+		requestLog(c).Infof("executeUpstreamRequest: 尝试使用密钥 %s 向 OpenRouter 发起请求 (URL: %s, 剩余重试次数: %d)",
+			utils.SafeSuffix(currentOpenRouterKey), upstreamReq.URL, retriesLeft)
+
+		// 调用封装的单次请求尝试逻辑。
+		success, retryNeeded, statusCode, errDetail, errType := attemptOpenRouterRequest(
+			attemptCtx, c, currentAPIKeyStatus, upstreamReq, clientOriginalContext,
+		)
+
+		endUpstreamAttemptSpan(attemptSpan, success, retryNeeded, statusCode, errDetail, errType)
+		recordKeyPerformance(c, currentOpenRouterKey, attemptStart, success, retryNeeded)
+		cancelAttemptCtx()               // 单次尝试结束（无论成功失败），取消其上下文以释放资源。
+		releaseKey(currentOpenRouterKey) // 归还密钥的并发名额，同一个密钥上的重试会重新占用
+
+		if success {
+			requestLog(c).Infof("executeUpstreamRequest: 请求使用密钥 %s 成功处理并完成。", utils.SafeSuffix(currentOpenRouterKey))
+			if usage := middleware.ReportedUsage(c); usage != nil && usage.PromptTokensDetails != nil && usage.PromptTokensDetails.CachedTokens > 0 {
+				requestLog(c).Infof("executeUpstreamRequest: %d/%d 个输入 token 命中了提供商的提示词缓存 (密钥 %s)。", usage.PromptTokensDetails.CachedTokens, usage.PromptTokens, utils.SafeSuffix(currentOpenRouterKey))
+			}
+			recordRequestCost(c, currentAPIKeyStatus, upstreamReq.Payload)
+			ModelHealth.RecordSuccess(requestModel)
+			UpstreamBreaker.RecordSuccess()
+			Alerts.RecordRequestOutcome(false)
+			return // 请求成功处理，整个调用结束。
+		}
+
+		// 如果尝试失败：
+		lastStatusCode = statusCode
+		lastExceptionDetail = errDetail
+		lastErrorType = errType
+
+		if !retryNeeded { // 如果错误类型指示不应重试 (例如400 Bad Request非密钥问题，或流已部分发送后中断)
+			if statusCode < http.StatusInternalServerError {
+				UpstreamBreaker.RecordSuccess() // 上游正常返回了客户端请求错误，说明上游可用
+			}
+			requestLog(c).Warnf("executeUpstreamRequest: 发生不可重试的错误 (密钥 %s, 状态码 %d: %s)。终止对此客户端请求的重试。", utils.SafeSuffix(currentOpenRouterKey), statusCode, errDetail)
+			break // 退出主重试循环。最终错误将在循环后发送。
+		}
+
+		// 如果需要重试：
+		// MarkKeyFailure 已在 attemptOpenRouterRequest 中根据情况调用
+		// 如果本次失败使上游熔断器打开，停止重试，避免继续消耗密钥。
+		if UpstreamBreaker.IsOpen() {
+			lastStatusCode = http.StatusServiceUnavailable
+			lastExceptionDetail = "上游服务当前不可用（多个密钥同时出现网络错误或 5xx），熔断器已打开，请稍后重试。最后错误: " + errDetail
+			lastErrorType = "upstream_unavailable_error"
+			break
+		}
+		// 如果本次失败使模型进入降级状态，继续换密钥重试没有意义：改用备用模型（不消耗重试次数），或直接失败。
+		if ModelHealth.IsDegraded(requestModel) {
+			if rerouted || !rerouteToFallback(c, &upstreamReq, &requestModel) {
+				lastStatusCode = http.StatusServiceUnavailable
+				lastExceptionDetail = "模型 " + requestModel + " 当前处于降级状态（上游在多个密钥上持续出错），请稍后重试或改用其他模型。最后错误: " + errDetail
+				lastErrorType = "model_degraded_error"
+				break
+			}
+			rerouted = true
+			clear(activeRequestKeysTried) // 备用模型可以重新使用所有密钥
+			continue
+		}
+		if !policy.Retryable(errType) {
+			requestLog(c).Warnf("executeUpstreamRequest: 错误类型 %s 不在重试策略的可重试列表中 (密钥 %s)，不再重试。", errType, utils.SafeSuffix(currentOpenRouterKey))
+			break
+		}
+		retriesLeft--
+		if retriesLeft < 0 { // 所有重试已用尽
+			requestLog(c).Errorf("executeUpstreamRequest: 所有重试已用尽。最后失败于密钥 %s。最终错误: %s (状态码 %d)", utils.SafeSuffix(currentOpenRouterKey), lastExceptionDetail, lastStatusCode)
+			break // 退出主重试循环。最终错误将在循环后发送。
+		}
+		// 重试前按指数退避（带随机抖动）等待，以避免快速耗尽所有密钥或对上游服务造成冲击。
+		backoff := policy.Backoff(policy.MaxRetries - retriesLeft - 1)
+		if !deadline.IsZero() && time.Now().Add(backoff).After(deadline) {
+			requestLog(c).Warnf("executeUpstreamRequest: 距离重试策略的截止时间不足以再次重试 (等待 %v)，不再重试。最终错误: %s", backoff, lastExceptionDetail)
+			break
+		}
+		if !RetryBudget.AllowRetry() {
+			requestLog(c).Warnf("executeUpstreamRequest: 全局重试预算已用尽，不再重试。最终错误: %s (状态码 %d)", lastExceptionDetail, lastStatusCode)
+			break
+		}
+		target := "新密钥"
+		if policy.SameKey(errType) {
+			sameKeyRetry = currentAPIKeyStatus
+			target = "同一密钥"
+		}
+
+		requestLog(c).Infof("executeUpstreamRequest: 由于错误/超时 (密钥 %s)，将在 %v 后使用%s重试 (还剩 %d 次)。错误: %s", utils.SafeSuffix(currentOpenRouterKey), backoff.Round(time.Millisecond), target, retriesLeft, lastExceptionDetail)
+		select {
+		case <-time.After(backoff):
+		case <-clientOriginalContext.Done(): // 客户端断开时不再等待，由下一轮循环开头处理
+		}
+	} // 结束主重试循环
+
+	// 如果循环结束（所有重试用尽或因不可重试错误跳出），并且客户端未断开连接，则发送最终错误响应。
+	if clientOriginalContext.Err() != context.Canceled {
+		// 只有上游或密钥池导致的失败（5xx、所有密钥都被限流）计入告警错误率，客户端请求本身的错误不计入
+		if lastStatusCode >= http.StatusInternalServerError || lastStatusCode == http.StatusTooManyRequests {
+			Alerts.RecordRequestOutcome(true)
+		}
+		requestLog(c).Errorf("executeUpstreamRequest: 请求最终失败。最后错误: %s (状态码: %d, 类型: %s)", lastExceptionDetail, lastStatusCode, lastErrorType)
+		sendUpstreamError(c, upstreamReq, lastStatusCode, lastExceptionDetail, lastErrorType)
+	} else {
+		requestLog(c).Warnf("executeUpstreamRequest: 请求最终失败，但客户端已断开。不发送最终错误。最后错误: %s (状态码: %d)", lastExceptionDetail, lastStatusCode)
+	}
+}
+
+// sendUpstreamError 向客户端发送最终错误，优先使用请求指定的协议格式（upstreamReq.SendError）。
+func sendUpstreamError(c *gin.Context, upstreamReq upstreamRequest, statusCode int, message, errorType string) {
+	if upstreamReq.SendError != nil {
+		upstreamReq.SendError(c, statusCode, message, errorType)
+		return
+	}
+	sendErrorResponse(c, statusCode, message, errorType, upstreamReq.IsStream, c.Request.Context())
+}
+
+// attemptOpenRouterRequest 封装了向 OpenRouter 发起单次 API 请求并处理其响应的逻辑。
+// attemptCtx: 本次特定尝试的上下文 (带超时)。
+// c: Gin 上下文，用于向客户端发送响应。
+// apiKeyStatus: 当前尝试使用的 ApiKeyStatus 对象。
+// upstreamReq: 上游请求描述（URL、请求体、200 响应处理函数）。
+// clientOriginalContext: 客户端原始请求的上下文，用于检测客户端是否已断开。
+// 返回:
+//
+//	success (bool): 本次尝试是否成功并将响应完整或部分（对于流）发送给了客户端。
+//	retryNeeded (bool): 如果失败或部分成功后中断，是否指示上层逻辑用新密钥重试。
+//	statusCodeForError (int): 如果发生错误，相关的 HTTP 状态码。
+//	errorDetail (string): 如果发生错误，错误详情。
+//	errorType (string): 如果发生错误，错误类型。
+func attemptOpenRouterRequest(
+	attemptCtx context.Context,
+	c *gin.Context,
+	apiKeyStatus *apimanager.ApiKeyStatus,
+	upstreamReq upstreamRequest,
+	clientOriginalContext context.Context,
+) (success bool, retryNeeded bool, statusCodeForError int, errorDetail string, errorType string) {
+	currentOpenRouterKey := apiKeyStatus.Key // 获取密钥字符串
+	logEntry := requestLog(c)
+
+	// 创建到 OpenRouter 的 POST 请求。
+	req, err := http.NewRequestWithContext(attemptCtx, "POST", upstreamReq.URL, bytes.NewBuffer(upstreamReq.Payload))
+	if err != nil {
+		logEntry.Errorf("attemptOpenRouterRequest: 创建到 OpenRouter 的请求失败: %v (密钥: %s)", err, utils.SafeSuffix(currentOpenRouterKey))
+		// 这种错误通常是内部问题，不一定与密钥有关，但为了安全，可以视为可重试。
+		return false, true, http.StatusInternalServerError, "创建上游 API 请求失败。", "internal_server_error"
+	}
+
+	// 设置必要的 HTTP 请求头。
+	req.Header.Set("Authorization", "Bearer "+currentOpenRouterKey)
+	req.Header.Set("Content-Type", "application/json")
+	if config.AppSettings.HTTPReferer != "" {
+		req.Header.Set("HTTP-Referer", config.AppSettings.HTTPReferer)
+	}
+	if config.AppSettings.XTitle != "" {
+		req.Header.Set("X-Title", config.AppSettings.XTitle)
+	}
+	// 将请求 ID 传递给上游，便于与上游日志关联。
+	if requestID := middleware.RequestID(c); requestID != "" {
+		req.Header.Set(middleware.RequestIDHeader, requestID)
+	}
+	// 将本次尝试的 span 作为上游请求的父 span（traceparent）。
+	otel.GetTextMapPropagator().Inject(attemptCtx, propagation.HeaderCarrier(req.Header))
+
+	// 使用全局 HttpClient 执行 HTTP 请求。
+	resp, err := HttpClient.Do(req)
+	if err != nil {
+		// 处理 HttpClient.Do 返回的错误 (例如网络错误、上下文超时/取消等)。
+		errMsg := fmt.Sprintf("请求 OpenRouter 时出错 (密钥: %s): %v", utils.SafeSuffix(currentOpenRouterKey), err)
+		logEntry.Error(errMsg) // 记录详细错误
+
+		// 根据错误类型决定是否重试和返回的状态码/信息。
+		if attemptCtx.Err() == context.DeadlineExceeded { // 单次尝试超时
+			if deadline := c.GetTime(requestDeadlineContextKey); !deadline.IsZero() && !time.Now().Before(deadline) {
+				// 超时由重试策略的总时长上限导致，与密钥无关，不计入密钥失败，也不再重试。
+				return false, false, http.StatusGatewayTimeout, "请求超过了重试策略的总时长上限。", "request_deadline_exceeded_error"
+			}
+			// 超时通常与密钥或其承载的服务有关，标记失败。
+			return failKeyForRetry(c, currentOpenRouterKey, http.StatusGatewayTimeout, fmt.Sprintf("请求上游 API 超时 (密钥: %s)。", utils.SafeSuffix(currentOpenRouterKey)), "upstream_timeout_error")
+		}
+		if attemptCtx.Err() == context.Canceled {
+			if clientOriginalContext.Err() == context.Canceled { // 检查是否是原始客户端请求取消导致的
+				logEntry.Warnf("attemptOpenRouterRequest: 客户端上下文在请求 OpenRouter 期间被取消 (密钥: %s). 客户端可能已断开。终止。", utils.SafeSuffix(currentOpenRouterKey))
+				return false, false, http.StatusServiceUnavailable, "客户端已断开连接。", "client_disconnected_error" // 不重试，因为客户端已离开。
+			}
+			// 可能是内部超时或其他原因导致的 attemptCtx 取消，假设与密钥相关。
+			return failKeyForRetry(c, currentOpenRouterKey, http.StatusServiceUnavailable, fmt.Sprintf("上游 API 请求被内部取消 (密钥: %s)。", utils.SafeSuffix(currentOpenRouterKey)), "request_canceled_error")
+		}
+		// 其他网络错误 (例如 DNS 解析失败、连接被拒绝等)，标记失败，因为无法连接到服务。
+		return failKeyForRetry(c, currentOpenRouterKey, http.StatusBadGateway, fmt.Sprintf("上游 API 网络错误 (密钥: %s): %v", utils.SafeSuffix(currentOpenRouterKey), err), "network_error")
+	}
+	defer resp.Body.Close() // 确保响应体在函数结束时关闭。
+
+	// --- 处理 OpenRouter 的响应 ---
+	if resp.StatusCode == http.StatusOK { // HTTP 200 OK
+		// 具体的响应转发（流式/非流式、内容检查）由各端点的处理函数负责。
+		// RecordKeySuccess 也由处理函数在确认响应有效后调用。
+		return upstreamReq.HandleOK(attemptCtx, c, resp, apiKeyStatus, clientOriginalContext)
+	}
+
+	// --- OpenRouter 返回非 200 OK 状态码 ---
+	// 调用 handleOpenRouterErrorResponse 处理错误，它会决定是否标记密钥失败和是否需要重试。
+	_, shouldRetry, errCode, errStr, errTypeStr := handleOpenRouterErrorResponse(resp, currentOpenRouterKey, clientOriginalContext, logEntry)
+	if shouldRetry { // 如果错误类型指示密钥可能有问题
+		markKeyFailure(c, currentOpenRouterKey, apimanager.KeyFailure{Source: apimanager.SourceRequest, ErrorType: errTypeStr, HTTPStatus: resp.StatusCode, Message: errStr}, resp.StatusCode)
+	}
+	return false, shouldRetry, errCode, errStr, errTypeStr
+}
+
+// requestDeadlineContextKey 是重试策略的请求截止时间在 gin.Context 中的键，未设置总时长上限时不存在。
+const requestDeadlineContextKey = "request_deadline"
+
+// firstTokenContextKey 是流式响应收到第一个有意义数据块的时间在 gin.Context 中的键。
+const firstTokenContextKey = "first_token_time"
+
+// recordKeyPerformance 记录一次尝试在密钥上的表现（成功率、首 token 延迟、输出速度）。
+// 不需要换密钥重试的失败（客户端请求错误、客户端断开等）与密钥无关，不计入统计。
+func recordKeyPerformance(c *gin.Context, key string, attemptStart time.Time, success, retryNeeded bool) {
+	if !success && !retryNeeded {
+		return
+	}
+	sample := apimanager.KeyPerfSample{Success: success, Duration: time.Since(attemptStart)}
+	if success {
+		sample.TTFT = sample.Duration // 非流式响应以完整响应时间作为首 token 延迟
+		if v, ok := c.Get(firstTokenContextKey); ok {
+			if firstToken, ok := v.(time.Time); ok && firstToken.After(attemptStart) {
+				sample.TTFT = firstToken.Sub(attemptStart)
+			}
+		}
+		if usage := middleware.ReportedUsage(c); usage != nil {
+			sample.OutputTokens = usage.CompletionTokens
+		}
+	}
+	ApiKeyMgr.RecordKeyPerformance(key, sample)
+}
+
+// markKeyFailure 将一次失败计入密钥。上游 5xx、超时等可能由模型引起的失败先计入模型健康统计，
+// 模型因此处于降级状态时归因于模型；网络错误、超时和 5xx 再计入上游熔断器，熔断器打开时归因于上游整体故障。
+// 这两种情况下失败都不计入密钥。
+func markKeyFailure(c *gin.Context, key string, failure apimanager.KeyFailure, statusCode int) {
+	if statusCode >= http.StatusInternalServerError && failure.ErrorType != "request_canceled_error" {
+		if failure.ErrorType != "network_error" {
+			model := c.GetString(requestModelContextKey)
+			if ModelHealth.RecordFailure(model, utils.SafeSuffix(key), failure.Message) {
+				requestLog(c).Warnf("markKeyFailure: 模型 %s 处于降级状态，密钥 %s 的本次失败 (%s) 不计入密钥。", model, utils.SafeSuffix(key), failure.ErrorType)
+				return
+			}
+		}
+		if UpstreamBreaker.RecordFailure(utils.SafeSuffix(key), failure.Message) {
+			requestLog(c).Warnf("markKeyFailure: 上游熔断器已打开，密钥 %s 的本次失败 (%s) 不计入密钥。", utils.SafeSuffix(key), failure.ErrorType)
+			return
+		}
+	}
+	ApiKeyMgr.MarkKeyFailure(key, failure)
+}
+
+// failKeyForRetry 将密钥标记为失败（原因记入密钥的状态变化历史，模型降级时不计入密钥），并返回需要换密钥重试的尝试结果。
+// 用于网络错误、超时等没有上游 HTTP 状态码的失败。
+func failKeyForRetry(c *gin.Context, key string, statusCode int, errDetail, errType string) (bool, bool, int, string, string) {
+	markKeyFailure(c, key, apimanager.KeyFailure{Source: apimanager.SourceRequest, ErrorType: errType, Message: errDetail}, statusCode)
+	return false, true, statusCode, errDetail, errType
+}
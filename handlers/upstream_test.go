@@ -0,0 +1,308 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"openrouter_polling/apimanager"
+	"openrouter_polling/circuitbreaker"
+	"openrouter_polling/config"
+	"openrouter_polling/middleware"
+	"openrouter_polling/modelhealth"
+	"openrouter_polling/models"
+	"openrouter_polling/retrypolicy"
+	"openrouter_polling/storage"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// stubUpstreamModel 是桩模型目录中唯一的模型，价格为每百万输入/输出 token 1/2 美元。
+const stubUpstreamModel = "test/model"
+
+// useStubUpstream 初始化执行上游请求所需的全部依赖：临时 SQLite 数据库、只包含 keys 的密钥池、
+// 熔断器、模型健康跟踪器与重试预算，并把所有 OpenRouter 地址指向 handler 提供的桩服务。
+// 重试退避缩短到毫秒级，测试结束后恢复所有全局状态。
+func useStubUpstream(t *testing.T, handler http.HandlerFunc, keys ...string) *gorm.DB {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatalf("打开测试数据库失败: %v", err)
+	}
+	if err := db.AutoMigrate(&storage.APIKey{}, &storage.StoredFile{}, &storage.Batch{}, &storage.BatchRequest{}, &storage.KeyEvent{}); err != nil {
+		t.Fatalf("迁移测试数据库失败: %v", err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	prevLog, prevKeyMgr, prevClient, prevCost, prevBatch, prevKeyEvents := Log, ApiKeyMgr, HttpClient, CostStore, BatchStore, KeyEventStore
+	prevHealth, prevBreaker, prevBudget, prevCatalog, prevSettings := ModelHealth, UpstreamBreaker, RetryBudget, modelCatalog, config.AppSettings
+	prevConfigLog, prevManagerLog, prevBreakerLog, prevBreakerKeys, prevHealthLog, prevMiddlewareLog := config.Log, apimanager.Log, circuitbreaker.Log, circuitbreaker.ApiKeyMgr, modelhealth.Log, middleware.Log
+	t.Cleanup(func() {
+		Log, ApiKeyMgr, HttpClient, CostStore, BatchStore, KeyEventStore = prevLog, prevKeyMgr, prevClient, prevCost, prevBatch, prevKeyEvents
+		ModelHealth, UpstreamBreaker, RetryBudget, modelCatalog, config.AppSettings = prevHealth, prevBreaker, prevBudget, prevCatalog, prevSettings
+		config.Log, apimanager.Log, circuitbreaker.Log, circuitbreaker.ApiKeyMgr, modelhealth.Log, middleware.Log = prevConfigLog, prevManagerLog, prevBreakerLog, prevBreakerKeys, prevHealthLog, prevMiddlewareLog
+	})
+
+	config.Init(logger)
+	config.AppSettings.OpenRouterAPIURL = server.URL + "/chat/completions"
+	config.AppSettings.OpenRouterCompletionsURL = server.URL + "/completions"
+	config.AppSettings.OpenRouterEmbeddingsURL = server.URL + "/embeddings"
+	config.AppSettings.OpenRouterModelsURL = server.URL + "/models"
+	config.AppSettings.OpenRouterGenerationURL = server.URL + "/generation"
+	config.AppSettings.RequestTimeout = 5 * time.Second
+	config.AppSettings.RetryBackoffBase = time.Millisecond
+	config.AppSettings.RetryBackoffMax = 5 * time.Millisecond
+	config.AppSettings.RetryDeadline = 0
+
+	Log, config.Log, apimanager.Log, circuitbreaker.Log, modelhealth.Log, middleware.Log = logger, logger, logger, logger, logger, logger
+	HttpClient = server.Client()
+	CostStore = nil // 费用在后台协程中累计，会比测试活得更久；需要费用的测试直接调用相关函数
+	BatchStore = storage.NewBatchStore(db)
+	KeyEventStore = storage.NewKeyEventStore(db)
+
+	if len(keys) == 0 {
+		keys = []string{"sk-or-v1-stub-upstream-key-0001"}
+	}
+	keyStore := storage.NewKeyStore(db)
+	for _, key := range keys {
+		if err := keyStore.AddKey(&storage.APIKey{Key: key, Weight: 1}); err != nil {
+			t.Fatalf("添加测试密钥失败: %v", err)
+		}
+	}
+	ApiKeyMgr = apimanager.NewApiKeyManager(logger, keyStore, KeyEventStore)
+	if err := ApiKeyMgr.LoadKeysFromDB(); err != nil {
+		t.Fatalf("加载测试密钥失败: %v", err)
+	}
+	circuitbreaker.ApiKeyMgr = ApiKeyMgr
+	ModelHealth = modelhealth.NewTracker()
+	UpstreamBreaker = circuitbreaker.NewBreaker()
+	RetryBudget = retrypolicy.NewBudget()
+
+	modelCatalog = &modelCatalogCache{models: make(map[string]models.OpenRouterModel)}
+	modelCatalog.store([]models.OpenRouterModel{{
+		ID:            stubUpstreamModel,
+		ContextLength: 8192,
+		Pricing:       &models.OpenRouterPricing{Prompt: "0.000001", Completion: "0.000002"},
+	}})
+	return db
+}
+
+// serveHandler 通过 gin 路由执行一个 JSON 请求并返回响应记录。
+func serveHandler(handler gin.HandlerFunc, route, target, body string) *httptest.ResponseRecorder {
+	router := gin.New()
+	router.POST(route, handler)
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestOpenBreakerSendsRetryAfterOnStreamingRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler gin.HandlerFunc
+		route   string
+		target  string
+		body    string
+	}{
+		{"chat", ChatCompletionsHandler, "/v1/chat/completions", "/v1/chat/completions",
+			`{"model":"` + stubUpstreamModel + `","stream":true,"messages":[{"role":"user","content":"hi"}]}`},
+		{"completions", CompletionsHandler, "/v1/completions", "/v1/completions",
+			`{"model":"` + stubUpstreamModel + `","stream":true,"prompt":"hi"}`},
+		{"anthropic", AnthropicMessagesHandler, "/v1/messages", "/v1/messages",
+			`{"model":"` + stubUpstreamModel + `","stream":true,"max_tokens":16,"messages":[{"role":"user","content":"hi"}]}`},
+		{"responses", ResponsesHandler, "/v1/responses", "/v1/responses",
+			`{"model":"` + stubUpstreamModel + `","stream":true,"store":false,"input":"hi"}`},
+		{"gemini", GeminiModelsHandler, "/v1beta/models/*modelAction", "/v1beta/models/" + stubUpstreamModel + ":streamGenerateContent?alt=sse",
+			`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			useStubUpstream(t, func(w http.ResponseWriter, r *http.Request) { calls.Add(1) })
+			if !UpstreamBreaker.RecordFailure("0001", "connection refused") {
+				t.Fatal("期望单个密钥的上游失败打开熔断器")
+			}
+
+			recorder := serveHandler(tt.handler, tt.route, tt.target, tt.body)
+			sent := recorder.Result().Header // 第一次写出时的头部快照
+			if retryAfter, err := strconv.Atoi(sent.Get("Retry-After")); err != nil || retryAfter < 1 {
+				t.Errorf("Retry-After = %q, 期望至少 1 秒", sent.Get("Retry-After"))
+			}
+			if !strings.HasPrefix(sent.Get("Content-Type"), "text/event-stream") {
+				t.Errorf("Content-Type = %q, 期望流式请求以 SSE 返回错误", sent.Get("Content-Type"))
+			}
+			if !strings.Contains(recorder.Body.String(), "熔断器") {
+				t.Errorf("响应体 = %q, 期望包含熔断错误", recorder.Body.String())
+			}
+			if got := calls.Load(); got != 0 {
+				t.Errorf("上游被请求了 %d 次, 期望熔断器打开时快速失败", got)
+			}
+		})
+	}
+}
+
+func TestBreakerProbeIsReleasedWhenRequestEndsUndecided(t *testing.T) {
+	useStubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":{"message":"invalid key","code":401}}`))
+	})
+	config.AppSettings.CircuitBreakerOpenDuration = 10 * time.Millisecond
+	UpstreamBreaker = circuitbreaker.NewBreaker()
+	UpstreamBreaker.RecordFailure("0001", "connection refused")
+	time.Sleep(15 * time.Millisecond)
+
+	// 探测请求遇到密钥错误（不计入熔断器），唯一的密钥进入冷却后请求失败。
+	recorder := serveHandler(ChatCompletionsHandler, "/v1/chat/completions", "/v1/chat/completions",
+		`{"model":"`+stubUpstreamModel+`","messages":[{"role":"user","content":"hi"}]}`)
+	if recorder.Code == http.StatusOK {
+		t.Fatalf("状态码 = %d, 期望请求失败", recorder.Code)
+	}
+	if allowed, _ := UpstreamBreaker.Allow(); !allowed {
+		t.Error("探测请求结束后期望立即放行下一个请求，而不是等待 REQUEST_TIMEOUT_SECONDS")
+	}
+}
+
+func TestQueueWaitHeaderReachesStreamingClients(t *testing.T) {
+	useStubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte(`data: {"id":"gen-1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"ok"}}]}` + "\n\n"))
+		_, _ = w.Write([]byte("data: [DONE]\n\n"))
+	})
+	config.AppSettings.KeyMaxConcurrentRequests = 1
+	config.AppSettings.RequestQueueMaxSize = 10
+	config.AppSettings.RequestQueueWaitLimit = 5 * time.Second
+
+	// 唯一的密钥被另一个请求占用，50ms 后释放。
+	held := ApiKeyMgr.GetNextAPIKey()
+	if held == nil {
+		t.Fatal("获取测试密钥失败")
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		releaseKey(held.Key)
+	}()
+
+	router := gin.New()
+	router.POST("/v1/chat/completions", ChatCompletionsHandler)
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"model":"`+stubUpstreamModel+`","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(queueMaxWaitHeader, "2")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+
+	sent := recorder.Result().Header // 第一次写出时的头部快照
+	if waited, err := strconv.Atoi(sent.Get(queueWaitHeader)); err != nil || waited < 40 {
+		t.Errorf("%s = %q, 期望记录约 50ms 的排队时间", queueWaitHeader, sent.Get(queueWaitHeader))
+	}
+	if !strings.HasPrefix(sent.Get("Content-Type"), "text/event-stream") {
+		t.Errorf("Content-Type = %q, 期望 SSE", sent.Get("Content-Type"))
+	}
+	if body := recorder.Body.String(); !strings.Contains(body, `"content":"ok"`) || !strings.Contains(body, "[DONE]") {
+		t.Errorf("响应体 = %q, 期望完整转发上游的流", body)
+	}
+}
+
+func TestDegradedModelIsReroutedToFallbackOnlyOnce(t *testing.T) {
+	tests := []struct {
+		name        string
+		preDegraded bool
+		wantPrimary int
+	}{
+		{"请求前已降级", true, 0},
+		{"请求过程中降级", false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			calls := make(map[string]int)
+			useStubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				var body struct {
+					Model string `json:"model"`
+				}
+				_ = json.NewDecoder(r.Body).Decode(&body)
+				mu.Lock()
+				calls[body.Model]++
+				mu.Unlock()
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadGateway)
+				_, _ = w.Write([]byte(`{"error":{"message":"model overloaded","code":502}}`))
+			}, "sk-or-v1-stub-upstream-key-0001", "sk-or-v1-stub-upstream-key-0002", "sk-or-v1-stub-upstream-key-0003")
+			// 每次失败都使模型立即降级；备用模型同样配置了备用模型，用于验证不会连续改用两次。
+			config.AppSettings.CircuitBreakerMinFailures = 0
+			config.AppSettings.ModelHealthErrorRateThreshold = 0.5
+			config.AppSettings.ModelHealthMinRequests = 1
+			config.AppSettings.ModelHealthMinKeys = 1
+			config.AppSettings.ModelFallbacks = stubUpstreamModel + "=fallback/a,fallback/a=fallback/b"
+			if tt.preDegraded && !ModelHealth.RecordFailure(stubUpstreamModel, "0009", "502 bad gateway") {
+				t.Fatal("期望模型降级")
+			}
+
+			recorder := serveHandler(ChatCompletionsHandler, "/v1/chat/completions", "/v1/chat/completions",
+				`{"model":"`+stubUpstreamModel+`","messages":[{"role":"user","content":"hi"}]}`)
+			if recorder.Code != http.StatusServiceUnavailable {
+				t.Errorf("状态码 = %d, 期望 503", recorder.Code)
+			}
+			if !strings.Contains(recorder.Body.String(), "model_degraded_error") {
+				t.Errorf("响应体 = %q, 期望 model_degraded_error", recorder.Body.String())
+			}
+			if got := recorder.Header().Get(fallbackModelHeader); got != "fallback/a" {
+				t.Errorf("%s = %q, 期望 fallback/a", fallbackModelHeader, got)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if calls[stubUpstreamModel] != tt.wantPrimary || calls["fallback/a"] != 1 || calls["fallback/b"] != 0 {
+				t.Errorf("上游请求次数 = %v, 期望原模型 %d 次、fallback/a 1 次、fallback/b 0 次", calls, tt.wantPrimary)
+			}
+		})
+	}
+}
+
+func TestRetryStopsWhenBackoffWouldPassDeadline(t *testing.T) {
+	var calls atomic.Int32
+	useStubUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"error":{"message":"rate limited","code":429}}`))
+	}, "sk-or-v1-stub-upstream-key-0001", "sk-or-v1-stub-upstream-key-0002", "sk-or-v1-stub-upstream-key-0003", "sk-or-v1-stub-upstream-key-0004")
+	// 每次重试前固定等待 100ms，总时长上限 150ms：第二次尝试后再等待就会超过截止时间。
+	config.AppSettings.RetryWithNewKeyCount = 10
+	config.AppSettings.RetryBackoffBase = 100 * time.Millisecond
+	config.AppSettings.RetryBackoffMax = 100 * time.Millisecond
+	config.AppSettings.RetryBackoffJitter = 0
+	config.AppSettings.RetryDeadline = 150 * time.Millisecond
+	config.AppSettings.RetryBudgetRatio = 0
+
+	start := time.Now()
+	recorder := serveHandler(ChatCompletionsHandler, "/v1/chat/completions", "/v1/chat/completions",
+		`{"model":"`+stubUpstreamModel+`","messages":[{"role":"user","content":"hi"}]}`)
+	elapsed := time.Since(start)
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("状态码 = %d, 期望返回最后一次上游错误 429", recorder.Code)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("上游被请求了 %d 次, 期望截止时间前只尝试 2 次", got)
+	}
+	if elapsed > time.Second {
+		t.Errorf("请求耗时 %v, 期望在截止时间附近结束", elapsed)
+	}
+}
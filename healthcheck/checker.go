@@ -4,7 +4,9 @@ import (
 	"context"
 	"io"
 	"net/http"
+	"openrouter_polling/alerting"
 	"openrouter_polling/apimanager"
+	"openrouter_polling/circuitbreaker"
 	"openrouter_polling/config"
 	"openrouter_polling/utils"
 	"strings"
@@ -16,6 +18,8 @@ import (
 var (
 	Log       *logrus.Logger
 	ApiKeyMgr *apimanager.ApiKeyManager
+	Alerts    *alerting.Manager       // 可为 nil，每个检查周期结束时报告本周期失败的密钥
+	Breaker   *circuitbreaker.Breaker // 上游熔断器，打开期间跳过健康检查，避免上游故障时密钥被误判失败
 )
 
 func PerformPeriodicHealthChecks(ctx context.Context) {
@@ -38,12 +42,17 @@ func PerformPeriodicHealthChecks(ctx context.Context) {
 			return
 		case <-ticker.C:
 			Log.Debug("健康检查: 运行计划中的 API 密钥健康检查周期...")
+			if Breaker.IsOpen() {
+				Log.Info("健康检查: 上游熔断器处于打开状态，跳过本周期的健康检查。")
+				continue
+			}
 
 			// 从管理器获取内存中密钥状态的快照
 			keysToCheckSnapshot := ApiKeyMgr.GetCachedKeys()
 
 			if len(keysToCheckSnapshot) == 0 {
 				Log.Debug("健康检查: 当前没有需要主动检查的密钥。")
+				Alerts.RecordHealthCheckCycle(nil)
 				continue
 			}
 			Log.Debugf("健康检查: 快照中包含 %d 个候选密钥，将逐个评估其当前状态。", len(keysToCheckSnapshot))
@@ -53,9 +62,10 @@ func PerformPeriodicHealthChecks(ctx context.Context) {
 			}
 
 			checkedCount := 0
+			var failedSuffixes []string // 本周期检查失败（被标记失败）的密钥后缀
 			for _, ks := range keysToCheckSnapshot {
-				// 确定是否需要对当前密钥进行主动健康检查
-				isCandidateForCheck := !ks.IsActive || ks.FailureCount > 0
+				// 确定是否需要对当前密钥进行主动健康检查（管理员停用的密钥不检查）
+				isCandidateForCheck := !ks.Disabled && (!ks.IsActive || ks.FailureCount > 0)
 				if !isCandidateForCheck {
 					continue
 				}
@@ -81,7 +91,8 @@ func PerformPeriodicHealthChecks(ctx context.Context) {
 					Log.Warnf("健康检查: 密钥 %s 的请求失败: %v。", utils.SafeSuffix(ks.Key), err)
 					if hcCtx.Err() == context.DeadlineExceeded || (err != nil && (strings.Contains(strings.ToLower(err.Error()), "timeout") || strings.Contains(strings.ToLower(err.Error()), "deadline exceeded"))) {
 						Log.Warnf("健康检查: 密钥 %s 因超时失败。", utils.SafeSuffix(ks.Key))
-						ApiKeyMgr.MarkKeyFailure(ks.Key)
+						ApiKeyMgr.MarkKeyFailure(ks.Key, apimanager.KeyFailure{Source: apimanager.SourceHealthCheck, ErrorType: "health_check_timeout", Message: err.Error()})
+						failedSuffixes = append(failedSuffixes, utils.SafeSuffix(ks.Key))
 					}
 					continue
 				}
@@ -91,12 +102,13 @@ func PerformPeriodicHealthChecks(ctx context.Context) {
 
 				if resp.StatusCode == http.StatusOK {
 					Log.Infof("健康检查: 密钥 %s 通过健康检查 (状态 %d)。", utils.SafeSuffix(ks.Key), resp.StatusCode)
-					ApiKeyMgr.RecordKeySuccess(ks.Key)
+					ApiKeyMgr.RecordHealthCheckPass(ks.Key)
 				} else if resp.StatusCode == http.StatusUnauthorized ||
 					resp.StatusCode == http.StatusForbidden ||
 					resp.StatusCode == http.StatusTooManyRequests {
 					Log.Warnf("健康检查: 密钥 %s 验证失败，返回状态 %d。", utils.SafeSuffix(ks.Key), resp.StatusCode)
-					ApiKeyMgr.MarkKeyFailure(ks.Key)
+					ApiKeyMgr.MarkKeyFailure(ks.Key, apimanager.KeyFailure{Source: apimanager.SourceHealthCheck, ErrorType: "health_check_status_error", HTTPStatus: resp.StatusCode})
+					failedSuffixes = append(failedSuffixes, utils.SafeSuffix(ks.Key))
 				} else {
 					Log.Warnf("健康检查: 密钥 %s 的请求返回非预期状态 %d。健康检查暂不改变其状态。",
 						utils.SafeSuffix(ks.Key), resp.StatusCode)
@@ -107,6 +119,7 @@ func PerformPeriodicHealthChecks(ctx context.Context) {
 			} else {
 				Log.Debug("健康检查: 本周期没有密钥符合主动检查的条件。")
 			}
+			Alerts.RecordHealthCheckCycle(failedSuffixes)
 			Log.Debug("健康检查: API 密钥健康检查周期完成。")
 		}
 	}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,12 +15,18 @@ import (
 	"syscall"
 	"time"
 
+	"openrouter_polling/alerting"
 	"openrouter_polling/apimanager"
+	"openrouter_polling/circuitbreaker"
 	"openrouter_polling/config"
 	"openrouter_polling/handlers"
 	"openrouter_polling/healthcheck"
 	"openrouter_polling/middleware"
+	"openrouter_polling/modelhealth"
+	"openrouter_polling/retrypolicy"
 	"openrouter_polling/storage"
+	"openrouter_polling/tracing"
+	"openrouter_polling/utils"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/sessions"
@@ -49,6 +57,7 @@ func main() {
 	} else {
 		log.Warnf("无效的 LOG_LEVEL 配置 '%s', 将使用默认 Info 级别。", config.AppSettings.LogLevel)
 	}
+	logOutput := configureLogOutput()
 	log.Infof("日志级别已设置为: %s", log.GetLevel().String())
 
 	if config.AppSettings.AdminPassword == "" {
@@ -91,11 +100,58 @@ func main() {
 	middleware.Log = log
 	handlers.Log = log
 	healthcheck.Log = log
+	tracing.Log = log
+	alerting.Log = log
+	modelhealth.Log = log
+	circuitbreaker.Log = log
+
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		log.Fatalf("分布式追踪初始化失败: %v", err)
+	}
 
 	keyStore := storage.NewKeyStore(db)
-	apiKeyMgr = apimanager.NewApiKeyManager(log, keyStore)
+	handlers.RespStore = storage.NewResponseStore(db)
+	handlers.CostStore = storage.NewCostStore(db)
+	handlers.GenerationStore = storage.NewGenerationStore(db)
+	handlers.JobStore = storage.NewJobStore(db)
+	handlers.BatchStore = storage.NewBatchStore(db)
+	if config.AppSettings.PayloadCaptureSampleRate > 0 || strings.TrimSpace(config.AppSettings.PayloadCaptureClients) != "" {
+		if config.AppSettings.PayloadCaptureStore == config.PayloadCaptureStoreDisk {
+			fileCaptureStore, err := storage.NewFileCaptureStore(config.AppSettings.PayloadCaptureDir)
+			if err != nil {
+				log.Fatalf("无法创建请求内容捕获目录 %s: %v", config.AppSettings.PayloadCaptureDir, err)
+			}
+			handlers.CaptureStore = fileCaptureStore
+		} else {
+			handlers.CaptureStore = storage.NewCaptureStore(db)
+		}
+		if err := handlers.InitPayloadRedaction(); err != nil {
+			log.Fatalf("请求内容捕获的脱敏规则无效: %v", err)
+		}
+	}
+	if config.AppSettings.RateLimitStore == config.RateLimitStoreDB {
+		middleware.RateLimitBackend = storage.NewRateLimitStore(db)
+		log.Info("客户端限流状态将保存在数据库中，多个实例共享限额。")
+	}
+	keyEventStore := storage.NewKeyEventStore(db)
+	handlers.KeyEventStore = keyEventStore
+	apiKeyMgr = apimanager.NewApiKeyManager(log, keyStore, keyEventStore)
 	handlers.ApiKeyMgr = apiKeyMgr
 	healthcheck.ApiKeyMgr = apiKeyMgr
+	alerting.ApiKeyMgr = apiKeyMgr
+	alertMgr := alerting.NewManager() // 未配置任何通知渠道时为 nil，即不启用告警
+	handlers.Alerts = alertMgr
+	handlers.ModelHealth = modelhealth.NewTracker()
+	circuitbreaker.ApiKeyMgr = apiKeyMgr
+	upstreamBreaker := circuitbreaker.NewBreaker()
+	handlers.UpstreamBreaker = upstreamBreaker
+	healthcheck.Breaker = upstreamBreaker
+	if _, err := retrypolicy.ParseOverrides(config.AppSettings.RetryPolicyModels); err != nil {
+		log.Fatalf("按模型的重试策略配置无效: %v", err)
+	}
+	handlers.RetryBudget = retrypolicy.NewBudget()
+	healthcheck.Alerts = alertMgr
 
 	httpClient = &http.Client{
 		Timeout: config.AppSettings.RequestTimeout,
@@ -121,6 +177,16 @@ func main() {
 	healthCheckCtx, healthCheckCancelFunc := context.WithCancel(context.Background())
 	go healthcheck.PerformPeriodicHealthChecks(healthCheckCtx)
 	log.Info("API 密钥管理器已初始化，定期健康检查任务已启动。")
+	if config.AppSettings.GenerationStatsEnabled {
+		handlers.RunGenerationStatsWorker(healthCheckCtx)
+	}
+	handlers.RunJobWorkers(healthCheckCtx)
+	handlers.RunBatchWorkers(healthCheckCtx)
+	handlers.RunPayloadCaptureCleanup(healthCheckCtx)
+	handlers.RunKeyEventCleanup(healthCheckCtx)
+	handlers.RunResponseCleanup(healthCheckCtx)
+	handlers.RunIdempotencyCleanup(healthCheckCtx)
+	go alertMgr.Run(healthCheckCtx)
 
 	// 8. 设置 Gin 路由器
 	if strings.ToLower(config.AppSettings.GinMode) == "release" {
@@ -132,19 +198,9 @@ func main() {
 	}
 
 	router := gin.New()
-	router.Use(gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
-		return fmt.Sprintf("%s | %s | %3d | %13v | %15s | %-7s %#v %s\n%s",
-			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
-			param.Request.Proto,
-			param.StatusCode,
-			param.Latency,
-			param.ClientIP,
-			param.Method,
-			param.Path,
-			param.Request.UserAgent(),
-			param.ErrorMessage,
-		)
-	}))
+	router.Use(middleware.AssignRequestID()) // 在访问日志之前分配请求 ID，所有日志和错误响应体均携带此 ID
+	router.Use(middleware.Trace())           // 服务端 span（未配置 OTEL_EXPORTER_OTLP_ENDPOINT 时为空操作）
+	router.Use(gin.LoggerWithConfig(gin.LoggerConfig{Output: logOutput, Formatter: accessLogFormatter()}))
 	router.Use(gin.Recovery())
 
 	templatesPath := filepath.Join("static", "*.html")
@@ -153,15 +209,46 @@ func main() {
 
 	// --- API 路由 (/v1) ---
 	v1Group := router.Group("/v1")
-	if config.AppSettings.AppAPIKey != "" {
+	if config.ClientAuthEnabled() {
 		v1Group.Use(middleware.VerifyAPIKey())
-		log.Info("'/v1/*' 路由组已启用 API 密钥认证 (APP_API_KEY)。")
+		log.Info("'/v1/*' 路由组已启用 API 密钥认证 (APP_API_KEY / CLIENT_API_KEYS)。")
 	} else {
-		log.Warn("警告: '/v1/*' 路由组未配置 API 密钥认证 (APP_API_KEY 未设置)。任何客户端都可访问。")
+		log.Warn("警告: '/v1/*' 路由组未配置 API 密钥认证 (APP_API_KEY 和 CLIENT_API_KEYS 均未设置)。任何客户端都可访问。")
 	}
+	v1Group.Use(middleware.RateLimit()) // 未配置 RPM/TPM 限额的客户端直接放行
 	{
 		v1Group.GET("/models", handlers.ListModelsHandler)
 		v1Group.POST("/chat/completions", handlers.ChatCompletionsHandler)
+		v1Group.POST("/completions", handlers.CompletionsHandler)
+		v1Group.POST("/embeddings", handlers.EmbeddingsHandler)
+		v1Group.POST("/messages", handlers.AnthropicMessagesHandler)
+		v1Group.POST("/messages/count_tokens", handlers.AnthropicCountTokensHandler)
+		v1Group.POST("/responses", handlers.ResponsesHandler)
+		v1Group.GET("/responses/:id", handlers.GetResponseHandler)
+		v1Group.DELETE("/responses/:id", handlers.DeleteResponseHandler)
+		v1Group.GET("/streams/:token", handlers.ResumeStreamHandler)
+		v1Group.POST("/jobs", handlers.CreateJobHandler)
+		v1Group.GET("/jobs/:id", handlers.GetJobHandler)
+		v1Group.POST("/files", handlers.UploadFileHandler)
+		v1Group.GET("/files", handlers.ListFilesHandler)
+		v1Group.GET("/files/:id", handlers.GetFileHandler)
+		v1Group.GET("/files/:id/content", handlers.GetFileContentHandler)
+		v1Group.DELETE("/files/:id", handlers.DeleteFileHandler)
+		v1Group.POST("/batches", handlers.CreateBatchHandler)
+		v1Group.GET("/batches", handlers.ListBatchesHandler)
+		v1Group.GET("/batches/:id", handlers.GetBatchHandler)
+		v1Group.POST("/batches/:id/cancel", handlers.CancelBatchHandler)
+	}
+
+	// --- Gemini 兼容路由 (/v1beta) ---
+	// 与 /v1 使用相同的客户端认证；Gemini SDK 通过 x-goog-api-key 头部或 ?key= 查询参数传递密钥（?key= 只在此路由组接受）。
+	v1betaGroup := router.Group("/v1beta")
+	if config.ClientAuthEnabled() {
+		v1betaGroup.Use(middleware.VerifyGeminiAPIKey())
+	}
+	v1betaGroup.Use(middleware.RateLimit())
+	{
+		v1betaGroup.POST("/models/*modelAction", handlers.GeminiModelsHandler)
 	}
 
 	// --- 管理员路由 (/admin) ---
@@ -176,16 +263,35 @@ func main() {
 			authorizedAdminGroup.GET("/dashboard", handlers.DashboardHandler)
 			authorizedAdminGroup.POST("/logout", handlers.LogoutHandler)
 			authorizedAdminGroup.GET("/key-status", handlers.GetKeyStatusesHandler)
+			authorizedAdminGroup.GET("/events", handlers.AdminEventsHandler) // 密钥状态的实时事件流 (SSE)
 			authorizedAdminGroup.POST("/session/heartbeat", handlers.SessionHeartbeatHandler)
 			authorizedAdminGroup.POST("/add-keys", handlers.AddKeysHandler)
 			authorizedAdminGroup.DELETE("/delete-key/:suffix", handlers.DeleteOpenRouterKeyHandler)
 			authorizedAdminGroup.POST("/delete-keys-batch", handlers.DeleteKeysBatchHandler) // 【新增】批量删除路由
 			authorizedAdminGroup.POST("/reload-keys", handlers.ReloadOpenRouterKeysHandler)
+			authorizedAdminGroup.GET("/keys/:suffix/events", handlers.KeyEventsHandler) // 密钥状态变化历史
+			authorizedAdminGroup.POST("/keys/:suffix/enable", handlers.EnableKeyHandler)
+			authorizedAdminGroup.POST("/keys/:suffix/disable", handlers.DisableKeyHandler)
+			authorizedAdminGroup.POST("/keys/:suffix/weight", handlers.UpdateKeyWeightHandler)
 			authorizedAdminGroup.GET("/app-status", handlers.AppStatusHandler)
+			authorizedAdminGroup.GET("/models/health", handlers.ModelHealthHandler) // 各模型的错误率与降级状态
 			// 【新增】设置页面路由
 			authorizedAdminGroup.GET("/settings-page", handlers.SettingsPageHandler)
 			authorizedAdminGroup.GET("/settings", handlers.GetSettingsHandler)
 			authorizedAdminGroup.POST("/settings", handlers.UpdateSettingsHandler)
+			// 费用报表与客户端预算
+			authorizedAdminGroup.GET("/costs", handlers.CostReportHandler)
+			authorizedAdminGroup.GET("/budgets", handlers.ListBudgetsHandler)
+			authorizedAdminGroup.POST("/budgets", handlers.SaveBudgetHandler)
+			authorizedAdminGroup.DELETE("/budgets/:client_id", handlers.DeleteBudgetHandler)
+			// 上游生成统计
+			authorizedAdminGroup.GET("/generations", handlers.ListGenerationsHandler)
+			authorizedAdminGroup.GET("/generations/:id", handlers.GetGenerationHandler)
+			// 请求内容捕获
+			authorizedAdminGroup.GET("/captures/:request_id", handlers.GetPayloadCaptureHandler)
+			// 告警通知
+			authorizedAdminGroup.GET("/alerts", handlers.ListAlertsHandler)
+			authorizedAdminGroup.POST("/alerts/test", handlers.TestAlertHandler)
 		}
 	}
 	log.Info("所有应用路由已设置完成。")
@@ -227,6 +333,80 @@ func main() {
 	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.Fatalf("服务器优雅关闭失败: %v", err)
 	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Warnf("导出剩余追踪数据失败: %v", err)
+	}
 
 	log.Println("服务器已成功优雅关闭。")
 }
+
+// configureLogOutput 按 LOG_FORMAT 设置日志格式，并在配置了 LOG_FILE 时同时写入按大小轮转的日志文件。
+// 返回的 writer 同时供 gin 的访问日志使用，使两者输出到相同的位置。
+func configureLogOutput() io.Writer {
+	switch config.AppSettings.LogFormat {
+	case config.LogFormatJSON:
+		log.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	case config.LogFormatText:
+	default:
+		log.Warnf("无效的 LOG_FORMAT 配置 '%s'，将使用 text 格式。", config.AppSettings.LogFormat)
+	}
+
+	var output io.Writer = os.Stdout
+	if config.AppSettings.LogFile != "" {
+		file, err := utils.NewRotatingFile(config.AppSettings.LogFile, config.AppSettings.LogMaxSizeBytes, config.AppSettings.LogMaxBackups)
+		if err != nil {
+			log.Fatalf("无法打开日志文件 '%s': %v", config.AppSettings.LogFile, err)
+		}
+		output = io.MultiWriter(os.Stdout, file)
+		log.Infof("日志将同时写入文件 '%s' (单个文件上限 %d MB，保留 %d 个旧文件)。",
+			config.AppSettings.LogFile, config.AppSettings.LogMaxSizeBytes>>20, config.AppSettings.LogMaxBackups)
+	}
+	log.SetOutput(output)
+	gin.DefaultWriter = output
+	gin.DefaultErrorWriter = output
+	return output
+}
+
+// accessLogFormatter 返回 gin 访问日志的格式化函数：LOG_FORMAT=json 时每个请求输出一行 JSON（含 request_id），
+// 否则保持原有的文本格式。
+func accessLogFormatter() gin.LogFormatter {
+	if config.AppSettings.LogFormat != config.LogFormatJSON {
+		return func(param gin.LogFormatterParams) string {
+			return fmt.Sprintf("%s | %s | %3d | %13v | %15s | %-7s %#v %s\n%s",
+				param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+				param.Request.Proto,
+				param.StatusCode,
+				param.Latency,
+				param.ClientIP,
+				param.Method,
+				middleware.RedactAPIKeyQuery(param.Path), // 隐藏 ?key= 形式传入的客户端令牌
+				param.Request.UserAgent(),
+				param.ErrorMessage,
+			)
+		}
+	}
+	return func(param gin.LogFormatterParams) string {
+		entry := map[string]interface{}{
+			"time":       param.TimeStamp.Format(time.RFC3339Nano),
+			"level":      "info",
+			"msg":        "access",
+			"request_id": param.Keys[middleware.RequestIDContextKey],
+			"status":     param.StatusCode,
+			"latency_ms": float64(param.Latency.Microseconds()) / 1000,
+			"client_ip":  param.ClientIP,
+			"method":     param.Method,
+			"path":       middleware.RedactAPIKeyQuery(param.Path),
+			"proto":      param.Request.Proto,
+			"user_agent": param.Request.UserAgent(),
+			"bytes":      param.BodySize,
+		}
+		if clientID, ok := param.Keys[middleware.ClientIDContextKey]; ok {
+			entry["client"] = clientID
+		}
+		if param.ErrorMessage != "" {
+			entry["error"] = strings.TrimSpace(param.ErrorMessage)
+		}
+		line, _ := json.Marshal(entry)
+		return string(line) + "\n"
+	}
+}
@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"net/http"
+	"net/url"
 	"openrouter_polling/config" // 项目配置包
 	"openrouter_polling/models" // 项目模型包，包含 ErrorResponse 等
 	"strings"                   // 用于字符串操作
@@ -13,56 +14,115 @@ import (
 // Log 是一个包级变量，用于日志记录。它应该由外部（例如 main.go）设置。
 var Log *logrus.Logger
 
+// ClientIDContextKey 是认证通过后客户端名称在 gin.Context 中的键。
+const ClientIDContextKey = "client_id"
+
+// 缺少 Authorization 头部时可接受的其他客户端凭据来源。
+const (
+	AnthropicAPIKeyHeader  = "x-api-key"      // Anthropic SDK 使用的认证头部
+	GoogleAPIKeyHeader     = "x-goog-api-key" // Gemini SDK 使用的认证头部
+	GoogleAPIKeyQueryParam = "key"            // Gemini REST 风格的 ?key= 查询参数
+)
+
 // VerifyAPIKey 是一个 Gin 中间件，用于验证访问 `/v1/*` API 端点的客户端请求。
-// 它检查 Authorization 头部是否包含有效的 Bearer Token，该 Token 必须与配置中的 `AppAPIKey` 匹配。
-// 如果 `config.AppSettings.AppAPIKey` 为空，则此中间件应被视为禁用（在 `main.go` 中控制是否应用）。
+// 它检查 Authorization 头部（或 x-api-key、x-goog-api-key 头部）是否包含有效的 Bearer Token，该 Token 必须与配置中的 `AppAPIKey`
+// 或 `ClientAPIKeys` 中的某个客户端令牌匹配。验证通过后，客户端名称会写入上下文（见 ClientID）。
+// 如果两者均未配置，则此中间件应被视为禁用（在 `main.go` 中控制是否应用）。
 func VerifyAPIKey() gin.HandlerFunc {
+	return verifyAPIKey(false)
+}
+
+// VerifyGeminiAPIKey 与 VerifyAPIKey 相同，但额外接受 Gemini REST 风格的 ?key= 查询参数，只用于 `/v1beta` 路由组。
+// 查询参数容易出现在代理日志、浏览器历史等位置，因此其他路由不接受这种方式。
+func VerifyGeminiAPIKey() gin.HandlerFunc {
+	return verifyAPIKey(true)
+}
+
+// verifyAPIKey 构造认证中间件。allowQueryKey 为 true 时接受 ?key= 查询参数。
+func verifyAPIKey(allowQueryKey bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// AppAPIKey 的配置检查应在 main.go 中决定是否实际应用此中间件。
-		// 如果 AppAPIKey 未配置，此中间件根本不应该被注册到路由上。
-		// 因此，这里假设如果中间件被调用，AppAPIKey 就是被配置了且需要验证。
-		if config.AppSettings.AppAPIKey == "" {
-			// 此情况理论上不应发生，因为 main.go 中会根据 AppAPIKey 是否配置来决定是否使用此中间件。
-			// 但作为防御性编程，如果意外执行到这里且 AppAPIKey 为空，则认为配置错误，允许请求通过并记录警告。
-			// 或者，更严格的做法是直接拒绝请求。为了安全，我们选择拒绝。
-			Log.Error("VerifyAPIKey 中间件被调用，但 AppAPIKey 未配置。拒绝请求。")
-			c.AbortWithStatusJSON(http.StatusInternalServerError, models.ErrorResponse{
-				Error: models.ErrorDetail{Message: "服务配置错误，无法验证API密钥", Type: "server_error", Code: "config_error_app_api_key_missing"},
-			})
+		// 客户端凭据的配置检查应在 main.go 中决定是否实际应用此中间件。
+		// 如果未配置任何凭据，此中间件根本不应该被注册到路由上。
+		// 因此，这里假设如果中间件被调用，凭据就是被配置了且需要验证。
+		if !config.ClientAuthEnabled() {
+			// 此情况理论上不应发生，因为 main.go 中会根据凭据是否配置来决定是否使用此中间件。
+			// 但作为防御性编程，如果意外执行到这里且凭据为空，则认为配置错误。为了安全，我们选择拒绝。
+			Log.Error("VerifyAPIKey 中间件被调用，但 AppAPIKey/ClientAPIKeys 均未配置。拒绝请求。")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, errorResponse(c, models.ErrorDetail{Message: "服务配置错误，无法验证API密钥", Type: "server_error", Code: "config_error_app_api_key_missing"}))
 			return
 		}
 
 		authHeader := c.GetHeader("Authorization")
+		token := ""
 		if authHeader == "" {
-			Log.Warn("VerifyAPIKey: 请求缺少 Authorization 头部。")
-			c.AbortWithStatusJSON(http.StatusUnauthorized, models.ErrorResponse{
-				Error: models.ErrorDetail{Message: "需要提供 API 密钥才能访问此服务。", Type: "authentication_error", Code: "missing_api_key"},
-			})
-			return
+			// Anthropic、Gemini 风格的客户端通过各自的头部或查询参数传递密钥，这里将其视作与 Bearer Token 等价。
+			token = alternativeClientToken(c, allowQueryKey)
+			if token == "" {
+				Log.Warn("VerifyAPIKey: 请求缺少 Authorization 头部。")
+				c.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse(c, models.ErrorDetail{Message: "需要提供 API 密钥才能访问此服务。", Type: "authentication_error", Code: "missing_api_key"}))
+				return
+			}
+		} else {
+			parts := strings.SplitN(authHeader, " ", 2) // 按空格分割，最多两部分
+			// 检查格式是否为 "Bearer <token>"
+			if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || strings.TrimSpace(parts[1]) == "" {
+				Log.Warnf("VerifyAPIKey: Authorization 头部格式无效。收到: '%s'", authHeader)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse(c, models.ErrorDetail{Message: "无效的授权方案或令牌缺失。请使用 'Bearer <token>' 格式。", Type: "authentication_error", Code: "invalid_auth_scheme"}))
+				return
+			}
+			token = parts[1]
 		}
 
-		parts := strings.SplitN(authHeader, " ", 2) // 按空格分割，最多两部分
-		// 检查格式是否为 "Bearer <token>"
-		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || strings.TrimSpace(parts[1]) == "" {
-			Log.Warnf("VerifyAPIKey: Authorization 头部格式无效。收到: '%s'", authHeader)
-			c.AbortWithStatusJSON(http.StatusUnauthorized, models.ErrorResponse{
-				Error: models.ErrorDetail{Message: "无效的授权方案或令牌缺失。请使用 'Bearer <token>' 格式。", Type: "authentication_error", Code: "invalid_auth_scheme"},
-			})
+		// 将提供的 token 解析为已配置的客户端
+		clientName, ok := config.ClientNameForToken(token)
+		if !ok {
+			Log.Warnf("VerifyAPIKey: 无效的服务 API 密钥。收到 token 后缀: ...%s", safeSuffixForLog(token, 6)) // 日志中显示密钥末尾几位
+			c.AbortWithStatusJSON(http.StatusUnauthorized, errorResponse(c, models.ErrorDetail{Message: "提供的 API 密钥无效。", Type: "authentication_error", Code: "invalid_api_key"}))
 			return
 		}
 
-		// 比较提供的 token 和配置的 AppAPIKey
-		if parts[1] != config.AppSettings.AppAPIKey {
-			Log.Warnf("VerifyAPIKey: 无效的服务 API 密钥。收到 token 后缀: ...%s", safeSuffixForLog(parts[1], 6)) // 日志中显示密钥末尾几位
-			c.AbortWithStatusJSON(http.StatusUnauthorized, models.ErrorResponse{
-				Error: models.ErrorDetail{Message: "提供的 API 密钥无效。", Type: "authentication_error", Code: "invalid_api_key"},
-			})
-			return
+		c.Set(ClientIDContextKey, clientName)
+		Log.Debugf("VerifyAPIKey: 服务 API 密钥验证成功 (客户端: %s)。", clientName)
+		c.Next() // 验证通过，继续处理请求
+	}
+}
+
+// alternativeClientToken 按 x-api-key、x-goog-api-key、?key=（仅当 allowQueryKey 为 true 时）的顺序查找客户端令牌。
+func alternativeClientToken(c *gin.Context, allowQueryKey bool) string {
+	for _, header := range []string{AnthropicAPIKeyHeader, GoogleAPIKeyHeader} {
+		if token := strings.TrimSpace(c.GetHeader(header)); token != "" {
+			return token
 		}
+	}
+	if !allowQueryKey {
+		return ""
+	}
+	return strings.TrimSpace(c.Query(GoogleAPIKeyQueryParam))
+}
 
-		Log.Debug("VerifyAPIKey: 服务 API 密钥验证成功。")
-		c.Next() // 验证通过，继续处理请求
+// RedactAPIKeyQuery 将请求路径中 ?key= 查询参数的值替换为 REDACTED，用于访问日志，避免客户端令牌被明文记录。
+func RedactAPIKeyQuery(path string) string {
+	idx := strings.IndexByte(path, '?')
+	if idx < 0 {
+		return path
+	}
+	query, err := url.ParseQuery(path[idx+1:])
+	if err != nil || !query.Has(GoogleAPIKeyQueryParam) {
+		return path
+	}
+	query.Set(GoogleAPIKeyQueryParam, "REDACTED")
+	return path[:idx+1] + query.Encode()
+}
+
+// ClientID 返回当前请求经认证后的客户端名称。
+// 如果 /v1 未启用认证（没有经过 VerifyAPIKey），则返回 config.AnonymousClientName。
+func ClientID(c *gin.Context) string {
+	if v, ok := c.Get(ClientIDContextKey); ok {
+		if name, ok := v.(string); ok && name != "" {
+			return name
+		}
 	}
+	return config.AnonymousClientName
 }
 
 // safeSuffixForLog 是一个内部辅助函数，用于安全地获取字符串的末尾部分以用于日志记录。
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"openrouter_polling/config"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+func TestQueryKeyOnlyAcceptedForGeminiRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	prevSettings, prevLog := config.AppSettings, Log
+	t.Cleanup(func() { config.AppSettings, Log = prevSettings, prevLog })
+	config.AppSettings.AppAPIKey = ""
+	config.AppSettings.ClientAPIKeys = "alice:secret-token"
+	Log = logrus.New()
+	Log.SetOutput(io.Discard)
+
+	router := gin.New()
+	ok := func(c *gin.Context) { c.String(http.StatusOK, ClientID(c)) }
+	router.POST("/v1/chat/completions", VerifyAPIKey(), ok)
+	router.POST("/v1beta/models/*modelAction", VerifyGeminiAPIKey(), ok)
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		want   int
+	}{
+		{"v1 拒绝查询参数", "/v1/chat/completions?key=secret-token", "", http.StatusUnauthorized},
+		{"v1 接受 x-goog-api-key 头部", "/v1/chat/completions", "secret-token", http.StatusOK},
+		{"v1beta 接受查询参数", "/v1beta/models/m:generateContent?key=secret-token", "", http.StatusOK},
+		{"v1beta 拒绝无效的查询参数", "/v1beta/models/m:generateContent?key=wrong", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+		if tt.header != "" {
+			req.Header.Set(GoogleAPIKeyHeader, tt.header)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		if recorder.Code != tt.want {
+			t.Errorf("%s: 状态码 = %d, 期望 %d (响应 %s)", tt.name, recorder.Code, tt.want, recorder.Body.String())
+		}
+	}
+}
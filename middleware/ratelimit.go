@@ -0,0 +1,266 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"openrouter_polling/config"
+	"openrouter_polling/models"
+	"openrouter_polling/utils"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UsageContextKey 是处理器记录上游报告的 token 用量在 gin.Context 中的键（值类型为 *models.Usage）。
+const UsageContextKey = "upstream_usage"
+
+// maxTokenEstimateBodyBytes 是预扣 TPM 时为估算 token 数读取的请求体大小上限，超出时返回 413。
+const maxTokenEstimateBodyBytes = 32 << 20
+
+// tokenEstimatedRoutes 是按请求体估算输入 token 数的路由（补全类 JSON 端点）。
+// 其他路由（例如 multipart 上传的 /v1/files）不读取请求体，只计入 RPM，TPM 按上游报告的用量结算。
+var tokenEstimatedRoutes = map[string]bool{
+	"/v1/chat/completions":        true,
+	"/v1/completions":             true,
+	"/v1/embeddings":              true,
+	"/v1/messages":                true,
+	"/v1/responses":               true,
+	"/v1/jobs":                    true,
+	"/v1beta/models/*modelAction": true,
+}
+
+// 令牌桶维度
+const (
+	rateLimitDimensionRequests = "requests"
+	rateLimitDimensionTokens   = "tokens"
+)
+
+// RateLimitBucketStore 提供令牌桶状态的原子读-改-写。
+// update 接收当前令牌数和上次补充时间（桶不存在时 updatedAt 为零值），返回新的令牌数和补充时间；
+// 在存在并发冲突的实现中，update 可能被调用多次，因此它必须是无副作用的纯计算。
+type RateLimitBucketStore interface {
+	UpdateBucket(clientID, dimension string, update func(tokens float64, updatedAt time.Time) (float64, time.Time)) error
+}
+
+// RateLimitBackend 是限流状态的存储后端。默认保存在进程内存中；
+// 当 RATE_LIMIT_STORE=db 时由 main.go 注入数据库实现，以便多个实例共享限额。
+var RateLimitBackend RateLimitBucketStore = newMemoryBucketStore()
+
+// memoryBucketStore 是 RateLimitBucketStore 的内存实现。
+type memoryBucketStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+func newMemoryBucketStore() *memoryBucketStore {
+	return &memoryBucketStore{buckets: make(map[string]*memoryBucket)}
+}
+
+// UpdateBucket 实现 RateLimitBucketStore。
+func (s *memoryBucketStore) UpdateBucket(clientID, dimension string, update func(tokens float64, updatedAt time.Time) (float64, time.Time)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := clientID + "|" + dimension
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{}
+		s.buckets[key] = bucket
+	}
+	bucket.tokens, bucket.updatedAt = update(bucket.tokens, bucket.updatedAt)
+	return nil
+}
+
+// bucketResult 是一次令牌桶操作后的状态快照。
+type bucketResult struct {
+	allowed    bool
+	remaining  float64
+	retryAfter time.Duration // 不允许时，需要等待多久才能获得足够的令牌
+	resetAfter time.Duration // 令牌桶完全补满所需时间
+}
+
+// takeFromBucket 尝试从每分钟容量为 limit 的令牌桶中取出 cost 个令牌。
+// cost 超过桶容量时按桶容量计算（满桶即放行），避免单个超大请求永远无法通过。
+// force 为 true 时无论余额多少都扣除（用于事后按实际用量结算，余额可以为负）。
+func takeFromBucket(clientID, dimension string, limit int, cost float64, force bool) (bucketResult, error) {
+	capacity := float64(limit)
+	ratePerSecond := capacity / 60
+	now := time.Now()
+	var result bucketResult
+	err := RateLimitBackend.UpdateBucket(clientID, dimension, func(tokens float64, updatedAt time.Time) (float64, time.Time) {
+		if updatedAt.IsZero() {
+			tokens = capacity
+		} else {
+			tokens = math.Min(capacity, tokens+now.Sub(updatedAt).Seconds()*ratePerSecond)
+		}
+		need := math.Min(cost, capacity)
+		result = bucketResult{allowed: force || tokens >= need}
+		if result.allowed {
+			tokens = math.Min(capacity, tokens-cost) // 退还（cost 为负）时同样不超过桶容量
+		} else {
+			result.retryAfter = time.Duration((need - tokens) / ratePerSecond * float64(time.Second))
+		}
+		result.remaining = tokens
+		result.resetAfter = time.Duration((capacity - tokens) / ratePerSecond * float64(time.Second))
+		return tokens, now
+	})
+	return result, err
+}
+
+// RecordUsage 由处理器在拿到上游报告的 token 用量后调用，供限流、计费等后续环节使用。
+func RecordUsage(c *gin.Context, usage *models.Usage) {
+	if usage != nil {
+		c.Set(UsageContextKey, usage)
+	}
+}
+
+// ReportedUsage 返回处理器记录的上游用量；未记录时返回 nil。
+func ReportedUsage(c *gin.Context) *models.Usage {
+	if v, ok := c.Get(UsageContextKey); ok {
+		if usage, ok := v.(*models.Usage); ok {
+			return usage
+		}
+	}
+	return nil
+}
+
+// RateLimit 是按客户端限制每分钟请求数 (RPM) 和 token 数 (TPM) 的 Gin 中间件，应注册在 VerifyAPIKey 之后。
+// 请求到达时按估算的输入 token 数预扣 TPM；请求结束后按上游报告的实际用量（输入 + 输出）结算差额，
+// 上游未报告用量且请求失败时退还预扣额度。超出限额时返回 429 rate_limit_exceeded 和 Retry-After 头部。
+func RateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientID := ClientID(c)
+		rpm, tpm := config.RateLimitsForClient(clientID)
+		if rpm <= 0 && tpm <= 0 {
+			c.Next()
+			return
+		}
+
+		estimatedTokens := 0
+		var tokensResult bucketResult
+		if tpm > 0 {
+			var err error
+			if estimatedTokens, err = estimateRequestTokens(c); err != nil {
+				c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, errorResponse(c, models.ErrorDetail{
+					Message: fmt.Sprintf("请求体超过 %d MB 上限。", maxTokenEstimateBodyBytes>>20),
+					Type:    "invalid_request_error",
+					Code:    "request_too_large",
+				}))
+				return
+			}
+			if tokensResult, err = takeFromBucket(clientID, rateLimitDimensionTokens, tpm, float64(estimatedTokens), false); err != nil {
+				Log.Errorf("RateLimit: 读取客户端 %s 的 TPM 令牌桶失败，本次请求不限流: %v", clientID, err)
+				tpm = 0
+			} else if !tokensResult.allowed {
+				abortRateLimited(c, clientID, rateLimitDimensionTokens, tpm, tokensResult)
+				return
+			}
+		}
+		if rpm > 0 {
+			requestsResult, err := takeFromBucket(clientID, rateLimitDimensionRequests, rpm, 1, false)
+			if err != nil {
+				Log.Errorf("RateLimit: 读取客户端 %s 的 RPM 令牌桶失败，本次请求不限流: %v", clientID, err)
+				rpm = 0
+			} else if !requestsResult.allowed {
+				if tpm > 0 { // 请求未被放行，退还已预扣的 token
+					_, _ = takeFromBucket(clientID, rateLimitDimensionTokens, tpm, -float64(estimatedTokens), true)
+				}
+				abortRateLimited(c, clientID, rateLimitDimensionRequests, rpm, requestsResult)
+				return
+			} else {
+				setRateLimitHeaders(c, rateLimitDimensionRequests, rpm, requestsResult)
+			}
+		}
+		if tpm > 0 {
+			setRateLimitHeaders(c, rateLimitDimensionTokens, tpm, tokensResult)
+		}
+
+		c.Next()
+
+		if tpm <= 0 {
+			return
+		}
+		adjustment := -float64(estimatedTokens)
+		if usage := ReportedUsage(c); usage != nil {
+			adjustment += float64(usage.PromptTokens + usage.CompletionTokens)
+		} else if c.Writer.Status() < http.StatusBadRequest {
+			adjustment = 0 // 成功但上游未报告用量：保留预扣的估算值
+		}
+		if adjustment != 0 {
+			if _, err := takeFromBucket(clientID, rateLimitDimensionTokens, tpm, adjustment, true); err != nil {
+				Log.Warnf("RateLimit: 结算客户端 %s 的 token 用量失败: %v", clientID, err)
+			}
+		}
+	}
+}
+
+// estimateRequestTokens 读取并估算补全类端点请求体的输入 token 数，随后恢复请求体供处理器继续读取。
+// 其他路由返回 0 且不读取请求体；请求体超过 maxTokenEstimateBodyBytes 时返回 *http.MaxBytesError。
+func estimateRequestTokens(c *gin.Context) (int, error) {
+	if c.Request.Body == nil || c.Request.Method != http.MethodPost || !tokenEstimatedRoutes[c.FullPath()] {
+		return 0, nil
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxTokenEstimateBodyBytes))
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return 0, err
+		}
+		return 0, nil
+	}
+	if len(body) == 0 {
+		return 0, nil
+	}
+	return utils.EstimateRequestBodyTokens(body), nil
+}
+
+// setRateLimitHeaders 写入 OpenAI 风格的 x-ratelimit-* 响应头。
+func setRateLimitHeaders(c *gin.Context, dimension string, limit int, result bucketResult) {
+	remaining := int(math.Max(0, math.Floor(result.remaining)))
+	c.Header("x-ratelimit-limit-"+dimension, strconv.Itoa(limit))
+	c.Header("x-ratelimit-remaining-"+dimension, strconv.Itoa(remaining))
+	c.Header("x-ratelimit-reset-"+dimension, formatResetDuration(result.resetAfter))
+}
+
+// abortRateLimited 以 429 rate_limit_exceeded 终止请求。
+func abortRateLimited(c *gin.Context, clientID, dimension string, limit int, result bucketResult) {
+	retryAfterSeconds := int(math.Ceil(result.retryAfter.Seconds()))
+	if retryAfterSeconds < 1 {
+		retryAfterSeconds = 1
+	}
+	setRateLimitHeaders(c, dimension, limit, result)
+	c.Header("Retry-After", strconv.Itoa(retryAfterSeconds))
+	Log.Warnf("RateLimit: 客户端 %s 超出每分钟 %s 限额 (%d)，需等待 %d 秒。", clientID, dimension, limit, retryAfterSeconds)
+
+	unit := "每分钟请求数"
+	if dimension == rateLimitDimensionTokens {
+		unit = "每分钟 token 数"
+	}
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, errorResponse(c, models.ErrorDetail{
+		Message: fmt.Sprintf("客户端 '%s' 已超出%s限额 (%d)。请在 %d 秒后重试。", clientID, unit, limit, retryAfterSeconds),
+		Type:    dimension,
+		Code:    "rate_limit_exceeded",
+	}))
+}
+
+// formatResetDuration 将补满时间格式化为 OpenAI 风格的字符串（例如 "1s"、"6m0s"）。
+func formatResetDuration(d time.Duration) string {
+	if d <= 0 {
+		return "0s"
+	}
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
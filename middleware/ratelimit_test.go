@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"openrouter_polling/config"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// newRateLimitTestRouter 创建一个只启用 TPM 限额的路由，处理器回显读取到的请求体长度。
+func newRateLimitTestRouter(t *testing.T, tpm int) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	prevSettings, prevBackend, prevLog := config.AppSettings, RateLimitBackend, Log
+	t.Cleanup(func() { config.AppSettings, RateLimitBackend, Log = prevSettings, prevBackend, prevLog })
+	config.AppSettings.RateLimitRPM = 0
+	config.AppSettings.RateLimitTPM = tpm
+	config.AppSettings.RateLimitClients = ""
+	RateLimitBackend = newMemoryBucketStore()
+	Log = logrus.New()
+	Log.SetOutput(io.Discard)
+
+	router := gin.New()
+	v1 := router.Group("/v1", RateLimit())
+	echoLength := func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.String(http.StatusOK, "%d", len(body))
+	}
+	v1.POST("/chat/completions", echoLength)
+	v1.POST("/files", echoLength)
+	return router
+}
+
+func TestRateLimitEstimatesCompletionBodies(t *testing.T) {
+	router := newRateLimitTestRouter(t, 100000)
+	body := `{"model":"m","messages":[{"role":"user","content":"` + strings.Repeat("hello ", 200) + `"}]}`
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("状态码 = %d, 响应 = %q", recorder.Code, recorder.Body.String())
+	}
+	if got := recorder.Body.String(); got != strconv.Itoa(len(body)) {
+		t.Errorf("处理器读取到 %s 字节, 期望完整的 %d 字节", got, len(body))
+	}
+	if remaining := recorder.Header().Get("x-ratelimit-remaining-tokens"); remaining == "" || remaining == "100000" {
+		t.Errorf("x-ratelimit-remaining-tokens = %q, 期望已按估算值预扣", remaining)
+	}
+}
+
+func TestRateLimitSkipsEstimationForFileUploads(t *testing.T) {
+	router := newRateLimitTestRouter(t, 1000)
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, _ := writer.CreateFormFile("file", "batch.jsonl")
+	_, _ = part.Write(bytes.Repeat([]byte(`{"custom_id":"x","body":{"messages":[{"content":"aaaaaaaaaaaaaaaa"}]}}`+"\n"), 2000))
+	_ = writer.Close()
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/files", &buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	router.ServeHTTP(recorder, req)
+
+	// 上传内容远超 TPM 限额，但不应被当作输入 token 预扣。
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("文件上传被限流: 状态码 %d, 响应 %s", recorder.Code, recorder.Body.String())
+	}
+	if remaining := recorder.Header().Get("x-ratelimit-remaining-tokens"); remaining != "1000" {
+		t.Errorf("x-ratelimit-remaining-tokens = %q, 期望文件上传不预扣 token", remaining)
+	}
+}
+
+func TestRateLimitRejectsOversizedCompletionBodies(t *testing.T) {
+	router := newRateLimitTestRouter(t, 100000)
+	body := `{"model":"m","prompt":"` + strings.Repeat("a", maxTokenEstimateBodyBytes) + `"}`
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("状态码 = %d, 期望 413", recorder.Code)
+	}
+	if !strings.Contains(recorder.Body.String(), "request_too_large") {
+		t.Errorf("响应 = %s, 期望 request_too_large 错误码", recorder.Body.String())
+	}
+}
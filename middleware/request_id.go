@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"openrouter_polling/models"
+	"openrouter_polling/utils"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// RequestIDHeader 标识一次请求的头部。客户端可以自行提供，否则由代理生成，并总是在响应中返回。
+	RequestIDHeader = "X-Request-ID"
+	// RequestIDContextKey 是请求 ID 在 gin.Context 中的键。
+	RequestIDContextKey = "request_id"
+)
+
+// validRequestID 限制客户端提供的请求 ID 格式（同时用作捕获文件名），不符合时由代理生成新的 ID。
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// AssignRequestID 是一个 Gin 中间件，为每个请求确定请求 ID：优先使用客户端提供的 X-Request-ID（格式有效时），
+// 否则生成新的 ID。请求 ID 写入上下文（见 RequestID）并通过响应头返回，日志和错误响应体均携带此 ID。
+func AssignRequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := strings.TrimSpace(c.GetHeader(RequestIDHeader))
+		if !validRequestID.MatchString(requestID) {
+			requestID = utils.NewID("req_")
+		}
+		c.Set(RequestIDContextKey, requestID)
+		c.Header(RequestIDHeader, requestID)
+		c.Next()
+	}
+}
+
+// RequestID 返回当前请求的 ID；未经过 AssignRequestID 时返回空字符串。
+func RequestID(c *gin.Context) string {
+	return c.GetString(RequestIDContextKey)
+}
+
+// errorResponse 构建携带当前请求 ID 的错误响应体。
+func errorResponse(c *gin.Context, detail models.ErrorDetail) models.ErrorResponse {
+	detail.RequestID = RequestID(c)
+	return models.ErrorResponse{Error: detail}
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"openrouter_polling/models"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAssignRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(AssignRequestID())
+	router.GET("/", func(c *gin.Context) {
+		c.JSON(http.StatusBadRequest, errorResponse(c, models.ErrorDetail{Message: "bad", Type: "invalid_request_error"}))
+	})
+
+	tests := []struct {
+		name     string
+		header   string
+		wantKeep bool
+	}{
+		{"沿用有效的客户端请求 ID", "trace-01.abc_DEF", true},
+		{"去除首尾空白", "  trace-02  ", true},
+		{"未提供时生成", "", false},
+		{"包含非法字符时重新生成", "../../etc/passwd", false},
+		{"不能以符号开头", "-trace", false},
+		{"超过 128 个字符时重新生成", strings.Repeat("a", 129), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set(RequestIDHeader, tt.header)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			got := recorder.Header().Get(RequestIDHeader)
+			if tt.wantKeep && got != strings.TrimSpace(tt.header) {
+				t.Errorf("%s = %q, 期望沿用 %q", RequestIDHeader, got, strings.TrimSpace(tt.header))
+			}
+			if !tt.wantKeep && (!strings.HasPrefix(got, "req_") || !validRequestID.MatchString(got)) {
+				t.Errorf("%s = %q, 期望生成 req_ 开头的新 ID", RequestIDHeader, got)
+			}
+			if !strings.Contains(recorder.Body.String(), `"request_id":"`+got+`"`) {
+				t.Errorf("错误响应体 = %s, 期望携带请求 ID %q", recorder.Body.String(), got)
+			}
+		})
+	}
+}
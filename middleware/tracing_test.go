@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// useSpanRecorder 安装记录所有 span 的全局 TracerProvider 和 W3C 传播器，测试结束后恢复。
+func useSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+	return recorder
+}
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestTraceCreatesServerSpan(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	spans := useSpanRecorder(t)
+	router := gin.New()
+	router.Use(AssignRequestID(), Trace())
+	router.POST("/v1/chat/:action", func(c *gin.Context) {
+		c.Set(ClientIDContextKey, "alice")
+		c.Status(http.StatusOK)
+	})
+	router.GET("/fail", func(c *gin.Context) { c.Status(http.StatusBadGateway) })
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	req.Header.Set(RequestIDHeader, "trace-1")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fail", nil))
+
+	ended := spans.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("span 数 = %d, 期望 2", len(ended))
+	}
+	span := ended[0]
+	if span.Name() != "POST /v1/chat/:action" || span.SpanKind() != trace.SpanKindServer {
+		t.Errorf("span = %s (%v), 期望以路由命名的服务端 span", span.Name(), span.SpanKind())
+	}
+	if got := span.SpanContext().TraceID().String(); got != traceID || span.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("trace ID = %s, 父 span = %s, 期望沿用请求的 traceparent", got, span.Parent().SpanID())
+	}
+	attrs := spanAttributes(span)
+	want := map[attribute.Key]attribute.Value{
+		"http.request.method":       attribute.StringValue("POST"),
+		"http.route":                attribute.StringValue("/v1/chat/:action"),
+		"url.path":                  attribute.StringValue("/v1/chat/completions"),
+		"http.response.status_code": attribute.IntValue(http.StatusOK),
+		"proxy.request_id":          attribute.StringValue("trace-1"),
+		"proxy.client":              attribute.StringValue("alice"),
+	}
+	for key, value := range want {
+		if attrs[key] != value {
+			t.Errorf("属性 %s = %v, 期望 %v", key, attrs[key].Emit(), value.Emit())
+		}
+	}
+	if span.Status().Code != codes.Unset {
+		t.Errorf("成功请求的 span 状态 = %v, 期望未设置", span.Status().Code)
+	}
+
+	failed := ended[1]
+	if failed.Status().Code != codes.Error || spanAttributes(failed)["http.response.status_code"] != attribute.IntValue(http.StatusBadGateway) {
+		t.Errorf("5xx 请求的 span 状态 = %v, 期望 Error", failed.Status().Code)
+	}
+	if failed.Parent().IsValid() {
+		t.Error("没有 traceparent 的请求期望创建根 span")
+	}
+}
@@ -0,0 +1,210 @@
+package modelhealth
+
+import (
+	"openrouter_polling/config"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var Log *logrus.Logger
+
+// 模型的健康状态。
+const (
+	StatusHealthy  = "healthy"
+	StatusDegraded = "degraded"
+)
+
+// lastErrorMaxLen 是保存的最近一次错误信息的最大字符数。
+const lastErrorMaxLen = 256
+
+// ModelHealth 是单个模型健康状态的快照，用于管理接口。
+type ModelHealth struct {
+	Model         string     `json:"model"`
+	Status        string     `json:"status"`
+	Requests      int        `json:"requests"`       // 统计窗口内的请求数
+	Failures      int        `json:"failures"`       // 统计窗口内可归因于模型的失败数
+	ErrorRate     float64    `json:"error_rate"`     // 统计窗口内的错误率
+	FailingKeys   int        `json:"failing_keys"`   // 统计窗口内出现失败的不同密钥数
+	DegradedUntil *time.Time `json:"degraded_until"` // 降级状态的截止时间，健康时为 null
+	Fallback      string     `json:"fallback,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Tracker 按模型统计上游请求的错误率，与密钥的失败统计相互独立。某个模型在多个密钥上集中失败时判定为降级：
+// 此时的失败是模型问题而不是密钥问题，不应计入密钥失败，新请求应快速失败或改用备用模型。
+// 方法可以在 nil 上安全调用（不做任何事）。
+type Tracker struct {
+	mu     sync.Mutex
+	models map[string]*modelState
+}
+
+type modelState struct {
+	buckets       []outcomeBucket
+	failingKeys   map[string]time.Time // 密钥后缀 -> 最近一次失败时间
+	degradedUntil time.Time
+	degraded      bool // 是否处于降级状态（含降级已到期、尚未恢复的探测阶段），用于记录恢复日志
+	lastError     string
+	lastErrorAt   time.Time
+}
+
+type outcomeBucket struct {
+	second int64
+	total  int
+	failed int
+}
+
+// NewTracker 创建一个模型健康跟踪器。
+func NewTracker() *Tracker {
+	return &Tracker{models: make(map[string]*modelState)}
+}
+
+func (t *Tracker) stateLocked(model string) *modelState {
+	state, ok := t.models[model]
+	if !ok {
+		seconds := max(int(config.AppSettings.ModelHealthWindow.Seconds()), 1)
+		state = &modelState{buckets: make([]outcomeBucket, seconds), failingKeys: make(map[string]time.Time)}
+		t.models[model] = state
+	}
+	return state
+}
+
+func (s *modelState) record(now time.Time, failed bool) {
+	second := now.Unix()
+	bucket := &s.buckets[second%int64(len(s.buckets))]
+	if bucket.second != second {
+		*bucket = outcomeBucket{second: second}
+	}
+	bucket.total++
+	if failed {
+		bucket.failed++
+	}
+}
+
+func (s *modelState) counts(now time.Time) (total, failed, failingKeys int) {
+	oldest := now.Unix() - int64(len(s.buckets)) + 1
+	for _, bucket := range s.buckets {
+		if bucket.second >= oldest {
+			total += bucket.total
+			failed += bucket.failed
+		}
+	}
+	cutoff := now.Add(-time.Duration(len(s.buckets)) * time.Second)
+	for suffix, at := range s.failingKeys {
+		if at.Before(cutoff) {
+			delete(s.failingKeys, suffix)
+		}
+	}
+	return total, failed, len(s.failingKeys)
+}
+
+func (s *modelState) reset() {
+	clear(s.buckets)
+	clear(s.failingKeys)
+}
+
+// RecordSuccess 记录模型的一次成功请求。降级到期后的第一次成功请求使模型恢复健康。
+func (t *Tracker) RecordSuccess(model string) {
+	if t == nil || model == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.stateLocked(model)
+	now := time.Now()
+	state.record(now, false)
+	if state.degraded && !now.Before(state.degradedUntil) {
+		state.degraded = false
+		Log.Infof("模型健康: 模型 %s 的请求已恢复成功，解除降级状态。", model)
+	}
+}
+
+// RecordFailure 记录模型在某个密钥上的一次可归因于模型的失败（上游 5xx、超时等），
+// 返回记录后模型是否处于降级状态。调用方据此决定是否将这次失败计入密钥。
+func (t *Tracker) RecordFailure(model, keySuffix, detail string) bool {
+	if t == nil || model == "" {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.stateLocked(model)
+	now := time.Now()
+	if now.Before(state.degradedUntil) {
+		return true // 降级期间仍在进行中的请求，失败同样视为模型问题
+	}
+	state.record(now, true)
+	state.failingKeys[keySuffix] = now
+	if runes := []rune(detail); len(runes) > lastErrorMaxLen {
+		detail = string(runes[:lastErrorMaxLen])
+	}
+	state.lastError, state.lastErrorAt = detail, now
+
+	settings := config.AppSettings
+	if settings.ModelHealthErrorRateThreshold <= 0 {
+		return false
+	}
+	total, failed, failingKeys := state.counts(now)
+	if total < settings.ModelHealthMinRequests || failingKeys < settings.ModelHealthMinKeys ||
+		float64(failed)/float64(total) < settings.ModelHealthErrorRateThreshold {
+		return false
+	}
+	state.degradedUntil = now.Add(settings.ModelHealthCooldown)
+	state.degraded = true
+	Log.Warnf("模型健康: 模型 %s 在最近 %v 内 %d/%d 个请求失败（涉及 %d 个密钥），判定为降级，持续至 %s。",
+		model, settings.ModelHealthWindow, failed, total, failingKeys, state.degradedUntil.Format(time.RFC3339))
+	// 降级到期后重新统计，避免旧的失败使模型在探测阶段立即再次降级。
+	state.reset()
+	return true
+}
+
+// IsDegraded 报告模型当前是否处于降级状态。
+func (t *Tracker) IsDegraded(model string) bool {
+	if t == nil || model == "" {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state, ok := t.models[model]
+	return ok && time.Now().Before(state.degradedUntil)
+}
+
+// Snapshot 返回所有有过请求记录的模型的健康状态，按模型名称排序。
+func (t *Tracker) Snapshot() []ModelHealth {
+	if t == nil {
+		return []ModelHealth{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	result := make([]ModelHealth, 0, len(t.models))
+	for model, state := range t.models {
+		total, failed, failingKeys := state.counts(now)
+		health := ModelHealth{
+			Model:       model,
+			Status:      StatusHealthy,
+			Requests:    total,
+			Failures:    failed,
+			FailingKeys: failingKeys,
+			Fallback:    config.ModelFallbackFor(model),
+			LastError:   state.lastError,
+		}
+		if total > 0 {
+			health.ErrorRate = float64(failed) / float64(total)
+		}
+		if now.Before(state.degradedUntil) {
+			until := state.degradedUntil
+			health.Status = StatusDegraded
+			health.DegradedUntil = &until
+		}
+		if !state.lastErrorAt.IsZero() {
+			at := state.lastErrorAt
+			health.LastErrorAt = &at
+		}
+		result = append(result, health)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Model < result[j].Model })
+	return result
+}
@@ -0,0 +1,117 @@
+package modelhealth
+
+import (
+	"io"
+	"openrouter_polling/config"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testCooldown = 30 * time.Millisecond
+
+// newTestTracker 创建一个至少 4 个请求、2 个密钥、50% 错误率时降级，降级持续 30ms 的跟踪器。
+func newTestTracker(t *testing.T) *Tracker {
+	t.Helper()
+	prevLog, prevSettings := Log, config.AppSettings
+	t.Cleanup(func() { Log, config.AppSettings = prevLog, prevSettings })
+	Log = logrus.New()
+	Log.SetOutput(io.Discard)
+	config.AppSettings.ModelHealthErrorRateThreshold = 0.5
+	config.AppSettings.ModelHealthWindow = 2 * time.Minute
+	config.AppSettings.ModelHealthMinRequests = 4
+	config.AppSettings.ModelHealthMinKeys = 2
+	config.AppSettings.ModelHealthCooldown = testCooldown
+	config.AppSettings.ModelFallbacks = ""
+	return NewTracker()
+}
+
+func TestTrackerDegradesAtThresholds(t *testing.T) {
+	tests := []struct {
+		name         string
+		successes    int
+		failingKeys  []string
+		wantDegraded bool
+	}{
+		{"请求数不足时不降级", 0, []string{"key1", "key2", "key1"}, false},
+		{"失败集中在单个密钥时不降级", 0, []string{"key1", "key1", "key1", "key1"}, false},
+		{"错误率低于阈值时不降级", 3, []string{"key1", "key2"}, false},
+		{"错误率达到阈值且涉及多个密钥时降级", 2, []string{"key1", "key2"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newTestTracker(t)
+			for range tt.successes {
+				tracker.RecordSuccess("test/model")
+			}
+			degraded := false
+			for _, key := range tt.failingKeys {
+				degraded = tracker.RecordFailure("test/model", key, "502 bad gateway")
+			}
+			if degraded != tt.wantDegraded {
+				t.Errorf("RecordFailure = %v, 期望 %v", degraded, tt.wantDegraded)
+			}
+			if got := tracker.IsDegraded("test/model"); got != tt.wantDegraded {
+				t.Errorf("IsDegraded = %v, 期望 %v", got, tt.wantDegraded)
+			}
+			if tracker.IsDegraded("other/model") {
+				t.Error("其他模型不应受影响")
+			}
+		})
+	}
+}
+
+func TestTrackerRecoversAfterCooldown(t *testing.T) {
+	tracker := newTestTracker(t)
+	for _, key := range []string{"key1", "key2", "key1", "key2"} {
+		tracker.RecordFailure("test/model", key, "502 bad gateway")
+	}
+	if !tracker.IsDegraded("test/model") {
+		t.Fatal("期望模型降级")
+	}
+	if snapshot := tracker.Snapshot(); len(snapshot) != 1 || snapshot[0].Status != StatusDegraded || snapshot[0].DegradedUntil == nil {
+		t.Errorf("快照 = %+v, 期望模型处于降级状态", snapshot)
+	}
+	// 降级期间仍在进行中的请求失败同样归因于模型。
+	if !tracker.RecordFailure("test/model", "key3", "timeout") {
+		t.Error("降级期间的失败期望返回 true")
+	}
+
+	time.Sleep(testCooldown + 5*time.Millisecond)
+	if tracker.IsDegraded("test/model") {
+		t.Fatal("降级到期后期望放行请求进行探测")
+	}
+	// 降级时已清空统计，探测阶段的单次失败不会使模型立即再次降级。
+	if tracker.RecordFailure("test/model", "key1", "502 bad gateway") || tracker.IsDegraded("test/model") {
+		t.Error("探测阶段的单次失败不应再次降级")
+	}
+	tracker.RecordSuccess("test/model")
+	if snapshot := tracker.Snapshot(); snapshot[0].Status != StatusHealthy || snapshot[0].DegradedUntil != nil {
+		t.Errorf("快照 = %+v, 期望模型恢复健康", snapshot)
+	}
+}
+
+func TestTrackerZeroThresholdNeverDegrades(t *testing.T) {
+	tracker := newTestTracker(t)
+	config.AppSettings.ModelHealthErrorRateThreshold = 0
+	for _, key := range []string{"key1", "key2", "key3", "key4", "key5"} {
+		if tracker.RecordFailure("test/model", key, "502 bad gateway") {
+			t.Fatal("阈值为 0 时不应降级")
+		}
+	}
+	if tracker.IsDegraded("test/model") {
+		t.Error("阈值为 0 时不应降级")
+	}
+}
+
+func TestNilTrackerIsNeverDegraded(t *testing.T) {
+	var tracker *Tracker
+	tracker.RecordSuccess("test/model")
+	if tracker.RecordFailure("test/model", "key1", "boom") || tracker.IsDegraded("test/model") {
+		t.Error("nil 跟踪器不应判定降级")
+	}
+	if snapshot := tracker.Snapshot(); len(snapshot) != 0 {
+		t.Errorf("nil 跟踪器快照 = %+v, 期望为空", snapshot)
+	}
+}
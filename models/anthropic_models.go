@@ -0,0 +1,104 @@
+// models/anthropic_models.go
+package models
+
+import "encoding/json"
+
+// --- Anthropic Messages API (/v1/messages) 兼容模型 ---
+
+// AnthropicContentBlock 表示 Anthropic 消息内容中的单个内容块。
+// 根据 Type 的不同（text、image、tool_use、tool_result、thinking），使用不同的字段。
+type AnthropicContentBlock struct {
+	Type string `json:"type"`
+
+	// type = "text" / "thinking"
+	Text     string `json:"text,omitempty"`
+	Thinking string `json:"thinking,omitempty"`
+
+	// type = "image"
+	Source *AnthropicImageSource `json:"source,omitempty"`
+
+	// type = "tool_use"
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// type = "tool_result"
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"` // 字符串或内容块数组
+	IsError   bool            `json:"is_error,omitempty"`
+}
+
+// AnthropicImageSource 图片内容块的来源。
+type AnthropicImageSource struct {
+	Type      string `json:"type"`                 // "base64" 或 "url"
+	MediaType string `json:"media_type,omitempty"` // 例如 "image/png"
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// AnthropicMessage 表示 Anthropic 对话中的单条消息。Content 可以是字符串或内容块数组。
+type AnthropicMessage struct {
+	Role    string          `json:"role"` // "user" 或 "assistant"
+	Content json.RawMessage `json:"content"`
+}
+
+// AnthropicTool 表示 Anthropic 格式的工具定义。
+type AnthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+// AnthropicToolChoice 控制模型如何使用工具。
+type AnthropicToolChoice struct {
+	Type                   string `json:"type"`           // "auto"、"any"、"tool" 或 "none"
+	Name                   string `json:"name,omitempty"` // type 为 "tool" 时指定工具名
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
+// AnthropicMessagesRequest 表示对 /v1/messages 的请求结构。
+type AnthropicMessagesRequest struct {
+	Model         string               `json:"model"`
+	Messages      []AnthropicMessage   `json:"messages"`
+	System        json.RawMessage      `json:"system,omitempty"` // 字符串或 text 内容块数组
+	MaxTokens     int                  `json:"max_tokens"`
+	Temperature   *float64             `json:"temperature,omitempty"`
+	TopP          *float64             `json:"top_p,omitempty"`
+	TopK          *int                 `json:"top_k,omitempty"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Stream        bool                 `json:"stream,omitempty"`
+	Tools         []AnthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *AnthropicToolChoice `json:"tool_choice,omitempty"`
+	Metadata      *struct {
+		UserID string `json:"user_id,omitempty"`
+	} `json:"metadata,omitempty"`
+}
+
+// AnthropicUsage Anthropic 格式的用量统计。
+type AnthropicUsage struct {
+	InputTokens          int `json:"input_tokens"`
+	OutputTokens         int `json:"output_tokens"`
+	CacheReadInputTokens int `json:"cache_read_input_tokens,omitempty"`
+}
+
+// AnthropicMessagesResponse 表示 /v1/messages 的非流式响应。
+type AnthropicMessagesResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"` // 固定为 "message"
+	Role         string                  `json:"role"` // 固定为 "assistant"
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   *string                 `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        AnthropicUsage          `json:"usage"`
+}
+
+// AnthropicErrorResponse 表示 Anthropic 风格的错误响应体。
+type AnthropicErrorResponse struct {
+	Type  string `json:"type"` // 固定为 "error"
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+	RequestID string `json:"request_id,omitempty"` // 本次请求的 ID (同 X-Request-ID 响应头)
+}
@@ -14,6 +14,8 @@ type ErrorDetail struct {
 	Type    string `json:"type"`            // 必需：错误类型，例如 "api_error", "auth_error", "invalid_request_error"。
 	Code    any    `json:"code,omitempty"`  // 可选：特定于错误的机器可读代码 (可以是数字状态码的字符串形式，或自定义错误代码如 "invalid_api_key")。
 	Param   string `json:"param,omitempty"` // 可选：导致错误的参数名称 (如果错误与特定请求参数相关)。
+	// 可选：本次请求的 ID (同 X-Request-ID 响应头)，便于客户端反馈问题时关联代理日志。
+	RequestID string `json:"request_id,omitempty"`
 }
 
 // ErrorResponse 统一的错误响应结构，包装了 ErrorDetail。
@@ -46,6 +48,64 @@ type AppStatusInfo struct {
 	LogLevel                   string    `json:"log_level"`                     // 当前配置的日志级别
 	GinMode                    string    `json:"gin_mode"`                      // 当前 Gin 框架的运行模式 (debug/release)
 	AdminPasswordConfigured    bool      `json:"admin_password_configured"`     // 【新增】仪表盘登录密码是否已配置且不是默认密码 (用于提示安全性)
+	UpstreamCircuitBreaker     CircuitBreakerStatus `json:"upstream_circuit_breaker"` // 上游熔断器的状态
+	RetryBudget                RetryBudgetStatus    `json:"retry_budget"`             // 全局重试预算的使用情况
+	RequestQueue               RequestQueueStatus   `json:"request_queue"`            // 等待可用密钥的请求队列
+	KeyAffinity                KeyAffinityStatus    `json:"key_affinity"`             // 会话与密钥的绑定情况
+}
+
+// KeyAffinityStatus 是会话亲和（同一会话的请求尽量使用同一个密钥）的统计快照。
+type KeyAffinityStatus struct {
+	Enabled          bool    `json:"enabled"`
+	Conversations    int     `json:"conversations"`     // 当前未过期的会话绑定数
+	IdleTTLSeconds   float64 `json:"idle_ttl_seconds"`  // 会话绑定空闲多久后过期
+	Hits             int64   `json:"hits"`              // 使用了会话上次所用密钥的请求数
+	Fallbacks        int64   `json:"fallbacks"`         // 会话上次所用的密钥不可用、改用其他密钥的请求数
+	NewConversations int64   `json:"new_conversations"` // 没有绑定（新会话或绑定已过期）、按一致性哈希选择密钥的请求数
+}
+
+// RequestQueueStatus 是等待可用密钥的请求队列的快照。
+type RequestQueueStatus struct {
+	Enabled               bool           `json:"enabled"`
+	Length                int            `json:"length"`                   // 当前排队的请求数
+	LengthByPriority      map[string]int `json:"length_by_priority"`       // 按优先级 (high/normal/low) 统计的排队请求数
+	MaxSize               int            `json:"max_size"`                 // 队列长度上限
+	DefaultMaxWaitSeconds float64        `json:"default_max_wait_seconds"` // 未指定时的最长排队时间，0 表示默认不排队
+	OldestWaitMs          int64          `json:"oldest_wait_ms"`           // 当前排队最久的请求已等待的时间
+	Enqueued              int64          `json:"enqueued"`                 // 自启动以来进入队列的请求数
+	Served                int64          `json:"served"`                   // 排队后获得密钥的请求数
+	TimedOut              int64          `json:"timed_out"`                // 排队超时的请求数
+	Canceled              int64          `json:"canceled"`                 // 排队期间客户端断开的请求数
+	Rejected              int64          `json:"rejected"`                 // 队列已满而被拒绝的请求数
+	WaitP50Ms             int64          `json:"wait_p50_ms"`              // 最近获得密钥的请求的排队时间中位数
+	WaitP95Ms             int64          `json:"wait_p95_ms"`              // 最近获得密钥的请求的排队时间 95 分位数
+	WaitMaxMs             int64          `json:"wait_max_ms"`              // 最近获得密钥的请求的最长排队时间
+}
+
+// RetryBudgetStatus 是全局重试预算使用情况的快照。
+type RetryBudgetStatus struct {
+	Enabled       bool    `json:"enabled"`
+	Ratio         float64 `json:"ratio"`          // 窗口内重试次数相对请求数的上限比例
+	MinRetries    int     `json:"min_retries"`    // 窗口内总是允许的重试次数
+	WindowSeconds int     `json:"window_seconds"` // 统计窗口（秒）
+	Requests      int     `json:"requests"`       // 窗口内的客户端请求数
+	Retries       int     `json:"retries"`        // 窗口内的重试次数
+	Denied        int     `json:"denied"`         // 自启动以来因预算用尽而放弃的重试次数
+}
+
+// CircuitBreakerStatus 是上游熔断器状态的快照。
+type CircuitBreakerStatus struct {
+	Enabled         bool       `json:"enabled"`
+	State           string     `json:"state"`             // closed（正常）、open（快速失败）或 half_open（正在探测）
+	Requests        int        `json:"requests"`          // 统计窗口内记录的上游请求数
+	Failures        int        `json:"failures"`          // 统计窗口内的上游失败数（网络错误、超时、5xx）
+	FailingKeys     int        `json:"failing_keys"`      // 统计窗口内出现上游失败的不同密钥数
+	OpenedAt        *time.Time `json:"opened_at"`         // 熔断器最近一次打开的时间，关闭时为 null
+	RetryAt         *time.Time `json:"retry_at"`          // 下一次放行探测请求的时间，关闭时为 null
+	OpenSeconds     float64    `json:"open_seconds"`      // 当前（或下一次）打开的持续时间，探测失败后按倍数增加
+	TripCount       int        `json:"trip_count"`        // 自启动以来熔断器从关闭变为打开的次数
+	LastError       string     `json:"last_error,omitempty"`
+	LastStateChange *time.Time `json:"last_state_change,omitempty"`
 }
 
 // SSE (Server-Sent Events) 相关常量，用于流式 API 响应。
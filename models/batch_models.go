@@ -0,0 +1,115 @@
+// models/batch_models.go
+package models
+
+import "encoding/json"
+
+// --- 文件 (/v1/files) 与批处理 (/v1/batches) 模型，与 OpenAI Batch API 格式一致 ---
+
+// File 是文件对象。
+type File struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"` // 固定为 "file"
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"` // batch、batch_output
+	Status    string `json:"status"`  // 固定为 "processed"
+}
+
+// FileList 是文件列表响应。
+type FileList struct {
+	Object  string `json:"object"` // 固定为 "list"
+	Data    []File `json:"data"`
+	HasMore bool   `json:"has_more"`
+}
+
+// BatchCreateRequest 是 POST /v1/batches 的请求体。
+type BatchCreateRequest struct {
+	InputFileID      string            `json:"input_file_id" binding:"required"`
+	Endpoint         string            `json:"endpoint" binding:"required"`
+	CompletionWindow string            `json:"completion_window" binding:"required"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+}
+
+// BatchRequestCounts 是批处理中各状态的请求数。
+type BatchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// BatchError 描述输入文件中的一处校验错误。
+type BatchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Param   string `json:"param,omitempty"`
+	Line    *int   `json:"line,omitempty"` // 出错的行号（从 1 开始）
+}
+
+// BatchErrors 是批处理对象中的 errors 字段。
+type BatchErrors struct {
+	Object string       `json:"object"` // 固定为 "list"
+	Data   []BatchError `json:"data"`
+}
+
+// Batch 是批处理对象。未发生的时间点为 null。
+type Batch struct {
+	ID               string             `json:"id"`
+	Object           string             `json:"object"` // 固定为 "batch"
+	Endpoint         string             `json:"endpoint"`
+	Errors           *BatchErrors       `json:"errors"`
+	InputFileID      string             `json:"input_file_id"`
+	CompletionWindow string             `json:"completion_window"`
+	Status           string             `json:"status"`
+	OutputFileID     *string            `json:"output_file_id"`
+	ErrorFileID      *string            `json:"error_file_id"`
+	CreatedAt        int64              `json:"created_at"`
+	InProgressAt     *int64             `json:"in_progress_at"`
+	ExpiresAt        *int64             `json:"expires_at"`
+	FinalizingAt     *int64             `json:"finalizing_at"`
+	CompletedAt      *int64             `json:"completed_at"`
+	FailedAt         *int64             `json:"failed_at"`
+	ExpiredAt        *int64             `json:"expired_at"`
+	CancellingAt     *int64             `json:"cancelling_at"`
+	CancelledAt      *int64             `json:"cancelled_at"`
+	RequestCounts    BatchRequestCounts `json:"request_counts"`
+	Metadata         map[string]string  `json:"metadata"`
+}
+
+// BatchList 是批处理列表响应。
+type BatchList struct {
+	Object  string  `json:"object"` // 固定为 "list"
+	Data    []Batch `json:"data"`
+	FirstID *string `json:"first_id"`
+	LastID  *string `json:"last_id"`
+	HasMore bool    `json:"has_more"`
+}
+
+// BatchInputLine 是批处理输入文件中的一行。
+type BatchInputLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// BatchOutputResponse 是结果行中的上游响应。
+type BatchOutputResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestID  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// BatchOutputError 是结果行中请求未能执行时的错误。
+type BatchOutputError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// BatchOutputLine 是批处理输出文件（或错误文件）中的一行。
+type BatchOutputLine struct {
+	ID       string               `json:"id"`
+	CustomID string               `json:"custom_id"`
+	Response *BatchOutputResponse `json:"response"`
+	Error    *BatchOutputError    `json:"error"`
+}
@@ -0,0 +1,18 @@
+// models/job_models.go
+package models
+
+import "encoding/json"
+
+// --- 异步任务 (/v1/jobs) 模型 ---
+
+// Job 是异步聊天补全任务对外返回的对象，也是完成回调的请求体。
+type Job struct {
+	ID          string          `json:"id"`
+	Object      string          `json:"object"` // 固定为 "job"
+	Status      string          `json:"status"` // queued / running / succeeded / failed
+	CreatedAt   int64           `json:"created_at"`
+	CompletedAt *int64          `json:"completed_at,omitempty"`
+	StatusCode  int             `json:"status_code,omitempty"` // 任务完成时对应的 HTTP 状态码
+	Result      json.RawMessage `json:"result,omitempty"`      // 成功时为 chat.completion 对象
+	Error       json.RawMessage `json:"error,omitempty"`       // 失败时为错误详情
+}
@@ -1,13 +1,50 @@
 // models/openai_models.go
 package models
 
+import "encoding/json"
+
 // --- OpenAI 兼容的聊天模型 ---
 
 // 【新增】FunctionParameters 定义了函数调用中的参数结构，遵循JSON Schema规范。
+// 反序列化时会保留原始 JSON，序列化时原样输出，从而不丢失嵌套对象、数组 items、anyOf 等
+// 未在结构体中显式建模的 Schema 字段。
 type FunctionParameters struct {
 	Type       string                        `json:"type"`                 // 通常是 "object"
 	Properties map[string]FunctionProperty `json:"properties"`             // 参数属性的映射
 	Required   []string                      `json:"required,omitempty"`   // 必需的参数列表
+
+	raw json.RawMessage // 原始 JSON Schema
+}
+
+// UnmarshalJSON 解析已建模的字段，同时保留完整的原始 Schema。
+func (p *FunctionParameters) UnmarshalJSON(data []byte) error {
+	type plain FunctionParameters
+	var parsed plain
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+	*p = FunctionParameters(parsed)
+	p.raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// MarshalJSON 优先输出原始 Schema；对于在代码中构造的参数则按结构体字段序列化。
+func (p FunctionParameters) MarshalJSON() ([]byte, error) {
+	if len(p.raw) > 0 {
+		return p.raw, nil
+	}
+	type plain FunctionParameters
+	return json.Marshal(plain(p))
+}
+
+// FunctionParametersFromRaw 从任意 JSON Schema 构造 FunctionParameters（完整保留原始 Schema）。
+func FunctionParametersFromRaw(schema json.RawMessage) (FunctionParameters, error) {
+	var p FunctionParameters
+	if len(schema) == 0 || string(schema) == "null" {
+		schema = json.RawMessage(`{"type":"object","properties":{}}`)
+	}
+	err := json.Unmarshal(schema, &p)
+	return p, err
 }
 
 // 【新增】FunctionProperty 定义了单个函数参数的属性。
@@ -32,6 +69,7 @@ type Tool struct {
 
 // 【新增】ToolCall 是模型决定要调用的一个具体工具实例。
 type ToolCall struct {
+	Index    *int           `json:"index,omitempty"`    // 流式增量中用于区分并行工具调用的序号
 	ID       string         `json:"id"`                 // 唯一的调用ID，用于后续关联结果
 	Type     string         `json:"type"`               // 工具类型，固定为 "function"
 	Function ToolCallFunction `json:"function"`           // 要调用的函数及其参数
@@ -66,8 +104,10 @@ type ChatCompletionRequest struct {
 	PresencePenalty  *float64    `json:"presence_penalty,omitempty"`    // 可选
 	FrequencyPenalty *float64    `json:"frequency_penalty,omitempty"`   // 可选
 	User             *string     `json:"user,omitempty"`                // 可选
+	Stop             interface{} `json:"stop,omitempty"`                // 可选：字符串或字符串数组
 	Tools            *[]Tool     `json:"tools,omitempty"`               // 【新增】模型可用的工具列表
 	ToolChoice       interface{} `json:"tool_choice,omitempty"`         // 【新增】控制模型如何响应工具调用 (可以是 "none", "auto", 或 {"type": "function", "function": {"name": "my_function"}})
+	ResponseFormat   interface{} `json:"response_format,omitempty"`     // 可选：结构化输出格式，例如 {"type": "json_object"}
 }
 
 // --- OpenAI 兼容的流式响应模型 (Server-Sent Events) ---
@@ -94,6 +134,87 @@ type ChatCompletionChunk struct {
 	Created int64       `json:"created"`
 	Model   string      `json:"model"`
 	Choices []SSEChoice `json:"choices"`
+	Usage   *Usage      `json:"usage,omitempty"` // OpenRouter 在最后一个数据块中附带用量统计
+}
+
+// --- OpenAI 兼容的非流式聊天响应模型 ---
+
+// PromptTokensDetails 提示词 token 的细分统计。
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"` // 命中提供商提示词缓存的 token 数
+}
+
+// Usage 表示一次补全的 token 用量统计。
+type Usage struct {
+	PromptTokens        int                  `json:"prompt_tokens"`
+	CompletionTokens    int                  `json:"completion_tokens"`
+	TotalTokens         int                  `json:"total_tokens"`
+	PromptTokensDetails *PromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+// ChatCompletionChoice 表示非流式响应中 choices 数组的单个元素。
+type ChatCompletionChoice struct {
+	Index        int     `json:"index"`
+	Message      Message `json:"message"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+// ChatCompletionResponse 表示非流式聊天补全的完整响应。
+type ChatCompletionResponse struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"` // "chat.completion"
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []ChatCompletionChoice `json:"choices"`
+	Usage   *Usage                 `json:"usage,omitempty"`
+}
+
+// --- OpenAI 兼容的旧版文本补全 (/v1/completions) 模型 ---
+
+// CompletionRequest 表示对旧版文本补全 API 的请求结构 (prompt 风格)。
+type CompletionRequest struct {
+	Model            string      `json:"model"`                       // 必需：要使用的模型 ID
+	Prompt           interface{} `json:"prompt"`                      // 必需：提示词，可以是字符串或字符串数组
+	Suffix           *string     `json:"suffix,omitempty"`            // 可选
+	MaxTokens        *int        `json:"max_tokens,omitempty"`        // 可选
+	Temperature      *float64    `json:"temperature,omitempty"`       // 可选
+	TopP             *float64    `json:"top_p,omitempty"`             // 可选
+	N                *int        `json:"n,omitempty"`                 // 可选
+	Stream           *bool       `json:"stream,omitempty"`            // 可选
+	Logprobs         *int        `json:"logprobs,omitempty"`          // 可选
+	Echo             *bool       `json:"echo,omitempty"`              // 可选
+	Stop             interface{} `json:"stop,omitempty"`              // 可选：字符串或字符串数组
+	PresencePenalty  *float64    `json:"presence_penalty,omitempty"`  // 可选
+	FrequencyPenalty *float64    `json:"frequency_penalty,omitempty"` // 可选
+	Seed             *int        `json:"seed,omitempty"`              // 可选
+	User             *string     `json:"user,omitempty"`              // 可选
+}
+
+// CompletionChunkChoice 表示文本补全流中 choices 数组的单个元素。
+type CompletionChunkChoice struct {
+	Text         string  `json:"text"`
+	Index        int     `json:"index"`
+	FinishReason *string `json:"finish_reason,omitempty"`
+}
+
+// CompletionChunk 表示文本补全 SSE 流中单个事件的数据结构。
+type CompletionChunk struct {
+	ID      string                  `json:"id"`
+	Object  string                  `json:"object"` // "text_completion"
+	Created int64                   `json:"created"`
+	Model   string                  `json:"model"`
+	Choices []CompletionChunkChoice `json:"choices"`
+}
+
+// --- OpenAI 兼容的向量嵌入 (/v1/embeddings) 模型 ---
+
+// EmbeddingRequest 表示对向量嵌入 API 的请求结构。
+type EmbeddingRequest struct {
+	Model          string      `json:"model"`                     // 必需：要使用的模型 ID
+	Input          interface{} `json:"input"`                     // 必需：字符串、字符串数组或 token 数组
+	EncodingFormat *string     `json:"encoding_format,omitempty"` // 可选："float" 或 "base64"
+	Dimensions     *int        `json:"dimensions,omitempty"`      // 可选
+	User           *string     `json:"user,omitempty"`            // 可选
 }
 
 // --- OpenAI 兼容的 /v1/models 响应模型 (这部分不需要修改) ---
@@ -134,7 +255,7 @@ type OpenRouterModel struct {
 	ID               string      `json:"id"`
 	Name             string      `json:"name"`
 	Description      string      `json:"description"`
-	Pricing          interface{} `json:"pricing"`
+	Pricing          *OpenRouterPricing `json:"pricing,omitempty"`
 	ContextLength    int         `json:"context_length"`
 	Architecture     *struct {
 		Modality        string `json:"modality"`
@@ -148,6 +269,40 @@ type OpenRouterModel struct {
 	PerRequestLimits *map[string]int `json:"per_request_limits,omitempty"`
 }
 
+// OpenRouterPricing 模型定价。OpenRouter 以字符串形式返回每个 token（或每次请求/每张图片）的美元价格，
+// 例如 "0.000003"；"-1" 表示价格可变（如 openrouter/auto）。
+type OpenRouterPricing struct {
+	Prompt          string `json:"prompt"`
+	Completion      string `json:"completion"`
+	Request         string `json:"request,omitempty"`
+	Image           string `json:"image,omitempty"`
+	InputCacheRead  string `json:"input_cache_read,omitempty"`
+	InputCacheWrite string `json:"input_cache_write,omitempty"`
+}
+
 type OpenRouterModelsResponse struct {
 	Data []OpenRouterModel `json:"data"`
 }
+
+// OpenRouterGeneration 是 OpenRouter 生成统计端点 (/api/v1/generation?id=...) 返回的单次生成信息。
+// native_* 字段为提供商原生分词器统计的 token 数，total_cost 为实际扣费金额（美元）。
+type OpenRouterGeneration struct {
+	ID                     string  `json:"id"`
+	Model                  string  `json:"model"`
+	ProviderName           string  `json:"provider_name"`
+	TotalCost              float64 `json:"total_cost"`
+	CacheDiscount          float64 `json:"cache_discount"`
+	TokensPrompt           int     `json:"tokens_prompt"`
+	TokensCompletion       int     `json:"tokens_completion"`
+	NativeTokensPrompt     int     `json:"native_tokens_prompt"`
+	NativeTokensCompletion int     `json:"native_tokens_completion"`
+	NativeTokensReasoning  int     `json:"native_tokens_reasoning"`
+	NativeTokensCached     int     `json:"native_tokens_cached"`
+	Latency                int     `json:"latency"`         // 首个 token 的延迟（毫秒）
+	GenerationTime         int     `json:"generation_time"` // 生成耗时（毫秒）
+	FinishReason           string  `json:"finish_reason"`
+}
+
+type OpenRouterGenerationResponse struct {
+	Data *OpenRouterGeneration `json:"data"`
+}
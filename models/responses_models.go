@@ -0,0 +1,120 @@
+// models/responses_models.go
+package models
+
+import "encoding/json"
+
+// --- OpenAI Responses API (/v1/responses) 兼容模型 ---
+
+// ResponsesRequest 表示对 /v1/responses 的请求结构。
+type ResponsesRequest struct {
+	Model              string            `json:"model"`
+	Input              json.RawMessage   `json:"input"`                          // 字符串或输入项数组
+	Instructions       string            `json:"instructions,omitempty"`         // 作为 system 消息插入，不会沿 previous_response_id 链继承
+	PreviousResponseID *string           `json:"previous_response_id,omitempty"` // 要续接的已存储响应 ID
+	Stream             bool              `json:"stream,omitempty"`
+	Store              *bool             `json:"store,omitempty"` // 是否存储响应，默认 true
+	MaxOutputTokens    *int              `json:"max_output_tokens,omitempty"`
+	Temperature        *float64          `json:"temperature,omitempty"`
+	TopP               *float64          `json:"top_p,omitempty"`
+	Tools              []ResponsesTool   `json:"tools,omitempty"`
+	ToolChoice         interface{}       `json:"tool_choice,omitempty"` // "auto" / "none" / "required" 或 {"type":"function","name":...}
+	Text               *ResponsesText    `json:"text,omitempty"`
+	User               *string           `json:"user,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+// ResponsesTool 表示 Responses API 的工具定义（扁平结构，仅支持 function 类型）。
+type ResponsesTool struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// ResponsesText 控制文本输出格式（结构化输出）。
+type ResponsesText struct {
+	Format *ResponsesTextFormat `json:"format,omitempty"`
+}
+
+// ResponsesTextFormat 文本输出格式：text、json_object 或 json_schema。
+type ResponsesTextFormat struct {
+	Type   string          `json:"type"`
+	Name   string          `json:"name,omitempty"`
+	Schema json.RawMessage `json:"schema,omitempty"`
+	Strict *bool           `json:"strict,omitempty"`
+}
+
+// ResponsesInputItem 表示 input 数组中的单个输入项。
+// 普通消息的 Type 为 "message"（可省略），工具调用及其结果分别为 "function_call" 和 "function_call_output"。
+type ResponsesInputItem struct {
+	Type    string          `json:"type,omitempty"`
+	Role    string          `json:"role,omitempty"`
+	Content json.RawMessage `json:"content,omitempty"` // 字符串或内容部件数组
+
+	// type = "function_call" / "function_call_output"
+	CallID    string `json:"call_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+	Output    string `json:"output,omitempty"`
+}
+
+// ResponsesContentPart 表示输入或输出消息中的单个内容部件。
+type ResponsesContentPart struct {
+	Type        string        `json:"type"` // input_text、input_image、output_text、refusal
+	Text        string        `json:"text,omitempty"`
+	ImageURL    string        `json:"image_url,omitempty"`
+	Refusal     string        `json:"refusal,omitempty"`
+	Annotations []interface{} `json:"annotations"` // 输出文本的引用标注（本代理不生成标注，始终为空数组）
+}
+
+// ResponsesOutputItem 表示响应 output 数组中的单个输出项（message 或 function_call）。
+type ResponsesOutputItem struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Status string `json:"status"`
+
+	// type = "message"
+	Role    string                 `json:"role,omitempty"`
+	Content []ResponsesContentPart `json:"content,omitempty"`
+
+	// type = "function_call"
+	CallID    string `json:"call_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+}
+
+// ResponsesUsage Responses API 格式的用量统计。
+type ResponsesUsage struct {
+	InputTokens        int `json:"input_tokens"`
+	InputTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+	OutputTokens        int `json:"output_tokens"`
+	OutputTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"output_tokens_details"`
+	TotalTokens int `json:"total_tokens"`
+}
+
+// ResponsesIncompleteDetails 说明响应未完成的原因。
+type ResponsesIncompleteDetails struct {
+	Reason string `json:"reason"` // "max_output_tokens" 或 "content_filter"
+}
+
+// ResponseObject 表示 Responses API 返回的 Response 对象。
+type ResponseObject struct {
+	ID                 string                      `json:"id"`
+	Object             string                      `json:"object"` // 固定为 "response"
+	CreatedAt          int64                       `json:"created_at"`
+	Status             string                      `json:"status"` // in_progress、completed、incomplete、failed
+	Model              string                      `json:"model"`
+	Output             []ResponsesOutputItem       `json:"output"`
+	Usage              *ResponsesUsage             `json:"usage"`
+	Instructions       *string                     `json:"instructions"`
+	PreviousResponseID *string                     `json:"previous_response_id"`
+	IncompleteDetails  *ResponsesIncompleteDetails `json:"incomplete_details"`
+	Error              *ErrorDetail                `json:"error"`
+	Store              bool                        `json:"store"`
+	Metadata           map[string]string           `json:"metadata"`
+}
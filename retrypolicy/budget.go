@@ -0,0 +1,98 @@
+package retrypolicy
+
+import (
+	"openrouter_polling/config"
+	"openrouter_polling/models"
+	"sync"
+	"time"
+)
+
+// Budget 是全局重试预算：统计窗口内的重试次数不超过请求数的 RETRY_BUDGET_RATIO（且总是允许 RETRY_BUDGET_MIN_RETRIES 次），
+// 防止上游大面积出错时每个请求都重试多次，形成重试风暴。方法可以在 nil 上安全调用（不限制重试）。
+type Budget struct {
+	mu      sync.Mutex
+	buckets []budgetBucket
+	denied  int // 自启动以来因预算用尽而放弃的重试次数
+}
+
+type budgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// NewBudget 创建一个全局重试预算，统计窗口为 RETRY_BUDGET_WINDOW_SECONDS。
+func NewBudget() *Budget {
+	seconds := max(int(config.AppSettings.RetryBudgetWindow.Seconds()), 1)
+	return &Budget{buckets: make([]budgetBucket, seconds)}
+}
+
+func (b *Budget) bucketLocked(now time.Time) *budgetBucket {
+	second := now.Unix()
+	bucket := &b.buckets[second%int64(len(b.buckets))]
+	if bucket.second != second {
+		*bucket = budgetBucket{second: second}
+	}
+	return bucket
+}
+
+func (b *Budget) countsLocked(now time.Time) (requests, retries int) {
+	oldest := now.Unix() - int64(len(b.buckets)) + 1
+	for _, bucket := range b.buckets {
+		if bucket.second >= oldest {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	return requests, retries
+}
+
+// RecordRequest 记录一个新的客户端请求（不含重试）。
+func (b *Budget) RecordRequest() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucketLocked(time.Now()).requests++
+}
+
+// AllowRetry 报告预算是否允许再重试一次，允许时计入一次重试。
+func (b *Budget) AllowRetry() bool {
+	if b == nil {
+		return true
+	}
+	settings := config.AppSettings
+	if settings.RetryBudgetRatio <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	requests, retries := b.countsLocked(now)
+	if retries >= settings.RetryBudgetMinRetries && float64(retries) >= settings.RetryBudgetRatio*float64(requests) {
+		b.denied++
+		return false
+	}
+	b.bucketLocked(now).retries++
+	return true
+}
+
+// Status 返回重试预算的快照，用于 /admin/app-status。
+func (b *Budget) Status() models.RetryBudgetStatus {
+	settings := config.AppSettings
+	status := models.RetryBudgetStatus{
+		Enabled:    settings.RetryBudgetRatio > 0,
+		Ratio:      settings.RetryBudgetRatio,
+		MinRetries: settings.RetryBudgetMinRetries,
+	}
+	if b == nil {
+		return status
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status.WindowSeconds = len(b.buckets)
+	status.Requests, status.Retries = b.countsLocked(time.Now())
+	status.Denied = b.denied
+	return status
+}
@@ -0,0 +1,63 @@
+package retrypolicy
+
+import (
+	"openrouter_polling/config"
+	"testing"
+	"time"
+)
+
+func TestBudgetAllowRetry(t *testing.T) {
+	useTestSettings(t)
+	config.AppSettings.RetryBudgetRatio = 0.5
+	config.AppSettings.RetryBudgetMinRetries = 2
+	config.AppSettings.RetryBudgetWindow = time.Minute
+	budget := NewBudget()
+
+	// 请求很少时仍允许 RETRY_BUDGET_MIN_RETRIES 次重试。
+	budget.RecordRequest()
+	for i := range 2 {
+		if !budget.AllowRetry() {
+			t.Fatalf("第 %d 次重试被拒绝, 期望总是允许最少重试次数", i+1)
+		}
+	}
+	if budget.AllowRetry() {
+		t.Fatal("超过最少重试次数且超过比例后期望拒绝重试")
+	}
+
+	// 请求增加后按比例放开：12 个请求最多 6 次重试（已用 2 次）。
+	for range 11 {
+		budget.RecordRequest()
+	}
+	for i := range 4 {
+		if !budget.AllowRetry() {
+			t.Fatalf("第 %d 次额外重试被拒绝, 期望在比例内允许", i+1)
+		}
+	}
+	if budget.AllowRetry() {
+		t.Error("达到比例后期望拒绝重试")
+	}
+
+	status := budget.Status()
+	if !status.Enabled || status.Requests != 12 || status.Retries != 6 || status.Denied != 2 || status.WindowSeconds != 60 {
+		t.Errorf("预算状态 = %+v, 期望 12 个请求、6 次重试、2 次拒绝", status)
+	}
+}
+
+func TestBudgetDisabled(t *testing.T) {
+	useTestSettings(t)
+	config.AppSettings.RetryBudgetRatio = 0
+	config.AppSettings.RetryBudgetMinRetries = 0
+	config.AppSettings.RetryBudgetWindow = time.Minute
+	budget := NewBudget()
+	for range 5 {
+		if !budget.AllowRetry() {
+			t.Fatal("RETRY_BUDGET_RATIO 为 0 时期望不限制重试")
+		}
+	}
+
+	var nilBudget *Budget
+	nilBudget.RecordRequest()
+	if !nilBudget.AllowRetry() {
+		t.Error("nil 预算期望不限制重试")
+	}
+}
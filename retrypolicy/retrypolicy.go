@@ -0,0 +1,146 @@
+package retrypolicy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"openrouter_polling/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy 是一个请求的重试策略：哪些错误可以重试、在同一个密钥还是新密钥上重试、重试前等待多久以及总时长上限。
+type Policy struct {
+	MaxRetries        int
+	RetryOn           string // 逗号分隔的可重试错误类型，* 表示所有需要换密钥重试的错误
+	SameKeyOn         string // 逗号分隔的错误类型，这些错误在同一个密钥上重试
+	BackoffBase       time.Duration
+	BackoffMax        time.Duration
+	BackoffMultiplier float64
+	BackoffJitter     float64
+	Deadline          time.Duration // 所有尝试（含等待）的总时长上限，0 表示不限制
+}
+
+// Override 是 RETRY_POLICY_MODELS 中单个模型的策略覆盖，未设置的字段沿用全局配置。
+type Override struct {
+	MaxRetries        *int     `json:"max_retries"`
+	RetryOn           *string  `json:"retry_on"`
+	SameKeyOn         *string  `json:"same_key_on"`
+	BackoffBaseMs     *int     `json:"backoff_base_ms"`
+	BackoffMaxMs      *int     `json:"backoff_max_ms"`
+	BackoffMultiplier *float64 `json:"backoff_multiplier"`
+	BackoffJitter     *float64 `json:"backoff_jitter"`
+	DeadlineSeconds   *int     `json:"deadline_seconds"`
+}
+
+// 解析后的 RETRY_POLICY_MODELS 缓存，配置热更新后按新的原始字符串重新解析。
+var (
+	overridesMu  sync.Mutex
+	overridesRaw string
+	overrides    map[string]Override
+)
+
+// ParseOverrides 解析 RETRY_POLICY_MODELS，格式为以模型为键的 JSON 对象，例如
+// {"openai/gpt-4o": {"max_retries": 1, "deadline_seconds": 30}}。空字符串表示没有覆盖。
+func ParseOverrides(raw string) (map[string]Override, error) {
+	result := make(map[string]Override)
+	if strings.TrimSpace(raw) == "" {
+		return result, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("RETRY_POLICY_MODELS 不是有效的 JSON 对象: %w", err)
+	}
+	return result, nil
+}
+
+func overrideFor(model string) (Override, bool) {
+	raw := config.AppSettings.RetryPolicyModels
+	overridesMu.Lock()
+	defer overridesMu.Unlock()
+	if raw != overridesRaw || overrides == nil {
+		parsed, err := ParseOverrides(raw)
+		if err != nil {
+			parsed = map[string]Override{} // 启动时和热更新时已校验，这里只做保护
+		}
+		overridesRaw, overrides = raw, parsed
+	}
+	if o, ok := overrides[model]; ok {
+		return o, true
+	}
+	o, ok := overrides["*"]
+	return o, ok
+}
+
+// For 返回模型的重试策略：全局配置叠加 RETRY_POLICY_MODELS 中该模型（或 *）的覆盖。
+func For(model string) Policy {
+	settings := config.AppSettings
+	policy := Policy{
+		MaxRetries:        settings.RetryWithNewKeyCount,
+		RetryOn:           settings.RetryOnErrorTypes,
+		SameKeyOn:         settings.RetrySameKeyErrorTypes,
+		BackoffBase:       settings.RetryBackoffBase,
+		BackoffMax:        settings.RetryBackoffMax,
+		BackoffMultiplier: settings.RetryBackoffMultiplier,
+		BackoffJitter:     settings.RetryBackoffJitter,
+		Deadline:          settings.RetryDeadline,
+	}
+	o, ok := overrideFor(model)
+	if !ok {
+		return policy
+	}
+	if o.MaxRetries != nil {
+		policy.MaxRetries = *o.MaxRetries
+	}
+	if o.RetryOn != nil {
+		policy.RetryOn = *o.RetryOn
+	}
+	if o.SameKeyOn != nil {
+		policy.SameKeyOn = *o.SameKeyOn
+	}
+	if o.BackoffBaseMs != nil {
+		policy.BackoffBase = time.Duration(*o.BackoffBaseMs) * time.Millisecond
+	}
+	if o.BackoffMaxMs != nil {
+		policy.BackoffMax = time.Duration(*o.BackoffMaxMs) * time.Millisecond
+	}
+	if o.BackoffMultiplier != nil {
+		policy.BackoffMultiplier = *o.BackoffMultiplier
+	}
+	if o.BackoffJitter != nil {
+		policy.BackoffJitter = *o.BackoffJitter
+	}
+	if o.DeadlineSeconds != nil {
+		policy.Deadline = time.Duration(*o.DeadlineSeconds) * time.Second
+	}
+	return policy
+}
+
+// Retryable 报告该错误类型是否允许重试。
+func (p Policy) Retryable(errType string) bool {
+	return config.ListContains(p.RetryOn, errType)
+}
+
+// SameKey 报告该错误类型是否在同一个密钥上重试（而不是换一个新密钥）。
+func (p Policy) SameKey(errType string) bool {
+	return config.ListContains(p.SameKeyOn, errType)
+}
+
+// Backoff 返回第 retry 次重试（从 0 开始）前的等待时间：BackoffBase × BackoffMultiplier^retry，
+// 不超过 BackoffMax，并在 ±BackoffJitter 的比例内随机抖动，避免大量请求同时重试。
+func (p Policy) Backoff(retry int) time.Duration {
+	if p.BackoffBase <= 0 {
+		return 0
+	}
+	delay := float64(p.BackoffBase) * math.Pow(max(p.BackoffMultiplier, 1), float64(retry))
+	if p.BackoffMax > 0 {
+		delay = min(delay, float64(p.BackoffMax))
+	}
+	if jitter := min(max(p.BackoffJitter, 0), 1); jitter > 0 {
+		delay *= 1 + jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(delay)
+}
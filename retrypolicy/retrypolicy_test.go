@@ -0,0 +1,108 @@
+package retrypolicy
+
+import (
+	"openrouter_polling/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestSettings 设置全局重试配置，测试结束后恢复。
+func useTestSettings(t *testing.T) {
+	t.Helper()
+	prevSettings := config.AppSettings
+	t.Cleanup(func() { config.AppSettings = prevSettings })
+	config.AppSettings.RetryWithNewKeyCount = 3
+	config.AppSettings.RetryOnErrorTypes = "*"
+	config.AppSettings.RetrySameKeyErrorTypes = ""
+	config.AppSettings.RetryBackoffBase = 250 * time.Millisecond
+	config.AppSettings.RetryBackoffMax = 5 * time.Second
+	config.AppSettings.RetryBackoffMultiplier = 2
+	config.AppSettings.RetryBackoffJitter = 0.2
+	config.AppSettings.RetryDeadline = 0
+	config.AppSettings.RetryPolicyModels = ""
+}
+
+func TestParseOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr string
+		want    int // 解析出的模型数
+	}{
+		{"空字符串表示没有覆盖", "  ", "", 0},
+		{"按模型解析", `{"openai/gpt-4o":{"max_retries":1,"deadline_seconds":30},"*":{"retry_on":"rate_limit_error"}}`, "", 2},
+		{"未知字段报错", `{"openai/gpt-4o":{"max_retry":1}}`, "max_retry", 0},
+		{"不是 JSON 对象时报错", `[1,2]`, "RETRY_POLICY_MODELS", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseOverrides(tt.raw)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("错误 = %v, 期望包含 %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("解析出 %d 个模型, 期望 %d", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestForLayersModelOverrides(t *testing.T) {
+	useTestSettings(t)
+	config.AppSettings.RetryPolicyModels = `{"openai/gpt-4o":{"max_retries":1,"backoff_base_ms":100,"deadline_seconds":30},"*":{"retry_on":"rate_limit_error"}}`
+
+	exact := For("openai/gpt-4o")
+	if exact.MaxRetries != 1 || exact.BackoffBase != 100*time.Millisecond || exact.Deadline != 30*time.Second {
+		t.Errorf("精确匹配的策略 = %+v, 期望使用模型的覆盖", exact)
+	}
+	if exact.RetryOn != "*" || exact.BackoffMax != 5*time.Second || exact.BackoffMultiplier != 2 {
+		t.Errorf("精确匹配的策略 = %+v, 期望未覆盖的字段沿用全局配置（且不叠加 * 的覆盖）", exact)
+	}
+
+	wildcard := For("anthropic/claude")
+	if wildcard.RetryOn != "rate_limit_error" || wildcard.MaxRetries != 3 {
+		t.Errorf("其他模型的策略 = %+v, 期望使用 * 的覆盖", wildcard)
+	}
+	if !wildcard.Retryable("rate_limit_error") || wildcard.Retryable("upstream_server_error") {
+		t.Error("期望只重试 rate_limit_error")
+	}
+
+	// 配置热更新后按新的配置重新解析。
+	config.AppSettings.RetryPolicyModels = ""
+	if got := For("openai/gpt-4o"); got.MaxRetries != 3 || got.Deadline != 0 {
+		t.Errorf("清空覆盖后的策略 = %+v, 期望使用全局配置", got)
+	}
+}
+
+func TestBackoffIsCappedAndJittered(t *testing.T) {
+	policy := Policy{BackoffBase: 100 * time.Millisecond, BackoffMax: time.Second, BackoffMultiplier: 2}
+	for retry, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		if got := policy.Backoff(retry); got != want {
+			t.Errorf("第 %d 次重试的等待时间 = %v, 期望 %v", retry, got, want)
+		}
+	}
+
+	policy.BackoffJitter = 0.2
+	seen := make(map[time.Duration]bool)
+	for range 200 {
+		got := policy.Backoff(10)
+		if got < 800*time.Millisecond || got > 1200*time.Millisecond {
+			t.Fatalf("带抖动的等待时间 = %v, 期望在上限的 ±20%% 以内", got)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Error("期望等待时间随机抖动")
+	}
+
+	if got := (Policy{BackoffMultiplier: 2}).Backoff(3); got != 0 {
+		t.Errorf("BackoffBase 为 0 时等待时间 = %v, 期望 0", got)
+	}
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrFileNotFound  = errors.New("file not found in the database")
+	ErrBatchNotFound = errors.New("batch not found in the database")
+)
+
+// BatchStore 提供了与数据库中 StoredFile、Batch 和 BatchRequest 表交互的方法。
+type BatchStore struct {
+	db *gorm.DB
+}
+
+// NewBatchStore 创建一个新的 BatchStore 实例。
+func NewBatchStore(db *gorm.DB) *BatchStore {
+	return &BatchStore{db: db}
+}
+
+// CreateFile 保存一个文件。
+func (s *BatchStore) CreateFile(file *StoredFile) error {
+	return s.db.Create(file).Error
+}
+
+// GetFile 按文件 ID 和客户端名称获取文件（含内容）；其他客户端的文件视为不存在。
+func (s *BatchStore) GetFile(fileID, clientID string) (*StoredFile, error) {
+	var file StoredFile
+	result := s.db.Where("file_id = ? AND client_id = ?", fileID, clientID).First(&file)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrFileNotFound
+		}
+		return nil, result.Error
+	}
+	return &file, nil
+}
+
+// ListFiles 返回客户端的文件（不含内容），按创建时间倒序。purpose 为空时不过滤。
+func (s *BatchStore) ListFiles(clientID, purpose string) ([]StoredFile, error) {
+	query := s.db.Omit("content").Where("client_id = ?", clientID)
+	if purpose != "" {
+		query = query.Where("purpose = ?", purpose)
+	}
+	var files []StoredFile
+	err := query.Order("id DESC").Find(&files).Error
+	return files, err
+}
+
+// DeleteFile 按文件 ID 和客户端名称删除文件。
+func (s *BatchStore) DeleteFile(fileID, clientID string) error {
+	result := s.db.Where("file_id = ? AND client_id = ?", fileID, clientID).Delete(&StoredFile{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrFileNotFound
+	}
+	return nil
+}
+
+// CreateBatch 保存一个新的批处理。
+func (s *BatchStore) CreateBatch(batch *Batch) error {
+	return s.db.Create(batch).Error
+}
+
+// GetBatch 按批处理 ID 和客户端名称获取批处理；其他客户端的批处理视为不存在。
+func (s *BatchStore) GetBatch(batchID, clientID string) (*Batch, error) {
+	var batch Batch
+	result := s.db.Where("batch_id = ? AND client_id = ?", batchID, clientID).First(&batch)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrBatchNotFound
+		}
+		return nil, result.Error
+	}
+	return &batch, nil
+}
+
+// ListBatches 按创建时间倒序返回客户端的批处理。after 为上一页最后一个批处理的 ID，用于分页；
+// 返回 limit+1 条以便调用者判断是否还有更多。
+func (s *BatchStore) ListBatches(clientID, after string, limit int) ([]Batch, error) {
+	query := s.db.Where("client_id = ?", clientID)
+	if after != "" {
+		var cursor Batch
+		if err := s.db.Select("id").Where("batch_id = ? AND client_id = ?", after, clientID).First(&cursor).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrBatchNotFound
+			}
+			return nil, err
+		}
+		query = query.Where("id < ?", cursor.ID)
+	}
+	var batches []Batch
+	err := query.Order("id DESC").Limit(limit + 1).Find(&batches).Error
+	return batches, err
+}
+
+// ListUnfinishedBatches 返回尚未结束的批处理，用于服务重启后恢复执行。
+func (s *BatchStore) ListUnfinishedBatches() ([]Batch, error) {
+	var batches []Batch
+	err := s.db.Where("status IN ?", []string{BatchStatusValidating, BatchStatusInProgress, BatchStatusFinalizing, BatchStatusCancelling}).
+		Order("id").Find(&batches).Error
+	return batches, err
+}
+
+// TransitionBatch 仅当批处理当前处于 from 中的某个状态时才应用 updates，返回是否更新成功。
+// 用于避免处理器（如取消）与后台执行协程的状态变更互相覆盖。
+func (s *BatchStore) TransitionBatch(batchID string, from []string, updates map[string]interface{}) (bool, error) {
+	result := s.db.Model(&Batch{}).Where("batch_id = ? AND status IN ?", batchID, from).Updates(updates)
+	return result.RowsAffected > 0, result.Error
+}
+
+// StartBatch 保存校验通过的请求并将批处理从 validating 切换为 in_progress。
+// 批处理已不处于 validating（例如已被取消）时不保存任何内容并返回 false。
+func (s *BatchStore) StartBatch(batchID string, requests []BatchRequest, startedAt time.Time) (bool, error) {
+	started := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// 清除上次校验中断时可能残留的请求
+		if err := tx.Where("batch_id = ?", batchID).Delete(&BatchRequest{}).Error; err != nil {
+			return err
+		}
+		result := tx.Model(&Batch{}).Where("batch_id = ? AND status = ?", batchID, BatchStatusValidating).Updates(map[string]interface{}{
+			"status":          BatchStatusInProgress,
+			"in_progress_at":  startedAt,
+			"total_count":     len(requests),
+			"completed_count": 0,
+			"failed_count":    0,
+		})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		started = true
+		return tx.CreateInBatches(requests, 500).Error
+	})
+	return started, err
+}
+
+// ListPendingBatchRequests 按行号顺序返回批处理中尚未执行完成的请求。
+func (s *BatchStore) ListPendingBatchRequests(batchID string) ([]BatchRequest, error) {
+	var requests []BatchRequest
+	err := s.db.Where("batch_id = ? AND status = ?", batchID, BatchRequestStatusPending).Order("line_index").Find(&requests).Error
+	return requests, err
+}
+
+// ListFinishedBatchRequests 按行号顺序返回批处理中已执行完成（成功或失败）的请求。
+func (s *BatchStore) ListFinishedBatchRequests(batchID string) ([]BatchRequest, error) {
+	var requests []BatchRequest
+	err := s.db.Where("batch_id = ? AND status IN ?", batchID, []string{BatchRequestStatusCompleted, BatchRequestStatusFailed}).
+		Order("line_index").Find(&requests).Error
+	return requests, err
+}
+
+// RecordBatchRequestResult 保存单个请求的最终结果，并在同一事务中累加批处理的完成或失败计数。
+func (s *BatchStore) RecordBatchRequestResult(request *BatchRequest) error {
+	counter := "completed_count"
+	if request.Status == BatchRequestStatusFailed {
+		counter = "failed_count"
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(request).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Batch{}).Where("batch_id = ?", request.BatchID).
+			UpdateColumn(counter, gorm.Expr(counter+" + ?", 1)).Error
+	})
+}
+
+// ExpirePendingBatchRequests 将批处理中所有未执行的请求标记为失败（状态码为 0），并累加失败计数。
+func (s *BatchStore) ExpirePendingBatchRequests(batchID string) (int64, error) {
+	var expired int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&BatchRequest{}).Where("batch_id = ? AND status = ?", batchID, BatchRequestStatusPending).
+			Updates(map[string]interface{}{"status": BatchRequestStatusFailed, "status_code": 0})
+		if result.Error != nil {
+			return result.Error
+		}
+		expired = result.RowsAffected
+		return tx.Model(&Batch{}).Where("batch_id = ?", batchID).
+			UpdateColumn("failed_count", gorm.Expr("failed_count + ?", expired)).Error
+	})
+	return expired, err
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CaptureStore 将请求/响应内容捕获保存在数据库 payload_captures 表中。
+type CaptureStore struct {
+	db *gorm.DB
+}
+
+// NewCaptureStore 创建一个新的 CaptureStore 实例。
+func NewCaptureStore(db *gorm.DB) *CaptureStore {
+	return &CaptureStore{db: db}
+}
+
+// SaveCapture 保存一条捕获。同一客户端的请求 ID 已存在时返回错误，不覆盖已有记录。
+func (s *CaptureStore) SaveCapture(capture *PayloadCapture) error {
+	return s.db.Create(capture).Error
+}
+
+// FindCaptures 按请求 ID 查找捕获；clientID 不为空时只返回该客户端的捕获。
+// 请求 ID 可由客户端提供，不同客户端可能使用相同的 ID，因此可能返回多条。
+func (s *CaptureStore) FindCaptures(requestID, clientID string) ([]PayloadCapture, error) {
+	query := s.db.Where("request_id = ?", requestID)
+	if clientID != "" {
+		query = query.Where("client_id = ?", clientID)
+	}
+	var captures []PayloadCapture
+	err := query.Order("id").Find(&captures).Error
+	return captures, err
+}
+
+// DeleteCapturesBefore 删除 cutoff 之前创建的捕获，返回删除的条数。
+func (s *CaptureStore) DeleteCapturesBefore(cutoff time.Time) (int64, error) {
+	result := s.db.Where("created_at < ?", cutoff).Delete(&PayloadCapture{})
+	return result.RowsAffected, result.Error
+}
+
+// FileCaptureStore 将每条捕获保存为 <目录>/<客户端>/<请求 ID>.json 文件。
+type FileCaptureStore struct {
+	dir string
+}
+
+// NewFileCaptureStore 创建一个新的 FileCaptureStore 实例，目录不存在时自动创建。
+func NewFileCaptureStore(dir string) (*FileCaptureStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileCaptureStore{dir: dir}, nil
+}
+
+// safePathSegment 判断名称能否安全地用作单级文件名（不含路径分隔符、不以 . 开头）。
+func safePathSegment(name string) bool {
+	return name != "" && name == filepath.Base(name) && !strings.HasPrefix(name, ".")
+}
+
+// pathFor 返回捕获对应的文件路径；客户端名称或请求 ID 含有路径分隔符等不安全字符时返回 false。
+func (s *FileCaptureStore) pathFor(clientID, requestID string) (string, bool) {
+	if !safePathSegment(clientID) || !safePathSegment(requestID) {
+		return "", false
+	}
+	return filepath.Join(s.dir, clientID, requestID+".json"), true
+}
+
+// SaveCapture 保存一条捕获。同一客户端的请求 ID 已存在时返回错误，不覆盖已有文件。
+func (s *FileCaptureStore) SaveCapture(capture *PayloadCapture) error {
+	path, ok := s.pathFor(capture.ClientID, capture.RequestID)
+	if !ok {
+		return errors.New("invalid client or request id for payload capture file")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	if capture.CreatedAt.IsZero() {
+		capture.CreatedAt = time.Now()
+	}
+	data, err := json.Marshal(capture)
+	if err != nil {
+		return err
+	}
+	// 先写入临时文件再以硬链接发布：避免读取到写了一半的文件，且目标已存在时失败而不是覆盖
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".capture-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Link(tmp.Name(), path)
+}
+
+// FindCaptures 按请求 ID 查找捕获；clientID 不为空时只读取该客户端的捕获。
+func (s *FileCaptureStore) FindCaptures(requestID, clientID string) ([]PayloadCapture, error) {
+	clientIDs := []string{clientID}
+	if clientID == "" {
+		entries, err := os.ReadDir(s.dir)
+		if err != nil {
+			return nil, err
+		}
+		clientIDs = clientIDs[:0]
+		for _, entry := range entries {
+			if entry.IsDir() {
+				clientIDs = append(clientIDs, entry.Name())
+			}
+		}
+	}
+	var captures []PayloadCapture
+	for _, id := range clientIDs {
+		path, ok := s.pathFor(id, requestID)
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		var capture PayloadCapture
+		if err := json.Unmarshal(data, &capture); err != nil {
+			return nil, err
+		}
+		captures = append(captures, capture)
+	}
+	return captures, nil
+}
+
+// DeleteCapturesBefore 删除修改时间早于 cutoff 的捕获文件，返回删除的文件数。
+func (s *FileCaptureStore) DeleteCapturesBefore(cutoff time.Time) (int64, error) {
+	var deleted int64
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err == nil {
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
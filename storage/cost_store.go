@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrBudgetNotFound = errors.New("budget not found in the database")
+
+// CostReportFilter 费用报表的筛选与分组条件。空字段表示不筛选。
+type CostReportFilter struct {
+	FromDay  string // 起始日期（含），格式 2006-01-02
+	ToDay    string // 结束日期（含）
+	ClientID string
+	Model    string
+	GroupBy  string // 分组维度：day、client、key、model；为空时返回完整明细
+}
+
+// costReportGroupColumns 报表分组维度与数据库列的对应关系。
+var costReportGroupColumns = map[string]string{
+	"day":    "day",
+	"client": "client_id",
+	"key":    "key_suffix",
+	"model":  "model",
+}
+
+// ValidCostReportGroupBy 判断分组维度是否受支持。
+func ValidCostReportGroupBy(groupBy string) bool {
+	_, ok := costReportGroupColumns[groupBy]
+	return groupBy == "" || ok
+}
+
+// CostStore 提供了与数据库中 UsageCost 和 ClientBudget 表交互的方法。
+type CostStore struct {
+	db *gorm.DB
+}
+
+// NewCostStore 创建一个新的 CostStore 实例。
+func NewCostStore(db *gorm.DB) *CostStore {
+	return &CostStore{db: db}
+}
+
+// AddUsage 将一次请求的用量和费用累加到对应的（天、客户端、密钥、模型）行上，行不存在时创建。
+func (s *CostStore) AddUsage(usage *UsageCost) error {
+	return s.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "day"}, {Name: "client_id"}, {Name: "key_suffix"}, {Name: "model"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"requests":          gorm.Expr("requests + ?", usage.Requests),
+			"prompt_tokens":     gorm.Expr("prompt_tokens + ?", usage.PromptTokens),
+			"completion_tokens": gorm.Expr("completion_tokens + ?", usage.CompletionTokens),
+			"cached_tokens":     gorm.Expr("cached_tokens + ?", usage.CachedTokens),
+			"cost_usd":          gorm.Expr("cost_usd + ?", usage.CostUSD),
+			"updated_at":        time.Now(),
+		}),
+	}).Create(usage).Error
+}
+
+// SumClientCost 返回客户端在 [fromDay, toDay] 日期范围内的总费用。
+func (s *CostStore) SumClientCost(clientID, fromDay, toDay string) (float64, error) {
+	var total float64
+	err := s.db.Model(&UsageCost{}).
+		Where("client_id = ? AND day >= ? AND day <= ?", clientID, fromDay, toDay).
+		Select("COALESCE(SUM(cost_usd), 0)").Scan(&total).Error
+	return total, err
+}
+
+// CostReport 按筛选条件查询费用报表。指定 GroupBy 时按该维度汇总，其余维度列为空。
+func (s *CostStore) CostReport(filter CostReportFilter) ([]UsageCost, error) {
+	query := s.db.Model(&UsageCost{})
+	if filter.FromDay != "" {
+		query = query.Where("day >= ?", filter.FromDay)
+	}
+	if filter.ToDay != "" {
+		query = query.Where("day <= ?", filter.ToDay)
+	}
+	if filter.ClientID != "" {
+		query = query.Where("client_id = ?", filter.ClientID)
+	}
+	if filter.Model != "" {
+		query = query.Where("model = ?", filter.Model)
+	}
+
+	var rows []UsageCost
+	column, grouped := costReportGroupColumns[filter.GroupBy]
+	if !grouped {
+		err := query.Order("day DESC, client_id, key_suffix, model").Find(&rows).Error
+		return rows, err
+	}
+	err := query.
+		Select(column + ", SUM(requests) AS requests, SUM(prompt_tokens) AS prompt_tokens, SUM(completion_tokens) AS completion_tokens, SUM(cached_tokens) AS cached_tokens, SUM(cost_usd) AS cost_usd").
+		Group(column).Order(column).Scan(&rows).Error
+	return rows, err
+}
+
+// ListBudgets 返回所有客户端预算。
+func (s *CostStore) ListBudgets() ([]ClientBudget, error) {
+	var budgets []ClientBudget
+	err := s.db.Order("client_id").Find(&budgets).Error
+	return budgets, err
+}
+
+// GetBudget 获取指定客户端的预算。
+func (s *CostStore) GetBudget(clientID string) (*ClientBudget, error) {
+	var budget ClientBudget
+	result := s.db.Where("client_id = ?", clientID).First(&budget)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrBudgetNotFound
+		}
+		return nil, result.Error
+	}
+	return &budget, nil
+}
+
+// SaveBudget 创建或更新客户端预算。
+func (s *CostStore) SaveBudget(budget *ClientBudget) error {
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "client_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"daily_limit_usd", "monthly_limit_usd", "warn_threshold", "updated_at"}),
+	}).Create(budget).Error
+}
+
+// DeleteBudget 删除客户端预算。
+func (s *CostStore) DeleteBudget(clientID string) error {
+	result := s.db.Where("client_id = ?", clientID).Delete(&ClientBudget{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrBudgetNotFound
+	}
+	return nil
+}
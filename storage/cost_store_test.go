@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+func newTestCostStore(t *testing.T) *CostStore {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatalf("打开测试数据库失败: %v", err)
+	}
+	if err := db.AutoMigrate(&UsageCost{}, &ClientBudget{}); err != nil {
+		t.Fatalf("迁移测试数据库失败: %v", err)
+	}
+	return NewCostStore(db)
+}
+
+func TestCostStoreAccumulatesAndReports(t *testing.T) {
+	store := newTestCostStore(t)
+	usages := []UsageCost{
+		{Day: "2026-01-01", ClientID: "alice", KeySuffix: "0001", Model: "model/a", Requests: 1, PromptTokens: 100, CompletionTokens: 10, CachedTokens: 40, CostUSD: 0.5},
+		{Day: "2026-01-01", ClientID: "alice", KeySuffix: "0001", Model: "model/a", Requests: 1, PromptTokens: 200, CompletionTokens: 20, CostUSD: 1},
+		{Day: "2026-01-01", ClientID: "bob", KeySuffix: "0002", Model: "model/b", Requests: 1, PromptTokens: 50, CompletionTokens: 5, CostUSD: 2},
+		{Day: "2026-01-02", ClientID: "alice", KeySuffix: "0002", Model: "model/b", Requests: 1, PromptTokens: 10, CompletionTokens: 1, CostUSD: 4},
+	}
+	for i := range usages {
+		if err := store.AddUsage(&usages[i]); err != nil {
+			t.Fatalf("累计用量失败: %v", err)
+		}
+	}
+
+	// 相同的（天、客户端、密钥、模型）累加到同一行。
+	rows, err := store.CostReport(CostReportFilter{ClientID: "alice", FromDay: "2026-01-01", ToDay: "2026-01-01"})
+	if err != nil {
+		t.Fatalf("查询费用报表失败: %v", err)
+	}
+	if len(rows) != 1 || rows[0].Requests != 2 || rows[0].PromptTokens != 300 || rows[0].CachedTokens != 40 || rows[0].CostUSD != 1.5 {
+		t.Errorf("明细 = %+v, 期望累加为一行", rows)
+	}
+
+	rows, err = store.CostReport(CostReportFilter{GroupBy: "client"})
+	if err != nil {
+		t.Fatalf("查询费用报表失败: %v", err)
+	}
+	if len(rows) != 2 || rows[0].ClientID != "alice" || rows[0].CostUSD != 5.5 || rows[0].Requests != 3 || rows[1].ClientID != "bob" || rows[1].CostUSD != 2 {
+		t.Errorf("按客户端汇总 = %+v, 期望 alice $5.5 (3 次)、bob $2", rows)
+	}
+	if rows[0].Model != "" || rows[0].Day != "" {
+		t.Errorf("按客户端汇总时其他维度 = %+v, 期望为空", rows[0])
+	}
+
+	rows, err = store.CostReport(CostReportFilter{Model: "model/b", GroupBy: "day"})
+	if err != nil {
+		t.Fatalf("查询费用报表失败: %v", err)
+	}
+	if len(rows) != 2 || rows[0].Day != "2026-01-01" || rows[0].CostUSD != 2 || rows[1].Day != "2026-01-02" || rows[1].CostUSD != 4 {
+		t.Errorf("按天汇总 model/b = %+v, 期望按日期排序", rows)
+	}
+
+	total, err := store.SumClientCost("alice", "2026-01-02", "2026-01-31")
+	if err != nil {
+		t.Fatalf("统计客户端费用失败: %v", err)
+	}
+	if total != 4 {
+		t.Errorf("alice 自 2026-01-02 的费用 = %v, 期望 4", total)
+	}
+	if total, _ := store.SumClientCost("carol", "2026-01-01", "2026-01-31"); total != 0 {
+		t.Errorf("没有用量的客户端费用 = %v, 期望 0", total)
+	}
+}
+
+func TestValidCostReportGroupBy(t *testing.T) {
+	for _, groupBy := range []string{"", "day", "client", "key", "model"} {
+		if !ValidCostReportGroupBy(groupBy) {
+			t.Errorf("ValidCostReportGroupBy(%q) = false, 期望 true", groupBy)
+		}
+	}
+	if ValidCostReportGroupBy("week") {
+		t.Error("ValidCostReportGroupBy(\"week\") = true, 期望 false")
+	}
+}
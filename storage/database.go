@@ -82,11 +82,19 @@ func InitDB(logger *logrus.Logger) (*gorm.DB, error) {
 // migrateSchema 负责自动迁移数据库表结构。
 func migrateSchema() error {
 	Log.Info("正在执行数据库模式自动迁移...")
-	err := DB.AutoMigrate(&APIKey{})
+	err := DB.AutoMigrate(&APIKey{}, &StoredResponse{}, &RateLimitBucket{}, &UsageCost{}, &ClientBudget{}, &GenerationRecord{}, &AsyncJob{}, &StoredFile{}, &Batch{}, &BatchRequest{}, &PayloadCapture{}, &KeyEvent{})
 	if err != nil {
 		Log.Errorf("数据库模式迁移失败: %v", err)
 		return err
 	}
+	// payload_captures 早期版本只按 request_id 建立唯一索引，现改为 (request_id, client_id)；删除旧索引，
+	// 否则不同客户端使用相同的 X-Request-ID 时后一条捕获无法保存。
+	if DB.Migrator().HasIndex(&PayloadCapture{}, "idx_payload_captures_request_id") {
+		if err := DB.Migrator().DropIndex(&PayloadCapture{}, "idx_payload_captures_request_id"); err != nil {
+			Log.Errorf("删除 payload_captures 的旧索引失败: %v", err)
+			return err
+		}
+	}
 	Log.Info("数据库模式迁移完成。")
 	return nil
 }
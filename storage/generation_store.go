@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrGenerationNotFound = errors.New("generation record not found in the database")
+
+// GenerationStore 提供了与数据库中 GenerationRecord 表交互的方法。
+type GenerationStore struct {
+	db *gorm.DB
+}
+
+// NewGenerationStore 创建一个新的 GenerationStore 实例。
+func NewGenerationStore(db *gorm.DB) *GenerationStore {
+	return &GenerationStore{db: db}
+}
+
+// CreateGeneration 创建一条待补全统计的生成记录。相同生成 ID 的记录已存在时忽略。
+func (s *GenerationStore) CreateGeneration(record *GenerationRecord) error {
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(record).Error
+}
+
+// UpdateGeneration 按生成 ID 更新记录中的统计字段和状态。
+func (s *GenerationStore) UpdateGeneration(record *GenerationRecord) error {
+	result := s.db.Model(&GenerationRecord{}).Where("generation_id = ?", record.GenerationID).
+		Select("status", "attempts", "next_attempt_at", "last_error", "provider_name",
+			"native_prompt_tokens", "native_completion_tokens", "native_reasoning_tokens", "native_cached_tokens",
+			"total_cost_usd", "latency_ms", "generation_time_ms", "finish_reason").
+		Updates(record)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrGenerationNotFound
+	}
+	return nil
+}
+
+// ListDueGenerations 返回到期需要查询生成统计的待补全记录（按计划时间先后），最多 limit 条。
+// 记录保存在数据库中，服务重启后未完成的查询会从这里恢复。
+func (s *GenerationStore) ListDueGenerations(now time.Time, limit int) ([]GenerationRecord, error) {
+	var records []GenerationRecord
+	err := s.db.Where("status = ? AND (next_attempt_at IS NULL OR next_attempt_at <= ?)", GenerationStatusPending, now).
+		Order("next_attempt_at").Limit(limit).Find(&records).Error
+	return records, err
+}
+
+// GetGeneration 按生成 ID 获取记录。
+func (s *GenerationStore) GetGeneration(generationID string) (*GenerationRecord, error) {
+	var record GenerationRecord
+	result := s.db.Where("generation_id = ?", generationID).First(&record)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrGenerationNotFound
+		}
+		return nil, result.Error
+	}
+	return &record, nil
+}
+
+// ListGenerations 按创建时间倒序返回最近的生成记录。clientID 或 status 为空时不筛选。
+func (s *GenerationStore) ListGenerations(clientID, status string, limit int) ([]GenerationRecord, error) {
+	query := s.db.Model(&GenerationRecord{})
+	if clientID != "" {
+		query = query.Where("client_id = ?", clientID)
+	}
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var records []GenerationRecord
+	err := query.Order("id DESC").Limit(limit).Find(&records).Error
+	return records, err
+}
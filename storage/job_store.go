@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+var ErrJobNotFound = errors.New("job not found in the database")
+
+// JobStore 提供了与数据库中 AsyncJob 表交互的方法。
+type JobStore struct {
+	db *gorm.DB
+}
+
+// NewJobStore 创建一个新的 JobStore 实例。
+func NewJobStore(db *gorm.DB) *JobStore {
+	return &JobStore{db: db}
+}
+
+// CreateJob 保存一个新任务。
+func (s *JobStore) CreateJob(job *AsyncJob) error {
+	return s.db.Create(job).Error
+}
+
+// SaveJob 更新任务的全部字段。
+func (s *JobStore) SaveJob(job *AsyncJob) error {
+	return s.db.Save(job).Error
+}
+
+// GetJob 按任务 ID 和客户端名称获取任务；其他客户端提交的任务视为不存在。
+func (s *JobStore) GetJob(jobID, clientID string) (*AsyncJob, error) {
+	var job AsyncJob
+	result := s.db.Where("job_id = ? AND client_id = ?", jobID, clientID).First(&job)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrJobNotFound
+		}
+		return nil, result.Error
+	}
+	return &job, nil
+}
+
+// ListUnfinishedJobs 返回尚未完成的任务（排队中或执行中），用于服务重启后恢复执行。
+func (s *JobStore) ListUnfinishedJobs() ([]AsyncJob, error) {
+	var jobs []AsyncJob
+	err := s.db.Where("status IN ?", []string{JobStatusQueued, JobStatusRunning}).Order("id").Find(&jobs).Error
+	return jobs, err
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// KeyEventStore 提供对 key_events 表（密钥状态变化历史）的访问。
+type KeyEventStore struct {
+	db *gorm.DB
+}
+
+// NewKeyEventStore 创建一个新的 KeyEventStore 实例。
+func NewKeyEventStore(db *gorm.DB) *KeyEventStore {
+	return &KeyEventStore{db: db}
+}
+
+// AddEvent 保存一条密钥状态变化记录。
+func (s *KeyEventStore) AddEvent(event *KeyEvent) error {
+	return s.db.Create(event).Error
+}
+
+// ListEvents 按时间倒序返回某个密钥的状态变化记录。eventTypes 为空时返回所有类型。
+func (s *KeyEventStore) ListEvents(keySuffix string, eventTypes []string, limit int) ([]KeyEvent, error) {
+	query := s.db.Where("key_suffix = ?", keySuffix)
+	if len(eventTypes) > 0 {
+		query = query.Where("event IN ?", eventTypes)
+	}
+	var events []KeyEvent
+	err := query.Order("created_at desc, id desc").Limit(limit).Find(&events).Error
+	return events, err
+}
+
+// CountEventsSince 统计某个密钥在 since 之后各类事件的次数。
+func (s *KeyEventStore) CountEventsSince(keySuffix string, since time.Time) (map[string]int64, error) {
+	var rows []struct {
+		Event string
+		Count int64
+	}
+	err := s.db.Model(&KeyEvent{}).
+		Select("event, COUNT(*) AS count").
+		Where("key_suffix = ? AND created_at >= ?", keySuffix, since).
+		Group("event").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		counts[row.Event] = row.Count
+	}
+	return counts, nil
+}
+
+// DeleteEventsBefore 删除 cutoff 之前的记录，返回删除的条数。
+func (s *KeyEventStore) DeleteEventsBefore(cutoff time.Time) (int64, error) {
+	result := s.db.Where("created_at < ?", cutoff).Delete(&KeyEvent{})
+	return result.RowsAffected, result.Error
+}
@@ -146,6 +146,16 @@ func (s *KeyStore) RecordFailure(keyStr string, failureCount int, cooldownDurati
 	return s.UpdateKeyFields(keyStr, updates)
 }
 
+// SetDisabled 设置密钥是否被管理员停用。
+func (s *KeyStore) SetDisabled(keyStr string, disabled bool) error {
+	return s.UpdateKeyFields(keyStr, map[string]interface{}{"disabled": disabled})
+}
+
+// UpdateWeight 更新密钥的权重。
+func (s *KeyStore) UpdateWeight(keyStr string, weight int) error {
+	return s.UpdateKeyFields(keyStr, map[string]interface{}{"weight": weight})
+}
+
 // UpdateLastUsedTime 更新密钥的最后使用时间。
 func (s *KeyStore) UpdateLastUsedTime(keyStr string) error {
 	return s.UpdateKeyFields(keyStr, map[string]interface{}{"last_used_time": time.Now()})
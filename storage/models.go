@@ -21,9 +21,300 @@ type APIKey struct {
 	LastFailureTime *time.Time // 上次失败的时间戳，可以为 null
 	CoolDownUntil   *time.Time // 冷却截止时间，可以为 null
 	LastUsedTime    *time.Time // 上次使用时间，可以为 null
+	Disabled        bool       `gorm:"default:false"`        // 是否被管理员手动停用，停用的密钥不参与轮询和健康检查
 }
 
 // TableName 自定义 APIKey 模型的表名
 func (APIKey) TableName() string {
 	return "openrouter_api_keys"
 }
+
+// StoredResponse 保存通过 /v1/responses 生成的响应，用于 previous_response_id 链式对话以及 GET 查询。
+// 每条记录只保存本轮新增的消息，完整的对话历史沿 PreviousResponseID 回溯拼接。
+// UpdatedAt 在响应被续接时刷新，过期清理以它为准，因此祖先响应不会早于其后代过期。
+type StoredResponse struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time `gorm:"index"`
+
+	ResponseID         string `gorm:"type:varchar(64);uniqueIndex;not null"` // 对外暴露的响应 ID (resp_...)
+	ClientID           string `gorm:"type:varchar(128);index"`               // 创建该响应的客户端名称，查询时按客户端隔离
+	PreviousResponseID string `gorm:"type:varchar(64)"`                      // 链上的前一个响应 ID，可为空
+	Model              string `gorm:"type:varchar(255)"`
+	Messages           string `gorm:"type:longtext"` // 本轮新增的对话消息（本次输入 + 模型输出），OpenAI 聊天消息格式的 JSON
+	MessagesIsDelta    bool   `gorm:"not null;default:false"` // 为 false 的旧记录在 Messages 中保存截至本响应的完整对话历史
+	Response           string `gorm:"type:longtext"` // 返回给客户端的 Response 对象 JSON
+}
+
+// TableName 自定义 StoredResponse 模型的表名
+func (StoredResponse) TableName() string {
+	return "stored_responses"
+}
+
+// RateLimitBucket 保存客户端限流令牌桶的状态，仅在 RATE_LIMIT_STORE=db 时使用，使多个实例共享同一份限额。
+type RateLimitBucket struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	ClientID   string    `gorm:"type:varchar(128);uniqueIndex:idx_rate_limit_client_dimension;not null"`
+	Dimension  string    `gorm:"type:varchar(16);uniqueIndex:idx_rate_limit_client_dimension;not null"` // requests 或 tokens
+	Tokens     float64   // 当前剩余令牌数（事后结算可能为负）
+	RefilledAt time.Time // 上次补充令牌的时间
+	Version    int64     `gorm:"default:0"` // 乐观锁版本号
+}
+
+// TableName 自定义 RateLimitBucket 模型的表名
+func (RateLimitBucket) TableName() string {
+	return "rate_limit_buckets"
+}
+
+// UsageCost 按天、客户端、上游密钥和模型累计的用量与费用。
+// 每次成功的请求都会累加到对应的行上，而不是逐条记录。
+type UsageCost struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+
+	Day              string  `gorm:"type:varchar(10);uniqueIndex:idx_usage_cost_bucket;not null" json:"day,omitempty"`        // UTC 日期，格式 2006-01-02
+	ClientID         string  `gorm:"type:varchar(128);uniqueIndex:idx_usage_cost_bucket;not null" json:"client_id,omitempty"` // 发起请求的客户端名称
+	KeySuffix        string  `gorm:"type:varchar(16);uniqueIndex:idx_usage_cost_bucket;not null" json:"key_suffix,omitempty"` // 使用的 OpenRouter 密钥后缀
+	Model            string  `gorm:"type:varchar(255);uniqueIndex:idx_usage_cost_bucket;not null" json:"model,omitempty"`
+	Requests         int64   `gorm:"default:0" json:"requests"`
+	PromptTokens     int64   `gorm:"default:0" json:"prompt_tokens"`
+	CompletionTokens int64   `gorm:"default:0" json:"completion_tokens"`
+	CachedTokens     int64   `gorm:"default:0" json:"cached_tokens"` // 命中提供商提示词缓存的输入 token 数（已包含在 prompt_tokens 中）
+	CostUSD          float64 `gorm:"default:0" json:"cost_usd"`      // 按模型目录定价计算的费用（美元）
+}
+
+// TableName 自定义 UsageCost 模型的表名
+func (UsageCost) TableName() string {
+	return "usage_costs"
+}
+
+// ClientBudget 客户端的费用预算。限额为 0 表示不限制。
+type ClientBudget struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+
+	ClientID        string  `gorm:"type:varchar(128);uniqueIndex;not null" json:"client_id"`
+	DailyLimitUSD   float64 `gorm:"default:0" json:"daily_limit_usd"`   // 每日（UTC）费用上限
+	MonthlyLimitUSD float64 `gorm:"default:0" json:"monthly_limit_usd"` // 每月（UTC）费用上限
+	WarnThreshold   float64 `gorm:"default:0.8" json:"warn_threshold"`  // 已用比例达到该值时在响应中附带预警头部
+}
+
+// TableName 自定义 ClientBudget 模型的表名
+func (ClientBudget) TableName() string {
+	return "client_budgets"
+}
+
+// 生成统计记录的状态
+const (
+	GenerationStatusPending   = "pending"   // 已记录请求，等待后台查询生成统计
+	GenerationStatusCompleted = "completed" // 已获取 OpenRouter 的生成统计
+	GenerationStatusFailed    = "failed"    // 多次重试后仍未能获取生成统计
+)
+
+// GenerationRecord 对应一次成功的上游请求，以 OpenRouter 返回的生成 ID 标识。
+// 请求完成时按估算值创建，后台任务随后从生成统计端点补全原生 token 数、提供商和精确费用。
+type GenerationRecord struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	GenerationID     string  `gorm:"type:varchar(128);uniqueIndex;not null" json:"generation_id"`
+	Day              string  `gorm:"type:varchar(10)" json:"day"` // 与 usage_costs 一致的 UTC 日期，用于修正当天累计费用
+	ClientID         string  `gorm:"type:varchar(128);index" json:"client_id"`
+	KeySuffix        string  `gorm:"type:varchar(16)" json:"key_suffix"`
+	Model            string  `gorm:"type:varchar(255)" json:"model"`
+	PromptTokens     int64   `json:"prompt_tokens"`      // 上游响应中报告的（归一化）token 数
+	CompletionTokens int64   `json:"completion_tokens"`
+	EstimatedCostUSD float64 `json:"estimated_cost_usd"` // 按模型目录定价估算的费用
+
+	Status                 string     `gorm:"type:varchar(16);index;default:'pending'" json:"status"`
+	Attempts               int        `gorm:"default:0" json:"attempts"`
+	NextAttemptAt          *time.Time `gorm:"index" json:"next_attempt_at,omitempty"` // 状态为 pending 时下一次查询生成统计的时间
+	LastError              string     `gorm:"type:text" json:"last_error,omitempty"`
+	ProviderName           string     `gorm:"type:varchar(128)" json:"provider_name,omitempty"`
+	NativePromptTokens     int64      `json:"native_prompt_tokens"`
+	NativeCompletionTokens int64      `json:"native_completion_tokens"`
+	NativeReasoningTokens  int64      `json:"native_reasoning_tokens"`
+	NativeCachedTokens     int64      `json:"native_cached_tokens"`
+	TotalCostUSD           float64    `json:"total_cost_usd"` // OpenRouter 报告的实际费用
+	LatencyMs              int64      `json:"latency_ms"`
+	GenerationTimeMs       int64      `json:"generation_time_ms"`
+	FinishReason           string     `gorm:"type:varchar(64)" json:"finish_reason,omitempty"`
+}
+
+// TableName 自定义 GenerationRecord 模型的表名
+func (GenerationRecord) TableName() string {
+	return "generation_records"
+}
+
+// 异步任务的状态
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+)
+
+// AsyncJob 是通过 X-Async 或 /v1/jobs 提交的异步聊天补全任务。
+// 请求在后台通过密钥池执行，结果保存在 Result 中供客户端轮询，也可以回调通知客户端。
+type AsyncJob struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	CompletedAt *time.Time
+
+	JobID          string `gorm:"type:varchar(64);uniqueIndex;not null"` // 对外暴露的任务 ID (job_...)
+	ClientID       string `gorm:"type:varchar(128);index"`               // 提交任务的客户端名称，查询时按客户端隔离
+	Status         string `gorm:"type:varchar(16);index;not null"`
+	Request        string `gorm:"type:longtext"` // 聊天补全请求 JSON
+	StatusCode     int    // 上游执行结束时返回给客户端的 HTTP 状态码
+	Result         string `gorm:"type:longtext"` // 成功时为聊天补全响应 JSON，失败时为错误响应 JSON
+	CallbackURL    string `gorm:"type:varchar(2048)"`
+	CallbackStatus string `gorm:"type:varchar(255)"` // 最后一次回调的结果，例如 "200 OK" 或错误信息
+}
+
+// TableName 自定义 AsyncJob 模型的表名
+func (AsyncJob) TableName() string {
+	return "async_jobs"
+}
+
+// StoredFile 是通过 /v1/files 上传的文件（批处理输入）或批处理生成的结果文件。
+type StoredFile struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	FileID   string `gorm:"type:varchar(64);uniqueIndex;not null"` // 对外暴露的文件 ID (file-...)
+	ClientID string `gorm:"type:varchar(128);index"`               // 上传（或生成）该文件的客户端名称，查询时按客户端隔离
+	Filename string `gorm:"type:varchar(255)"`
+	Purpose  string `gorm:"type:varchar(32)"` // batch、batch_output
+	Bytes    int64
+	Content  string `gorm:"type:longtext"` // 文件内容 (JSONL)
+}
+
+// TableName 自定义 StoredFile 模型的表名
+func (StoredFile) TableName() string {
+	return "files"
+}
+
+// 批处理状态，与 OpenAI Batch API 一致。
+const (
+	BatchStatusValidating = "validating"
+	BatchStatusFailed     = "failed"
+	BatchStatusInProgress = "in_progress"
+	BatchStatusFinalizing = "finalizing"
+	BatchStatusCompleted  = "completed"
+	BatchStatusExpired    = "expired"
+	BatchStatusCancelling = "cancelling"
+	BatchStatusCancelled  = "cancelled"
+)
+
+// Batch 是通过 /v1/batches 创建的批处理任务。输入文件中的每一行在校验后保存为一条 BatchRequest，
+// 执行进度以 BatchRequest 的状态为检查点，服务重启后从未完成的请求继续。
+type Batch struct {
+	ID           uint `gorm:"primarykey"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	InProgressAt *time.Time
+	FinalizingAt *time.Time
+	CompletedAt  *time.Time
+	FailedAt     *time.Time
+	ExpiresAt    time.Time
+	ExpiredAt    *time.Time
+	CancellingAt *time.Time
+	CancelledAt  *time.Time
+
+	BatchID          string `gorm:"type:varchar(64);uniqueIndex;not null"` // 对外暴露的批处理 ID (batch_...)
+	ClientID         string `gorm:"type:varchar(128);index"`               // 创建该批处理的客户端名称，查询时按客户端隔离
+	Endpoint         string `gorm:"type:varchar(64)"`
+	InputFileID      string `gorm:"type:varchar(64)"`
+	CompletionWindow string `gorm:"type:varchar(16)"`
+	Status           string `gorm:"type:varchar(16);index;not null"`
+	OutputFileID     string `gorm:"type:varchar(64)"`
+	ErrorFileID      string `gorm:"type:varchar(64)"`
+	Errors           string `gorm:"type:text"` // 输入文件校验失败时的错误列表 JSON
+	Metadata         string `gorm:"type:text"` // 客户端提供的 metadata JSON
+	TotalCount       int
+	CompletedCount   int
+	FailedCount      int
+}
+
+// TableName 自定义 Batch 模型的表名
+func (Batch) TableName() string {
+	return "batches"
+}
+
+// 批处理中单个请求的状态。
+const (
+	BatchRequestStatusPending   = "pending"
+	BatchRequestStatusCompleted = "completed"
+	BatchRequestStatusFailed    = "failed"
+)
+
+// BatchRequest 是批处理输入文件中的一行请求及其执行结果。
+type BatchRequest struct {
+	ID        uint `gorm:"primarykey"`
+	UpdatedAt time.Time
+
+	BatchID    string `gorm:"type:varchar(64);uniqueIndex:idx_batch_request_line;not null"`
+	LineIndex  int    `gorm:"uniqueIndex:idx_batch_request_line;not null"` // 在输入文件中的行号（从 0 开始），结果文件按此顺序输出
+	RequestID  string `gorm:"type:varchar(64)"`                           // 结果行的 ID (batch_req_...)
+	CustomID   string `gorm:"type:varchar(255)"`
+	Status     string `gorm:"type:varchar(16);index;not null"`
+	Attempts   int
+	Body       string `gorm:"type:longtext"` // 请求体 JSON
+	StatusCode int    // 上游执行结束时的 HTTP 状态码
+	Response   string `gorm:"type:longtext"` // 响应体 JSON（成功或错误响应）
+}
+
+// TableName 自定义 BatchRequest 模型的表名
+func (BatchRequest) TableName() string {
+	return "batch_requests"
+}
+
+// PayloadCapture 是一次 API 请求被抽样捕获的完整内容（已按配置脱敏），用于排查客户端反馈的异常回答。
+type PayloadCapture struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+
+	RequestID    string `gorm:"type:varchar(128);uniqueIndex:idx_payload_capture_request_client;not null" json:"request_id"` // X-Request-ID，管理员按此查询
+	ClientID     string `gorm:"type:varchar(128);index;uniqueIndex:idx_payload_capture_request_client" json:"client_id"`     // 请求 ID 可由客户端提供，因此按 (请求 ID, 客户端) 区分
+	Endpoint     string `gorm:"type:varchar(128)" json:"endpoint"`
+	Model        string `gorm:"type:varchar(255)" json:"model"`
+	Stream       bool   `json:"stream"`
+	StatusCode   int    `json:"status_code"`
+	DurationMs   int64  `json:"duration_ms"`
+	GenerationID string `gorm:"type:varchar(128)" json:"generation_id,omitempty"`
+	Request      string `gorm:"type:longtext" json:"request"`  // 客户端提交的请求 JSON（按客户端使用的协议格式）
+	Response     string `gorm:"type:longtext" json:"response"` // 非流式为最终响应体；流式聊天为由各数据块拼接成的完整响应，其他协议为原始事件流
+}
+
+// TableName 自定义 PayloadCapture 模型的表名
+func (PayloadCapture) TableName() string {
+	return "payload_captures"
+}
+
+// KeyEvent 记录 API 密钥的一次状态变化（失败、冷却、恢复、健康检查结果、管理员操作等），
+// 用于查看单个密钥的历史时间线，区分长期不稳定的密钥和偶发故障。
+type KeyEvent struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+
+	KeySuffix     string     `gorm:"type:varchar(32);index;not null" json:"key_suffix"`
+	Event         string     `gorm:"type:varchar(32);not null" json:"event"`     // failure、cooldown_start、cooldown_end、reactivated 等
+	Cause         string     `gorm:"type:varchar(32)" json:"cause,omitempty"`     // request、health_check、cooldown_expired、admin
+	ErrorType     string     `gorm:"type:varchar(64)" json:"error_type,omitempty"`
+	HTTPStatus    int        `json:"http_status,omitempty"`
+	Message       string     `gorm:"type:varchar(512)" json:"message,omitempty"` // 上游错误信息片段或变更说明
+	FailureCount  int        `json:"failure_count"`                               // 事件发生后的连续失败次数
+	CoolDownUntil *time.Time `json:"cool_down_until,omitempty"`                   // 事件发生后的冷却截止时间
+}
+
+// TableName 自定义 KeyEvent 模型的表名
+func (KeyEvent) TableName() string {
+	return "key_events"
+}
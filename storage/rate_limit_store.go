@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// rateLimitMaxRetries 是乐观锁冲突时的最大重试次数。
+const rateLimitMaxRetries = 5
+
+// RateLimitStore 提供了与数据库中 RateLimitBucket 表交互的方法，实现 middleware.RateLimitBucketStore。
+type RateLimitStore struct {
+	db *gorm.DB
+}
+
+// NewRateLimitStore 创建一个新的 RateLimitStore 实例。
+func NewRateLimitStore(db *gorm.DB) *RateLimitStore {
+	return &RateLimitStore{db: db}
+}
+
+// UpdateBucket 以乐观锁方式读取并更新指定客户端、维度的令牌桶。
+// 多个实例并发更新同一个桶时，版本号冲突的一方会重新读取并再次调用 update。
+func (s *RateLimitStore) UpdateBucket(clientID, dimension string, update func(tokens float64, updatedAt time.Time) (float64, time.Time)) error {
+	for attempt := 0; attempt < rateLimitMaxRetries; attempt++ {
+		var bucket RateLimitBucket
+		err := s.db.Where("client_id = ? AND dimension = ?", clientID, dimension).First(&bucket).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			tokens, refilledAt := update(0, time.Time{})
+			bucket = RateLimitBucket{ClientID: clientID, Dimension: dimension, Tokens: tokens, RefilledAt: refilledAt}
+			if err := s.db.Create(&bucket).Error; err == nil {
+				return nil
+			}
+			continue // 其他实例已抢先创建，重新读取
+		}
+		if err != nil {
+			return err
+		}
+
+		tokens, refilledAt := update(bucket.Tokens, bucket.RefilledAt)
+		result := s.db.Model(&RateLimitBucket{}).
+			Where("id = ? AND version = ?", bucket.ID, bucket.Version).
+			Updates(map[string]interface{}{"tokens": tokens, "refilled_at": refilledAt, "version": bucket.Version + 1})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("更新限流令牌桶 %s/%s 时冲突次数过多", clientID, dimension)
+}
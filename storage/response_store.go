@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrResponseNotFound = errors.New("response not found in the database")
+
+// ErrResponseChainBroken 表示 previous_response_id 链上较早的响应已被删除或过期，无法还原完整对话。
+var ErrResponseChainBroken = errors.New("an earlier response in the chain no longer exists")
+
+// maxResponseChainLength 回溯 previous_response_id 链的最大长度，防止异常数据导致无限回溯。
+const maxResponseChainLength = 10000
+
+// ResponseStore 提供了与数据库中 StoredResponse 表交互的方法。
+type ResponseStore struct {
+	db *gorm.DB
+}
+
+// NewResponseStore 创建一个新的 ResponseStore 实例。
+func NewResponseStore(db *gorm.DB) *ResponseStore {
+	return &ResponseStore{db: db}
+}
+
+// SaveResponse 保存一个响应记录。
+func (s *ResponseStore) SaveResponse(resp *StoredResponse) error {
+	return s.db.Create(resp).Error
+}
+
+// GetResponse 按响应 ID 和客户端名称获取响应记录；其他客户端创建的响应视为不存在。
+func (s *ResponseStore) GetResponse(responseID, clientID string) (*StoredResponse, error) {
+	var resp StoredResponse
+	result := s.db.Where("response_id = ? AND client_id = ?", responseID, clientID).First(&resp)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrResponseNotFound
+		}
+		return nil, result.Error
+	}
+	return &resp, nil
+}
+
+// DeleteResponse 按响应 ID 和客户端名称删除响应记录。
+func (s *ResponseStore) DeleteResponse(responseID, clientID string) error {
+	result := s.db.Where("response_id = ? AND client_id = ?", responseID, clientID).Delete(&StoredResponse{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrResponseNotFound
+	}
+	return nil
+}
+
+// GetResponseChain 返回 responseID 对应的响应及其全部祖先，按从旧到新的顺序排列。
+// 沿 PreviousResponseID 回溯，遇到保存完整历史的旧记录（MessagesIsDelta 为 false）时停止。
+// responseID 本身不存在时返回 ErrResponseNotFound，链上较早的响应缺失时返回 ErrResponseChainBroken。
+func (s *ResponseStore) GetResponseChain(responseID, clientID string) ([]StoredResponse, error) {
+	var chain []StoredResponse
+	seen := make(map[string]bool)
+	for id := responseID; id != ""; {
+		if seen[id] || len(chain) >= maxResponseChainLength {
+			return nil, ErrResponseChainBroken
+		}
+		seen[id] = true
+		resp, err := s.GetResponse(id, clientID)
+		if err != nil {
+			if errors.Is(err, ErrResponseNotFound) && len(chain) > 0 {
+				return nil, ErrResponseChainBroken
+			}
+			return nil, err
+		}
+		chain = append(chain, *resp)
+		if !resp.MessagesIsDelta {
+			break
+		}
+		id = resp.PreviousResponseID
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
+
+// TouchResponses 将指定响应的 updated_at 刷新为 at，使仍在被续接的对话链不会被过期清理。
+func (s *ResponseStore) TouchResponses(responseIDs []string, at time.Time) error {
+	if len(responseIDs) == 0 {
+		return nil
+	}
+	return s.db.Model(&StoredResponse{}).Where("response_id IN ?", responseIDs).UpdateColumn("updated_at", at).Error
+}
+
+// DeleteResponsesBefore 删除 cutoff 之前最后一次使用（创建或被续接）的响应，返回删除的条数。
+func (s *ResponseStore) DeleteResponsesBefore(cutoff time.Time) (int64, error) {
+	result := s.db.Where("updated_at < ?", cutoff).Delete(&StoredResponse{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+func newTestResponseStore(t *testing.T) *ResponseStore {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: gormlogger.Discard})
+	if err != nil {
+		t.Fatalf("打开测试数据库失败: %v", err)
+	}
+	if err := db.AutoMigrate(&StoredResponse{}); err != nil {
+		t.Fatalf("迁移测试数据库失败: %v", err)
+	}
+	return NewResponseStore(db)
+}
+
+func TestGetResponseChain(t *testing.T) {
+	store := newTestResponseStore(t)
+	records := []StoredResponse{
+		{ResponseID: "resp_legacy", ClientID: "alice", Messages: `["full history"]`},
+		{ResponseID: "resp_1", ClientID: "alice", PreviousResponseID: "resp_legacy", Messages: `["turn 1"]`, MessagesIsDelta: true},
+		{ResponseID: "resp_2", ClientID: "alice", PreviousResponseID: "resp_1", Messages: `["turn 2"]`, MessagesIsDelta: true},
+		{ResponseID: "resp_orphan", ClientID: "alice", PreviousResponseID: "resp_gone", Messages: `[]`, MessagesIsDelta: true},
+	}
+	for i := range records {
+		if err := store.SaveResponse(&records[i]); err != nil {
+			t.Fatalf("保存响应失败: %v", err)
+		}
+	}
+
+	chain, err := store.GetResponseChain("resp_2", "alice")
+	if err != nil {
+		t.Fatalf("GetResponseChain 失败: %v", err)
+	}
+	var ids []string
+	for _, resp := range chain {
+		ids = append(ids, resp.ResponseID)
+	}
+	if len(ids) != 3 || ids[0] != "resp_legacy" || ids[1] != "resp_1" || ids[2] != "resp_2" {
+		t.Errorf("链 = %v, 期望从保存完整历史的旧记录开始按从旧到新排列", ids)
+	}
+
+	if _, err := store.GetResponseChain("resp_2", "mallory"); !errors.Is(err, ErrResponseNotFound) {
+		t.Errorf("其他客户端读取链的错误 = %v, 期望 ErrResponseNotFound", err)
+	}
+	if _, err := store.GetResponseChain("resp_orphan", "alice"); !errors.Is(err, ErrResponseChainBroken) {
+		t.Errorf("祖先缺失时的错误 = %v, 期望 ErrResponseChainBroken", err)
+	}
+}
+
+func TestDeleteResponsesBeforeKeepsTouchedChains(t *testing.T) {
+	store := newTestResponseStore(t)
+	for _, id := range []string{"resp_old", "resp_used"} {
+		if err := store.SaveResponse(&StoredResponse{ResponseID: id, ClientID: "alice", Messages: `[]`}); err != nil {
+			t.Fatalf("保存响应失败: %v", err)
+		}
+	}
+	past := time.Now().Add(-48 * time.Hour)
+	if err := store.TouchResponses([]string{"resp_old", "resp_used"}, past); err != nil {
+		t.Fatalf("TouchResponses 失败: %v", err)
+	}
+	if err := store.TouchResponses([]string{"resp_used"}, time.Now()); err != nil {
+		t.Fatalf("TouchResponses 失败: %v", err)
+	}
+
+	deleted, err := store.DeleteResponsesBefore(time.Now().Add(-24 * time.Hour))
+	if err != nil || deleted != 1 {
+		t.Fatalf("DeleteResponsesBefore = %d, %v, 期望删除 1 条", deleted, err)
+	}
+	if _, err := store.GetResponse("resp_old", "alice"); !errors.Is(err, ErrResponseNotFound) {
+		t.Error("期望长期未使用的响应被删除")
+	}
+	if _, err := store.GetResponse("resp_used", "alice"); err != nil {
+		t.Errorf("近期被续接的响应不应被删除: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"openrouter_polling/config"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Log 是一个包级变量，用于日志记录。它应该由外部（例如 main.go）设置。
+var Log *logrus.Logger
+
+// instrumentationName 是本服务创建 span 时使用的 tracer 名称。
+const instrumentationName = "openrouter_polling"
+
+// Init 在配置了 OTEL_EXPORTER_OTLP_ENDPOINT 时初始化全局 TracerProvider（通过 OTLP/HTTP 批量导出）
+// 和 W3C traceparent/baggage 传播器。未配置时不做任何事，Tracer() 返回的 tracer 为空操作实现。
+// 返回的 shutdown 函数应在服务关闭时调用，以导出缓冲中剩余的 span。
+func Init(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	endpoint := strings.TrimRight(config.AppSettings.OTLPEndpoint, "/")
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint+"/v1/traces"))
+	if err != nil {
+		return nil, fmt.Errorf("创建 OTLP 导出器失败: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(config.AppSettings.OTelServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("创建 OTel 资源失败: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// 有上游 traceparent 时沿用其采样决定，否则按 TRACE_SAMPLE_RATE 抽样
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.AppSettings.TraceSampleRate))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		Log.Warnf("OpenTelemetry: %v", err)
+	}))
+	Log.Infof("分布式追踪已启用 (OTLP 端点: %s, 服务名: %s, 抽样比例: %.4g)。", endpoint, config.AppSettings.OTelServiceName, config.AppSettings.TraceSampleRate)
+	return provider.Shutdown, nil
+}
+
+// Tracer 返回本服务使用的 tracer。
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
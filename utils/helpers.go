@@ -1,5 +1,12 @@
 package utils
 
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
 // SafeSuffix 辅助函数，用于安全地获取字符串末尾的指定长度的子串，并添加前缀 "..."。
 // 主要用于日志或显示，避免暴露完整的敏感信息（如API密钥）。
 // 例如，SafeSuffix("sk-abcdefghijklmnopqrstuvwxyz") 返回 "...wxyz" (假设内部 suffixLength 为 4)。
@@ -32,3 +39,14 @@ func DerefString(s *string, def string) string {
 	}
 	return def
 }
+
+// NewID 生成带前缀的随机标识符，例如 NewID("resp_") 返回 "resp_3f9a..."。
+// 用于响应、任务等需要对外暴露且不可猜测的对象 ID。
+// 如果系统随机源不可用（极少见），则退化为基于时间戳的 ID。
+func NewID(prefix string) string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return prefix + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return prefix + hex.EncodeToString(buf)
+}
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func readLogFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("读取 %s 失败: %v", path, err)
+	}
+	return string(data)
+}
+
+func TestRotatingFileRotatesAndKeepsBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "app.log")
+	r, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("NewRotatingFile 失败: %v", err)
+	}
+	defer r.Close()
+
+	for _, line := range []string{"line-1\n", "line-2\n", "line-3\n", "line-4\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatalf("写入失败: %v", err)
+		}
+	}
+	// 每行 7 字节，两行就会超过 10 字节，因此每个文件只有一行；只保留 2 个旧文件，line-1 被丢弃。
+	for file, want := range map[string]string{path: "line-4\n", path + ".1": "line-3\n", path + ".2": "line-2\n"} {
+		if got := readLogFile(t, file); got != want {
+			t.Errorf("%s 内容 = %q, 期望 %q", filepath.Base(file), got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("期望最多保留 2 个旧文件, %s.3 的状态: %v", filepath.Base(path), err)
+	}
+
+	// 超过上限的单次写入不会被拆分，也不会在空文件上触发轮转。
+	big := strings.Repeat("x", 25) + "\n"
+	if _, err := r.Write([]byte(big)); err != nil {
+		t.Fatalf("写入失败: %v", err)
+	}
+	if got := readLogFile(t, path); got != big {
+		t.Errorf("大块写入后当前文件内容 = %q, 期望完整的一次写入", got)
+	}
+}
+
+func TestRotatingFileWithoutBackupsTruncates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	r, err := NewRotatingFile(path, 10, 0)
+	if err != nil {
+		t.Fatalf("NewRotatingFile 失败: %v", err)
+	}
+	defer r.Close()
+	r.Write([]byte("line-1\n"))
+	r.Write([]byte("line-2\n"))
+	if got := readLogFile(t, path); got != "line-2\n" {
+		t.Errorf("内容 = %q, 期望截断后只有最新的一行", got)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("maxBackups 为 0 时不应保留旧文件: %v", err)
+	}
+}
+
+func TestRotatingFileAppendsToExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(path, []byte("old-1\n"), 0o644); err != nil {
+		t.Fatalf("创建已有日志失败: %v", err)
+	}
+	r, err := NewRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatalf("NewRotatingFile 失败: %v", err)
+	}
+	defer r.Close()
+	// 已有文件的大小计入上限：6 + 7 字节超过 10 字节，写入前先轮转。
+	r.Write([]byte("line-1\n"))
+	if got := readLogFile(t, path+".1"); got != "old-1\n" {
+		t.Errorf("旧文件内容 = %q, 期望重启前的日志", got)
+	}
+	if got := readLogFile(t, path); got != "line-1\n" {
+		t.Errorf("当前文件内容 = %q, 期望新写入的日志", got)
+	}
+}
+
+func TestRotatingFileConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	r, err := NewRotatingFile(path, 200, 100)
+	if err != nil {
+		t.Fatalf("NewRotatingFile 失败: %v", err)
+	}
+	const writers, lines = 8, 50
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range lines {
+				fmt.Fprintf(r, "writer-%d line-%03d\n", w, i)
+			}
+		}()
+	}
+	wg.Wait()
+	r.Close()
+
+	files, _ := filepath.Glob(path + "*")
+	total := 0
+	for _, file := range files {
+		for _, line := range strings.Split(strings.TrimSuffix(readLogFile(t, file), "\n"), "\n") {
+			if !strings.HasPrefix(line, "writer-") || len(line) != len("writer-0 line-000") {
+				t.Fatalf("%s 中出现了不完整的行 %q", filepath.Base(file), line)
+			}
+			total++
+		}
+	}
+	if total != writers*lines {
+		t.Errorf("所有文件共 %d 行, 期望 %d 行", total, writers*lines)
+	}
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"openrouter_polling/models"
+)
+
+// 令牌估算相关常量。
+// 这里不依赖任何具体模型的分词器，只做保守的近似估算，用于上下文裁剪、限流等需要“大致数量级”的场景。
+const (
+	asciiCharsPerToken     = 4   // 英文等 ASCII 文本大约 4 个字符对应 1 个 token
+	perMessageOverhead     = 4   // 每条消息的角色、分隔符等固定开销
+	perRequestOverhead     = 3   // 整个请求的起始/结束标记开销
+	imageContentTokens     = 765 // 单张图片的保守估算（相当于 OpenAI 高精度模式下 512x512 的开销）
+	nonTextPartTokens      = 100 // 其他非文本多模态片段（如音频、文件）的兜底估算
+	toolCallOverheadTokens = 8   // 每个工具调用的结构开销
+)
+
+// EstimateTextTokens 粗略估算一段文本的 token 数量。
+// ASCII 字符按约 4 字符/token 计算，CJK 等非 ASCII 字符按 1 字符/token 计算，
+// 对中文为主的对话也能给出不至于严重低估的结果。
+func EstimateTextTokens(text string) int {
+	if text == "" {
+		return 0
+	}
+	asciiChars := 0
+	otherTokens := 0
+	for _, r := range text {
+		if r < utf8.RuneSelf || unicode.IsSpace(r) {
+			asciiChars++
+		} else {
+			otherTokens++
+		}
+	}
+	return (asciiChars+asciiCharsPerToken-1)/asciiCharsPerToken + otherTokens
+}
+
+// EstimateContentTokens 估算消息 Content 字段的 token 数量。
+// Content 可以是字符串，也可以是多模态片段数组（[{"type":"text",...},{"type":"image_url",...}]）。
+func EstimateContentTokens(content interface{}) int {
+	switch v := content.(type) {
+	case nil:
+		return 0
+	case string:
+		return EstimateTextTokens(v)
+	case []interface{}:
+		total := 0
+		for _, part := range v {
+			partMap, ok := part.(map[string]interface{})
+			if !ok {
+				total += EstimateContentTokens(part)
+				continue
+			}
+			switch partMap["type"] {
+			case "text", "input_text", "output_text":
+				if text, ok := partMap["text"].(string); ok {
+					total += EstimateTextTokens(text)
+				}
+			case "image_url", "input_image", "image":
+				total += imageContentTokens
+			default:
+				total += nonTextPartTokens
+			}
+		}
+		return total
+	default:
+		// 未知结构：按其 JSON 序列化长度估算。
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return 0
+		}
+		return EstimateTextTokens(string(raw))
+	}
+}
+
+// EstimateMessageTokens 估算单条消息（含工具调用与工具结果）的 token 数量。
+func EstimateMessageTokens(msg models.Message) int {
+	total := perMessageOverhead + EstimateContentTokens(msg.Content)
+	if msg.Name != nil {
+		total += EstimateTextTokens(*msg.Name)
+	}
+	if msg.ToolCallID != nil {
+		total += EstimateTextTokens(*msg.ToolCallID)
+	}
+	if msg.ToolCalls != nil {
+		for _, tc := range *msg.ToolCalls {
+			total += toolCallOverheadTokens + EstimateTextTokens(tc.Function.Name) + EstimateTextTokens(tc.Function.Arguments)
+		}
+	}
+	return total
+}
+
+// EstimatePromptTokens 估算整个聊天请求的提示词 token 数量，包括消息列表和工具定义。
+func EstimatePromptTokens(messages []models.Message, tools *[]models.Tool) int {
+	total := perRequestOverhead
+	for _, msg := range messages {
+		total += EstimateMessageTokens(msg)
+	}
+	total += EstimateToolsTokens(tools)
+	return total
+}
+
+// EstimateToolsTokens 估算工具定义部分的 token 数量（按 JSON 序列化后的文本估算）。
+func EstimateToolsTokens(tools *[]models.Tool) int {
+	if tools == nil || len(*tools) == 0 {
+		return 0
+	}
+	raw, err := json.Marshal(tools)
+	if err != nil {
+		return 0
+	}
+	return EstimateTextTokens(string(raw))
+}
+
+// EstimateRequestBodyTokens 粗略估算任意 JSON 请求体（OpenAI、Anthropic、Gemini 等格式）的输入 token 数量。
+// 只统计字符串值（忽略字段名和结构符号）；data: URL 以及名为 "data" 的字段视为内联二进制（如 base64 图片），
+// 按单张图片计，避免 base64 长度把估算值放大几个数量级。无法解析为 JSON 时按纯文本估算。
+func EstimateRequestBodyTokens(body []byte) int {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return EstimateTextTokens(string(body))
+	}
+	var walk func(key string, v interface{}) int
+	walk = func(key string, v interface{}) int {
+		switch node := v.(type) {
+		case string:
+			if key == "data" || strings.HasPrefix(node, "data:") {
+				return imageContentTokens
+			}
+			return EstimateTextTokens(node)
+		case map[string]interface{}:
+			total := 0
+			for k, child := range node {
+				total += walk(k, child)
+			}
+			return total
+		case []interface{}:
+			total := 0
+			for _, child := range node {
+				total += walk(key, child)
+			}
+			return total
+		}
+		return 0
+	}
+	return walk("", doc) + perRequestOverhead
+}